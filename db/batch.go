@@ -0,0 +1,441 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	errNotDeclared = errors.New("ERR command accesses a key which is not declared by the transaction")
+	errReadOnly    = errors.New("ERR Write commands are not allowed from read-only scripts.")
+)
+
+const intentsPrefix = "system/intents/"
+
+// DBKey designates a key of a database.
+type DBKey struct {
+	DB  *Database
+	Key []byte
+}
+
+type batchContextKey struct{}
+
+type readOnlyContextKey struct{}
+
+// ReadOnly returns a context with which the methods of Database refuse to
+// write, like within a read-only script
+func ReadOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readOnlyContextKey{}, true)
+}
+
+// checkWritable returns errReadOnly if ctx comes from ReadOnly
+func checkWritable(ctx context.Context) error {
+	if ctx.Value(readOnlyContextKey{}) != nil {
+		return errReadOnly
+	}
+	return nil
+}
+
+// InBatch reports whether ctx comes from Batch, within which commands must
+// not wait for other clients since the partitions of Batch are locked
+func InBatch(ctx context.Context) bool {
+	_, ok := ctx.Value(batchContextKey{}).(*batchTxs)
+	return ok
+}
+
+// batchTxs holds the read-write transactions opened by Batch, by database
+// and partition id
+type batchTxs struct {
+	txs map[*Database]map[string]*Tx
+}
+
+// batchTx returns the transaction of Batch for the partition, and whether
+// ctx is running in Batch. It returns errNotDeclared if the partition was not
+// locked by Batch.
+func (db *Database) batchTx(ctx context.Context, partitionId string) (*Tx, bool, error) {
+	b, ok := ctx.Value(batchContextKey{}).(*batchTxs)
+	if !ok {
+		return nil, false, nil
+	}
+	tx, ok := b.txs[db][partitionId]
+	if !ok {
+		return nil, true, errNotDeclared
+	}
+	return tx, true, nil
+}
+
+// batchMultiTx returns a MultiTx made of the transactions of Batch for the
+// partitions of keys, and whether ctx is running in Batch
+func (db *Database) batchMultiTx(ctx context.Context, keys [][]byte) (*MultiTx, bool, error) {
+	m := &MultiTx{db: db, txs: map[string]*Tx{}}
+	for partitionId := range db.groupByPartition(keys) {
+		tx, ok, err := db.batchTx(ctx, partitionId)
+		if !ok || err != nil {
+			return nil, ok, err
+		}
+		m.txs[partitionId] = tx
+	}
+	if len(m.txs) == 0 {
+		return m, InBatch(ctx), nil
+	}
+	return m, true, nil
+}
+
+// viewTx runs fn in a read-only transaction on the partition, or in the
+// transaction of Batch if ctx comes from it
+func (db *Database) viewTx(ctx context.Context, partitionId string, fn func(tx *Tx) error) error {
+	tx, ok, err := db.batchTx(ctx, partitionId)
+	if err != nil {
+		return err
+	}
+	if ok {
+		err = fn(tx)
+		// reads do not change the versions of the keys they open
+		tx.touched = nil
+		return err
+	}
+	return db.view(partitionId, func(tx *bolt.Tx) error {
+		return fn(newTx(tx))
+	})
+}
+
+// updateTx runs fn in a read-write transaction on the partition and uploads
+// it, or runs fn in the transaction of Batch if ctx comes from it
+func (db *Database) updateTx(ctx context.Context, partitionId string, fn func(tx *Tx) error) error {
+	err := checkWritable(ctx)
+	if err != nil {
+		return err
+	}
+	tx, ok, err := db.batchTx(ctx, partitionId)
+	if err != nil {
+		return err
+	}
+	if ok {
+		tx.touched = nil
+		tx.command = CommandFromContext(ctx)
+		err = fn(tx)
+		if err != nil && len(tx.touched) == 0 {
+			return err
+		}
+		// the writes of a failed command can not be rolled back alone
+		if err := tx.written(); err != nil {
+			return err
+		}
+		return err
+	}
+	var events []Event
+	err = db.update(partitionId, func(tx *bolt.Tx) error {
+		t := newTx(tx)
+		t.command = CommandFromContext(ctx)
+		err := fn(t)
+		if err != nil {
+			return err
+		}
+		events = t.events
+		err = t.written()
+		if err != nil {
+			return err
+		}
+		return db.recordChanges(t, partitionId)
+	})
+	if err != nil {
+		return err
+	}
+	db.queueChanges(partitionId)
+	db.dispatch(events)
+	return nil
+}
+
+// Batch runs fn with read-write transactions on the partitions holding
+// keys, which may belong to several databases. The methods of Database
+// called with the context passed to fn stage their writes in these
+// transactions instead of committing their own, and return an error if they
+// access another partition.
+//
+// Once fn returns, the staged writes are committed all or nothing: nothing is
+// written if fn returns an error, and writes to several partitions are
+// recorded as an intent in object storage before the partitions are uploaded,
+// so that a crash in between is repaired at startup, see the package
+// documentation. All the partitions stay
+// locked until they are uploaded, so that fn is also atomic with respect to
+// the other callers of this process. A method called by fn which fails keeps
+// the writes it made before failing, like a failed command of a Redis
+// transaction.
+//
+// Batch called with a context coming from Batch runs fn in the enclosing
+// transactions, which must cover keys.
+func Batch(ctx context.Context, keys []DBKey, fn func(ctx context.Context) error) error {
+	type ref struct {
+		db          *Database
+		partitionId string
+	}
+	refs := []ref{}
+	seen := map[ref]bool{}
+	for _, key := range keys {
+		r := ref{key.DB, key.DB.getPartitionId(key.Key)}
+		if !seen[r] {
+			seen[r] = true
+			refs = append(refs, r)
+		}
+	}
+	if _, ok := ctx.Value(batchContextKey{}).(*batchTxs); ok {
+		for _, r := range refs {
+			_, _, err := r.db.batchTx(ctx, r.partitionId)
+			if err != nil {
+				return err
+			}
+		}
+		return fn(ctx)
+	}
+
+	// events are delivered once the partitions are unlocked
+	dispatch := func() {}
+	defer func() {
+		dispatch()
+	}()
+
+	// partitions are locked in namespace then partition id order, like
+	// lockPartitionIds
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].db.namespace != refs[j].db.namespace {
+			return refs[i].db.namespace < refs[j].db.namespace
+		}
+		return refs[i].partitionId < refs[j].partitionId
+	})
+	partitions := make([]*Partition, 0, len(refs))
+	defer func() {
+		for _, partition := range partitions {
+			partition.rw.Unlock()
+		}
+	}()
+	b := &batchTxs{txs: map[*Database]map[string]*Tx{}}
+	txs := make([]*Tx, 0, len(refs))
+	// the etags the partitions were loaded with, which intents are recorded
+	// against
+	etags := make([]string, 0, len(refs))
+	for _, r := range refs {
+		partition, err := r.db.getPartition(r.partitionId)
+		if err != nil {
+			return err
+		}
+		partition.rw.Lock()
+		partitions = append(partitions, partition)
+		etags = append(etags, partition.etag)
+		tx, err := partition.db.Begin(true)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		t := newTx(tx)
+		if b.txs[r.db] == nil {
+			b.txs[r.db] = map[string]*Tx{}
+		}
+		b.txs[r.db][r.partitionId] = t
+		txs = append(txs, t)
+	}
+	err := fn(context.WithValue(ctx, batchContextKey{}, b))
+	if err != nil {
+		return err
+	}
+
+	written := []int{}
+	for i, t := range txs {
+		if t.writes > 0 {
+			written = append(written, i)
+		}
+	}
+	var pending *intent
+	if len(written) > 1 {
+		pending = &intent{ID: uuid.NewString(), Partitions: []partitionWrites{}}
+		for _, i := range written {
+			w, err := txs[i].partitionWrites(partitions[i], etags[i])
+			if err != nil {
+				return err
+			}
+			w.Namespace = refs[i].db.namespace
+			w.PartitionID = refs[i].partitionId
+			pending.Partitions = append(pending.Partitions, *w)
+		}
+		err = refs[0].db.addIntent(ctx, pending)
+		if err != nil {
+			return err
+		}
+	}
+	for _, i := range written {
+		err = refs[i].db.recordChanges(txs[i], refs[i].partitionId)
+		if err != nil {
+			return err
+		}
+		err = txs[i].tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	// from now on failures leave the intent to be replayed at startup, on
+	// the partitions which are not uploaded by a later write
+	var resError error
+	mu := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, i := range written {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := refs[i].db.upload(refs[i].partitionId, partitions[i])
+			if err != nil {
+				mu.Lock()
+				resError = err
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if resError != nil {
+		return resError
+	}
+	for _, i := range written {
+		refs[i].db.queueChanges(refs[i].partitionId)
+	}
+	dispatch = func() {
+		type dbEvent struct {
+			db *Database
+			e  Event
+		}
+		events := []dbEvent{}
+		for _, i := range written {
+			for _, e := range txs[i].events {
+				events = append(events, dbEvent{refs[i].db, e})
+			}
+		}
+		sort.Slice(events, func(i, j int) bool {
+			return events[i].e.seq < events[j].e.seq
+		})
+		for _, e := range events {
+			e.db.dispatch([]Event{e.e})
+		}
+	}
+	if pending == nil {
+		return nil
+	}
+	return refs[0].db.removeIntent(ctx, pending)
+}
+
+// partitionWrites are the writes of a batch to a partition, recorded as
+// deltas from the partition stored with Etag
+type partitionWrites struct {
+	Namespace   int        `json:"namespace"`
+	PartitionID string     `json:"partitionId"`
+	Etag        string     `json:"etag"`
+	Keys        []keyDelta `json:"keys"`
+}
+
+// partitionWrites returns the deltas of the keys written by tx from their
+// committed state in partition, the caller must hold partition.rw
+func (tx *Tx) partitionWrites(partition *Partition, etag string) (*partitionWrites, error) {
+	// the staged writes are not visible to another transaction
+	committed, err := partition.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer committed.Rollback()
+	before := newTx(committed)
+	w := &partitionWrites{Etag: etag, Keys: []keyDelta{}}
+	for key := range tx.dirty {
+		d, err := tx.delta(before, []byte(key))
+		if err != nil {
+			return nil, err
+		}
+		w.Keys = append(w.Keys, *d)
+	}
+	return w, nil
+}
+
+// intent is the commit record of a batch writing several partitions,
+// recorded in system/intents/$id.json while the partitions are uploaded, and
+// removed once they all are. The partitions of an intent left by a crash
+// which are still stored with the etag they were written against are rolled
+// forward at startup, the other ones were uploaded with the writes of the
+// batch, and maybe later ones. Each batch writes its own object, so that
+// concurrent batches do not wait for each other.
+type intent struct {
+	ID         string            `json:"id"`
+	Partitions []partitionWrites `json:"partitions"`
+}
+
+func intentPath(id string) string {
+	return intentsPrefix + id + ".json"
+}
+
+func (db *Database) addIntent(ctx context.Context, i *intent) error {
+	data, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	err = db.checkLeader()
+	if err != nil {
+		return err
+	}
+	return db.storage.PutObject(ctx, intentPath(i.ID), data)
+}
+
+func (db *Database) removeIntent(ctx context.Context, i *intent) error {
+	return db.storage.RemoveObject(ctx, intentPath(i.ID))
+}
+
+// replayIntents completes the batches interrupted by a crash, before any
+// command is served
+func (db *Database) replayIntents(ctx context.Context) error {
+	paths, err := db.storage.ListObjects(ctx, intentsPrefix)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		data, err := db.storage.GetObject(ctx, p)
+		if err != nil {
+			return err
+		}
+		i := &intent{}
+		err = json.Unmarshal(data, i)
+		if err != nil {
+			return err
+		}
+		for _, w := range i.Partitions {
+			err = db.inNamespace(w.Namespace).replayWrites(ctx, &w)
+			if err != nil {
+				return err
+			}
+		}
+		err = db.removeIntent(ctx, i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayWrites rolls the partition forward with the writes of an intent,
+// unless it was uploaded since they were recorded
+func (db *Database) replayWrites(ctx context.Context, w *partitionWrites) error {
+	etag, err := db.storage.GetEtag(ctx, db.objectPath(w.PartitionID))
+	if err != nil || etag != w.Etag {
+		return err
+	}
+	return db.updateTx(ctx, w.PartitionID, func(tx *Tx) error {
+		for _, d := range w.Keys {
+			d := d
+			if d.Dump != nil {
+				tx.Notify(EventGeneric, "restore", d.Key)
+			}
+			err := tx.rollForward(&d)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,259 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/onsi/gomega"
+)
+
+func version(g *gomega.WithT, d *Database, key []byte) string {
+	var v string
+	err := d.View(context.Background(), key, func(tx *Tx) error {
+		var err error
+		v, err = tx.Version(key)
+		return err
+	})
+	g.Expect(err).To(BeNil())
+	return v
+}
+
+func TestBatch(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	a, b := keysInPartitions(false)
+	put := func(ctx context.Context, key []byte, val string) error {
+		return db.Set(ctx, key, func(prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
+			return []byte(val), nil, nil
+		})
+	}
+
+	err := Batch(ctx, []DBKey{{db, a}, {db, b}}, func(ctx context.Context) error {
+		err := put(ctx, a, "1")
+		if err != nil {
+			return err
+		}
+		err = db.MSet(ctx, [][]byte{b}, func(i int, prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
+			return []byte("2"), nil, nil
+		})
+		if err != nil {
+			return err
+		}
+		// writes are visible within the transaction
+		values, err := db.MGet(ctx, [][]byte{a, b})
+		g.Expect(values).To(Equal([][]byte{[]byte("1"), []byte("2")}))
+		if err != nil {
+			return err
+		}
+		// keys outside of the transaction can not be accessed
+		_, err = db.Rename(ctx, a, []byte(uuid.NewString()), false)
+		g.Expect(err).To(Equal(errNotDeclared))
+		err = Batch(ctx, []DBKey{{db, []byte(uuid.NewString())}}, func(ctx context.Context) error {
+			return nil
+		})
+		g.Expect(err).To(Equal(errNotDeclared))
+		// nested calls join the transaction
+		return Batch(ctx, []DBKey{{db, b}}, func(ctx context.Context) error {
+			_, err := db.Rename(ctx, b, b, false)
+			return err
+		})
+	})
+	g.Expect(err).To(BeNil())
+	values, err := db.MGet(ctx, [][]byte{a, b})
+	g.Expect(err).To(BeNil())
+	g.Expect(values).To(Equal([][]byte{[]byte("1"), []byte("2")}))
+
+	// nothing is written if fn fails
+	errFailed := errors.New("failed")
+	err = Batch(ctx, []DBKey{{db, a}, {db, b}}, func(ctx context.Context) error {
+		err := put(ctx, a, "3")
+		if err != nil {
+			return err
+		}
+		_, err = db.Rename(ctx, b, a, false)
+		if err != nil {
+			return err
+		}
+		return errFailed
+	})
+	g.Expect(err).To(Equal(errFailed))
+	values, err = db.MGet(ctx, [][]byte{a, b})
+	g.Expect(err).To(BeNil())
+	g.Expect(values).To(Equal([][]byte{[]byte("1"), []byte("2")}))
+}
+
+func TestVersion(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key, other := keysInPartitions(true)
+	put := func(key []byte, exp *time.Time) {
+		err := db.Set(ctx, key, func(prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
+			return []byte("v"), exp, nil
+		})
+		g.Expect(err).To(BeNil())
+	}
+
+	missing := version(g, db, key)
+	addMembers(g, db, other, nil, "a")
+	g.Expect(version(g, db, key)).To(Equal(missing))
+	put(key, nil)
+	created := version(g, db, key)
+	g.Expect(created).NotTo(Equal(missing))
+
+	// reads do not change versions
+	_, _, err := db.Get(ctx, key)
+	g.Expect(err).To(BeNil())
+	expectMembers(g, db, other, nil, "a")
+	g.Expect(version(g, db, key)).To(Equal(created))
+
+	put(key, nil)
+	written := version(g, db, key)
+	g.Expect(written).NotTo(Equal(created))
+
+	// deletions and expirations change versions
+	exp := time.Now().Add(100 * time.Millisecond)
+	put(key, &exp)
+	expiring := version(g, db, key)
+	time.Sleep(150 * time.Millisecond)
+	g.Expect(version(g, db, key)).NotTo(Equal(expiring))
+	put(key, nil)
+	written = version(g, db, key)
+	_, err = db.Rename(ctx, key, []byte(uuid.NewString()), false)
+	g.Expect(err).To(BeNil())
+	deleted := version(g, db, key)
+	g.Expect(deleted).NotTo(Equal(written))
+	put(key, nil)
+	g.Expect(version(g, db, key)).NotTo(Equal(deleted))
+}
+
+func TestBatchRecovery(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	a, b := keysInPartitions(false)
+	mset := func(ctx context.Context, val string) error {
+		return db.MSet(ctx, [][]byte{a, b}, func(i int, prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
+			return []byte(val), nil, nil
+		})
+	}
+	g.Expect(mset(ctx, "old")).To(BeNil())
+
+	// the upload of b fails, a crash would leave the batch half done
+	err := Batch(ctx, []DBKey{{db, a}, {db, b}}, func(ctx context.Context) error {
+		tx, _, err := db.batchTx(ctx, db.getPartitionId(b))
+		g.Expect(err).To(BeNil())
+		g.Expect(tx).NotTo(BeNil())
+		partition, _ := db.partitions.Load(db.getPartitionId(b))
+		partition.(*Partition).etag = "stale"
+		return mset(ctx, "new")
+	})
+	g.Expect(err).NotTo(BeNil())
+	paths, err := objectStorage.ListObjects(ctx, intentsPrefix)
+	g.Expect(err).To(BeNil())
+	g.Expect(paths).To(gomega.HaveLen(1))
+	data, err := objectStorage.GetObject(ctx, paths[0])
+	g.Expect(err).To(BeNil())
+	pending := &intent{}
+	g.Expect(json.Unmarshal(data, pending)).To(BeNil())
+	g.Expect(paths[0]).To(Equal(intentPath(pending.ID)))
+
+	// the batch is completed by the next leader before it serves commands
+	db = NewDatabase(objectStorage, 1024, os.Getenv("S3DIS_TEST_CACHE_DIR"), true)
+	values, err := db.MGet(ctx, [][]byte{a, b})
+	g.Expect(err).To(BeNil())
+	g.Expect(values).To(Equal([][]byte{[]byte("new"), []byte("new")}))
+	paths, err = objectStorage.ListObjects(ctx, intentsPrefix)
+	g.Expect(err).To(BeNil())
+	g.Expect(paths).To(BeEmpty())
+}
+
+func TestBatchRecoveryAfterUpload(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	a, b := keysInPartitions(false)
+	addMembers(g, db, b, nil, "x", "y")
+	value, _ := db.partitions.Load(db.getPartitionId(b))
+	partition := value.(*Partition)
+
+	// the upload of b fails
+	var etag string
+	err := Batch(ctx, []DBKey{{db, a}, {db, b}}, func(ctx context.Context) error {
+		etag = partition.etag
+		partition.etag = "stale"
+		err := db.Set(ctx, a, func(prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
+			return []byte("new"), nil, nil
+		})
+		if err != nil {
+			return err
+		}
+		return db.Update(ctx, b, func(tx *Tx) error {
+			set, err := tx.OpenSet(b, false)
+			if err != nil {
+				return err
+			}
+			_, err = set.Add([]byte("z"))
+			if err != nil {
+				return err
+			}
+			_, err = set.Rem([]byte("x"))
+			return err
+		})
+	})
+	g.Expect(err).NotTo(BeNil())
+
+	// the intent records the changed members of b, against its etag
+	paths, err := objectStorage.ListObjects(ctx, intentsPrefix)
+	g.Expect(err).To(BeNil())
+	g.Expect(paths).To(gomega.HaveLen(1))
+	data, err := objectStorage.GetObject(ctx, paths[0])
+	g.Expect(err).To(BeNil())
+	pending := &intent{}
+	g.Expect(json.Unmarshal(data, pending)).To(BeNil())
+	g.Expect(pending.Partitions).To(gomega.HaveLen(2))
+	for _, w := range pending.Partitions {
+		if w.PartitionID != db.getPartitionId(b) {
+			continue
+		}
+		g.Expect(w.Etag).To(Equal(etag))
+		g.Expect(w.Keys).To(gomega.HaveLen(1))
+		g.Expect(w.Keys[0].Dump.Elements).To(BeNil())
+		g.Expect(w.Keys[0].Changes).To(Equal(&bucketDelta{
+			Delete: [][]byte{memberKey([]byte("x"))},
+			Put:    []bucketEntry{{Key: memberKey([]byte("z"))}},
+		}))
+	}
+
+	// b is uploaded again with a newer write, which the intent must not undo
+	partition.etag = etag
+	addMembers(g, db, b, nil, "w")
+
+	db = NewDatabase(objectStorage, 1024, os.Getenv("S3DIS_TEST_CACHE_DIR"), true)
+	val, _, err := db.Get(ctx, a)
+	g.Expect(err).To(BeNil())
+	g.Expect(val).To(Equal([]byte("new")))
+	expectMembers(g, db, b, nil, "y", "z", "w")
+	paths, err = objectStorage.ListObjects(ctx, intentsPrefix)
+	g.Expect(err).To(BeNil())
+	g.Expect(paths).To(BeEmpty())
+}
+
+func TestReadOnly(t *testing.T) {
+	g := NewWithT(t)
+	ctx := ReadOnly(context.Background())
+	a, b := keysInPartitions(false)
+	err := db.Set(ctx, a, func(prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
+		return []byte("1"), nil, nil
+	})
+	g.Expect(err).To(Equal(errReadOnly))
+	_, err = db.MSetNX(ctx, [][]byte{a, b}, [][]byte{[]byte("1"), []byte("2")})
+	g.Expect(err).To(Equal(errReadOnly))
+	_, err = db.Rename(ctx, a, b, true)
+	g.Expect(err).To(Equal(errReadOnly))
+	values, err := db.MGet(ctx, [][]byte{a, b})
+	g.Expect(err).To(BeNil())
+	g.Expect(values).To(Equal([][]byte{nil, nil}))
+}
@@ -0,0 +1,542 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	checkpointPath = "system/cdc.json"
+	// changesBucket holds the change records of a partition which may not be
+	// delivered yet, by sequence
+	changesBucket = "changes"
+	// changeBatchLen is the maximum number of changes written to the sink
+	// at once
+	changeBatchLen = 1000
+	// sinkRetryInterval is how long the delivery waits after the sink failed
+	sinkRetryInterval = time.Second
+)
+
+var errCaptureRunning = errors.New("change data capture is already running")
+
+// Change is a change record of change data capture, one per event of a
+// write other than new, see CaptureChanges. Type, Value, Elements and
+// Expiry are those of the key once the write is committed.
+type Change struct {
+	Partition string `json:"partition"` // object path of the partition
+	// Seq orders the changes of the partition, it starts at 1 and never
+	// decreases, even across flushes
+	Seq uint64 `json:"seq"`
+	// ETag is the version of the partition from which the change was read,
+	// which includes the change and maybe later ones
+	ETag string    `json:"etag"`
+	Time time.Time `json:"time"`
+	DB   int       `json:"db"` // logical database of the key when written
+	Op   string    `json:"op"` // name of the event, e.g. set, del or lpush
+	Key  []byte    `json:"key,omitempty"`
+	// Args are the name and arguments of the command which made the write,
+	// e.g. LPUSH k a b, see WithCommand; the Go API of the server package
+	// records the command equivalent to each call. They are empty for the
+	// writes made by no command, e.g. the purge of an expired key.
+	Args [][]byte `json:"args,omitempty"`
+	// Type is the type of the key, empty if it does not exist
+	Type   string     `json:"type,omitempty"`
+	Value  []byte     `json:"value,omitempty"` // value of a string
+	Expiry *time.Time `json:"expiry,omitempty"`
+	// Elements holds the value of the other types, as the bolt bucket
+	// storing the elements of the key
+	Elements *bucketDump `json:"elements,omitempty"`
+}
+
+type commandContextKey struct{}
+
+// WithCommand returns a context whose writes record args, the name and
+// arguments of a command, in their change records
+func WithCommand(ctx context.Context, args [][]byte) context.Context {
+	return context.WithValue(ctx, commandContextKey{}, args)
+}
+
+// CommandFromContext returns the command of WithCommand, or nil
+func CommandFromContext(ctx context.Context) [][]byte {
+	args, _ := ctx.Value(commandContextKey{}).([][]byte)
+	return args
+}
+
+// ChangeSink receives the change records. WriteChanges must only return nil
+// once the changes are stored, they are written again otherwise, so that
+// every change is delivered at least once.
+type ChangeSink interface {
+	WriteChanges(ctx context.Context, changes []Change) error
+}
+
+// checkpoint is the content of system/cdc.json
+type checkpoint struct {
+	Enabled bool `json:"enabled"`
+	// Delivered is the sequence of the last delivered change by partition
+	Delivered map[string]uint64 `json:"delivered"`
+}
+
+// dirtyPartition is a partition which may hold changes to deliver
+type dirtyPartition struct {
+	db          *Database
+	partitionId string
+}
+
+// capture holds the state of change data capture. The changes are recorded
+// in their partition by the transaction of the write, and delivered in the
+// background to the sink, after which the checkpoint is saved and the
+// delivered changes are removed by the next write of the partition.
+type capture struct {
+	mu        sync.Mutex
+	enabled   bool
+	delivered map[string]uint64
+	sink      ChangeSink
+	stop      context.CancelFunc
+	done      chan struct{}
+	dirty     []dirtyPartition // in the order they were written
+	queued    map[string]bool  // object paths of dirty
+	rewritten map[string]bool  // queued partitions written again
+	wake      chan struct{}
+}
+
+func (db *Database) loadCheckpoint() error {
+	etag, err := db.storage.GetEtag(context.Background(), checkpointPath)
+	if err != nil || etag == "" {
+		return err
+	}
+	data, err := db.storage.GetObject(context.Background(), checkpointPath)
+	if err != nil {
+		return err
+	}
+	cp := &checkpoint{}
+	err = json.Unmarshal(data, cp)
+	if err != nil {
+		return err
+	}
+	c := &db.shared.capture
+	c.enabled = cp.Enabled
+	c.delivered = cp.Delivered
+	return nil
+}
+
+// saveCheckpoint writes system/cdc.json, the caller must hold capture.mu
+func (db *Database) saveCheckpoint(ctx context.Context) error {
+	c := &db.shared.capture
+	data, err := json.Marshal(&checkpoint{Enabled: c.enabled, Delivered: c.delivered})
+	if err != nil {
+		return err
+	}
+	return db.putCheckpoint(ctx, data)
+}
+
+// saveDelivered writes system/cdc.json without holding capture.mu during
+// the upload, which would block the writes recording their changes
+func (db *Database) saveDelivered(ctx context.Context) error {
+	c := &db.shared.capture
+	c.mu.Lock()
+	data, err := json.Marshal(&checkpoint{Enabled: c.enabled, Delivered: c.delivered})
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return db.putCheckpoint(ctx, data)
+}
+
+func (db *Database) putCheckpoint(ctx context.Context, data []byte) error {
+	err := db.checkLeader()
+	if err != nil {
+		return err
+	}
+	return db.storage.PutObject(ctx, checkpointPath, data)
+}
+
+// CaptureChanges records a change for every event of every write of every
+// logical database, and delivers the changes to sink in the background
+// until ctx is done, in the order of each partition. Changes are recorded
+// from now on, including while no sink is running, until StopCapture is
+// called; the changes not delivered yet, e.g. by a previous process, are
+// delivered first. Only the leader can capture changes.
+func (db *Database) CaptureChanges(ctx context.Context, sink ChangeSink) error {
+	c := &db.shared.capture
+	c.mu.Lock()
+	if c.sink != nil {
+		c.mu.Unlock()
+		return errCaptureRunning
+	}
+	enabled := c.enabled
+	c.enabled = true
+	err := db.saveCheckpoint(ctx)
+	if err != nil {
+		c.enabled = enabled
+		c.mu.Unlock()
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c.sink = sink
+	c.stop = cancel
+	c.done = make(chan struct{})
+	c.dirty = nil
+	c.queued = map[string]bool{}
+	c.rewritten = map[string]bool{}
+	c.wake = make(chan struct{}, 1)
+	done := c.done
+	c.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		defer func() {
+			c.mu.Lock()
+			c.sink = nil
+			c.mu.Unlock()
+		}()
+		// partitions written while no sink was running
+		err := db.queueStoredPartitions(ctx)
+		for err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(sinkRetryInterval):
+			}
+			err = db.queueStoredPartitions(ctx)
+		}
+		db.deliverChanges(ctx, sink)
+	}()
+	return nil
+}
+
+// StopCapture stops recording and delivering changes. The recorded changes
+// which were not delivered are kept, and delivered if the capture resumes.
+func (db *Database) StopCapture(ctx context.Context) error {
+	c := &db.shared.capture
+	c.mu.Lock()
+	stop, done := c.stop, c.done
+	c.mu.Unlock()
+	if stop != nil {
+		stop()
+		<-done
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stop = nil
+	c.enabled = false
+	return db.saveCheckpoint(ctx)
+}
+
+var partitionPathPattern = regexp.MustCompile(`^(?:databases/(\d+)/)?partitions/(\d+)/data\.db$`)
+
+// queueStoredPartitions queues every partition in object storage for
+// delivery
+func (db *Database) queueStoredPartitions(ctx context.Context) error {
+	for _, prefix := range []string{"partitions/", "databases/"} {
+		paths, err := db.storage.ListObjects(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			m := partitionPathPattern.FindStringSubmatch(p)
+			if m == nil {
+				continue
+			}
+			namespace := 0
+			if m[1] != "" {
+				namespace, _ = strconv.Atoi(m[1])
+			}
+			db.inNamespace(namespace).queueChanges(m[2])
+		}
+	}
+	return nil
+}
+
+// recordChanges stores a change for every event of tx in the changes bucket
+// of its partition, so that the changes are committed with the write, and
+// removes the changes which were delivered
+func (db *Database) recordChanges(tx *Tx, partitionId string) error {
+	c := &db.shared.capture
+	path := db.objectPath(partitionId)
+	c.mu.Lock()
+	enabled, delivered := c.enabled, c.delivered[path]
+	c.mu.Unlock()
+	if !enabled || len(tx.events) == 0 {
+		return nil
+	}
+	bucket, err := tx.bucket(changesBucket)
+	if err != nil {
+		return err
+	}
+	err = pruneChanges(bucket, delivered)
+	if err != nil {
+		return err
+	}
+	index := db.Index()
+	states := map[string]*Change{}
+	return tx.quietly(func() error {
+		for _, e := range tx.events {
+			if e.Class == EventNew {
+				// the event of the write follows
+				continue
+			}
+			state, ok := states[string(e.Key)]
+			if !ok {
+				state, err = tx.changedState(e.Key)
+				if err != nil {
+					return err
+				}
+				states[string(e.Key)] = state
+			}
+			change := *state
+			change.Partition = path
+			change.Time = tx.now
+			change.DB = index
+			change.Op = e.Name
+			change.Key = e.Key
+			change.Args = e.command
+			err = putChange(bucket, &change)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// changedState returns a change holding the type, expiration and value of
+// key
+func (tx *Tx) changedState(key []byte) (*Change, error) {
+	d, err := tx.dump(key)
+	if err != nil || d == nil {
+		return &Change{}, err
+	}
+	change := &Change{Type: d.Type, Value: d.Value, Elements: d.Elements}
+	if d.ExpireAt != 0 {
+		exp := time.UnixMilli(d.ExpireAt)
+		change.Expiry = &exp
+	}
+	return change, nil
+}
+
+// putChange numbers change and stores it
+func putChange(bucket *bolt.Bucket, change *Change) error {
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	change.Seq = seq
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(encodeUint64(seq), data)
+}
+
+// pruneChanges removes the changes up to the sequence delivered
+func pruneChanges(bucket *bolt.Bucket, delivered uint64) error {
+	keys := [][]byte{}
+	cursor := bucket.Cursor()
+	last := encodeUint64(delivered)
+	for k, _ := cursor.First(); k != nil && bytes.Compare(k, last) <= 0; k, _ = cursor.Next() {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		err := bucket.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// carryChanges copies the changes which were not delivered and the
+// sequence of the changes of a partition being replaced by an empty one,
+// and records op for the whole partition
+func (db *Database) carryChanges(from *bolt.Tx, to *bolt.Tx, partitionId string, op string) error {
+	c := &db.shared.capture
+	c.mu.Lock()
+	enabled := c.enabled
+	c.mu.Unlock()
+	prev := from.Bucket([]byte(changesBucket))
+	if !enabled && prev == nil {
+		return nil
+	}
+	bucket, err := to.CreateBucketIfNotExists([]byte(changesBucket))
+	if err != nil {
+		return err
+	}
+	if prev != nil {
+		d, err := dumpBucket(prev)
+		if err != nil {
+			return err
+		}
+		err = restoreBucket(bucket, d)
+		if err != nil {
+			return err
+		}
+		err = bucket.SetSequence(prev.Sequence())
+		if err != nil {
+			return err
+		}
+	}
+	if !enabled {
+		return nil
+	}
+	return putChange(bucket, &Change{
+		Partition: db.objectPath(partitionId),
+		Time:      time.Now(),
+		DB:        db.Index(),
+		Op:        op,
+	})
+}
+
+// queueChanges schedules the delivery of the changes of a partition, which
+// was just written
+func (db *Database) queueChanges(partitionId string) {
+	c := &db.shared.capture
+	path := db.objectPath(partitionId)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sink == nil {
+		return
+	}
+	if c.queued[path] {
+		c.rewritten[path] = true
+	} else {
+		c.queued[path] = true
+		c.dirty = append(c.dirty, dirtyPartition{db, partitionId})
+	}
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverChanges writes the recorded changes to sink until ctx is done. A
+// checkpoint which failed to be saved is saved again after
+// sinkRetryInterval, or with the next delivered changes.
+func (db *Database) deliverChanges(ctx context.Context, sink ChangeSink) {
+	c := &db.shared.capture
+	saved := true
+	for {
+		changes, n, err := db.nextChanges()
+		if err == nil && len(changes) == 0 {
+			var retry <-chan time.Time
+			if !saved {
+				retry = time.After(sinkRetryInterval)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.wake:
+			case <-retry:
+				saved = db.saveDelivered(ctx) == nil
+			}
+			continue
+		}
+		if err == nil {
+			err = sink.WriteChanges(ctx, changes)
+		}
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(sinkRetryInterval):
+			}
+			continue
+		}
+		c.mu.Lock()
+		if c.delivered == nil {
+			c.delivered = map[string]uint64{}
+		}
+		for _, change := range changes {
+			c.delivered[change.Partition] = change.Seq
+		}
+		// partitions written since they were read are queued again
+		read := c.dirty[:n:n]
+		c.dirty = c.dirty[n:]
+		for _, p := range read {
+			path := p.db.objectPath(p.partitionId)
+			if c.rewritten[path] {
+				delete(c.rewritten, path)
+				c.dirty = append(c.dirty, p)
+			} else {
+				delete(c.queued, path)
+			}
+		}
+		c.mu.Unlock()
+		// the changes are delivered again if the checkpoint is lost
+		saved = db.saveDelivered(ctx) == nil
+	}
+}
+
+// nextChanges reads the changes to deliver from the dirty partitions, up to
+// changeBatchLen, and returns the number of partitions read entirely, which
+// leave the queue once the changes are delivered
+func (db *Database) nextChanges() ([]Change, int, error) {
+	c := &db.shared.capture
+	c.mu.Lock()
+	dirty := c.dirty
+	delivered := map[string]uint64{}
+	for _, p := range dirty {
+		path := p.db.objectPath(p.partitionId)
+		delivered[path] = c.delivered[path]
+	}
+	c.mu.Unlock()
+
+	changes := []Change{}
+	read := 0 // partitions read entirely
+	var err error
+	for _, p := range dirty {
+		if len(changes) == changeBatchLen {
+			break
+		}
+		var more bool
+		changes, more, err = p.db.readChanges(p.partitionId, delivered[p.db.objectPath(p.partitionId)], changes)
+		if err != nil || more {
+			break
+		}
+		read++
+	}
+
+	return changes, read, err
+}
+
+// readChanges appends the changes of a partition after the sequence
+// delivered to changes, up to changeBatchLen, and reports whether more
+// changes are left
+func (db *Database) readChanges(partitionId string, delivered uint64, changes []Change) ([]Change, bool, error) {
+	partition, err := db.getPartition(partitionId)
+	if err != nil {
+		return changes, false, err
+	}
+	partition.rw.RLock()
+	defer partition.rw.RUnlock()
+	more := false
+	err = partition.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(changesBucket))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek(encodeUint64(delivered + 1)); k != nil; k, v = cursor.Next() {
+			if len(changes) == changeBatchLen {
+				more = true
+				return nil
+			}
+			change := Change{}
+			err := json.Unmarshal(v, &change)
+			if err != nil {
+				return err
+			}
+			change.ETag = partition.etag
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	return changes, more, err
+}
@@ -0,0 +1,220 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// memorySink keeps the changes of some keys, and fails while failing is set
+type memorySink struct {
+	mu      sync.Mutex
+	keys    map[string]bool
+	changes []Change
+	failing bool
+}
+
+func (s *memorySink) WriteChanges(ctx context.Context, changes []Change) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return errors.New("sink unavailable")
+	}
+	for _, change := range changes {
+		if s.keys[string(change.Key)] {
+			s.changes = append(s.changes, change)
+		}
+	}
+	return nil
+}
+
+// wait returns the changes received once there are n of them
+func (s *memorySink) wait(t *testing.T, n int) []Change {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		s.mu.Lock()
+		changes := append([]Change{}, s.changes...)
+		s.mu.Unlock()
+		if len(changes) >= n || time.Now().After(deadline) {
+			return changes
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCaptureChanges(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+	list := []byte(uuid.NewString())
+	sink := &memorySink{keys: map[string]bool{string(key): true, string(list): true}}
+	capturing, stop := context.WithCancel(ctx)
+	defer stop()
+	g.Expect(db.CaptureChanges(capturing, sink)).To(BeNil())
+	g.Expect(db.CaptureChanges(capturing, sink)).To(Equal(errCaptureRunning))
+	defer db.StopCapture(ctx)
+
+	exp := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+	err := db.Update(ctx, key, func(tx *Tx) error {
+		return tx.Put(key, []byte("a"), &exp)
+	})
+	g.Expect(err).To(BeNil())
+	err = db.Update(WithCommand(ctx, [][]byte{[]byte("RPUSH"), list, []byte("x")}), list, func(tx *Tx) error {
+		l, err := tx.OpenList(list, true)
+		if err != nil {
+			return err
+		}
+		return l.Push(false, []byte("x"))
+	})
+	g.Expect(err).To(BeNil())
+	_, err = db.Rename(ctx, key, list, false)
+	g.Expect(err).To(BeNil())
+
+	// the changes are ordered by partition
+	byKey := map[string][]Change{}
+	ops := map[string][]string{}
+	for _, change := range sink.wait(t, 5) {
+		byKey[string(change.Key)] = append(byKey[string(change.Key)], change)
+		ops[string(change.Key)] = append(ops[string(change.Key)], change.Op)
+		g.Expect(change.ETag).NotTo(BeEmpty())
+		g.Expect(change.DB).To(Equal(0))
+	}
+	g.Expect(ops).To(Equal(map[string][]string{
+		string(key):  {"set", "expire", "rename_from"},
+		string(list): {"rpush", "rename_to"},
+	}))
+	changes := byKey[string(key)]
+	g.Expect(changes[0].Partition).To(Equal(db.objectPath(db.getPartitionId(key))))
+	g.Expect(changes[0].Type).To(Equal(TypeString))
+	g.Expect(changes[0].Value).To(Equal([]byte("a")))
+	g.Expect(changes[0].Expiry.Equal(exp)).To(Equal(true))
+	g.Expect(changes[1].Seq > changes[0].Seq).To(Equal(true))
+	// the values are those once the write is committed
+	g.Expect(changes[2].Type).To(Equal(""))
+	changes = byKey[string(list)]
+	g.Expect(changes[0].Type).To(Equal(TypeList))
+	g.Expect(changes[0].Args).To(Equal([][]byte{[]byte("RPUSH"), list, []byte("x")}))
+	g.Expect(len(changes[0].Elements.Entries)).To(Equal(1))
+	g.Expect(changes[1].Type).To(Equal(TypeString))
+	g.Expect(changes[1].Value).To(Equal([]byte("a")))
+
+	// the changes are delivered again until the sink succeeds
+	sink.mu.Lock()
+	sink.failing = true
+	sink.changes = nil
+	sink.mu.Unlock()
+	err = db.Update(ctx, key, func(tx *Tx) error {
+		return tx.Put(key, []byte("b"), nil)
+	})
+	g.Expect(err).To(BeNil())
+	time.Sleep(100 * time.Millisecond)
+	g.Expect(sink.wait(t, 0)).To(BeEmpty())
+	sink.mu.Lock()
+	sink.failing = false
+	sink.mu.Unlock()
+	changes = sink.wait(t, 1)
+	g.Expect(len(changes)).To(Equal(1))
+	g.Expect(changes[0].Value).To(Equal([]byte("b")))
+
+	// changes are recorded while no sink runs, and delivered from the
+	// checkpoint by the next leader
+	stop()
+	time.Sleep(100 * time.Millisecond)
+	err = db.Update(ctx, key, func(tx *Tx) error {
+		return tx.Put(key, []byte("c"), nil)
+	})
+	g.Expect(err).To(BeNil())
+	db = NewDatabase(objectStorage, 1024, os.Getenv("S3DIS_TEST_CACHE_DIR"), true)
+	resumed := &memorySink{keys: sink.keys}
+	g.Expect(db.CaptureChanges(ctx, resumed)).To(BeNil())
+	changes = resumed.wait(t, 1)
+	g.Expect(len(changes)).To(Equal(1))
+	g.Expect(changes[0].Value).To(Equal([]byte("c")))
+
+	// nothing is recorded once stopped
+	g.Expect(db.StopCapture(ctx)).To(BeNil())
+	err = db.Update(ctx, key, func(tx *Tx) error {
+		return tx.Put(key, []byte("d"), nil)
+	})
+	g.Expect(err).To(BeNil())
+	err = db.view(db.getPartitionId(key), func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(changesBucket)).ForEach(func(k, v []byte) error {
+			change := Change{}
+			err := json.Unmarshal(v, &change)
+			g.Expect(change.Value).NotTo(Equal([]byte("d")))
+			return err
+		})
+	})
+	g.Expect(err).To(BeNil())
+}
+
+func TestFileSink(t *testing.T) {
+	g := NewWithT(t)
+	sink := &FileSink{Path: filepath.Join(t.TempDir(), "changes.jsonl")}
+	for i := 1; i <= 2; i++ {
+		err := sink.WriteChanges(context.Background(), []Change{{Seq: uint64(i), Op: "set", Key: []byte("k")}})
+		g.Expect(err).To(BeNil())
+	}
+	f, err := os.Open(sink.Path)
+	g.Expect(err).To(BeNil())
+	defer f.Close()
+	seqs := []uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		change := Change{}
+		g.Expect(json.Unmarshal(scanner.Bytes(), &change)).To(BeNil())
+		seqs = append(seqs, change.Seq)
+	}
+	g.Expect(seqs).To(Equal([]uint64{1, 2}))
+}
+
+func TestWebhookSink(t *testing.T) {
+	g := NewWithT(t)
+	status := http.StatusInternalServerError
+	var body []byte
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer webhook.Close()
+	sink := &WebhookSink{URL: webhook.URL}
+	changes := []Change{{Seq: 1, Op: "set", Key: []byte("k")}}
+	g.Expect(sink.WriteChanges(context.Background(), changes)).NotTo(BeNil())
+	status = http.StatusNoContent
+	g.Expect(sink.WriteChanges(context.Background(), changes)).To(BeNil())
+	data, err := encodeChanges(changes)
+	g.Expect(err).To(BeNil())
+	g.Expect(body).To(Equal(data))
+}
+
+func TestObjectStorageSink(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	prefix := "cdc/" + uuid.NewString() + "/"
+	sink := &ObjectStorageSink{Storage: objectStorage, Prefix: prefix}
+	for i := 1; i <= 2; i++ {
+		g.Expect(sink.WriteChanges(ctx, []Change{{Seq: uint64(i), Op: "set"}})).To(BeNil())
+	}
+	paths, err := objectStorage.ListObjects(ctx, prefix)
+	g.Expect(err).To(BeNil())
+	g.Expect(len(paths)).To(Equal(2))
+	for i, p := range paths {
+		data, err := objectStorage.GetObject(ctx, p)
+		g.Expect(err).To(BeNil())
+		change := Change{}
+		g.Expect(json.Unmarshal(data, &change)).To(BeNil())
+		g.Expect(change.Seq).To(Equal(uint64(i + 1)))
+	}
+}
@@ -21,12 +21,17 @@ type Database struct {
 	uuid            string
 	storage         *storage.ObjectStorage
 	partitions      sync.Map
+	namespace       int         // namespace of the partitions in object storage
+	shared          *namespaces // shared by the databases of the same storage
 	MaxPartitionNum int
 	LocalDataDir    string
 	Singleton       bool
 }
 
 func NewDatabase(storage *storage.ObjectStorage, MaxPartitionNum int, LocalDataDir string, Singleton bool) *Database {
+	if MaxPartitionNum > maxScanPartitions {
+		panic(fmt.Errorf("MaxPartitionNum must not exceed %d", maxScanPartitions))
+	}
 	db := &Database{
 		uuid:            uuid.NewString(),
 		storage:         storage,
@@ -35,20 +40,73 @@ func NewDatabase(storage *storage.ObjectStorage, MaxPartitionNum int, LocalDataD
 		Singleton:       Singleton,
 	}
 
+	db.shared = &namespaces{
+		databases: map[int]*Database{0: db},
+	}
+
 	err := db.electLeader()
 	if err != nil {
 		panic(err)
 	}
+	err = db.refreshMapping(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	// the writes of the replayed intents and flushes are captured
+	err = db.loadCheckpoint()
+	if err != nil {
+		panic(err)
+	}
+	if db.Singleton {
+		err = db.replayIntents(context.Background())
+		if err != nil {
+			panic(err)
+		}
+		// flushes are replayed after the batches, which they followed
+		err = db.replayFlushes(context.Background())
+		if err != nil {
+			panic(err)
+		}
+	}
 	return db
 }
 
 type Partition struct {
-	rw   sync.RWMutex
+	rw sync.RWMutex
+	// mu guards db and etag, which are written holding both rw and mu, so
+	// that they can be read holding either: getPartition checks them without
+	// waiting for the writers of the partition
+	mu   sync.Mutex
 	db   *bolt.DB
 	path string // db path
 	etag string
 }
 
+// loaded returns the etag of the local copy of the partition, and whether
+// there is a local copy
+func (p *Partition) loaded() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.etag, p.db != nil
+}
+
+// setLoaded replaces the local copy of the partition, the caller must hold
+// p.rw
+func (p *Partition) setLoaded(boltDB *bolt.DB, path string, etag string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.db = boltDB
+	p.path = path
+	p.etag = etag
+}
+
+// setEtag records the etag of an upload, the caller must hold p.rw
+func (p *Partition) setEtag(etag string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.etag = etag
+}
+
 type Leader struct {
 	UUID string `json:"uuid"`
 }
@@ -87,6 +145,24 @@ func (db *Database) getLeader() (*Leader, error) {
 	return leader, err
 }
 
+// objectPath returns the path of a partition in object storage, partitions
+// of namespace 0 are stored at the root for compatibility
+func (db *Database) objectPath(partitionId string) string {
+	if db.namespace == 0 {
+		return fmt.Sprintf("partitions/%s/data.db", partitionId)
+	}
+	return fmt.Sprintf("databases/%d/partitions/%s/data.db", db.namespace, partitionId)
+}
+
+// localPath returns a new path for a local copy of a partition
+func (db *Database) localPath(partitionId string) string {
+	name := fmt.Sprintf("%s-%d.db", partitionId, time.Now().UnixNano())
+	if db.namespace != 0 {
+		name = fmt.Sprintf("db%d-%s", db.namespace, name)
+	}
+	return path.Join(db.LocalDataDir, name)
+}
+
 func (db *Database) getPartitionId(key []byte) string {
 	partitionId := crc32.ChecksumIEEE(key) % uint32(db.MaxPartitionNum)
 	return fmt.Sprintf("%d", partitionId)
@@ -99,23 +175,27 @@ func (db *Database) getPartition(partitionId string) (*Partition, error) {
 		etag: "",
 	})
 	partition := actual.(*Partition)
-	latestEtag, err := db.storage.GetEtag(context.Background(), fmt.Sprintf("partitions/%s/data.db", partitionId))
+	latestEtag, err := db.storage.GetEtag(context.Background(), db.objectPath(partitionId))
 	if err != nil {
 		return nil, err
 	}
 
-	if partition.etag == latestEtag && partition.db != nil {
+	if etag, ok := partition.loaded(); etag == latestEtag && ok {
 		return partition, nil
 	}
 
 	partition.rw.Lock()
 	defer partition.rw.Unlock()
+	// another caller may have loaded it while this one waited
+	if partition.etag == latestEtag && partition.db != nil {
+		return partition, nil
+	}
 
-	localDBPath := path.Join(db.LocalDataDir, fmt.Sprintf("%s-%d.db", partitionId, time.Now().UnixNano()))
+	localDBPath := db.localPath(partitionId)
 
 	// Fetching latest db if etag not matching
 	if partition.etag != latestEtag {
-		obj, err := db.storage.Get(context.Background(), fmt.Sprintf("partitions/%s/data.db", partitionId), latestEtag)
+		obj, err := db.storage.Get(context.Background(), db.objectPath(partitionId), latestEtag)
 		if err != nil {
 			return nil, err
 		}
@@ -144,9 +224,12 @@ func (db *Database) getPartition(partitionId string) (*Partition, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare bolt db: %w", err)
 	}
-	partition.db = boltDB
-	partition.path = localDBPath
-	partition.etag = latestEtag
+	prevDB := partition.db
+	partition.setLoaded(boltDB, localDBPath, latestEtag)
+	if prevDB != nil {
+		// the copy of another etag, written by another process
+		prevDB.Close()
+	}
 	return partition, nil
 }
 
@@ -164,6 +247,18 @@ func (db *Database) prepare(boldDB *bolt.DB) error {
 			}
 		}
 		if string(version) == "1" {
+			version, err = db.migrateToV2(tx)
+			if err != nil {
+				return err
+			}
+		}
+		if string(version) == "2" {
+			version, err = db.migrateToV3(tx)
+			if err != nil {
+				return err
+			}
+		}
+		if string(version) == "3" {
 			return nil
 		}
 		panic(fmt.Errorf("unknown version: %s", version))
@@ -188,6 +283,84 @@ func (db *Database) migrateToV1(tx *bolt.Tx) ([]byte, error) {
 	return newVersion, systemBucket.Put([]byte("version"), newVersion)
 }
 
+// Migrate from v1 to v2, adding the buckets of non-string types.
+// Keys without an entry in the type bucket are strings.
+func (db *Database) migrateToV2(tx *bolt.Tx) ([]byte, error) {
+	systemBucket, err := tx.CreateBucketIfNotExists([]byte("system"))
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.CreateBucketIfNotExists([]byte("type"))
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.CreateBucketIfNotExists([]byte("length"))
+	if err != nil {
+		return nil, err
+	}
+	newVersion := []byte("2")
+	return newVersion, systemBucket.Put([]byte("version"), newVersion)
+}
+
+// Migrate from v2 to v3, storing the members of sets and sorted sets which
+// start with 0x00 under their memberKey, so that empty members can be stored.
+func (db *Database) migrateToV3(tx *bolt.Tx) ([]byte, error) {
+	systemBucket, err := tx.CreateBucketIfNotExists([]byte("system"))
+	if err != nil {
+		return nil, err
+	}
+	escape := func(b *bolt.Bucket) error {
+		members := [][]byte{}
+		values := [][]byte{}
+		err := b.ForEach(func(k, v []byte) error {
+			if k[0] == 0 {
+				members = append(members, append([]byte{}, k...))
+				values = append(values, append([]byte{}, v...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// keys are deleted first, since an escaped member may be another
+		// member of the bucket
+		for _, member := range members {
+			err = b.Delete(member)
+			if err != nil {
+				return err
+			}
+		}
+		for i, member := range members {
+			err = b.Put(memberKey(member), values[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for typ, sub := range map[string]string{TypeSet: "", TypeZSet: "score"} {
+		typeBucket := tx.Bucket([]byte(typ))
+		if typeBucket == nil {
+			continue
+		}
+		err = typeBucket.ForEach(func(key, v []byte) error {
+			b := typeBucket.Bucket(key)
+			if b != nil && sub != "" {
+				b = b.Bucket([]byte(sub))
+			}
+			if b == nil {
+				return nil
+			}
+			return escape(b)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	newVersion := []byte("3")
+	return newVersion, systemBucket.Put([]byte("version"), newVersion)
+}
+
 func (db *Database) view(partitionId string, fn func(tx *bolt.Tx) error) error {
 	partition, err := db.getPartition(partitionId)
 	if err != nil {
@@ -198,6 +371,28 @@ func (db *Database) view(partitionId string, fn func(tx *bolt.Tx) error) error {
 	return partition.db.View(fn)
 }
 
+// viewExisting is like view but skips partitions which were never uploaded,
+// so that reads of the whole database do not create empty local copies
+func (db *Database) viewExisting(partitionId string, fn func(tx *bolt.Tx) error) error {
+	exists, err := db.partitionExists(partitionId)
+	if err != nil || !exists {
+		return err
+	}
+	return db.view(partitionId, fn)
+}
+
+// partitionExists reports whether the partition is loaded or stored in object
+// storage
+func (db *Database) partitionExists(partitionId string) (bool, error) {
+	if actual, ok := db.partitions.Load(partitionId); ok {
+		if etag, _ := actual.(*Partition).loaded(); etag != "" {
+			return true, nil
+		}
+	}
+	etag, err := db.storage.GetEtag(context.Background(), db.objectPath(partitionId))
+	return etag != "", err
+}
+
 func (db *Database) update(partitionId string, fn func(tx *bolt.Tx) error) error {
 	partition, err := db.getPartition(partitionId)
 	if err != nil {
@@ -205,63 +400,74 @@ func (db *Database) update(partitionId string, fn func(tx *bolt.Tx) error) error
 	}
 	partition.rw.Lock()
 	defer partition.rw.Unlock()
-	err = partition.db.Update(fn)
+	return db.commit(partitionId, partition, fn)
+}
+
+// commit applies fn to the bolt db of partition and uploads the result,
+// the caller must hold partition.rw
+func (db *Database) commit(partitionId string, partition *Partition, fn func(tx *bolt.Tx) error) error {
+	err := partition.db.Update(fn)
 	if err != nil {
 		return err
 	}
-	file, err := os.Open(partition.path)
+	return db.upload(partitionId, partition)
+}
+
+// upload replaces the partition in object storage with the local bolt db,
+// the caller must hold partition.rw
+func (db *Database) upload(partitionId string, partition *Partition) error {
+	etag, err := db.uploadFile(partitionId, partition.path, partition.etag)
 	if err != nil {
 		return err
 	}
-	fi, err := file.Stat()
+	partition.setEtag(etag)
+	return nil
+}
+
+// uploadFile replaces the partition in object storage with the bolt db at
+// localPath if its etag is still etag, and returns the new etag
+func (db *Database) uploadFile(partitionId string, localPath string, etag string) (string, error) {
+	file, err := os.Open(localPath)
 	if err != nil {
-		return err
+		return "", err
 	}
-	leader, err := db.getLeader()
+	defer file.Close()
+	fi, err := file.Stat()
 	if err != nil {
-		return err
+		return "", err
 	}
-	if db.uuid != leader.UUID {
-		return fmt.Errorf("leader changed leader.uuid=%s, db.uuid=%s", leader.UUID, db.uuid)
+	err = db.checkLeader()
+	if err != nil {
+		return "", err
 	}
-	etag, err := db.storage.CompareAndSwap(
+	return db.storage.CompareAndSwap(
 		context.Background(),
-		fmt.Sprintf("partitions/%s/data.db", partitionId),
+		db.objectPath(partitionId),
 		file,
 		fi.Size(),
-		partition.etag,
+		etag,
 	)
+}
+
+// checkLeader returns an error unless this database is still the leader
+func (db *Database) checkLeader() error {
+	leader, err := db.getLeader()
 	if err != nil {
 		return err
 	}
-	partition.etag = etag
+	if db.uuid != leader.UUID {
+		return fmt.Errorf("leader changed leader.uuid=%s, db.uuid=%s", leader.UUID, db.uuid)
+	}
 	return nil
 }
 
 func (c *Database) Get(ctx context.Context, key []byte) ([]byte, *time.Time, error) {
-	partitionId := c.getPartitionId(key)
 	var val []byte
 	var exp *time.Time
-	err := c.view(partitionId, func(tx *bolt.Tx) error {
-		valueBucket := tx.Bucket([]byte("value"))
-		if valueBucket == nil {
-			return nil
-		}
-		pxatBucket := tx.Bucket([]byte("expiration"))
-		val = valueBucket.Get(key)
-		pxat := pxatBucket.Get(key)
-		if len(pxat) > 0 {
-			unixMilli, err := strconv.ParseInt(string(pxat), 10, 64)
-			if err != nil {
-				return err
-			}
-			pxTime := time.UnixMilli(unixMilli)
-			exp = &pxTime
-			if !pxTime.After(time.Now()) {
-				val = nil
-			}
-		}
-		return nil
+	err := c.View(ctx, key, func(tx *Tx) error {
+		var err error
+		val, exp, err = tx.Get(key)
+		return err
 	})
 	return val, exp, err
 }
@@ -277,17 +483,12 @@ func MustParseInt(val []byte) int64 {
 	return n
 }
 
-func (db *Database) incrStat(bucket *bolt.Bucket, key []byte, incrBy int64) error {
-	n := MustParseInt(bucket.Get(key)) + incrBy
-	return bucket.Put(key, []byte(fmt.Sprintf("%d", n)))
-}
-
 // Set sets the value for a key.
 //
 // Buckets:
 //
 //	system: {
-//	    version: "1",
+//	    version: "3",
 //	    keys: "number of keys",
 //	    expires: "number of keys with an expiration",
 //	    total_write_commands_processed: "Total number of write commands processed by the server"
@@ -297,88 +498,15 @@ func (db *Database) incrStat(bucket *bolt.Bucket, key []byte, incrBy int64) erro
 //		$key: $value
 //	}
 //
-//	pxat: {
+//	expiration: {
 //	    $key: "Unix timestamp at which the key will expire, in milliseconds."
 //	}
+//
+// Keys of other types are stored in the bucket named after their type,
+// see Tx.
 func (db *Database) Set(ctx context.Context, key []byte, w func([]byte, *time.Time) ([]byte, *time.Time, error)) error {
-	partitionId := db.getPartitionId(key)
-	return db.update(partitionId, func(tx *bolt.Tx) error {
-		systemBucket, err := tx.CreateBucketIfNotExists([]byte("system"))
-		if err != nil {
-			return err
-		}
-		valueBucket, err := tx.CreateBucketIfNotExists([]byte("value"))
-		if err != nil {
-			return err
-		}
-		pxatBucket, err := tx.CreateBucketIfNotExists([]byte("expiration"))
-		if err != nil {
-			return err
-		}
-		prevVal := valueBucket.Get(key)
-		prevPXAt := pxatBucket.Get(key)
-		var prevExp *time.Time
-		if len(prevPXAt) > 0 {
-			unixMilli, err := strconv.ParseInt(string(prevPXAt), 10, 64)
-			if err != nil {
-				return err
-			}
-			prevExpTime := time.UnixMilli(unixMilli)
-			prevExp = &prevExpTime
-			if !prevExp.After(time.Now()) {
-				prevVal = nil
-			}
-		}
-
-		val, exp, err := w(prevVal, prevExp)
-		if err != nil {
-			return err
-		}
-		err = valueBucket.Put(key, val)
-		if err != nil {
-			return err
-		}
-		if exp != nil {
-			err = pxatBucket.Put(key, []byte(fmt.Sprintf("%d", exp.UnixNano()/time.Millisecond.Nanoseconds())))
-			if err != nil {
-				return err
-			}
-		} else {
-			err = pxatBucket.Delete(key)
-			if err != nil {
-				return err
-			}
-		}
-		err = db.incrStat(systemBucket, []byte("total_write_commands_processed"), 1)
-		if err != nil {
-			return err
-		}
-		if len(prevVal) == 0 {
-			err = db.incrStat(systemBucket, []byte("keys"), 1)
-			if err != nil {
-				return err
-			}
-			if exp != nil {
-				err = db.incrStat(systemBucket, []byte("expires"), 1)
-				if err != nil {
-					return err
-				}
-			}
-		} else {
-			if prevExp != nil && exp == nil {
-				err = db.incrStat(systemBucket, []byte("expires"), -1)
-				if err != nil {
-					return err
-				}
-			}
-			if prevExp == nil && exp != nil {
-				err = db.incrStat(systemBucket, []byte("expires"), 1)
-				if err != nil {
-					return err
-				}
-			}
-		}
-		return nil
+	return db.Update(ctx, key, func(tx *Tx) error {
+		return tx.Set(key, w)
 	})
 }
 
@@ -391,39 +519,53 @@ type Info struct {
 func (db *Database) Info(ctx context.Context) (*Info, error) {
 	info := &Info{}
 	mu := &sync.Mutex{}
-	var resError error
-	workers := 100
-	wg := &sync.WaitGroup{}
-	wg.Add(workers)
-	queue := make(chan string, workers)
-	for i := 0; i < workers; i++ {
-		go func() {
-			defer wg.Done()
-			for partitionID := range queue {
-				err := db.view(partitionID, func(tx *bolt.Tx) error {
-					systemBucket := tx.Bucket([]byte("system"))
-					if systemBucket == nil {
-						return nil
+	err := db.forEachPartitionId(func(partitionId string) error {
+		return db.viewExisting(partitionId, func(tx *bolt.Tx) error {
+			systemBucket := tx.Bucket([]byte("system"))
+			if systemBucket == nil {
+				return nil
+			}
+			mu.Lock()
+			info.Keys += MustParseInt(systemBucket.Get([]byte("keys")))
+			info.Expires += MustParseInt(systemBucket.Get([]byte("expires")))
+			info.TotalWriteCommandsProcessed += MustParseInt(systemBucket.Get([]byte("total_write_commands_processed")))
+			mu.Unlock()
+			return nil
+		})
+	})
+	return info, err
+}
+
+// DBSize returns the number of keys, not counting expired keys which have
+// not been purged yet. Only the system and expiration buckets are read.
+func (db *Database) DBSize(ctx context.Context) (int64, error) {
+	now := time.Now().UnixMilli()
+	size := int64(0)
+	mu := &sync.Mutex{}
+	err := db.forEachPartitionId(func(partitionId string) error {
+		return db.viewExisting(partitionId, func(tx *bolt.Tx) error {
+			systemBucket := tx.Bucket([]byte("system"))
+			if systemBucket == nil {
+				return nil
+			}
+			n := MustParseInt(systemBucket.Get([]byte("keys")))
+			pxatBucket := tx.Bucket([]byte("expiration"))
+			if pxatBucket != nil {
+				err := pxatBucket.ForEach(func(key, pxat []byte) error {
+					if MustParseInt(pxat) <= now {
+						n--
 					}
-					mu.Lock()
-					info.Keys += MustParseInt(systemBucket.Get([]byte("keys")))
-					info.Expires += MustParseInt(systemBucket.Get([]byte("expires")))
-					info.TotalWriteCommandsProcessed += MustParseInt(systemBucket.Get([]byte("total_write_commands_processed")))
-					mu.Unlock()
 					return nil
 				})
 				if err != nil {
-					mu.Lock()
-					resError = err
-					mu.Unlock()
+					return err
 				}
 			}
-		}()
-	}
-	for partitionID := 0; partitionID < db.MaxPartitionNum; partitionID++ {
-		queue <- fmt.Sprintf("%d", partitionID)
-	}
-	close(queue)
-	wg.Wait()
-	return info, resError
+			mu.Lock()
+			size += n
+			mu.Unlock()
+			return nil
+		})
+	})
+	return size, err
 }
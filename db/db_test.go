@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -10,6 +11,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/onsi/gomega"
 	"github.com/zenozeng/s3dis/storage"
+	bolt "go.etcd.io/bbolt"
 )
 
 var (
@@ -101,4 +103,45 @@ func TestInfo(t *testing.T) {
 	g.Expect(err).To(BeNil())
 	g.Expect(info2.Keys).To(Equal(info.Keys + 1))
 	g.Expect(info2.TotalWriteCommandsProcessed).To(Equal(info.TotalWriteCommandsProcessed + 1))
-}
\ No newline at end of file
+}
+
+func TestMigrateToV3(t *testing.T) {
+	g := NewWithT(t)
+	boltDB, err := bolt.Open(filepath.Join(t.TempDir(), "v2.db"), 0600, nil)
+	g.Expect(err).To(BeNil())
+	defer boltDB.Close()
+	// members starting with 0x00 were stored as is by v2
+	raw := [][]byte{[]byte("\x00"), []byte("\x00\x00"), []byte("a")}
+	err = boltDB.Update(func(tx *bolt.Tx) error {
+		system, _ := tx.CreateBucket([]byte("system"))
+		system.Put([]byte("version"), []byte("2"))
+		set, _ := tx.CreateBucket([]byte(TypeSet))
+		members, _ := set.CreateBucket([]byte("s"))
+		zset, _ := tx.CreateBucket([]byte(TypeZSet))
+		z, _ := zset.CreateBucket([]byte("z"))
+		scores, _ := z.CreateBucket([]byte("score"))
+		for _, member := range raw {
+			members.Put(member, []byte{})
+			scores.Put(member, EncodeScore(1))
+		}
+		return nil
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(db.prepare(boltDB)).To(BeNil())
+	err = boltDB.View(func(tx *bolt.Tx) error {
+		g.Expect(tx.Bucket([]byte("system")).Get([]byte("version"))).To(Equal([]byte("3")))
+		for _, b := range []*bolt.Bucket{
+			tx.Bucket([]byte(TypeSet)).Bucket([]byte("s")),
+			tx.Bucket([]byte(TypeZSet)).Bucket([]byte("z")).Bucket([]byte("score")),
+		} {
+			members := [][]byte{}
+			b.ForEach(func(k, v []byte) error {
+				members = append(members, decodeMemberKey(k))
+				return nil
+			})
+			g.Expect(members).To(Equal(raw))
+		}
+		return nil
+	})
+	g.Expect(err).To(BeNil())
+}
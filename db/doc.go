@@ -0,0 +1,26 @@
+// Package db stores the logical databases of s3dis in object storage, one
+// bolt db per partition of keys.
+//
+// # Commits
+//
+// A write to one partition commits a bolt transaction on the local copy of
+// the partition, then uploads it if its etag in object storage is still the
+// one it was loaded with. Only the leader, see system/leader.json, uploads.
+//
+// Writes spanning several partitions, e.g. RENAME, MOVE, or EXEC of
+// MULTI without keyspace commands like FLUSHDB or SWAPDB, go through Batch. Batch locks the partitions, stages the writes
+// in their bolt transactions, then records an intent in
+// system/intents/$id.json before committing and uploading the partitions,
+// and removes it once they all are uploaded. The intent holds, for each
+// partition, the etag it was loaded with and the changes of the written
+// keys since. A flush, see FlushAll, records the flushed partitions in
+// system/flushes/$id.json the same way before resetting them.
+//
+// The leader replays the intents, then the flush records, left by a crash
+// before serving any command. The changes of an intent are only applied to
+// the partitions still stored with the recorded etag: the other ones were
+// uploaded with the writes of the batch, and maybe later writes which
+// replaying would undo. Replaying the flush records is idempotent. Commands
+// of the process are isolated from a commit in progress by the locks of the
+// partitions, which are held until the partitions are uploaded.
+package db
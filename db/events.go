@@ -0,0 +1,202 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// EventClass is a class of keyspace notifications, named by its character in
+// notify-keyspace-events
+type EventClass byte
+
+const (
+	EventGeneric EventClass = 'g' // del, expire, rename_from, ...
+	EventString  EventClass = '$'
+	EventList    EventClass = 'l'
+	EventSet     EventClass = 's'
+	EventHash    EventClass = 'h'
+	EventZSet    EventClass = 'z'
+	// EventExpired is notified when a write or PurgeExpired purges an
+	// expired key
+	EventExpired EventClass = 'x'
+	// EventEvicted is accepted for compatibility, s3dis does not evict keys
+	EventEvicted EventClass = 'e'
+	EventStream  EventClass = 't'
+	EventModule  EventClass = 'd' // JSON documents
+	EventNew     EventClass = 'n'
+	// EventKeyMiss is accepted for compatibility, reads do not notify
+	EventKeyMiss EventClass = 'm'
+)
+
+// allEventClasses are the classes enabled by A in notify-keyspace-events
+const allEventClasses = "g$lshzxetd"
+
+var errInvalidEventClass = errors.New("Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
+
+// Event is a keyspace notification, emitted once the write which caused it
+// is committed
+type Event struct {
+	DB    int // logical database of the key when the event is delivered
+	Class EventClass
+	Name  string // e.g. set, del, expired
+	Key   []byte
+	seq   uint64 // order of the events of a Batch, which spans transactions
+	// command is the command which made the write, recorded by change data
+	// capture
+	command [][]byte
+}
+
+// eventSeq numbers the events in the order they are notified
+var eventSeq uint64
+
+// notifier holds notify-keyspace-events and the functions receiving the
+// events
+type notifier struct {
+	mu        sync.RWMutex
+	flags     map[byte]bool
+	listeners map[int]listener
+	nextId    int
+}
+
+type listener struct {
+	fn  func(Event)
+	all bool // receives the events of every class, see OnWrite
+}
+
+// SetNotifyKeyspaceEvents enables the classes of events of flags, in the
+// syntax of notify-keyspace-events. K and E select the Pub/Sub channels of
+// the events and are only recorded, see NotifyKeyspaceEvents.
+func (db *Database) SetNotifyKeyspaceEvents(flags string) error {
+	parsed := map[byte]bool{}
+	for _, c := range []byte(flags) {
+		switch {
+		case c == 'A':
+			for _, class := range []byte(allEventClasses) {
+				parsed[class] = true
+			}
+		case strings.IndexByte(allEventClasses+"KEmn", c) >= 0:
+			parsed[c] = true
+		default:
+			return errInvalidEventClass
+		}
+	}
+	n := &db.shared.notifier
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.flags = parsed
+	return nil
+}
+
+// NotifyKeyspaceEvents returns notify-keyspace-events, with all the classes
+// of A written as A like Redis does
+func (db *Database) NotifyKeyspaceEvents() string {
+	n := &db.shared.notifier
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	res := ""
+	for _, class := range []byte(allEventClasses) {
+		if n.flags[class] {
+			res += string(class)
+		}
+	}
+	if res == allEventClasses {
+		res = "A"
+	}
+	for _, c := range []byte("KEmn") {
+		if n.flags[c] {
+			res += string(c)
+		}
+	}
+	return res
+}
+
+// OnEvent calls fn with the events of the classes enabled by
+// SetNotifyKeyspaceEvents, of every logical database, until the returned
+// function is called. fn is called after the write is committed, by the
+// goroutine which wrote, and must not block.
+func (db *Database) OnEvent(fn func(Event)) func() {
+	return db.listen(listener{fn: fn})
+}
+
+// OnWrite is like OnEvent, but fn receives the events of every class
+// whatever notify-keyspace-events is, e.g. to learn which keys are written.
+func (db *Database) OnWrite(fn func(Event)) func() {
+	return db.listen(listener{fn: fn, all: true})
+}
+
+func (db *Database) listen(l listener) func() {
+	n := &db.shared.notifier
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.listeners == nil {
+		n.listeners = map[int]listener{}
+	}
+	id := n.nextId
+	n.nextId++
+	n.listeners[id] = l
+	return func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.listeners, id)
+	}
+}
+
+// Notify records an event for key, delivered once the transaction is
+// committed. The methods of Tx notify the events of the writes they name,
+// e.g. set, del or lpush, callers notify the events of writes they name
+// themselves, e.g. hset for a hash stored as a string.
+func (tx *Tx) Notify(class EventClass, name string, key []byte) {
+	if !tx.tx.Writable() {
+		return
+	}
+	e := Event{
+		Class: class,
+		Name:  name,
+		Key:   append([]byte{}, key...),
+		seq:   atomic.AddUint64(&eventSeq, 1),
+	}
+	if class != EventExpired {
+		// a key expires on its own, not by the command which purges it
+		e.command = tx.command
+	}
+	tx.events = append(tx.events, e)
+}
+
+// quietly runs fn without recording the events of its writes, which the
+// caller notifies under another name
+func (tx *Tx) quietly(fn func() error) error {
+	n := len(tx.events)
+	err := fn()
+	tx.events = tx.events[:n]
+	return err
+}
+
+// dispatch delivers the events of committed transactions
+func (db *Database) dispatch(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	n := &db.shared.notifier
+	n.mu.RLock()
+	listeners := make([]listener, 0, len(n.listeners))
+	for _, l := range n.listeners {
+		listeners = append(listeners, l)
+	}
+	flags := n.flags
+	n.mu.RUnlock()
+	if len(listeners) == 0 {
+		return
+	}
+	index := db.Index()
+	for _, e := range events {
+		e.DB = index
+		e.seq = 0
+		for _, l := range listeners {
+			if l.all || flags[byte(e.Class)] {
+				l.fn(e)
+			}
+		}
+	}
+}
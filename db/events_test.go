@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestEvents(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	g.Expect(db.SetNotifyKeyspaceEvents("X")).To(Equal(errInvalidEventClass))
+	g.Expect(db.SetNotifyKeyspaceEvents("KEA")).To(BeNil())
+	defer db.SetNotifyKeyspaceEvents("")
+	g.Expect(db.NotifyKeyspaceEvents()).To(Equal("AKE"))
+
+	key := []byte(uuid.NewString())
+	dst := []byte(uuid.NewString())
+	var mu sync.Mutex
+	events := []Event{}
+	stop := db.OnEvent(func(e Event) {
+		if string(e.Key) != string(key) && string(e.Key) != string(dst) {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	})
+	defer stop()
+	received := func() []Event {
+		mu.Lock()
+		defer mu.Unlock()
+		res := events
+		events = []Event{}
+		return res
+	}
+
+	err := db.Update(ctx, key, func(tx *Tx) error {
+		return tx.Put(key, []byte("a"), nil)
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(received()).To(Equal([]Event{{DB: 0, Class: EventString, Name: "set", Key: key}}))
+
+	// new keys are only notified with n
+	g.Expect(db.SetNotifyKeyspaceEvents("gn")).To(BeNil())
+	err = db.Update(ctx, dst, func(tx *Tx) error {
+		l, err := tx.OpenList(dst, true)
+		if err != nil {
+			return err
+		}
+		return l.Push(true, []byte("a"))
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(received()).To(Equal([]Event{{DB: 0, Class: EventNew, Name: "new", Key: dst}}))
+
+	g.Expect(db.SetNotifyKeyspaceEvents("A")).To(BeNil())
+	err = db.Update(ctx, dst, func(tx *Tx) error {
+		l, err := tx.OpenList(dst, false)
+		if err != nil {
+			return err
+		}
+		_, err = l.Pop(false, 1)
+		return err
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(received()).To(Equal([]Event{{DB: 0, Class: EventList, Name: "rpop", Key: dst}, {DB: 0, Class: EventGeneric, Name: "del", Key: dst}}))
+
+	_, err = db.Rename(ctx, key, dst, false)
+	g.Expect(err).To(BeNil())
+	g.Expect(received()).To(Equal([]Event{{DB: 0, Class: EventGeneric, Name: "rename_from", Key: key}, {DB: 0, Class: EventGeneric, Name: "rename_to", Key: dst}}))
+
+	// nothing is notified if the write fails
+	err = db.Update(ctx, dst, func(tx *Tx) error {
+		tx.Notify(EventGeneric, "del", dst)
+		return errInvalidEventClass
+	})
+	g.Expect(err).To(Equal(errInvalidEventClass))
+	g.Expect(received()).To(BeEmpty())
+
+	// events carry the index of the logical database
+	other, err := db.Select(1)
+	g.Expect(err).To(BeNil())
+	exp := time.Now().Add(-time.Second)
+	err = other.Update(ctx, key, func(tx *Tx) error {
+		return tx.Put(key, []byte("b"), &exp)
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(received()).To(Equal([]Event{{DB: 1, Class: EventString, Name: "set", Key: key}, {DB: 1, Class: EventGeneric, Name: "expire", Key: key}}))
+	err = other.Update(ctx, key, func(tx *Tx) error {
+		_, err := tx.Type(key)
+		return err
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(received()).To(Equal([]Event{{DB: 1, Class: EventExpired, Name: "expired", Key: key}}))
+}
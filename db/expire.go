@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// PurgeExpired deletes the expired keys of db, notifying an expired event
+// for each, and returns the number of deleted keys. Only the partitions
+// loaded by this process are read unless all is set, in which case every
+// partition of db in object storage is loaded. Partitions without expired
+// keys are not written. It is meant for the leader, whose local copies of
+// the partitions are up to date.
+func (db *Database) PurgeExpired(ctx context.Context, all bool) (int, error) {
+	now := time.Now()
+	expired := map[string][][]byte{}
+	collect := func(partitionId string) func(tx *bolt.Tx) error {
+		return func(tx *bolt.Tx) error {
+			pxatBucket := tx.Bucket([]byte("expiration"))
+			if pxatBucket == nil {
+				return nil
+			}
+			return pxatBucket.ForEach(func(k, v []byte) error {
+				unixMilli, err := strconv.ParseInt(string(v), 10, 64)
+				if err != nil || time.UnixMilli(unixMilli).After(now) {
+					return err
+				}
+				expired[partitionId] = append(expired[partitionId], append([]byte{}, k...))
+				return nil
+			})
+		}
+	}
+	var err error
+	if all {
+		var partitionIds []string
+		partitionIds, err = db.storedPartitionIds(ctx)
+		for _, partitionId := range partitionIds {
+			if err != nil {
+				break
+			}
+			err = db.view(partitionId, collect(partitionId))
+		}
+	} else {
+		db.partitions.Range(func(k, v any) bool {
+			partition := v.(*Partition)
+			partition.rw.RLock()
+			defer partition.rw.RUnlock()
+			if partition.db != nil {
+				err = partition.db.View(collect(k.(string)))
+			}
+			return err == nil
+		})
+	}
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for partitionId, keys := range expired {
+		n := 0
+		err := db.updateTx(ctx, partitionId, func(tx *Tx) error {
+			for _, key := range keys {
+				// keys written since they were collected are kept
+				typ, err := tx.rawType(key)
+				if err != nil {
+					return err
+				}
+				if typ == TypeNone {
+					continue
+				}
+				typ, err = tx.Type(key)
+				if err != nil {
+					return err
+				}
+				if typ == TypeNone {
+					n++
+				}
+			}
+			if n == 0 {
+				return errNotApplied
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errNotApplied) {
+			return purged, err
+		}
+		purged += n
+	}
+	return purged, nil
+}
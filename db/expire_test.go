@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestPurgeExpired(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	expired := []byte(uuid.NewString())
+	live := []byte(uuid.NewString())
+	var mu sync.Mutex
+	events := []Event{}
+	stop := db.OnWrite(func(e Event) {
+		if string(e.Key) != string(expired) && string(e.Key) != string(live) {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	})
+	defer stop()
+
+	past := time.Now().Add(-time.Second)
+	future := time.Now().Add(time.Hour)
+	for _, all := range []bool{false, true} {
+		err := db.Update(ctx, expired, func(tx *Tx) error {
+			return tx.Put(expired, []byte("v"), &past)
+		})
+		g.Expect(err).To(BeNil())
+		err = db.Update(ctx, live, func(tx *Tx) error {
+			return tx.Put(live, []byte("v"), &future)
+		})
+		g.Expect(err).To(BeNil())
+		mu.Lock()
+		events = []Event{}
+		mu.Unlock()
+
+		n, err := db.PurgeExpired(ctx, all)
+		g.Expect(err).To(BeNil())
+		g.Expect(n > 0).To(Equal(true))
+		mu.Lock()
+		g.Expect(events).To(Equal([]Event{{DB: 0, Class: EventExpired, Name: "expired", Key: expired}}))
+		mu.Unlock()
+		err = db.View(ctx, expired, func(tx *Tx) error {
+			typ, err := tx.rawType(expired)
+			g.Expect(typ).To(Equal(TypeNone))
+			return err
+		})
+		g.Expect(err).To(BeNil())
+	}
+}
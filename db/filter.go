@@ -0,0 +1,120 @@
+package db
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+// FilterPageSize is the size of the pages holding the arrays of filters.
+const FilterPageSize = 4096
+
+// Filter is a handle on a probabilistic filter key, such as a Bloom or a
+// Cuckoo filter, made of sub-filters which each own an array of bytes.
+//
+// The bucket of the key holds:
+//
+//	meta: {
+//	    $name: "parameter of the filter"
+//	}
+//
+//	subs: {
+//	    $index: "parameters of the sub-filter"
+//	}
+//
+//	pages: {
+//	    $index$page: "FilterPageSize bytes of the array of the sub-filter"
+//	}
+//
+// where indexes and page numbers are 8 bytes big endian. Missing pages are
+// zeros, so that large sparse filters only store the pages they use.
+type Filter struct {
+	tx    *Tx
+	key   []byte
+	meta  *bolt.Bucket
+	subs  *bolt.Bucket
+	pages *bolt.Bucket
+}
+
+// OpenFilter returns the filter of type typ stored at key, creating an
+// empty one if create is true. It returns nil if the key does not exist and
+// create is false, and ErrWrongType if the key holds another type.
+func (tx *Tx) OpenFilter(key []byte, typ string, create bool) (*Filter, error) {
+	bucket, err := tx.open(key, typ, create)
+	if err != nil || bucket == nil {
+		return nil, err
+	}
+	f := &Filter{
+		tx:    tx,
+		key:   key,
+		meta:  bucket.Bucket([]byte("meta")),
+		subs:  bucket.Bucket([]byte("subs")),
+		pages: bucket.Bucket([]byte("pages")),
+	}
+	if f.meta == nil {
+		f.meta, err = bucket.CreateBucket([]byte("meta"))
+		if err != nil {
+			return nil, err
+		}
+		f.subs, err = bucket.CreateBucket([]byte("subs"))
+		if err != nil {
+			return nil, err
+		}
+		f.pages, err = bucket.CreateBucket([]byte("pages"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Meta returns the parameter name of the filter, or nil if it is not set.
+func (f *Filter) Meta(name string) []byte {
+	return f.meta.Get([]byte(name))
+}
+
+// SetMeta sets the parameter name of the filter.
+func (f *Filter) SetMeta(name string, val []byte) error {
+	return f.meta.Put([]byte(name), val)
+}
+
+// Subs returns the parameters of the sub-filters, in order.
+func (f *Filter) Subs() [][]byte {
+	res := [][]byte{}
+	f.subs.ForEach(func(k, v []byte) error {
+		res = append(res, append([]byte{}, v...))
+		return nil
+	})
+	return res
+}
+
+// SetSub sets the parameters of the sub-filter i, which may be a new one.
+func (f *Filter) SetSub(i int, val []byte) error {
+	return f.subs.Put(encodeUint64(uint64(i)), val)
+}
+
+func pageKey(sub int, page uint64) []byte {
+	return append(encodeUint64(uint64(sub)), encodeUint64(page)...)
+}
+
+// Byte returns the byte at offset of the array of the sub-filter sub.
+func (f *Filter) Byte(sub int, offset uint64) byte {
+	page := f.pages.Get(pageKey(sub, offset/FilterPageSize))
+	if page == nil {
+		return 0
+	}
+	return page[offset%FilterPageSize]
+}
+
+// SetByte sets the byte at offset of the array of the sub-filter sub.
+func (f *Filter) SetByte(sub int, offset uint64, b byte) error {
+	k := pageKey(sub, offset/FilterPageSize)
+	page := make([]byte, FilterPageSize)
+	copy(page, f.pages.Get(k))
+	page[offset%FilterPageSize] = b
+	return f.pages.Put(k, page)
+}
+
+// Pages returns the number of stored pages, the size of the filter being
+// about Pages() * FilterPageSize bytes.
+func (f *Filter) Pages() int {
+	return f.pages.Stats().KeyN
+}
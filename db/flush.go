@@ -0,0 +1,259 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const flushesPrefix = "system/flushes/"
+
+// flushRetryInterval is how long a flush waits before resetting again the
+// partitions whose upload failed
+const flushRetryInterval = time.Second
+
+// flushRecord is the commit record of a flush, recorded in
+// system/flushes/$id.json before the first partition is reset and removed
+// once they all are. Records left by a crash are replayed at startup by
+// resetting the partitions again.
+type flushRecord struct {
+	ID         string           `json:"id"`
+	Partitions []flushPartition `json:"partitions"`
+}
+
+type flushPartition struct {
+	Namespace int    `json:"namespace"`
+	Partition string `json:"partition"`
+}
+
+func flushPath(id string) string {
+	return flushesPrefix + id + ".json"
+}
+
+// Flush deletes every key of db, see FlushAll.
+func (db *Database) Flush(ctx context.Context, async bool) error {
+	return FlushAll(ctx, []*Database{db}, async)
+}
+
+// FlushAll deletes every key of every partition of dbs, which share an
+// object storage, all or nothing. The flush is committed by a record listing
+// the partitions, see the package documentation, and the partitions whose upload failed
+// are reset again until they all are or the leadership is lost, in which
+// case the next leader completes the flush at startup. All the partitions
+// stay locked until they are reset, so that no command of this process
+// observes a partly flushed database. With async, FlushAll returns once the
+// flush is committed and resets the partitions in the background, commands
+// touching a partition wait until it is flushed.
+func FlushAll(ctx context.Context, dbs []*Database, async bool) error {
+	leader := dbs[0]
+	err := leader.checkLeader()
+	if err != nil {
+		return err
+	}
+	// partitions are locked in namespace then partition id order, like
+	// Batch
+	dbs = append([]*Database{}, dbs...)
+	sort.Slice(dbs, func(i, j int) bool {
+		return dbs[i].namespace < dbs[j].namespace
+	})
+	type target struct {
+		db          *Database
+		partitionId string
+		partition   *Partition
+	}
+	targets := []target{}
+	unlocks := []func(){}
+	unlock := func() {
+		for _, unlock := range unlocks {
+			unlock()
+		}
+	}
+	record := &flushRecord{ID: uuid.NewString(), Partitions: []flushPartition{}}
+	for _, db := range dbs {
+		// partitions which were never uploaded are empty, writes to them
+		// during the flush happen after it
+		partitionIds, err := db.storedPartitionIds(ctx)
+		if err != nil {
+			unlock()
+			return err
+		}
+		partitionIds, partitions, dbUnlock, err := db.lockPartitionIds(partitionIds, true)
+		if err != nil {
+			unlock()
+			return err
+		}
+		unlocks = append(unlocks, dbUnlock)
+		for _, partitionId := range partitionIds {
+			targets = append(targets, target{db, partitionId, partitions[partitionId]})
+			record.Partitions = append(record.Partitions, flushPartition{db.namespace, partitionId})
+		}
+	}
+	data, err := json.Marshal(record)
+	if err == nil {
+		err = leader.storage.PutObject(ctx, flushPath(record.ID), data)
+	}
+	if err != nil {
+		unlock()
+		return err
+	}
+
+	// the partitions are reset whatever happens to ctx, the flush is
+	// committed
+	flush := func() error {
+		defer unlock()
+		for {
+			failed := []target{}
+			mu := &sync.Mutex{}
+			wg := &sync.WaitGroup{}
+			for _, t := range targets {
+				wg.Add(1)
+				go func(t target) {
+					defer wg.Done()
+					err := t.db.resetPartition(t.partitionId, t.partition)
+					if err != nil {
+						mu.Lock()
+						failed = append(failed, t)
+						mu.Unlock()
+					}
+				}(t)
+			}
+			wg.Wait()
+			if len(failed) == 0 {
+				return leader.storage.RemoveObject(context.Background(), flushPath(record.ID))
+			}
+			targets = failed
+			time.Sleep(flushRetryInterval)
+			err := leader.checkLeader()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if async {
+		go flush()
+		return nil
+	}
+	return flush()
+}
+
+// storedPartitionIds returns the ids of the partitions of db in object
+// storage
+func (db *Database) storedPartitionIds(ctx context.Context) ([]string, error) {
+	paths, err := db.storage.ListObjects(ctx, strings.TrimSuffix(db.objectPath(""), "/data.db"))
+	if err != nil {
+		return nil, err
+	}
+	partitionIds := []string{}
+	for _, p := range paths {
+		if m := partitionPathPattern.FindStringSubmatch(p); m != nil {
+			partitionIds = append(partitionIds, m[2])
+		}
+	}
+	return partitionIds, nil
+}
+
+// replayFlushes completes the flushes interrupted by a crash, before any
+// command is served
+func (db *Database) replayFlushes(ctx context.Context) error {
+	paths, err := db.storage.ListObjects(ctx, flushesPrefix)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		data, err := db.storage.GetObject(ctx, p)
+		if err != nil {
+			return err
+		}
+		record := &flushRecord{}
+		err = json.Unmarshal(data, record)
+		if err != nil {
+			return err
+		}
+		for _, fp := range record.Partitions {
+			d := db.inNamespace(fp.Namespace)
+			partition, err := d.getPartition(fp.Partition)
+			if err != nil {
+				return err
+			}
+			partition.rw.Lock()
+			err = d.resetPartition(fp.Partition, partition)
+			partition.rw.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		err = db.storage.RemoveObject(ctx, p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetPartition replaces the partition with an empty bolt db, in object
+// storage and in the local cache, keeping the statistics other than the key
+// counts and the changes which were not delivered to the change sink, see
+// CaptureChanges. The caller must hold partition.rw.
+func (db *Database) resetPartition(partitionId string, partition *Partition) error {
+	if partition.etag == "" {
+		// the partition was never uploaded, it is empty
+		return nil
+	}
+	var writes []byte
+	err := partition.db.View(func(tx *bolt.Tx) error {
+		writes = append(writes, tx.Bucket([]byte("system")).Get([]byte("total_write_commands_processed"))...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	localDBPath := db.localPath(partitionId)
+	boltDB, err := bolt.Open(localDBPath, 0600, &bolt.Options{
+		ReadOnly: false,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open bolt db: %w", err)
+	}
+	discard := func(err error) error {
+		boltDB.Close()
+		os.Remove(localDBPath)
+		return err
+	}
+	err = db.prepare(boltDB)
+	if err != nil {
+		return discard(fmt.Errorf("failed to prepare bolt db: %w", err))
+	}
+	err = boltDB.Update(func(tx *bolt.Tx) error {
+		if len(writes) > 0 {
+			err := tx.Bucket([]byte("system")).Put([]byte("total_write_commands_processed"), writes)
+			if err != nil {
+				return err
+			}
+		}
+		return partition.db.View(func(prev *bolt.Tx) error {
+			return db.carryChanges(prev, tx, partitionId, "flushdb")
+		})
+	})
+	if err != nil {
+		return discard(err)
+	}
+	etag, err := db.uploadFile(partitionId, localDBPath, partition.etag)
+	if err != nil {
+		return discard(err)
+	}
+	prevDB, prevPath := partition.db, partition.path
+	partition.setLoaded(boltDB, localDBPath, etag)
+	prevDB.Close()
+	os.Remove(prevPath)
+	db.queueChanges(partitionId)
+	return nil
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestFlush(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	set := func(key []byte, exp *time.Time) {
+		err := db.Set(ctx, key, func(b []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
+			return []byte("v"), exp, nil
+		})
+		g.Expect(err).To(BeNil())
+	}
+	for _, async := range []bool{false, true} {
+		key := []byte(uuid.NewString())
+		set(key, nil)
+		size, err := db.DBSize(ctx)
+		g.Expect(err).To(BeNil())
+		g.Expect(size > 0).To(Equal(true))
+		past := time.Now().Add(-time.Second)
+		set([]byte(uuid.NewString()), &past)
+		sizeWithExpired, err := db.DBSize(ctx)
+		g.Expect(err).To(BeNil())
+		g.Expect(sizeWithExpired).To(Equal(size))
+		before, err := db.Info(ctx)
+		g.Expect(err).To(BeNil())
+
+		err = db.Flush(ctx, async)
+		g.Expect(err).To(BeNil())
+		val, _, err := db.Get(ctx, key)
+		g.Expect(err).To(BeNil())
+		g.Expect(val).To(BeNil())
+		size, err = db.DBSize(ctx)
+		g.Expect(err).To(BeNil())
+		g.Expect(size).To(Equal(int64(0)))
+		info, err := db.Info(ctx)
+		g.Expect(err).To(BeNil())
+		g.Expect(info.Keys).To(Equal(int64(0)))
+		g.Expect(info.Expires).To(Equal(int64(0)))
+		g.Expect(info.TotalWriteCommandsProcessed).To(Equal(before.TotalWriteCommandsProcessed))
+
+		// the flushed partitions are the ones in object storage
+		db.partitions.Delete(db.getPartitionId(key))
+		val, _, err = db.Get(ctx, key)
+		g.Expect(err).To(BeNil())
+		g.Expect(val).To(BeNil())
+	}
+}
+
+func TestFlushAll(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	other, err := db.Select(1)
+	g.Expect(err).To(BeNil())
+	set := func(d *Database) []byte {
+		key := []byte(uuid.NewString())
+		err := d.Set(ctx, key, func(b []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
+			return []byte("v"), nil, nil
+		})
+		g.Expect(err).To(BeNil())
+		return key
+	}
+	expectFlushed := func(d *Database, key []byte) {
+		val, _, err := d.Get(ctx, key)
+		g.Expect(err).To(BeNil())
+		g.Expect(val).To(BeNil())
+	}
+
+	a, b := set(db), set(other)
+	g.Expect(FlushAll(ctx, []*Database{db, other}, false)).To(BeNil())
+	expectFlushed(db, a)
+	expectFlushed(other, b)
+	paths, err := objectStorage.ListObjects(ctx, flushesPrefix)
+	g.Expect(err).To(BeNil())
+	g.Expect(paths).To(BeEmpty())
+
+	// a flush interrupted by a crash is completed by the next leader
+	a, b = set(db), set(other)
+	data, err := json.Marshal(&flushRecord{ID: uuid.NewString(), Partitions: []flushPartition{
+		{Namespace: 0, Partition: db.getPartitionId(a)},
+		{Namespace: 1, Partition: other.getPartitionId(b)},
+	}})
+	g.Expect(err).To(BeNil())
+	g.Expect(objectStorage.PutObject(ctx, flushPath("interrupted"), data)).To(BeNil())
+	db = NewDatabase(objectStorage, 1024, os.Getenv("S3DIS_TEST_CACHE_DIR"), true)
+	other, err = db.Select(1)
+	g.Expect(err).To(BeNil())
+	expectFlushed(db, a)
+	expectFlushed(other, b)
+	paths, err = objectStorage.ListObjects(ctx, flushesPrefix)
+	g.Expect(err).To(BeNil())
+	g.Expect(paths).To(BeEmpty())
+}
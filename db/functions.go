@@ -0,0 +1,92 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+const functionsPath = "system/functions.json"
+
+// Library is a library of functions loaded by FUNCTION LOAD. Its code is
+// only interpreted by the server.
+type Library struct {
+	Name   string `json:"name"`
+	Engine string `json:"engine"`
+	Code   string `json:"code"`
+}
+
+// libraries caches the content of system/functions.json, which holds the
+// libraries of every logical database sharing the object storage
+type libraries struct {
+	mu   sync.Mutex
+	etag string
+	list []Library
+}
+
+// refresh reads the libraries again if they were changed in object storage,
+// the caller must hold mu
+func (l *libraries) refresh(db *Database, ctx context.Context) error {
+	etag, err := db.storage.GetEtag(ctx, functionsPath)
+	if err != nil || etag == l.etag {
+		return err
+	}
+	list := []Library{}
+	if etag != "" {
+		data, err := db.storage.GetObject(ctx, functionsPath)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &list)
+		if err != nil {
+			return err
+		}
+	}
+	l.etag, l.list = etag, list
+	return nil
+}
+
+// Libraries returns the function libraries, as last written by any process
+// sharing the object storage
+func (db *Database) Libraries(ctx context.Context) ([]Library, error) {
+	l := &db.shared.libraries
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.refresh(db, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append([]Library{}, l.list...), nil
+}
+
+// UpdateLibraries replaces the function libraries with the result of fn,
+// which receives the current ones. Nothing is written if fn returns an
+// error.
+func (db *Database) UpdateLibraries(ctx context.Context, fn func(list []Library) ([]Library, error)) error {
+	l := &db.shared.libraries
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.refresh(db, ctx)
+	if err != nil {
+		return err
+	}
+	list, err := fn(append([]Library{}, l.list...))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	err = db.checkLeader()
+	if err != nil {
+		return err
+	}
+	etag, err := db.storage.CompareAndSwap(ctx, functionsPath, bytes.NewReader(data), int64(len(data)), l.etag)
+	if err != nil {
+		return err
+	}
+	l.etag, l.list = etag, list
+	return nil
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/onsi/gomega"
+)
+
+func TestLibraries(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	lib := Library{Name: uuid.NewString(), Engine: "LUA", Code: "code"}
+	err := db.UpdateLibraries(ctx, func(list []Library) ([]Library, error) {
+		return append(list, lib), nil
+	})
+	g.Expect(err).To(BeNil())
+	list, err := db.Libraries(ctx)
+	g.Expect(err).To(BeNil())
+	g.Expect(list).To(gomega.ContainElement(lib))
+
+	// nothing is written if fn fails
+	errFailed := errors.New("failed")
+	err = db.UpdateLibraries(ctx, func(list []Library) ([]Library, error) {
+		return nil, errFailed
+	})
+	g.Expect(err).To(Equal(errFailed))
+
+	// libraries are seen by the other processes sharing the object storage
+	other := NewDatabase(objectStorage, 1024, os.Getenv("S3DIS_TEST_CACHE_DIR"), false)
+	list, err = other.Libraries(ctx)
+	g.Expect(err).To(BeNil())
+	g.Expect(list).To(gomega.ContainElement(lib))
+
+	err = db.UpdateLibraries(ctx, func(list []Library) ([]Library, error) {
+		kept := []Library{}
+		for _, l := range list {
+			if l.Name != lib.Name {
+				kept = append(kept, l)
+			}
+		}
+		return kept, nil
+	})
+	g.Expect(err).To(BeNil())
+	list, err = other.Libraries(ctx)
+	g.Expect(err).To(BeNil())
+	g.Expect(list).NotTo(gomega.ContainElement(lib))
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+// Document is a handle on a JSON document key.
+//
+// The bucket of the key holds the serialized document:
+//
+//	document: "the JSON document"
+//
+// Documents are read and written as a whole, path queries are evaluated by
+// the server.
+type Document struct {
+	tx     *Tx
+	key    []byte
+	bucket *bolt.Bucket
+}
+
+// OpenDocument returns the JSON document stored at key, creating the key if
+// create is true. It returns nil if the key does not exist and create is
+// false, and ErrWrongType if the key holds another type.
+func (tx *Tx) OpenDocument(key []byte, create bool) (*Document, error) {
+	bucket, err := tx.open(key, TypeJSON, create)
+	if err != nil || bucket == nil {
+		return nil, err
+	}
+	return &Document{
+		tx:     tx,
+		key:    key,
+		bucket: bucket,
+	}, nil
+}
+
+// Get returns a copy of the serialized document, or nil if it was just
+// created.
+func (d *Document) Get() []byte {
+	val := d.bucket.Get([]byte("document"))
+	if val == nil {
+		return nil
+	}
+	return append([]byte{}, val...)
+}
+
+// Put replaces the serialized document.
+func (d *Document) Put(val []byte) error {
+	d.tx.Notify(EventModule, "json.set", d.key)
+	return d.bucket.Put([]byte("document"), val)
+}
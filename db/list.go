@@ -0,0 +1,279 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var ErrIndexOutOfRange = errors.New("ERR index out of range")
+
+// List is a handle on the elements of a list key.
+//
+// Elements are stored in the bucket of the key under their position, encoded
+// as a sortable 8 byte integer. Positions are contiguous from the head to the
+// tail, so pushing or popping on either end only touches one element and
+// accessing an index is a single lookup.
+type List struct {
+	tx     *Tx
+	key    []byte
+	bucket *bolt.Bucket
+	len    int64
+}
+
+// OpenList returns the list stored at key, creating an empty one if create is
+// true. It returns nil if the key does not exist and create is false, and
+// ErrWrongType if the key holds another type.
+func (tx *Tx) OpenList(key []byte, create bool) (*List, error) {
+	bucket, err := tx.open(key, TypeList, create)
+	if err != nil || bucket == nil {
+		return nil, err
+	}
+	n, err := tx.length(key)
+	if err != nil {
+		return nil, err
+	}
+	return &List{
+		tx:     tx,
+		key:    key,
+		bucket: bucket,
+		len:    n,
+	}, nil
+}
+
+func encodePosition(pos int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(pos)^(1<<63))
+	return b
+}
+
+func decodePosition(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b) ^ (1 << 63))
+}
+
+// Len returns the number of elements of the list.
+func (l *List) Len() int64 {
+	return l.len
+}
+
+// head returns the position of the first element
+func (l *List) head() int64 {
+	k, _ := l.bucket.Cursor().First()
+	if k == nil {
+		return 0
+	}
+	return decodePosition(k)
+}
+
+// sideEvent returns the name of the event of a write at the head of the list
+// if left is true, at its tail otherwise
+func sideEvent(left bool, head, tail string) string {
+	if left {
+		return head
+	}
+	return tail
+}
+
+func (l *List) setLen(n int64) error {
+	l.len = n
+	return l.tx.setLength(l.key, TypeList, n)
+}
+
+// Push adds values to the head of the list if left is true, to its tail
+// otherwise, one after the other as LPUSH and RPUSH do.
+func (l *List) Push(left bool, values ...[]byte) error {
+	head := l.head()
+	tail := head + l.len - 1
+	for _, val := range values {
+		var pos int64
+		if left {
+			head--
+			pos = head
+		} else {
+			tail++
+			pos = tail
+		}
+		err := l.bucket.Put(encodePosition(pos), val)
+		if err != nil {
+			return err
+		}
+	}
+	if len(values) > 0 {
+		l.tx.Notify(EventList, sideEvent(left, "lpush", "rpush"), l.key)
+	}
+	return l.setLen(l.len + int64(len(values)))
+}
+
+// Pop removes and returns up to count elements from the head of the list if
+// left is true, from its tail otherwise.
+func (l *List) Pop(left bool, count int64) ([][]byte, error) {
+	if count > l.len {
+		count = l.len
+	}
+	values := [][]byte{}
+	head := l.head()
+	tail := head + l.len - 1
+	for i := int64(0); i < count; i++ {
+		pos := tail - i
+		if left {
+			pos = head + i
+		}
+		k := encodePosition(pos)
+		values = append(values, append([]byte{}, l.bucket.Get(k)...))
+		err := l.bucket.Delete(k)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if count > 0 {
+		l.tx.Notify(EventList, sideEvent(left, "lpop", "rpop"), l.key)
+	}
+	return values, l.setLen(l.len - count)
+}
+
+// normalize converts a Redis index, which may be negative to count from the
+// tail, to an offset from the head. It reports false if it is out of range.
+func (l *List) normalize(index int64) (int64, bool) {
+	if index < 0 {
+		index += l.len
+	}
+	return index, index >= 0 && index < l.len
+}
+
+// Index returns the element at index, or false if index is out of range.
+func (l *List) Index(index int64) ([]byte, bool) {
+	offset, ok := l.normalize(index)
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, l.bucket.Get(encodePosition(l.head()+offset))...), true
+}
+
+// Set replaces the element at index.
+func (l *List) Set(index int64, val []byte) error {
+	offset, ok := l.normalize(index)
+	if !ok {
+		return ErrIndexOutOfRange
+	}
+	l.tx.Notify(EventList, "lset", l.key)
+	return l.bucket.Put(encodePosition(l.head()+offset), val)
+}
+
+// bounds converts the inclusive Redis range start, stop to offsets from the
+// head, it reports false if the range is empty.
+func (l *List) bounds(start, stop int64) (int64, int64, bool) {
+	if start < 0 {
+		start += l.len
+	}
+	if stop < 0 {
+		stop += l.len
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= l.len {
+		stop = l.len - 1
+	}
+	return start, stop, start <= stop && start < l.len
+}
+
+// Range returns the elements between the offsets start and stop, inclusive,
+// with the semantics of LRANGE.
+func (l *List) Range(start, stop int64) [][]byte {
+	values := [][]byte{}
+	start, stop, ok := l.bounds(start, stop)
+	if !ok {
+		return values
+	}
+	head := l.head()
+	c := l.bucket.Cursor()
+	k, v := c.Seek(encodePosition(head + start))
+	for ; k != nil && decodePosition(k) <= head+stop; k, v = c.Next() {
+		values = append(values, append([]byte{}, v...))
+	}
+	return values
+}
+
+// Trim keeps only the elements between start and stop, inclusive, with the
+// semantics of LTRIM.
+func (l *List) Trim(start, stop int64) error {
+	l.tx.Notify(EventList, "ltrim", l.key)
+	start, stop, ok := l.bounds(start, stop)
+	if !ok {
+		return l.removeRange(0, l.len)
+	}
+	err := l.removeRange(stop+1, l.len)
+	if err != nil {
+		return err
+	}
+	return l.removeRange(0, start)
+}
+
+// removeRange removes the elements with offsets in [from, to), which must
+// touch one end of the list to keep positions contiguous
+func (l *List) removeRange(from, to int64) error {
+	if from >= to {
+		return nil
+	}
+	head := l.head()
+	for offset := from; offset < to; offset++ {
+		err := l.bucket.Delete(encodePosition(head + offset))
+		if err != nil {
+			return err
+		}
+	}
+	return l.setLen(l.len - (to - from))
+}
+
+// Rem removes the first count occurrences of val, starting from the tail if
+// count is negative and removing all of them if count is zero, and returns
+// the number of removed elements. Elements after the first removed one are
+// renumbered.
+func (l *List) Rem(count int64, val []byte) (int64, error) {
+	values := l.Range(0, -1)
+	removed := make([]bool, len(values))
+	var n int64
+	for i := range values {
+		j := i
+		if count < 0 {
+			j = len(values) - 1 - i
+		}
+		if bytes.Equal(values[j], val) {
+			removed[j] = true
+			n++
+			if count != 0 && (n == count || n == -count) {
+				break
+			}
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	first := 0
+	for !removed[first] {
+		first++
+	}
+	head := l.head()
+	kept := int64(first)
+	for i := first; i < len(values); i++ {
+		if removed[i] {
+			continue
+		}
+		v := values[i]
+		err := l.bucket.Put(encodePosition(head+kept), v)
+		if err != nil {
+			return 0, err
+		}
+		kept++
+	}
+	for offset := kept; offset < l.len; offset++ {
+		err := l.bucket.Delete(encodePosition(head + offset))
+		if err != nil {
+			return 0, err
+		}
+	}
+	l.tx.Notify(EventList, "lrem", l.key)
+	return n, l.setLen(kept)
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var errNotApplied = errors.New("not applied")
+
+// groupByPartition returns the indexes of keys grouped by partition id,
+// indexes within a group keep the order of keys
+func (db *Database) groupByPartition(keys [][]byte) map[string][]int {
+	groups := map[string][]int{}
+	for i, key := range keys {
+		partitionId := db.getPartitionId(key)
+		groups[partitionId] = append(groups[partitionId], i)
+	}
+	return groups
+}
+
+// forEachPartition calls fn concurrently for every partition group and
+// returns the first error
+func forEachPartition(groups map[string][]int, fn func(partitionId string, indexes []int) error) error {
+	var resError error
+	mu := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for partitionId, indexes := range groups {
+		wg.Add(1)
+		go func(partitionId string, indexes []int) {
+			defer wg.Done()
+			err := fn(partitionId, indexes)
+			if err != nil {
+				mu.Lock()
+				if resError == nil {
+					resError = err
+				}
+				mu.Unlock()
+			}
+		}(partitionId, indexes)
+	}
+	wg.Wait()
+	return resError
+}
+
+// MGet returns the values of keys in request order, a missing or expired key
+// has a nil value. Keys are read with one transaction per touched partition.
+func (db *Database) MGet(ctx context.Context, keys [][]byte) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	err := forEachPartition(db.groupByPartition(keys), func(partitionId string, indexes []int) error {
+		return db.viewTx(ctx, partitionId, func(t *Tx) error {
+			for _, i := range indexes {
+				val, _, err := t.Get(keys[i])
+				if errors.Is(err, ErrWrongType) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				values[i] = val
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// MSet applies the read-modify-write function w to every key, w receives the
+// index of the key in keys. Keys holding a value of another type are
+// overwritten. Keys of several partitions are written in a Batch, so the
+// update is all or nothing.
+func (db *Database) MSet(ctx context.Context, keys [][]byte, w func(i int, prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error)) error {
+	groups := db.groupByPartition(keys)
+	if len(groups) == 1 {
+		for partitionId, indexes := range groups {
+			return db.updateTx(ctx, partitionId, func(t *Tx) error {
+				return t.setAll(keys, indexes, w)
+			})
+		}
+	}
+	dbKeys := make([]DBKey, len(keys))
+	for i, key := range keys {
+		dbKeys[i] = DBKey{db, key}
+	}
+	return Batch(ctx, dbKeys, func(ctx context.Context) error {
+		return forEachPartition(groups, func(partitionId string, indexes []int) error {
+			return db.updateTx(ctx, partitionId, func(t *Tx) error {
+				return t.setAll(keys, indexes, w)
+			})
+		})
+	})
+}
+
+func (tx *Tx) setAll(keys [][]byte, indexes []int, w func(i int, prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error)) error {
+	for _, i := range indexes {
+		i := i
+		err := tx.deleteUnlessString(keys[i])
+		if err != nil {
+			return err
+		}
+		err = tx.Set(keys[i], func(prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
+			return w(i, prevVal, prevExp)
+		})
+		if err != nil {
+			return err
+		}
+		tx.Notify(EventString, "set", keys[i])
+	}
+	return nil
+}
+
+// MSetNX sets keys to values only if none of the keys exists. It returns
+// false without writing anything if at least one key exists.
+func (db *Database) MSetNX(ctx context.Context, keys [][]byte, values [][]byte) (bool, error) {
+	if len(keys) != len(values) {
+		return false, fmt.Errorf("wrong number of values: %d keys, %d values", len(keys), len(values))
+	}
+	ok := false
+	err := db.UpdateKeys(ctx, keys, func(m *MultiTx) error {
+		for _, key := range keys {
+			exists, err := m.Tx(key).Exists(key)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return errNotApplied
+			}
+		}
+		for i, key := range keys {
+			err := m.Tx(key).setAll(keys, []int{i}, func(i int, prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
+				return values[i], nil, nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		ok = true
+		return nil
+	})
+	if errors.Is(err, errNotApplied) {
+		return false, nil
+	}
+	return ok, err
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const mappingPath = "system/databases.json"
+
+// mappingRefreshInterval is how often Select reads the etag of the mapping,
+// to follow the swaps by other processes
+const mappingRefreshInterval = time.Second
+
+// namespaces holds the databases sharing an object storage, one per
+// namespace, and maps logical database indexes to namespaces. The mapping
+// starts as the identity and is changed by Swap, in this process or another
+// one sharing the object storage.
+type namespaces struct {
+	mu          sync.Mutex
+	databases   map[int]*Database
+	mapping     []int     // namespace of each logical database, identity beyond
+	mappingEtag string    // etag of the mapping as last read or written
+	refreshed   time.Time // when the etag of the mapping was last read
+
+	libraries libraries // function libraries
+	notifier  notifier  // keyspace notifications
+	capture   capture   // change data capture
+	cursors   scanCursors
+}
+
+// Mapping is the content of system/databases.json.
+type Mapping struct {
+	Namespaces []int `json:"namespaces"`
+}
+
+// refreshMapping reads system/databases.json again if its etag changed,
+// e.g. after a swap by another process. The caller must hold shared.mu.
+func (db *Database) refreshMapping(ctx context.Context) error {
+	etag, err := db.storage.GetEtag(ctx, mappingPath)
+	if err != nil || etag == db.shared.mappingEtag {
+		return err
+	}
+	mapping := &Mapping{}
+	if etag != "" {
+		data, err := db.storage.GetObject(ctx, mappingPath)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, mapping)
+		if err != nil {
+			return err
+		}
+	}
+	db.shared.mapping, db.shared.mappingEtag = mapping.Namespaces, etag
+	return nil
+}
+
+// refreshMappingEvery is refreshMapping unless the mapping was read less
+// than mappingRefreshInterval ago, the caller must hold shared.mu
+func (db *Database) refreshMappingEvery(ctx context.Context) error {
+	if time.Since(db.shared.refreshed) < mappingRefreshInterval {
+		return nil
+	}
+	err := db.refreshMapping(ctx)
+	if err == nil {
+		db.shared.refreshed = time.Now()
+	}
+	return err
+}
+
+// namespaceOf returns the namespace of the logical database index, the
+// caller must hold shared.mu
+func (ns *namespaces) namespaceOf(index int) int {
+	if index < len(ns.mapping) {
+		return ns.mapping[index]
+	}
+	return index
+}
+
+// Index returns the logical database currently mapped to the namespace of
+// db, which changes if the database is swapped by SwapDB. A swap by another
+// process is only seen once the mapping is refreshed by Select or Swap.
+func (db *Database) Index() int {
+	db.shared.mu.Lock()
+	defer db.shared.mu.Unlock()
+	for index, namespace := range db.shared.mapping {
+		if namespace == db.namespace {
+			return index
+		}
+	}
+	return db.namespace
+}
+
+// Select returns the logical database index, which shares the object
+// storage and the leadership of db. The swaps by other processes are seen
+// within mappingRefreshInterval. The returned database keeps using the same
+// namespace if the index is later swapped.
+func (db *Database) Select(index int) (*Database, error) {
+	if index < 0 {
+		return nil, fmt.Errorf("ERR DB index is out of range")
+	}
+	db.shared.mu.Lock()
+	err := db.refreshMappingEvery(context.Background())
+	namespace := db.shared.namespaceOf(index)
+	db.shared.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return db.inNamespace(namespace), nil
+}
+
+// inNamespace returns the database of a namespace
+func (db *Database) inNamespace(namespace int) *Database {
+	db.shared.mu.Lock()
+	defer db.shared.mu.Unlock()
+	selected, ok := db.shared.databases[namespace]
+	if !ok {
+		selected = &Database{
+			uuid:            db.uuid,
+			storage:         db.storage,
+			namespace:       namespace,
+			shared:          db.shared,
+			MaxPartitionNum: db.MaxPartitionNum,
+			LocalDataDir:    db.LocalDataDir,
+			Singleton:       db.Singleton,
+		}
+		db.shared.databases[namespace] = selected
+	}
+	return selected
+}
+
+// Swap exchanges the logical databases a and b by swapping their namespaces
+// in system/databases.json, which is a single atomic write. Databases
+// selected before the swap keep their namespace.
+func (db *Database) Swap(ctx context.Context, a, b int) error {
+	if a < 0 || b < 0 {
+		return fmt.Errorf("ERR DB index is out of range")
+	}
+	db.shared.mu.Lock()
+	defer db.shared.mu.Unlock()
+	err := db.refreshMapping(ctx)
+	if err != nil {
+		return err
+	}
+	mapping := append([]int{}, db.shared.mapping...)
+	for len(mapping) <= a || len(mapping) <= b {
+		mapping = append(mapping, len(mapping))
+	}
+	mapping[a], mapping[b] = mapping[b], mapping[a]
+	data, err := json.Marshal(&Mapping{Namespaces: mapping})
+	if err != nil {
+		return err
+	}
+	err = db.checkLeader()
+	if err != nil {
+		return err
+	}
+	etag, err := db.storage.CompareAndSwap(ctx, mappingPath, bytes.NewReader(data), int64(len(data)), db.shared.mappingEtag)
+	if err != nil {
+		return err
+	}
+	db.shared.mapping, db.shared.mappingEtag = mapping, etag
+	return nil
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestNamespaces(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	db1, err := db.Select(1)
+	g.Expect(err).To(BeNil())
+	db0, err := db1.Select(0)
+	g.Expect(err).To(BeNil())
+	g.Expect(db0).To(Equal(db))
+	_, err = db.Select(-1)
+	g.Expect(err).NotTo(BeNil())
+
+	key := []byte(uuid.NewString())
+	err = db1.Set(ctx, key, func(b []byte, exp *time.Time) ([]byte, *time.Time, error) {
+		return []byte("v"), nil, nil
+	})
+	g.Expect(err).To(BeNil())
+	val, _, err := db.Get(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(val).To(BeNil())
+	g.Expect(db1.objectPath("3")).To(Equal("databases/1/partitions/3/data.db"))
+
+	// swapped databases are selected in the other namespace
+	err = db.Swap(ctx, 0, 1)
+	g.Expect(err).To(BeNil())
+	swapped, err := db.Select(0)
+	g.Expect(err).To(BeNil())
+	val, _, err = swapped.Get(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(val).To(Equal([]byte("v")))
+	err = db.Swap(ctx, 0, 1)
+	g.Expect(err).To(BeNil())
+	selected, err := db.Select(0)
+	g.Expect(err).To(BeNil())
+	g.Expect(selected).To(Equal(db))
+
+	// swaps by another process are seen by Select
+	err = db.storage.PutObject(ctx, mappingPath, []byte(`{"namespaces":[1,0]}`))
+	g.Expect(err).To(BeNil())
+	time.Sleep(mappingRefreshInterval)
+	selected, err = db.Select(0)
+	g.Expect(err).To(BeNil())
+	g.Expect(selected).To(Equal(db1))
+	err = db.Swap(ctx, 0, 1)
+	g.Expect(err).To(BeNil())
+	selected, err = db.Select(0)
+	g.Expect(err).To(BeNil())
+	g.Expect(selected).To(Equal(db))
+}
+
+func TestMove(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	db2, err := db.Select(2)
+	g.Expect(err).To(BeNil())
+	key := []byte(uuid.NewString())
+	exp := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	err = db.Update(ctx, key, func(tx *Tx) error {
+		list, err := tx.OpenList(key, true)
+		if err != nil {
+			return err
+		}
+		err = list.Push(false, []byte("a"), []byte("b"))
+		if err != nil {
+			return err
+		}
+		return tx.SetExpiration(key, &exp)
+	})
+	g.Expect(err).To(BeNil())
+
+	_, err = db.Move(ctx, key, db)
+	g.Expect(err).NotTo(BeNil())
+	moved, err := db.Move(ctx, key, db2)
+	g.Expect(err).To(BeNil())
+	g.Expect(moved).To(Equal(true))
+	moved, err = db.Move(ctx, key, db2)
+	g.Expect(err).To(BeNil())
+	g.Expect(moved).To(Equal(false))
+
+	err = db.View(ctx, key, func(tx *Tx) error {
+		exists, err := tx.Exists(key)
+		g.Expect(exists).To(Equal(false))
+		return err
+	})
+	g.Expect(err).To(BeNil())
+	err = db2.View(ctx, key, func(tx *Tx) error {
+		list, err := tx.OpenList(key, false)
+		if err != nil {
+			return err
+		}
+		g.Expect(list.Len()).To(Equal(int64(2)))
+		keyExp, err := tx.Expiration(key)
+		g.Expect(keyExp.Equal(exp)).To(Equal(true))
+		return err
+	})
+	g.Expect(err).To(BeNil())
+
+	// a key existing in the destination is not moved
+	err = db.Set(ctx, key, func(b []byte, exp *time.Time) ([]byte, *time.Time, error) {
+		return []byte("v"), nil, nil
+	})
+	g.Expect(err).To(BeNil())
+	moved, err = db.Move(ctx, key, db2)
+	g.Expect(err).To(BeNil())
+	g.Expect(moved).To(Equal(false))
+}
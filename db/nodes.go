@@ -0,0 +1,78 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const nodesPrefix = "system/nodes/"
+
+// NodeTTL is how long a process stays registered without renewing its
+// registration, see RegisterNode
+const NodeTTL = 30 * time.Second
+
+// Node is the content of system/nodes/$addr, which registers a process
+// sharing the object storage at the address where the other processes reach
+// it. A process restarted at the same address replaces its previous entry.
+type Node struct {
+	Addr string `json:"addr"`
+	UUID string `json:"uuid"`
+	// unix milliseconds of the last registration
+	Heartbeat int64 `json:"heartbeat"`
+}
+
+// RegisterNode registers this process at addr, or renews its registration.
+// The process must renew it within NodeTTL to stay registered.
+func (db *Database) RegisterNode(ctx context.Context, addr string) error {
+	data, err := json.Marshal(&Node{Addr: addr, UUID: db.uuid, Heartbeat: time.Now().UnixMilli()})
+	if err != nil {
+		return err
+	}
+	return db.storage.PutObject(ctx, nodesPrefix+addr, data)
+}
+
+// DeregisterNode removes the registration of this process at addr, unless
+// another process registered at the same address since
+func (db *Database) DeregisterNode(ctx context.Context, addr string) error {
+	node, err := db.getNode(ctx, addr)
+	if err != nil || node.UUID != db.uuid {
+		return err
+	}
+	return db.storage.RemoveObject(ctx, nodesPrefix+addr)
+}
+
+func (db *Database) getNode(ctx context.Context, addr string) (*Node, error) {
+	data, err := db.storage.GetObject(ctx, nodesPrefix+addr)
+	if err != nil {
+		return nil, err
+	}
+	node := &Node{}
+	err = json.Unmarshal(data, node)
+	return node, err
+}
+
+// Nodes returns the addresses of the processes registered within NodeTTL.
+// The registrations which expired are removed.
+func (db *Database) Nodes(ctx context.Context) ([]string, error) {
+	paths, err := db.storage.ListObjects(ctx, nodesPrefix)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{}
+	for _, p := range paths {
+		addr := strings.TrimPrefix(p, nodesPrefix)
+		node, err := db.getNode(ctx, addr)
+		if err != nil {
+			// e.g. removed since it was listed
+			continue
+		}
+		if time.Since(time.UnixMilli(node.Heartbeat)) > NodeTTL {
+			db.storage.RemoveObject(ctx, p)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestNodes(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	registered := func(addr string) bool {
+		addrs, err := db.Nodes(ctx)
+		g.Expect(err).To(BeNil())
+		for _, a := range addrs {
+			if a == addr {
+				return true
+			}
+		}
+		return false
+	}
+
+	addr := uuid.NewString()
+	g.Expect(db.RegisterNode(ctx, addr)).To(BeNil())
+	g.Expect(registered(addr)).To(Equal(true))
+	g.Expect(db.DeregisterNode(ctx, addr)).To(BeNil())
+	g.Expect(registered(addr)).To(Equal(false))
+
+	// registrations which were not renewed within NodeTTL expire
+	stale, err := json.Marshal(&Node{Addr: addr, UUID: uuid.NewString(), Heartbeat: time.Now().Add(-NodeTTL - time.Second).UnixMilli()})
+	g.Expect(err).To(BeNil())
+	g.Expect(db.storage.PutObject(ctx, nodesPrefix+addr, stale)).To(BeNil())
+	g.Expect(registered(addr)).To(Equal(false))
+	paths, err := db.storage.ListObjects(ctx, nodesPrefix+addr)
+	g.Expect(err).To(BeNil())
+	g.Expect(paths).To(BeEmpty())
+
+	// the registration of another process at the same address is kept
+	other, err := json.Marshal(&Node{Addr: addr, UUID: uuid.NewString(), Heartbeat: time.Now().UnixMilli()})
+	g.Expect(err).To(BeNil())
+	g.Expect(db.storage.PutObject(ctx, nodesPrefix+addr, other)).To(BeNil())
+	g.Expect(db.DeregisterNode(ctx, addr)).To(BeNil())
+	g.Expect(registered(addr)).To(Equal(true))
+	g.Expect(db.storage.RemoveObject(ctx, nodesPrefix+addr)).To(BeNil())
+}
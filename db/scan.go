@@ -0,0 +1,365 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const defaultScanCount = 10
+
+// keyCursor iterates over the keys of a partition in order, merging the
+// string keys of the value bucket with the keys of the type bucket
+type keyCursor struct {
+	cursors []*bolt.Cursor
+	keys    [][]byte // current key of each cursor, nil once exhausted
+}
+
+func newKeyCursor(tx *Tx) (*keyCursor, error) {
+	kc := &keyCursor{}
+	for _, name := range []string{"value", "type"} {
+		bucket, err := tx.bucket(name)
+		if err != nil {
+			return nil, err
+		}
+		if bucket != nil {
+			kc.cursors = append(kc.cursors, bucket.Cursor())
+			kc.keys = append(kc.keys, nil)
+		}
+	}
+	return kc, nil
+}
+
+// seek positions the cursor on the first key greater than or equal to key
+// and returns it, or nil if there is none
+func (kc *keyCursor) seek(key []byte) []byte {
+	for i, c := range kc.cursors {
+		kc.keys[i], _ = c.Seek(key)
+	}
+	return kc.current()
+}
+
+// next advances past the current key and returns the next one
+func (kc *keyCursor) next() []byte {
+	cur := kc.current()
+	for i, c := range kc.cursors {
+		if kc.keys[i] != nil && bytes.Equal(kc.keys[i], cur) {
+			kc.keys[i], _ = c.Next()
+		}
+	}
+	return kc.current()
+}
+
+func (kc *keyCursor) current() []byte {
+	var min []byte
+	for _, key := range kc.keys {
+		if key != nil && (min == nil || bytes.Compare(key, min) < 0) {
+			min = key
+		}
+	}
+	return min
+}
+
+// MatchGlob reports whether s matches the glob-style pattern, with the
+// syntax of Redis: *, ?, [abc], [^abc], [a-z] and \ to escape a character
+func MatchGlob(pattern, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if MatchGlob(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			p := pattern[1:]
+			not := len(p) > 0 && p[0] == '^'
+			if not {
+				p = p[1:]
+			}
+			match := false
+			for len(p) > 0 && p[0] != ']' {
+				if p[0] == '\\' && len(p) >= 2 {
+					p = p[1:]
+					match = match || p[0] == s[0]
+				} else if len(p) >= 3 && p[1] == '-' {
+					lo, hi := p[0], p[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					match = match || (s[0] >= lo && s[0] <= hi)
+					p = p[2:]
+				} else {
+					match = match || p[0] == s[0]
+				}
+				p = p[1:]
+			}
+			if match == not {
+				return false
+			}
+			s = s[1:]
+			if len(p) == 0 {
+				// an unterminated class ends the pattern
+				return len(s) == 0
+			}
+			pattern = p
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
+
+// globPrefix returns the literal prefix shared by all the keys matching
+// pattern, so that scans can seek to it
+func globPrefix(pattern string) []byte {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return []byte(pattern[:i])
+	}
+	return []byte(pattern)
+}
+
+// ScanOptions mirrors the options of SCAN.
+type ScanOptions struct {
+	Match string // glob-style pattern, all keys if empty
+	Count int64  // number of keys to examine, 10 if zero
+	Type  string // only return keys of this type, any type if empty
+}
+
+// scanPartition calls fn with the live keys of the partition following
+// after, or from the start if after is nil, which match opts. It stops once
+// fn returns false.
+func (db *Database) scanPartition(partitionId string, after []byte, opts *ScanOptions, fn func(key []byte, matched bool) bool) error {
+	prefix := globPrefix(opts.Match)
+	return db.viewExisting(partitionId, func(tx *bolt.Tx) error {
+		t := newTx(tx)
+		kc, err := newKeyCursor(t)
+		if err != nil {
+			return err
+		}
+		key := kc.seek(prefix)
+		if after != nil && bytes.Compare(after, prefix) >= 0 {
+			key = kc.seek(after)
+			if bytes.Equal(key, after) {
+				key = kc.next()
+			}
+		}
+		for ; key != nil && bytes.HasPrefix(key, prefix); key = kc.next() {
+			matched := opts.Match == "" || MatchGlob([]byte(opts.Match), key)
+			if matched {
+				// expired keys are skipped, they are purged by writes
+				typ, err := t.Type(key)
+				if err != nil {
+					return err
+				}
+				matched = typ != TypeNone && (opts.Type == "" || strings.EqualFold(opts.Type, typ))
+			}
+			if !fn(append([]byte{}, key...), matched) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// Scan cursors are unsigned integers, like those of Redis which clients
+// parse as such. A cursor holds the partition in its high bits, a random tag
+// telling apart the cursors issued at the same position, and the number of
+// keys of the partition examined before it. It stays below 2^63.
+const (
+	cursorPartitionShift = 47
+	cursorTagShift       = 32
+	cursorOrdinalMask    = 1<<cursorTagShift - 1
+	maxScanPartitions    = 1 << (63 - cursorPartitionShift)
+	// number of cursors whose key is remembered, the oldest are forgotten
+	maxScanCursors = 10000
+)
+
+// scanCursors remembers the key after which each cursor returned by Scan
+// resumes, so that the writes between the calls do not shift the scan. A
+// cursor which is not remembered, e.g. returned by another process, resumes
+// after as many keys of its partition as it counts, which may return again
+// or skip the keys written in the partition meanwhile.
+type scanCursors struct {
+	mu     sync.Mutex
+	after  map[uint64][]byte
+	issued []uint64 // in the order they were issued
+}
+
+func (c *scanCursors) issue(partition int, ordinal int64, after []byte) uint64 {
+	if ordinal > cursorOrdinalMask {
+		ordinal = cursorOrdinalMask
+	}
+	tag := uint64(rand.Int63n(1 << (cursorPartitionShift - cursorTagShift)))
+	cursor := uint64(partition)<<cursorPartitionShift | tag<<cursorTagShift | uint64(ordinal)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.after == nil {
+		c.after = map[uint64][]byte{}
+	}
+	if _, ok := c.after[cursor]; !ok {
+		c.issued = append(c.issued, cursor)
+	}
+	c.after[cursor] = after
+	if len(c.issued) > maxScanCursors {
+		delete(c.after, c.issued[0])
+		c.issued = c.issued[1:]
+	}
+	return cursor
+}
+
+func (c *scanCursors) lookup(cursor uint64) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.after[cursor]
+}
+
+// parseScanCursor returns the partition a scan resumes from, the number of
+// keys of the partition examined before, and the key after which it resumes
+// if the cursor is remembered
+func (db *Database) parseScanCursor(cursor string) (int, int64, []byte, error) {
+	v, err := strconv.ParseUint(cursor, 10, 64)
+	partition := v >> cursorPartitionShift
+	if err != nil || partition >= uint64(db.MaxPartitionNum) {
+		return 0, 0, nil, fmt.Errorf("ERR invalid cursor")
+	}
+	if v == 0 {
+		return 0, 0, nil, nil
+	}
+	return int(partition), int64(v & cursorOrdinalMask), db.shared.cursors.lookup(v), nil
+}
+
+// Scan examines about opts.Count keys following cursor, partition after
+// partition and in key order within a partition, and returns the cursor to
+// resume from together with the examined keys matching opts. Cursors are "0"
+// at the start and at the end of a scan, and unsigned integers in between,
+// see scanCursors: keys which exist during the whole scan are returned
+// exactly once whatever the writes between calls, unless the scan resumes on
+// another process.
+func (db *Database) Scan(ctx context.Context, cursor string, opts *ScanOptions) (string, [][]byte, error) {
+	if opts == nil {
+		opts = &ScanOptions{}
+	}
+	count := opts.Count
+	if count <= 0 {
+		count = defaultScanCount
+	}
+	p, ordinal, after, err := db.parseScanCursor(cursor)
+	if err != nil {
+		return "", nil, err
+	}
+	skip := int64(0)
+	if after == nil {
+		skip = ordinal
+	}
+	keys := [][]byte{}
+	examined := int64(0)
+	for ; p < db.MaxPartitionNum; p, ordinal, after, skip = p+1, 0, nil, 0 {
+		var last []byte
+		err := db.scanPartition(fmt.Sprintf("%d", p), after, opts, func(key []byte, matched bool) bool {
+			if skip > 0 {
+				skip--
+				return true
+			}
+			if matched {
+				keys = append(keys, key)
+			}
+			examined++
+			ordinal++
+			last = key
+			return examined < count
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		if examined >= count {
+			next := db.shared.cursors.issue(p, ordinal, last)
+			return strconv.FormatUint(next, 10), keys, nil
+		}
+	}
+	return "0", keys, nil
+}
+
+// forEachPartitionId calls fn concurrently for every partition, with a
+// bounded number of workers, and returns the last error
+func (db *Database) forEachPartitionId(fn func(partitionId string) error) error {
+	mu := &sync.Mutex{}
+	var resError error
+	workers := 100
+	wg := &sync.WaitGroup{}
+	wg.Add(workers)
+	queue := make(chan string, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for partitionId := range queue {
+				err := fn(partitionId)
+				if err != nil {
+					mu.Lock()
+					resError = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for partitionId := 0; partitionId < db.MaxPartitionNum; partitionId++ {
+		queue <- fmt.Sprintf("%d", partitionId)
+	}
+	close(queue)
+	wg.Wait()
+	return resError
+}
+
+// Keys returns all the live keys matching the glob-style pattern, in the
+// order of Scan. It reads every partition at once and is meant for small
+// datasets.
+func (db *Database) Keys(ctx context.Context, pattern string) ([][]byte, error) {
+	byPartition := make([][][]byte, db.MaxPartitionNum)
+	err := db.forEachPartitionId(func(partitionId string) error {
+		p, _ := strconv.Atoi(partitionId)
+		return db.scanPartition(partitionId, nil, &ScanOptions{Match: pattern}, func(key []byte, matched bool) bool {
+			if matched {
+				byPartition[p] = append(byPartition[p], key)
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := [][]byte{}
+	for _, partitionKeys := range byPartition {
+		keys = append(keys, partitionKeys...)
+	}
+	return keys, nil
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMatchGlob(t *testing.T) {
+	g := NewWithT(t)
+	for _, tc := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"", "", true},
+		{"*", "anything", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hello world", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{"user:[0-9]*", "user:42", true},
+	} {
+		g.Expect(MatchGlob([]byte(tc.pattern), []byte(tc.s))).To(Equal(tc.match), "%q %q", tc.pattern, tc.s)
+	}
+	g.Expect(string(globPrefix("user:*"))).To(Equal("user:"))
+	g.Expect(string(globPrefix(`a\*`))).To(Equal("a"))
+	g.Expect(string(globPrefix("abc"))).To(Equal("abc"))
+}
+
+func TestScan(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	prefix := uuid.NewString()
+	want := []string{}
+	for i := 0; i < 30; i++ {
+		key := []byte(fmt.Sprintf("%s:%d", prefix, i))
+		want = append(want, string(key))
+		if i%2 == 0 {
+			err := db.Set(ctx, key, func(b []byte, exp *time.Time) ([]byte, *time.Time, error) {
+				return []byte("v"), nil, nil
+			})
+			g.Expect(err).To(BeNil())
+			continue
+		}
+		err := db.Update(ctx, key, func(tx *Tx) error {
+			list, err := tx.OpenList(key, true)
+			if err != nil {
+				return err
+			}
+			return list.Push(false, []byte("a"))
+		})
+		g.Expect(err).To(BeNil())
+	}
+	expired := []byte(prefix + ":expired")
+	err := db.Set(ctx, expired, func(b []byte, exp *time.Time) ([]byte, *time.Time, error) {
+		past := time.Now().Add(-time.Second)
+		return []byte("v"), &past, nil
+	})
+	g.Expect(err).To(BeNil())
+
+	// forget resumes every call as a cursor returned by another process
+	scan := func(opts *ScanOptions, forget bool) []string {
+		keys := []string{}
+		cursor := "0"
+		for {
+			next, res, err := db.Scan(ctx, cursor, opts)
+			g.Expect(err).To(BeNil())
+			_, err = strconv.ParseUint(next, 10, 64)
+			g.Expect(err).To(BeNil())
+			if forget {
+				db.shared.cursors.mu.Lock()
+				db.shared.cursors.after = nil
+				db.shared.cursors.issued = nil
+				db.shared.cursors.mu.Unlock()
+			}
+			for _, key := range res {
+				keys = append(keys, string(key))
+			}
+			if next == "0" {
+				break
+			}
+			cursor = next
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	sort.Strings(want)
+	g.Expect(scan(&ScanOptions{Match: prefix + ":*", Count: 7}, false)).To(Equal(want))
+	g.Expect(scan(&ScanOptions{Match: prefix + ":*", Count: 7}, true)).To(Equal(want))
+	lists := scan(&ScanOptions{Match: prefix + ":*", Count: 1000, Type: TypeList}, false)
+	g.Expect(len(lists)).To(Equal(15))
+
+	keys, err := db.Keys(ctx, prefix+":1?")
+	g.Expect(err).To(BeNil())
+	g.Expect(len(keys)).To(Equal(10))
+
+	_, _, err = db.Scan(ctx, "bad", nil)
+	g.Expect(err).NotTo(BeNil())
+	_, _, err = db.Scan(ctx, "-1", nil)
+	g.Expect(err).NotTo(BeNil())
+}
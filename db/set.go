@@ -0,0 +1,185 @@
+package db
+
+import (
+	"math/rand"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Set is a handle on the members of a set key.
+//
+// Every member is stored as a key of the bucket of the set with an empty
+// value, see memberKey, so membership tests, additions and removals touch a
+// single member.
+type Set struct {
+	tx     *Tx
+	key    []byte
+	bucket *bolt.Bucket
+	len    int64
+}
+
+// OpenSet returns the set stored at key, creating an empty one if create is
+// true. It returns nil if the key does not exist and create is false, and
+// ErrWrongType if the key holds another type.
+func (tx *Tx) OpenSet(key []byte, create bool) (*Set, error) {
+	bucket, err := tx.open(key, TypeSet, create)
+	if err != nil || bucket == nil {
+		return nil, err
+	}
+	n, err := tx.length(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Set{
+		tx:     tx,
+		key:    key,
+		bucket: bucket,
+		len:    n,
+	}, nil
+}
+
+// memberKey returns the bolt key of a member of a set or a sorted set. Bolt
+// refuses empty keys, so members which are empty or start with 0x00 are
+// prefixed with 0x00, which keeps the keys in the order of the members.
+func memberKey(member []byte) []byte {
+	if len(member) > 0 && member[0] != 0 {
+		return member
+	}
+	return append([]byte{0}, member...)
+}
+
+// decodeMemberKey returns a copy of the member of a bolt key, see memberKey
+func decodeMemberKey(k []byte) []byte {
+	if len(k) > 0 && k[0] == 0 {
+		k = k[1:]
+	}
+	return append([]byte{}, k...)
+}
+
+// Len returns the number of members of the set.
+func (s *Set) Len() int64 {
+	return s.len
+}
+
+func (s *Set) setLen(n int64) error {
+	s.len = n
+	return s.tx.setLength(s.key, TypeSet, n)
+}
+
+// IsMember reports whether member belongs to the set.
+func (s *Set) IsMember(member []byte) bool {
+	return s.bucket.Get(memberKey(member)) != nil
+}
+
+// Add adds members to the set and returns the number of members which were
+// not already present.
+func (s *Set) Add(members ...[]byte) (int64, error) {
+	added := int64(0)
+	for _, member := range members {
+		if s.IsMember(member) {
+			continue
+		}
+		err := s.bucket.Put(memberKey(member), []byte{})
+		if err != nil {
+			return 0, err
+		}
+		added++
+	}
+	if added > 0 {
+		s.tx.Notify(EventSet, "sadd", s.key)
+	}
+	return added, s.setLen(s.len + added)
+}
+
+// Rem removes members from the set and returns the number of members which
+// were present.
+func (s *Set) Rem(members ...[]byte) (int64, error) {
+	removed := int64(0)
+	for _, member := range members {
+		if !s.IsMember(member) {
+			continue
+		}
+		err := s.bucket.Delete(memberKey(member))
+		if err != nil {
+			return 0, err
+		}
+		removed++
+	}
+	if removed > 0 {
+		s.tx.Notify(EventSet, "srem", s.key)
+	}
+	return removed, s.setLen(s.len - removed)
+}
+
+// Members returns all members of the set in lexicographical order.
+func (s *Set) Members() [][]byte {
+	members := [][]byte{}
+	_ = s.bucket.ForEach(func(k, v []byte) error {
+		members = append(members, decodeMemberKey(k))
+		return nil
+	})
+	return members
+}
+
+// at returns the members at the given offsets in lexicographical order, the
+// offsets must be sorted
+func (s *Set) at(offsets []int64) [][]byte {
+	members := [][]byte{}
+	c := s.bucket.Cursor()
+	i := int64(0)
+	for k, _ := c.First(); k != nil && len(members) < len(offsets); k, _ = c.Next() {
+		for len(members) < len(offsets) && offsets[len(members)] == i {
+			members = append(members, decodeMemberKey(k))
+		}
+		i++
+	}
+	return members
+}
+
+// RandMembers returns count random members. Members are distinct if count is
+// positive, and may repeat count times if it is negative, as in SRANDMEMBER.
+func (s *Set) RandMembers(count int64) [][]byte {
+	offsets := []int64{}
+	if count >= 0 {
+		if count > s.len {
+			count = s.len
+		}
+		picked := map[int64]bool{}
+		for int64(len(picked)) < count {
+			picked[rand.Int63n(s.len)] = true
+		}
+		for offset := range picked {
+			offsets = append(offsets, offset)
+		}
+	} else {
+		for i := int64(0); i < -count && s.len > 0; i++ {
+			offsets = append(offsets, rand.Int63n(s.len))
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	members := s.at(offsets)
+	rand.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+	return members
+}
+
+// Pop removes and returns up to count random members.
+func (s *Set) Pop(count int64) ([][]byte, error) {
+	members := s.RandMembers(count)
+	if len(members) == 0 {
+		return members, nil
+	}
+	removed := map[string]bool{}
+	for _, member := range members {
+		if removed[string(member)] {
+			continue
+		}
+		err := s.bucket.Delete(memberKey(member))
+		if err != nil {
+			return nil, err
+		}
+		removed[string(member)] = true
+	}
+	s.tx.Notify(EventSet, "spop", s.key)
+	return members, s.setLen(s.len - int64(len(removed)))
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zenozeng/s3dis/storage"
+)
+
+// cdcPrefix is where ObjectStorageSink writes the changes by default
+const cdcPrefix = "cdc/"
+
+// encodeChanges serializes changes as JSON lines
+func encodeChanges(changes []Change) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	for i := range changes {
+		err := encoder.Encode(&changes[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// FileSink appends the changes to a local file as JSON lines. A change may
+// be appended twice if the process stops between the write and the
+// checkpoint.
+type FileSink struct {
+	Path string
+}
+
+func (s *FileSink) WriteChanges(ctx context.Context, changes []Change) error {
+	data, err := encodeChanges(changes)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WebhookSink posts the changes to URL as JSON lines, the changes are posted
+// again until it responds with a 2xx status
+type WebhookSink struct {
+	URL    string
+	Client *http.Client // http.DefaultClient if nil
+}
+
+func (s *WebhookSink) WriteChanges(ctx context.Context, changes []Change) error {
+	data, err := encodeChanges(changes)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// ObjectStorageSink writes every batch of changes as a JSON lines object
+// under Prefix, cdc/ if empty, named after the time of the write so that the
+// objects list in order
+type ObjectStorageSink struct {
+	Storage *storage.ObjectStorage
+	Prefix  string
+}
+
+func (s *ObjectStorageSink) WriteChanges(ctx context.Context, changes []Change) error {
+	data, err := encodeChanges(changes)
+	if err != nil {
+		return err
+	}
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = cdcPrefix
+	}
+	name := fmt.Sprintf("%s%020d-%s.jsonl", prefix, time.Now().UnixNano(), uuid.NewString())
+	return s.Storage.PutObject(ctx, name, data)
+}
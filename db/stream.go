@@ -0,0 +1,739 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ErrStreamIDTooSmall = errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	ErrBusyGroup        = errors.New("BUSYGROUP Consumer Group name already exists")
+	ErrNoGroup          = errors.New("NOGROUP No such key or consumer group")
+)
+
+// StreamID is the ID of a stream entry, made of a millisecond timestamp and
+// a sequence number.
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+// MaxStreamID is the greatest possible stream ID.
+var MaxStreamID = StreamID{Ms: ^uint64(0), Seq: ^uint64(0)}
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+// Less reports whether id is lower than other.
+func (id StreamID) Less(other StreamID) bool {
+	return id.Ms < other.Ms || id.Ms == other.Ms && id.Seq < other.Seq
+}
+
+// Next returns the smallest ID greater than id, or false if id is the
+// greatest ID.
+func (id StreamID) Next() (StreamID, bool) {
+	if id.Seq < ^uint64(0) {
+		return StreamID{Ms: id.Ms, Seq: id.Seq + 1}, true
+	}
+	if id.Ms < ^uint64(0) {
+		return StreamID{Ms: id.Ms + 1}, true
+	}
+	return id, false
+}
+
+// Prev returns the greatest ID lower than id, or false if id is 0-0.
+func (id StreamID) Prev() (StreamID, bool) {
+	if id.Seq > 0 {
+		return StreamID{Ms: id.Ms, Seq: id.Seq - 1}, true
+	}
+	if id.Ms > 0 {
+		return StreamID{Ms: id.Ms - 1, Seq: ^uint64(0)}, true
+	}
+	return id, false
+}
+
+// ParseStreamID parses an ID such as 1526919030474-55, or 1526919030474
+// whose sequence is defaultSeq.
+func ParseStreamID(s string, defaultSeq uint64) (StreamID, error) {
+	ms, seq, found := strings.Cut(s, "-")
+	id := StreamID{Seq: defaultSeq}
+	var err error
+	id.Ms, err = strconv.ParseUint(ms, 10, 64)
+	if err != nil {
+		return id, fmt.Errorf("ERR Invalid stream ID specified as stream command argument")
+	}
+	if found {
+		id.Seq, err = strconv.ParseUint(seq, 10, 64)
+		if err != nil {
+			return id, fmt.Errorf("ERR Invalid stream ID specified as stream command argument")
+		}
+	}
+	return id, nil
+}
+
+func (id StreamID) bytes() []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, id.Ms)
+	binary.BigEndian.PutUint64(b[8:], id.Seq)
+	return b
+}
+
+func decodeStreamID(b []byte) StreamID {
+	if len(b) != 16 {
+		return StreamID{}
+	}
+	return StreamID{
+		Ms:  binary.BigEndian.Uint64(b),
+		Seq: binary.BigEndian.Uint64(b[8:]),
+	}
+}
+
+// StreamEntry is an entry of a stream, Fields holds field names and values
+// alternately. Fields is nil for entries which were deleted but are still
+// pending in a consumer group.
+type StreamEntry struct {
+	ID     StreamID
+	Fields [][]byte
+}
+
+func encodeFields(fields [][]byte) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(fields)))
+	for _, field := range fields {
+		buf = binary.AppendUvarint(buf, uint64(len(field)))
+		buf = append(buf, field...)
+	}
+	return buf
+}
+
+func decodeFields(b []byte) [][]byte {
+	n, i := binary.Uvarint(b)
+	fields := make([][]byte, 0, n)
+	for ; n > 0; n-- {
+		l, j := binary.Uvarint(b[i:])
+		i += j
+		fields = append(fields, append([]byte{}, b[i:i+int(l)]...))
+		i += int(l)
+	}
+	return fields
+}
+
+func encodeUint64(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+func decodeUint64(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// Stream is a handle on a stream key.
+//
+// The bucket of the key holds:
+//
+//	last_id: "ID of the last added entry"
+//	entries_added: "number of entries ever added"
+//	max_deleted_id: "greatest ID of a deleted entry"
+//
+//	entries: {
+//	    $id: "fields and values of the entry"
+//	}
+//
+//	groups: {
+//	    $group: {
+//	        last_id: "ID of the last delivered entry"
+//	        entries_read: "number of entries read by the group"
+//	        consumers: {
+//	            $consumer: "last time the consumer was seen, in milliseconds"
+//	        }
+//	        pel: {
+//	            $id: "delivery time, delivery count and consumer"
+//	        }
+//	    }
+//	}
+//
+// where IDs are encoded as 16 bytes so that byte order matches ID order.
+// Unlike other types, a stream is not deleted when it becomes empty.
+type Stream struct {
+	tx      *Tx
+	key     []byte
+	bucket  *bolt.Bucket
+	entries *bolt.Bucket
+	groups  *bolt.Bucket
+	len     int64
+}
+
+// OpenStream returns the stream stored at key, creating an empty one if
+// create is true. It returns nil if the key does not exist and create is
+// false, and ErrWrongType if the key holds another type.
+func (tx *Tx) OpenStream(key []byte, create bool) (*Stream, error) {
+	bucket, err := tx.open(key, TypeStream, create)
+	if err != nil || bucket == nil {
+		return nil, err
+	}
+	s := &Stream{
+		tx:      tx,
+		key:     key,
+		bucket:  bucket,
+		entries: bucket.Bucket([]byte("entries")),
+		groups:  bucket.Bucket([]byte("groups")),
+	}
+	if s.entries == nil {
+		s.entries, err = bucket.CreateBucket([]byte("entries"))
+		if err != nil {
+			return nil, err
+		}
+		s.groups, err = bucket.CreateBucket([]byte("groups"))
+		if err != nil {
+			return nil, err
+		}
+		err = tx.putLength(key, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.len, err = tx.length(key)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Len returns the number of entries of the stream.
+func (s *Stream) Len() int64 {
+	return s.len
+}
+
+func (s *Stream) setLen(n int64) error {
+	s.len = n
+	return s.tx.putLength(s.key, n)
+}
+
+// LastID returns the ID of the last entry ever added to the stream.
+func (s *Stream) LastID() StreamID {
+	return decodeStreamID(s.bucket.Get([]byte("last_id")))
+}
+
+// EntriesAdded returns the number of entries ever added to the stream.
+func (s *Stream) EntriesAdded() uint64 {
+	return decodeUint64(s.bucket.Get([]byte("entries_added")))
+}
+
+// MaxDeletedID returns the greatest ID of an entry removed from the stream.
+func (s *Stream) MaxDeletedID() StreamID {
+	return decodeStreamID(s.bucket.Get([]byte("max_deleted_id")))
+}
+
+// SetLastID sets the ID of the last added entry, as XSETID does.
+func (s *Stream) SetLastID(id StreamID) error {
+	if last, ok := s.Last(); ok && id.Less(last.ID) {
+		return fmt.Errorf("ERR The ID specified in XSETID is smaller than the target stream top item")
+	}
+	s.tx.Notify(EventStream, "xsetid", s.key)
+	return s.bucket.Put([]byte("last_id"), id.bytes())
+}
+
+// NextID returns the ID of a new entry added now.
+func (s *Stream) NextID() StreamID {
+	last := s.LastID()
+	ms := uint64(s.tx.now.UnixMilli())
+	if ms > last.Ms {
+		return StreamID{Ms: ms}
+	}
+	next, _ := last.Next()
+	return next
+}
+
+// NextSeq returns the ID of a new entry with the millisecond part ms, or
+// false if there is none.
+func (s *Stream) NextSeq(ms uint64) (StreamID, bool) {
+	last := s.LastID()
+	if ms > last.Ms {
+		return StreamID{Ms: ms}, true
+	}
+	if ms == last.Ms && last.Seq < ^uint64(0) {
+		return StreamID{Ms: ms, Seq: last.Seq + 1}, true
+	}
+	return StreamID{}, false
+}
+
+// Add appends an entry with the given ID, which must be greater than the ID
+// of the last added entry.
+func (s *Stream) Add(id StreamID, fields [][]byte) error {
+	if id == (StreamID{}) {
+		return fmt.Errorf("ERR The ID specified in XADD must be greater than 0-0")
+	}
+	if !s.LastID().Less(id) {
+		return ErrStreamIDTooSmall
+	}
+	err := s.entries.Put(id.bytes(), encodeFields(fields))
+	if err != nil {
+		return err
+	}
+	err = s.bucket.Put([]byte("last_id"), id.bytes())
+	if err != nil {
+		return err
+	}
+	err = s.bucket.Put([]byte("entries_added"), encodeUint64(s.EntriesAdded()+1))
+	if err != nil {
+		return err
+	}
+	s.tx.Notify(EventStream, "xadd", s.key)
+	return s.setLen(s.len + 1)
+}
+
+// Get returns the entry with the given ID, or false if it does not exist.
+func (s *Stream) Get(id StreamID) (StreamEntry, bool) {
+	v := s.entries.Get(id.bytes())
+	if v == nil {
+		return StreamEntry{}, false
+	}
+	return StreamEntry{ID: id, Fields: decodeFields(v)}, true
+}
+
+// First returns the first entry of the stream, or false if it is empty.
+func (s *Stream) First() (StreamEntry, bool) {
+	k, v := s.entries.Cursor().First()
+	if k == nil {
+		return StreamEntry{}, false
+	}
+	return StreamEntry{ID: decodeStreamID(k), Fields: decodeFields(v)}, true
+}
+
+// Last returns the last entry of the stream, or false if it is empty.
+func (s *Stream) Last() (StreamEntry, bool) {
+	k, v := s.entries.Cursor().Last()
+	if k == nil {
+		return StreamEntry{}, false
+	}
+	return StreamEntry{ID: decodeStreamID(k), Fields: decodeFields(v)}, true
+}
+
+// Range returns up to count entries with IDs between start and end,
+// inclusive, in reverse order if rev is true. A negative count means no
+// limit.
+func (s *Stream) Range(start, end StreamID, rev bool, count int64) []StreamEntry {
+	res := []StreamEntry{}
+	if count == 0 || end.Less(start) {
+		return res
+	}
+	c := s.entries.Cursor()
+	var k, v []byte
+	if rev {
+		k, v = c.Seek(end.bytes())
+		if k == nil {
+			k, v = c.Last()
+		} else if bytes.Compare(k, end.bytes()) > 0 {
+			k, v = c.Prev()
+		}
+	} else {
+		k, v = c.Seek(start.bytes())
+	}
+	for ; k != nil; k, v = nextEntry(c, rev) {
+		id := decodeStreamID(k)
+		if id.Less(start) || end.Less(id) {
+			break
+		}
+		res = append(res, StreamEntry{ID: id, Fields: decodeFields(v)})
+		if count > 0 && int64(len(res)) >= count {
+			break
+		}
+	}
+	return res
+}
+
+func nextEntry(c *bolt.Cursor, rev bool) ([]byte, []byte) {
+	if rev {
+		return c.Prev()
+	}
+	return c.Next()
+}
+
+func (s *Stream) remove(id StreamID) error {
+	err := s.entries.Delete(id.bytes())
+	if err != nil {
+		return err
+	}
+	if s.MaxDeletedID().Less(id) {
+		return s.bucket.Put([]byte("max_deleted_id"), id.bytes())
+	}
+	return nil
+}
+
+// Delete removes the entries with the given IDs and returns the number of
+// removed entries.
+func (s *Stream) Delete(ids ...StreamID) (int64, error) {
+	n := int64(0)
+	for _, id := range ids {
+		if _, ok := s.Get(id); !ok {
+			continue
+		}
+		err := s.remove(id)
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if n > 0 {
+		s.tx.Notify(EventStream, "xdel", s.key)
+	}
+	return n, s.setLen(s.len - n)
+}
+
+// Trim removes the oldest entries while the stream has more than maxLen
+// entries, or while their IDs are lower than minID if minID is not nil,
+// removing at most limit entries if limit is positive. It returns the number
+// of removed entries.
+func (s *Stream) Trim(maxLen int64, minID *StreamID, limit int64) (int64, error) {
+	n := int64(0)
+	c := s.entries.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.First() {
+		if limit > 0 && n >= limit {
+			break
+		}
+		if minID != nil {
+			if !decodeStreamID(k).Less(*minID) {
+				break
+			}
+		} else if s.len-n <= maxLen {
+			break
+		}
+		err := s.remove(decodeStreamID(k))
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if n > 0 {
+		s.tx.Notify(EventStream, "xtrim", s.key)
+	}
+	return n, s.setLen(s.len - n)
+}
+
+// Group returns the consumer group named name, or nil if it does not exist.
+func (s *Stream) Group(name []byte) *Group {
+	bucket := s.groups.Bucket(name)
+	if bucket == nil {
+		return nil
+	}
+	return &Group{
+		stream:    s,
+		Name:      append([]byte{}, name...),
+		bucket:    bucket,
+		consumers: bucket.Bucket([]byte("consumers")),
+		pel:       bucket.Bucket([]byte("pel")),
+	}
+}
+
+// Groups returns all consumer groups of the stream.
+func (s *Stream) Groups() []*Group {
+	groups := []*Group{}
+	_ = s.groups.ForEach(func(k, v []byte) error {
+		groups = append(groups, s.Group(k))
+		return nil
+	})
+	return groups
+}
+
+// CreateGroup creates a consumer group whose last delivered ID is lastID.
+// entriesRead is the number of entries read by the group, or -1 if unknown.
+func (s *Stream) CreateGroup(name []byte, lastID StreamID, entriesRead int64) error {
+	if s.groups.Bucket(name) != nil {
+		return ErrBusyGroup
+	}
+	bucket, err := s.groups.CreateBucket(name)
+	if err != nil {
+		return err
+	}
+	_, err = bucket.CreateBucket([]byte("consumers"))
+	if err != nil {
+		return err
+	}
+	_, err = bucket.CreateBucket([]byte("pel"))
+	if err != nil {
+		return err
+	}
+	s.tx.Notify(EventStream, "xgroup-create", s.key)
+	return s.Group(name).setLastID(lastID, entriesRead)
+}
+
+// DestroyGroup removes a consumer group and reports whether it existed.
+func (s *Stream) DestroyGroup(name []byte) (bool, error) {
+	if s.groups.Bucket(name) == nil {
+		return false, nil
+	}
+	s.tx.Notify(EventStream, "xgroup-destroy", s.key)
+	return true, s.groups.DeleteBucket(name)
+}
+
+// Group is a handle on a consumer group of a stream.
+type Group struct {
+	stream    *Stream
+	Name      []byte
+	bucket    *bolt.Bucket
+	consumers *bolt.Bucket
+	pel       *bolt.Bucket
+}
+
+// LastID returns the ID of the last entry delivered to the group.
+func (g *Group) LastID() StreamID {
+	return decodeStreamID(g.bucket.Get([]byte("last_id")))
+}
+
+// EntriesRead returns the number of entries read by the group, or -1 if it
+// is unknown.
+func (g *Group) EntriesRead() int64 {
+	return int64(decodeUint64(g.bucket.Get([]byte("entries_read"))))
+}
+
+// SetLastID sets the last delivered ID of the group and the number of
+// entries it has read, -1 meaning unknown.
+func (g *Group) SetLastID(id StreamID, entriesRead int64) error {
+	g.stream.tx.Notify(EventStream, "xgroup-setid", g.stream.key)
+	return g.setLastID(id, entriesRead)
+}
+
+// setLastID sets the last delivered ID of the group as it delivers entries
+func (g *Group) setLastID(id StreamID, entriesRead int64) error {
+	err := g.bucket.Put([]byte("last_id"), id.bytes())
+	if err != nil {
+		return err
+	}
+	return g.bucket.Put([]byte("entries_read"), encodeUint64(uint64(entriesRead)))
+}
+
+// Lag returns the number of entries not yet delivered to the group, or -1
+// if it can not be computed because of deleted entries.
+func (g *Group) Lag() int64 {
+	s := g.stream
+	read := g.EntriesRead()
+	if s.len == 0 {
+		return 0
+	}
+	if read < 0 || g.LastID().Less(s.MaxDeletedID()) {
+		return -1
+	}
+	return int64(s.EntriesAdded()) - read
+}
+
+// Consumer describes a consumer of a group.
+type Consumer struct {
+	Name    []byte
+	SeenMs  int64
+	Pending int64
+}
+
+// CreateConsumer creates a consumer and reports whether it was created.
+func (g *Group) CreateConsumer(name []byte) (bool, error) {
+	if g.consumers.Get(name) != nil {
+		return false, nil
+	}
+	return true, g.touch(name)
+}
+
+// touch records that consumer was seen now, creating it if needed
+func (g *Group) touch(consumer []byte) error {
+	if g.consumers.Get(consumer) == nil {
+		g.stream.tx.Notify(EventStream, "xgroup-createconsumer", g.stream.key)
+	}
+	return g.consumers.Put(consumer, encodeUint64(uint64(g.stream.tx.now.UnixMilli())))
+}
+
+// DeleteConsumer removes a consumer and its pending entries, and returns the
+// number of pending entries it had.
+func (g *Group) DeleteConsumer(name []byte) (int64, error) {
+	if g.consumers.Get(name) == nil {
+		return 0, nil
+	}
+	pending := g.Pending(StreamID{}, MaxStreamID, -1, name, 0)
+	for _, p := range pending {
+		err := g.pel.Delete(p.ID.bytes())
+		if err != nil {
+			return 0, err
+		}
+	}
+	g.stream.tx.Notify(EventStream, "xgroup-delconsumer", g.stream.key)
+	return int64(len(pending)), g.consumers.Delete(name)
+}
+
+// Consumers returns the consumers of the group with their number of pending
+// entries.
+func (g *Group) Consumers() []Consumer {
+	pending := map[string]int64{}
+	for _, p := range g.Pending(StreamID{}, MaxStreamID, -1, nil, 0) {
+		pending[string(p.Consumer)]++
+	}
+	consumers := []Consumer{}
+	_ = g.consumers.ForEach(func(k, v []byte) error {
+		consumers = append(consumers, Consumer{
+			Name:    append([]byte{}, k...),
+			SeenMs:  int64(decodeUint64(v)),
+			Pending: pending[string(k)],
+		})
+		return nil
+	})
+	return consumers
+}
+
+// PendingEntry is an entry delivered to a consumer but not acknowledged yet.
+type PendingEntry struct {
+	ID            StreamID
+	Consumer      []byte
+	DeliveryMs    int64
+	DeliveryCount int64
+}
+
+func encodePendingEntry(p PendingEntry) []byte {
+	b := make([]byte, 16, 16+len(p.Consumer))
+	binary.BigEndian.PutUint64(b, uint64(p.DeliveryMs))
+	binary.BigEndian.PutUint64(b[8:], uint64(p.DeliveryCount))
+	return append(b, p.Consumer...)
+}
+
+func decodePendingEntry(k, v []byte) PendingEntry {
+	return PendingEntry{
+		ID:            decodeStreamID(k),
+		DeliveryMs:    int64(binary.BigEndian.Uint64(v)),
+		DeliveryCount: int64(binary.BigEndian.Uint64(v[8:])),
+		Consumer:      append([]byte{}, v[16:]...),
+	}
+}
+
+// PendingCount returns the number of pending entries of the group.
+func (g *Group) PendingCount() int64 {
+	return int64(g.pel.Stats().KeyN)
+}
+
+// Pending returns up to count pending entries with IDs between start and end,
+// owned by consumer if it is not nil and idle for at least minIdleMs. A
+// negative count means no limit.
+func (g *Group) Pending(start, end StreamID, count int64, consumer []byte, minIdleMs int64) []PendingEntry {
+	res := []PendingEntry{}
+	if count == 0 {
+		return res
+	}
+	now := g.stream.tx.now.UnixMilli()
+	c := g.pel.Cursor()
+	for k, v := c.Seek(start.bytes()); k != nil; k, v = c.Next() {
+		p := decodePendingEntry(k, v)
+		if end.Less(p.ID) {
+			break
+		}
+		if consumer != nil && !bytes.Equal(consumer, p.Consumer) || now-p.DeliveryMs < minIdleMs {
+			continue
+		}
+		res = append(res, p)
+		if count > 0 && int64(len(res)) >= count {
+			break
+		}
+	}
+	return res
+}
+
+// GetPending returns the pending entry with the given ID, or false if the
+// entry is not pending.
+func (g *Group) GetPending(id StreamID) (PendingEntry, bool) {
+	v := g.pel.Get(id.bytes())
+	if v == nil {
+		return PendingEntry{}, false
+	}
+	return decodePendingEntry(id.bytes(), v), true
+}
+
+// SetPending records that the entry p.ID is pending for p.Consumer.
+func (g *Group) SetPending(p PendingEntry) error {
+	err := g.touch(p.Consumer)
+	if err != nil {
+		return err
+	}
+	return g.pel.Put(p.ID.bytes(), encodePendingEntry(p))
+}
+
+// Ack removes the given IDs from the pending entries and returns the number
+// of acknowledged entries.
+func (g *Group) Ack(ids ...StreamID) (int64, error) {
+	n := int64(0)
+	for _, id := range ids {
+		if g.pel.Get(id.bytes()) == nil {
+			continue
+		}
+		err := g.pel.Delete(id.bytes())
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// ReadNew delivers up to count entries added after the last delivered ID to
+// consumer, recording them as pending unless noAck is true.
+func (g *Group) ReadNew(consumer []byte, count int64, noAck bool) ([]StreamEntry, error) {
+	err := g.touch(consumer)
+	if err != nil {
+		return nil, err
+	}
+	start, ok := g.LastID().Next()
+	if !ok {
+		return []StreamEntry{}, nil
+	}
+	entries := g.stream.Range(start, MaxStreamID, false, count)
+	if len(entries) == 0 {
+		return entries, nil
+	}
+	read := g.EntriesRead()
+	if read >= 0 {
+		read += int64(len(entries))
+	}
+	err = g.setLastID(entries[len(entries)-1].ID, read)
+	if err != nil {
+		return nil, err
+	}
+	if noAck {
+		return entries, nil
+	}
+	for _, entry := range entries {
+		err = g.SetPending(PendingEntry{
+			ID:            entry.ID,
+			Consumer:      consumer,
+			DeliveryMs:    g.stream.tx.now.UnixMilli(),
+			DeliveryCount: 1,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// ReadPending returns up to count entries pending for consumer with IDs
+// greater than start. Entries deleted from the stream have nil fields.
+func (g *Group) ReadPending(consumer []byte, start StreamID, count int64) ([]StreamEntry, error) {
+	err := g.touch(consumer)
+	if err != nil {
+		return nil, err
+	}
+	entries := []StreamEntry{}
+	next, ok := start.Next()
+	if !ok {
+		return entries, nil
+	}
+	for _, p := range g.Pending(next, MaxStreamID, count, consumer, 0) {
+		entry, ok := g.stream.Get(p.ID)
+		if !ok {
+			entry = StreamEntry{ID: p.ID}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
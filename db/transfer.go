@@ -0,0 +1,477 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var ErrNoSuchKey = errors.New("ERR no such key")
+
+// keyDump is a serialized key of any type, with its expiration
+type keyDump struct {
+	Type     string      `json:"type"`
+	Value    []byte      `json:"value,omitempty"`
+	Length   []byte      `json:"length,omitempty"`
+	ExpireAt int64       `json:"pxat,omitempty"`
+	Elements *bucketDump `json:"elements,omitempty"`
+}
+
+type bucketDump struct {
+	Entries []bucketEntry `json:"entries"`
+}
+
+// bucketEntry is a value, or a nested bucket if Bucket is set
+type bucketEntry struct {
+	Key    []byte      `json:"key"`
+	Value  []byte      `json:"value,omitempty"`
+	Bucket *bucketDump `json:"bucket,omitempty"`
+}
+
+func dumpBucket(b *bolt.Bucket) (*bucketDump, error) {
+	d := &bucketDump{Entries: []bucketEntry{}}
+	err := b.ForEach(func(k, v []byte) error {
+		entry := bucketEntry{Key: append([]byte{}, k...)}
+		if v == nil {
+			nested, err := dumpBucket(b.Bucket(k))
+			if err != nil {
+				return err
+			}
+			entry.Bucket = nested
+		} else {
+			entry.Value = append([]byte{}, v...)
+		}
+		d.Entries = append(d.Entries, entry)
+		return nil
+	})
+	return d, err
+}
+
+func restoreBucket(b *bolt.Bucket, d *bucketDump) error {
+	for _, entry := range d.Entries {
+		if entry.Bucket == nil {
+			err := b.Put(entry.Key, append([]byte{}, entry.Value...))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		nested, err := b.CreateBucket(entry.Key)
+		if err != nil {
+			return err
+		}
+		err = restoreBucket(nested, entry.Bucket)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dump serializes key, it returns nil if the key does not exist
+func (tx *Tx) dump(key []byte) (*keyDump, error) {
+	d, err := tx.dumpHeader(key)
+	if err != nil || d == nil || d.Type == TypeString {
+		return d, err
+	}
+	typeBucket, err := tx.bucket(d.Type)
+	if err != nil {
+		return nil, err
+	}
+	d.Elements, err = dumpBucket(typeBucket.Bucket(key))
+	return d, err
+}
+
+// dumpHeader is dump without the elements of key
+func (tx *Tx) dumpHeader(key []byte) (*keyDump, error) {
+	typ, err := tx.Type(key)
+	if err != nil || typ == TypeNone {
+		return nil, err
+	}
+	d := &keyDump{Type: typ}
+	exp, err := tx.expiration(key)
+	if err != nil {
+		return nil, err
+	}
+	if exp != nil {
+		d.ExpireAt = exp.UnixMilli()
+	}
+	if typ == TypeString {
+		d.Value, _, err = tx.Get(key)
+		return d, err
+	}
+	lengthBucket, err := tx.bucket("length")
+	if err != nil {
+		return nil, err
+	}
+	d.Length = append([]byte{}, lengthBucket.Get(key)...)
+	return d, nil
+}
+
+// keyDelta rolls a key forward from a previous state. The key is deleted if
+// Dump is nil, and replaced by Dump unless Changes is set. With Changes, the
+// key kept its type, Dump holds it without its elements and Changes the
+// elements which changed.
+type keyDelta struct {
+	Key     []byte       `json:"key"`
+	Dump    *keyDump     `json:"dump,omitempty"`
+	Changes *bucketDelta `json:"changes,omitempty"`
+}
+
+// bucketDelta turns a bucket into another: entries are deleted, then put,
+// then the nested buckets found in both are changed by their own delta
+type bucketDelta struct {
+	Delete [][]byte      `json:"delete,omitempty"`
+	Put    []bucketEntry `json:"put,omitempty"`
+	Nested []nestedDelta `json:"nested,omitempty"`
+}
+
+type nestedDelta struct {
+	Key   []byte       `json:"key"`
+	Delta *bucketDelta `json:"delta"`
+}
+
+func (d *bucketDelta) empty() bool {
+	return len(d.Delete) == 0 && len(d.Put) == 0 && len(d.Nested) == 0
+}
+
+// diffBucket returns the delta turning the bucket before into after
+func diffBucket(before, after *bolt.Bucket) (*bucketDelta, error) {
+	d := &bucketDelta{}
+	put := func(k, v []byte) error {
+		entry := bucketEntry{Key: append([]byte{}, k...)}
+		if v != nil {
+			entry.Value = append([]byte{}, v...)
+			d.Put = append(d.Put, entry)
+			return nil
+		}
+		nested, err := dumpBucket(after.Bucket(k))
+		if err != nil {
+			return err
+		}
+		entry.Bucket = nested
+		d.Put = append(d.Put, entry)
+		return nil
+	}
+	bc, ac := before.Cursor(), after.Cursor()
+	bk, bv := bc.First()
+	ak, av := ac.First()
+	for bk != nil || ak != nil {
+		cmp := 0
+		switch {
+		case ak == nil:
+			cmp = -1
+		case bk == nil:
+			cmp = 1
+		default:
+			cmp = bytes.Compare(bk, ak)
+		}
+		switch {
+		case cmp < 0:
+			d.Delete = append(d.Delete, append([]byte{}, bk...))
+			bk, bv = bc.Next()
+			continue
+		case cmp > 0:
+			err := put(ak, av)
+			if err != nil {
+				return nil, err
+			}
+			ak, av = ac.Next()
+			continue
+		}
+		switch {
+		case bv != nil && av != nil:
+			if !bytes.Equal(bv, av) {
+				d.Put = append(d.Put, bucketEntry{Key: append([]byte{}, ak...), Value: append([]byte{}, av...)})
+			}
+		case bv == nil && av == nil:
+			nested, err := diffBucket(before.Bucket(bk), after.Bucket(ak))
+			if err != nil {
+				return nil, err
+			}
+			if !nested.empty() {
+				d.Nested = append(d.Nested, nestedDelta{Key: append([]byte{}, ak...), Delta: nested})
+			}
+		default:
+			// a value replaced by a nested bucket or the other way around
+			d.Delete = append(d.Delete, append([]byte{}, bk...))
+			err := put(ak, av)
+			if err != nil {
+				return nil, err
+			}
+		}
+		bk, bv = bc.Next()
+		ak, av = ac.Next()
+	}
+	return d, nil
+}
+
+func applyBucketDelta(b *bolt.Bucket, d *bucketDelta) error {
+	for _, k := range d.Delete {
+		var err error
+		if b.Bucket(k) != nil {
+			err = b.DeleteBucket(k)
+		} else {
+			err = b.Delete(k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err := restoreBucket(b, &bucketDump{Entries: d.Put})
+	if err != nil {
+		return err
+	}
+	for _, n := range d.Nested {
+		nested := b.Bucket(n.Key)
+		if nested == nil {
+			return fmt.Errorf("bucket %q of the delta does not exist", n.Key)
+		}
+		err = applyBucketDelta(nested, n.Delta)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delta returns the keyDelta rolling key forward from its state in before
+// to its state in tx. Only the changed elements are recorded when the key
+// kept its type, except for strings which are recorded whole.
+func (tx *Tx) delta(before *Tx, key []byte) (*keyDelta, error) {
+	d := &keyDelta{Key: key}
+	header, err := tx.dumpHeader(key)
+	if err != nil || header == nil {
+		return d, err
+	}
+	prevTyp, err := before.Type(key)
+	if err != nil {
+		return nil, err
+	}
+	if header.Type == TypeString || header.Type != prevTyp {
+		d.Dump, err = tx.dump(key)
+		return d, err
+	}
+	prevBucket, err := before.bucket(prevTyp)
+	if err != nil {
+		return nil, err
+	}
+	typeBucket, err := tx.bucket(header.Type)
+	if err != nil {
+		return nil, err
+	}
+	d.Dump = header
+	d.Changes, err = diffBucket(prevBucket.Bucket(key), typeBucket.Bucket(key))
+	return d, err
+}
+
+// rollForward applies a keyDelta recorded against the current state of the
+// key, the caller notifies the events of the write unless it is a deletion
+func (tx *Tx) rollForward(d *keyDelta) error {
+	if d.Dump == nil {
+		_, err := tx.Delete(d.Key)
+		return err
+	}
+	if d.Changes == nil {
+		return tx.restore(d.Key, d.Dump)
+	}
+	typeBucket, err := tx.bucket(d.Dump.Type)
+	if err != nil {
+		return err
+	}
+	bucket := typeBucket.Bucket(d.Key)
+	if bucket == nil {
+		return fmt.Errorf("key %q of the delta does not exist", d.Key)
+	}
+	tx.touch(d.Key)
+	err = applyBucketDelta(bucket, d.Changes)
+	if err != nil {
+		return err
+	}
+	if len(d.Dump.Length) > 0 {
+		err = tx.putLength(d.Key, MustParseInt(d.Dump.Length))
+		if err != nil {
+			return err
+		}
+	}
+	var exp *time.Time
+	if d.Dump.ExpireAt != 0 {
+		t := time.UnixMilli(d.Dump.ExpireAt)
+		exp = &t
+	}
+	return tx.setExpiration(d.Key, exp)
+}
+
+// restore replaces the value of key with a dump, the caller notifies the
+// events of the write
+func (tx *Tx) restore(key []byte, d *keyDump) error {
+	return tx.quietly(func() error {
+		return tx.restoreDump(key, d)
+	})
+}
+
+func (tx *Tx) restoreDump(key []byte, d *keyDump) error {
+	_, err := tx.Delete(key)
+	if err != nil {
+		return err
+	}
+	var exp *time.Time
+	if d.ExpireAt != 0 {
+		t := time.UnixMilli(d.ExpireAt)
+		exp = &t
+	}
+	if d.Type == TypeString {
+		return tx.Put(key, d.Value, exp)
+	}
+	bucket, err := tx.create(key, d.Type)
+	if err != nil {
+		return err
+	}
+	err = restoreBucket(bucket, d.Elements)
+	if err != nil {
+		return err
+	}
+	if len(d.Length) > 0 {
+		err = tx.putLength(key, MustParseInt(d.Length))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.setExpiration(key, exp)
+}
+
+// copyTo copies key to dstKey of the transaction dst, which may be tx, and
+// returns the dump of key. It returns ErrNoSuchKey if key does not exist,
+// and errNotApplied if dstKey exists and replace is false.
+func (tx *Tx) copyTo(key []byte, dst *Tx, dstKey []byte, replace bool) (*keyDump, error) {
+	d, err := tx.dump(key)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, ErrNoSuchKey
+	}
+	exists, err := dst.Exists(dstKey)
+	if err != nil {
+		return nil, err
+	}
+	if exists && !replace {
+		return nil, errNotApplied
+	}
+	return d, dst.restore(dstKey, d)
+}
+
+// transfer copies the key src of srcDB to the key dst of dstDB, replacing it
+// only if replace is true, and deletes src if move is true. It reports
+// whether the key was transferred, and returns ErrNoSuchKey if src does not
+// exist. A move between partitions is a Batch, so that a crash can neither
+// lose nor duplicate the key.
+func transfer(ctx context.Context, srcDB *Database, src []byte, dstDB *Database, dst []byte, move bool, replace bool) (bool, error) {
+	err := checkWritable(ctx)
+	if err != nil {
+		return false, err
+	}
+	transferred := false
+	err = Batch(ctx, []DBKey{{srcDB, src}, {dstDB, dst}}, func(ctx context.Context) error {
+		srcTx, _, err := srcDB.batchTx(ctx, srcDB.getPartitionId(src))
+		if err != nil {
+			return err
+		}
+		dstTx, _, err := dstDB.batchTx(ctx, dstDB.getPartitionId(dst))
+		if err != nil {
+			return err
+		}
+		transferred, err = transferIn(srcTx, src, dstTx, dst, move, replace, srcDB == dstDB)
+		return err
+	})
+	return transferred, err
+}
+
+// transferIn is transfer with the transactions of the source and of the
+// destination, which may be the same. sameDB tells a move is a rename, for
+// the events it notifies.
+func transferIn(srcTx *Tx, src []byte, dstTx *Tx, dst []byte, move bool, replace bool, sameDB bool) (bool, error) {
+	_, err := srcTx.copyTo(src, dstTx, dst, replace)
+	if errors.Is(err, errNotApplied) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case !move:
+		dstTx.Notify(EventGeneric, "copy_to", dst)
+	case sameDB:
+		srcTx.Notify(EventGeneric, "rename_from", src)
+		dstTx.Notify(EventGeneric, "rename_to", dst)
+	default:
+		srcTx.Notify(EventGeneric, "move_from", src)
+		dstTx.Notify(EventGeneric, "move_to", dst)
+	}
+	if move {
+		err = srcTx.quietly(func() error {
+			_, err := srcTx.Delete(src)
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	err = dstTx.written()
+	if err == nil && move && srcTx != dstTx {
+		err = srcTx.written()
+	}
+	return err == nil, err
+}
+
+// Rename renames key to newKey, replacing newKey unless nx is true, and
+// reports whether the key was renamed. It returns ErrNoSuchKey if key does
+// not exist.
+func (db *Database) Rename(ctx context.Context, key []byte, newKey []byte, nx bool) (bool, error) {
+	if string(key) == string(newKey) {
+		exists := false
+		err := db.View(ctx, key, func(tx *Tx) error {
+			var err error
+			exists, err = tx.Exists(key)
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			return false, ErrNoSuchKey
+		}
+		return !nx, nil
+	}
+	return transfer(ctx, db, key, db, newKey, true, !nx)
+}
+
+// Copy copies key to dstKey of the database dst, replacing dstKey only if
+// replace is true, and reports whether the key was copied.
+func (db *Database) Copy(ctx context.Context, key []byte, dst *Database, dstKey []byte, replace bool) (bool, error) {
+	if db == dst && string(key) == string(dstKey) {
+		return false, fmt.Errorf("ERR source and destination objects are the same")
+	}
+	copied, err := transfer(ctx, db, key, dst, dstKey, false, replace)
+	if errors.Is(err, ErrNoSuchKey) {
+		return false, nil
+	}
+	return copied, err
+}
+
+// Move moves key to the database dst unless it does not exist or dst already
+// holds it, and reports whether it was moved. See transfer for crash safety.
+func (db *Database) Move(ctx context.Context, key []byte, dst *Database) (bool, error) {
+	if db == dst {
+		return false, fmt.Errorf("ERR source and destination objects are the same")
+	}
+	moved, err := transfer(ctx, db, key, dst, key, true, false)
+	if errors.Is(err, ErrNoSuchKey) {
+		return false, nil
+	}
+	return moved, err
+}
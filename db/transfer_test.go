@@ -0,0 +1,153 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/onsi/gomega"
+	bolt "go.etcd.io/bbolt"
+)
+
+// keysInPartitions returns two new keys, in the same partition or not
+func keysInPartitions(samePartition bool) ([]byte, []byte) {
+	a := []byte(uuid.NewString())
+	for {
+		b := []byte(uuid.NewString())
+		if (db.getPartitionId(a) == db.getPartitionId(b)) == samePartition {
+			return a, b
+		}
+	}
+}
+
+func addMembers(g *gomega.WithT, d *Database, key []byte, exp *time.Time, members ...string) {
+	err := d.Update(context.Background(), key, func(tx *Tx) error {
+		set, err := tx.OpenSet(key, true)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			_, err = set.Add([]byte(member))
+			if err != nil {
+				return err
+			}
+		}
+		return tx.SetExpiration(key, exp)
+	})
+	g.Expect(err).To(BeNil())
+}
+
+func expectMembers(g *gomega.WithT, d *Database, key []byte, exp *time.Time, members ...string) {
+	err := d.View(context.Background(), key, func(tx *Tx) error {
+		set, err := tx.OpenSet(key, false)
+		if err != nil {
+			return err
+		}
+		if len(members) == 0 {
+			g.Expect(set).To(BeNil())
+			return nil
+		}
+		g.Expect(set.Len()).To(Equal(int64(len(members))))
+		for _, member := range members {
+			g.Expect(set.IsMember([]byte(member))).To(Equal(true))
+		}
+		keyExp, err := tx.Expiration(key)
+		if exp == nil {
+			g.Expect(keyExp).To(BeNil())
+		} else {
+			g.Expect(keyExp.Equal(*exp)).To(Equal(true))
+		}
+		return err
+	})
+	g.Expect(err).To(BeNil())
+}
+
+func TestRename(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	exp := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	for _, samePartition := range []bool{true, false} {
+		src, dst := keysInPartitions(samePartition)
+		_, err := db.Rename(ctx, src, dst, false)
+		g.Expect(err).To(Equal(ErrNoSuchKey))
+		addMembers(g, db, src, &exp, "a", "b")
+		addMembers(g, db, dst, nil, "c")
+
+		renamed, err := db.Rename(ctx, src, dst, true)
+		g.Expect(err).To(BeNil())
+		g.Expect(renamed).To(Equal(false))
+		renamed, err = db.Rename(ctx, src, dst, false)
+		g.Expect(err).To(BeNil())
+		g.Expect(renamed).To(Equal(true))
+		expectMembers(g, db, src, nil)
+		expectMembers(g, db, dst, &exp, "a", "b")
+
+		renamed, err = db.Rename(ctx, dst, dst, false)
+		g.Expect(err).To(BeNil())
+		g.Expect(renamed).To(Equal(true))
+		paths, err := objectStorage.ListObjects(ctx, intentsPrefix)
+		g.Expect(err).To(BeNil())
+		g.Expect(paths).To(BeEmpty())
+	}
+}
+
+func TestCopy(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	db3, err := db.Select(3)
+	g.Expect(err).To(BeNil())
+	for _, samePartition := range []bool{true, false} {
+		src, dst := keysInPartitions(samePartition)
+		copied, err := db.Copy(ctx, src, db, dst, false)
+		g.Expect(err).To(BeNil())
+		g.Expect(copied).To(Equal(false))
+		_, err = db.Copy(ctx, src, db, src, false)
+		g.Expect(err).NotTo(BeNil())
+
+		addMembers(g, db, src, nil, "a")
+		addMembers(g, db, dst, nil, "b")
+		copied, err = db.Copy(ctx, src, db, dst, false)
+		g.Expect(err).To(BeNil())
+		g.Expect(copied).To(Equal(false))
+		copied, err = db.Copy(ctx, src, db, dst, true)
+		g.Expect(err).To(BeNil())
+		g.Expect(copied).To(Equal(true))
+		expectMembers(g, db, src, nil, "a")
+		expectMembers(g, db, dst, nil, "a")
+
+		copied, err = db.Copy(ctx, src, db3, src, false)
+		g.Expect(err).To(BeNil())
+		g.Expect(copied).To(Equal(true))
+		expectMembers(g, db3, src, nil, "a")
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	src, dst := keysInPartitions(true)
+	err := db.Update(ctx, src, func(tx *Tx) error {
+		stream, err := tx.OpenStream(src, true)
+		if err != nil {
+			return err
+		}
+		return stream.Add(StreamID{Ms: 1, Seq: 1}, [][]byte{[]byte("f"), []byte("v")})
+	})
+	g.Expect(err).To(BeNil())
+	err = db.Update(ctx, src, func(tx *Tx) error {
+		_, err := tx.copyTo(src, tx, dst, false)
+		return err
+	})
+	g.Expect(err).To(BeNil())
+	err = db.view(db.getPartitionId(src), func(tx *bolt.Tx) error {
+		a, err := newTx(tx).dump(src)
+		if err != nil {
+			return err
+		}
+		b, err := newTx(tx).dump(dst)
+		g.Expect(b).To(Equal(a))
+		return err
+	})
+	g.Expect(err).To(BeNil())
+}
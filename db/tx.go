@@ -0,0 +1,552 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	TypeNone   = "none"
+	TypeString = "string"
+	TypeList   = "list"
+	TypeSet    = "set"
+	TypeZSet   = "zset"
+	TypeStream = "stream"
+	TypeJSON   = "ReJSON-RL"
+	TypeBloom  = "MBbloom--"
+	TypeCuckoo = "MBbloomCF"
+)
+
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// Tx is a transaction on the bolt db of a single partition.
+//
+// Besides the string buckets described in Database.Set, a partition holds:
+//
+//	type: {
+//	    $key: "type of a non-string key, e.g. list"
+//	}
+//
+//	length: {
+//	    $key: "number of elements of a non-string key"
+//	}
+//
+//	$type: {
+//	    $key: { elements of the key, layout depends on the type }
+//	}
+//
+// Expired keys are treated as missing, and purged lazily by read-write
+// transactions when they are looked up, or by PurgeExpired.
+type Tx struct {
+	tx      *bolt.Tx
+	now     time.Time
+	touched map[string]bool // keys written since the last call to written
+	dirty   map[string]bool // keys written by the transaction
+	writes  int             // number of calls to written
+	events  []Event         // keyspace notifications of the writes
+	command [][]byte        // command running in the transaction, see WithCommand
+}
+
+func newTx(tx *bolt.Tx) *Tx {
+	return &Tx{
+		tx:  tx,
+		now: time.Now(),
+	}
+}
+
+// View runs fn in a read-only transaction on the partition of key.
+func (db *Database) View(ctx context.Context, key []byte, fn func(tx *Tx) error) error {
+	return db.viewTx(ctx, db.getPartitionId(key), fn)
+}
+
+// Update runs fn in a read-write transaction on the partition of key and
+// uploads the partition. Nothing is written if fn returns an error.
+func (db *Database) Update(ctx context.Context, key []byte, fn func(tx *Tx) error) error {
+	return db.updateTx(ctx, db.getPartitionId(key), fn)
+}
+
+// MultiTx gives access to the transactions of every partition locked by
+// ViewKeys or UpdateKeys.
+type MultiTx struct {
+	db  *Database
+	txs map[string]*Tx
+}
+
+// Tx returns the transaction of the partition holding key, the key must be
+// one of the keys passed to ViewKeys or UpdateKeys.
+func (m *MultiTx) Tx(key []byte) *Tx {
+	tx, ok := m.txs[m.db.getPartitionId(key)]
+	if !ok {
+		panic(fmt.Errorf("key %q was not declared", key))
+	}
+	return tx
+}
+
+// lockPartitions loads and locks the partitions holding keys, see
+// lockPartitionIds.
+func (db *Database) lockPartitions(keys [][]byte, write bool) ([]string, map[string]*Partition, func(), error) {
+	partitionIds := []string{}
+	for partitionId := range db.groupByPartition(keys) {
+		partitionIds = append(partitionIds, partitionId)
+	}
+	return db.lockPartitionIds(partitionIds, write)
+}
+
+// lockPartitionIds loads and locks partitions in partition id order, so that
+// concurrent callers can not deadlock. It returns the sorted partition ids
+// and a function releasing the locks.
+func (db *Database) lockPartitionIds(partitionIds []string, write bool) ([]string, map[string]*Partition, func(), error) {
+	sort.Strings(partitionIds)
+	partitions := map[string]*Partition{}
+	unlock := func() {
+		for _, partition := range partitions {
+			if write {
+				partition.rw.Unlock()
+			} else {
+				partition.rw.RUnlock()
+			}
+		}
+	}
+	for _, partitionId := range partitionIds {
+		partition, err := db.getPartition(partitionId)
+		if err != nil {
+			unlock()
+			return nil, nil, nil, err
+		}
+		if write {
+			partition.rw.Lock()
+		} else {
+			partition.rw.RLock()
+		}
+		partitions[partitionId] = partition
+	}
+	return partitionIds, partitions, unlock, nil
+}
+
+// ViewKeys runs fn with read-only transactions on every partition holding
+// one of keys, giving a consistent view of all of them.
+func (db *Database) ViewKeys(ctx context.Context, keys [][]byte, fn func(m *MultiTx) error) error {
+	if m, ok, err := db.batchMultiTx(ctx, keys); ok {
+		if err != nil {
+			return err
+		}
+		err = fn(m)
+		for _, tx := range m.txs {
+			tx.touched = nil
+		}
+		return err
+	}
+	partitionIds, partitions, unlock, err := db.lockPartitions(keys, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m := &MultiTx{db: db, txs: map[string]*Tx{}}
+	for _, partitionId := range partitionIds {
+		tx, err := partitions[partitionId].db.Begin(false)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		m.txs[partitionId] = newTx(tx)
+	}
+	return fn(m)
+}
+
+// UpdateKeys runs fn with read-write transactions on every partition holding
+// one of keys, in a Batch: the update is all or nothing, and nothing is
+// written if fn returns an error.
+func (db *Database) UpdateKeys(ctx context.Context, keys [][]byte, fn func(m *MultiTx) error) error {
+	err := checkWritable(ctx)
+	if err != nil {
+		return err
+	}
+	dbKeys := make([]DBKey, len(keys))
+	for i, key := range keys {
+		dbKeys[i] = DBKey{db, key}
+	}
+	return Batch(ctx, dbKeys, func(ctx context.Context) error {
+		m, _, err := db.batchMultiTx(ctx, keys)
+		if err != nil {
+			return err
+		}
+		for _, tx := range m.txs {
+			tx.touched = nil
+			tx.command = CommandFromContext(ctx)
+		}
+		err = fn(m)
+		for _, tx := range m.txs {
+			if err == nil || len(tx.touched) > 0 {
+				if err := tx.written(); err != nil {
+					return err
+				}
+			}
+		}
+		return err
+	})
+}
+
+func (tx *Tx) bucket(name string) (*bolt.Bucket, error) {
+	if tx.tx.Writable() {
+		return tx.tx.CreateBucketIfNotExists([]byte(name))
+	}
+	return tx.tx.Bucket([]byte(name)), nil
+}
+
+func (tx *Tx) incrStat(name string, incrBy int64) error {
+	systemBucket, err := tx.bucket("system")
+	if err != nil {
+		return err
+	}
+	n := MustParseInt(systemBucket.Get([]byte(name))) + incrBy
+	return systemBucket.Put([]byte(name), []byte(fmt.Sprintf("%d", n)))
+}
+
+// expiration returns the expiration of key, ignoring whether it has passed
+func (tx *Tx) expiration(key []byte) (*time.Time, error) {
+	pxatBucket, err := tx.bucket("expiration")
+	if err != nil || pxatBucket == nil {
+		return nil, err
+	}
+	pxat := pxatBucket.Get(key)
+	if len(pxat) == 0 {
+		return nil, nil
+	}
+	unixMilli, err := strconv.ParseInt(string(pxat), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	exp := time.UnixMilli(unixMilli)
+	return &exp, nil
+}
+
+// rawType returns the type of key, ignoring whether it has expired
+func (tx *Tx) rawType(key []byte) (string, error) {
+	typeBucket, err := tx.bucket("type")
+	if err != nil {
+		return "", err
+	}
+	if typeBucket != nil {
+		if typ := typeBucket.Get(key); len(typ) > 0 {
+			return string(typ), nil
+		}
+	}
+	valueBucket, err := tx.bucket("value")
+	if err != nil {
+		return "", err
+	}
+	if valueBucket != nil && len(valueBucket.Get(key)) > 0 {
+		return TypeString, nil
+	}
+	return TypeNone, nil
+}
+
+// Type returns the type of key, or TypeNone if the key does not exist.
+// Read-write transactions delete the key if it has expired.
+func (tx *Tx) Type(key []byte) (string, error) {
+	typ, err := tx.rawType(key)
+	if err != nil || typ == TypeNone {
+		return typ, err
+	}
+	exp, err := tx.expiration(key)
+	if err != nil {
+		return "", err
+	}
+	if exp != nil && !exp.After(tx.now) {
+		if tx.tx.Writable() {
+			_, err = tx.delete(key, typ)
+			if err != nil {
+				return "", err
+			}
+			tx.Notify(EventExpired, "expired", key)
+		}
+		return TypeNone, nil
+	}
+	return typ, nil
+}
+
+// checkType returns ErrWrongType if key exists with a type other than typ,
+// and whether the key exists.
+func (tx *Tx) checkType(key []byte, typ string) (bool, error) {
+	actual, err := tx.Type(key)
+	if err != nil {
+		return false, err
+	}
+	if actual == TypeNone {
+		return false, nil
+	}
+	if actual != typ {
+		return false, ErrWrongType
+	}
+	return true, nil
+}
+
+// Exists reports whether key exists, whatever its type.
+func (tx *Tx) Exists(key []byte) (bool, error) {
+	typ, err := tx.Type(key)
+	return typ != TypeNone, err
+}
+
+// Delete removes key whatever its type, and reports whether it existed.
+func (tx *Tx) Delete(key []byte) (bool, error) {
+	typ, err := tx.Type(key)
+	if err != nil || typ == TypeNone {
+		return false, err
+	}
+	tx.Notify(EventGeneric, "del", key)
+	return tx.delete(key, typ)
+}
+
+func (tx *Tx) delete(key []byte, typ string) (bool, error) {
+	tx.touch(key)
+	if typ == TypeString {
+		valueBucket, err := tx.bucket("value")
+		if err != nil {
+			return false, err
+		}
+		err = valueBucket.Delete(key)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		for _, name := range []string{"type", "length"} {
+			bucket, err := tx.bucket(name)
+			if err != nil {
+				return false, err
+			}
+			err = bucket.Delete(key)
+			if err != nil {
+				return false, err
+			}
+		}
+		typeBucket, err := tx.bucket(typ)
+		if err != nil {
+			return false, err
+		}
+		err = typeBucket.DeleteBucket(key)
+		if err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return false, err
+		}
+	}
+	err := tx.setExpiration(key, nil)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.incrStat("keys", -1)
+}
+
+// Expiration returns the expiration of key, or nil if it has none.
+func (tx *Tx) Expiration(key []byte) (*time.Time, error) {
+	typ, err := tx.Type(key)
+	if err != nil || typ == TypeNone {
+		return nil, err
+	}
+	return tx.expiration(key)
+}
+
+// SetExpiration sets or, if exp is nil, removes the expiration of key.
+func (tx *Tx) SetExpiration(key []byte, exp *time.Time) error {
+	prevExp, err := tx.expiration(key)
+	if err != nil {
+		return err
+	}
+	if exp != nil {
+		tx.Notify(EventGeneric, "expire", key)
+	} else if prevExp != nil {
+		tx.Notify(EventGeneric, "persist", key)
+	}
+	return tx.setExpiration(key, exp)
+}
+
+// setExpiration is SetExpiration for writes which set the expiration along
+// with the value, and notify their own events
+func (tx *Tx) setExpiration(key []byte, exp *time.Time) error {
+	tx.touch(key)
+	prevExp, err := tx.expiration(key)
+	if err != nil {
+		return err
+	}
+	pxatBucket, err := tx.bucket("expiration")
+	if err != nil {
+		return err
+	}
+	if exp != nil {
+		err = pxatBucket.Put(key, []byte(fmt.Sprintf("%d", exp.UnixNano()/time.Millisecond.Nanoseconds())))
+		if err != nil {
+			return err
+		}
+		if prevExp == nil {
+			return tx.incrStat("expires", 1)
+		}
+		return nil
+	}
+	err = pxatBucket.Delete(key)
+	if err != nil {
+		return err
+	}
+	if prevExp != nil {
+		return tx.incrStat("expires", -1)
+	}
+	return nil
+}
+
+// Get returns the string value of key and its expiration. The returned value
+// is a copy and remains valid after the transaction is closed.
+func (tx *Tx) Get(key []byte) ([]byte, *time.Time, error) {
+	exists, err := tx.checkType(key, TypeString)
+	if err != nil || !exists {
+		return nil, nil, err
+	}
+	valueBucket, err := tx.bucket("value")
+	if err != nil {
+		return nil, nil, err
+	}
+	exp, err := tx.expiration(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append([]byte{}, valueBucket.Get(key)...), exp, nil
+}
+
+// Set applies the read-modify-write function w to the string value of key.
+// It returns ErrWrongType if key holds a value of another type.
+func (tx *Tx) Set(key []byte, w func([]byte, *time.Time) ([]byte, *time.Time, error)) error {
+	prevVal, prevExp, err := tx.Get(key)
+	if err != nil {
+		return err
+	}
+	val, exp, err := w(prevVal, prevExp)
+	if err != nil {
+		return err
+	}
+	valueBucket, err := tx.bucket("value")
+	if err != nil {
+		return err
+	}
+	tx.touch(key)
+	err = valueBucket.Put(key, val)
+	if err != nil {
+		return err
+	}
+	err = tx.setExpiration(key, exp)
+	if err != nil {
+		return err
+	}
+	if len(prevVal) == 0 {
+		tx.Notify(EventNew, "new", key)
+		return tx.incrStat("keys", 1)
+	}
+	return nil
+}
+
+// Put sets the string value and the expiration of key, replacing a value of
+// any type, like SET.
+func (tx *Tx) Put(key []byte, val []byte, exp *time.Time) error {
+	err := tx.deleteUnlessString(key)
+	if err != nil {
+		return err
+	}
+	expire := false
+	err = tx.Set(key, func(prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
+		expire = exp != nil && (prevExp == nil || !exp.Equal(*prevExp))
+		return val, exp, nil
+	})
+	if err != nil {
+		return err
+	}
+	tx.Notify(EventString, "set", key)
+	if expire {
+		tx.Notify(EventGeneric, "expire", key)
+	}
+	return nil
+}
+
+// deleteUnlessString deletes key if it holds a value of a non-string type
+func (tx *Tx) deleteUnlessString(key []byte) error {
+	typ, err := tx.Type(key)
+	if err != nil || typ == TypeNone || typ == TypeString {
+		return err
+	}
+	_, err = tx.delete(key, typ)
+	return err
+}
+
+// create registers key as a new key of a non-string type and returns the
+// bucket holding its elements
+func (tx *Tx) create(key []byte, typ string) (*bolt.Bucket, error) {
+	tx.touch(key)
+	tx.Notify(EventNew, "new", key)
+	typeBucket, err := tx.bucket("type")
+	if err != nil {
+		return nil, err
+	}
+	err = typeBucket.Put(key, []byte(typ))
+	if err != nil {
+		return nil, err
+	}
+	err = tx.incrStat("keys", 1)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := tx.bucket(typ)
+	if err != nil {
+		return nil, err
+	}
+	return bucket.CreateBucketIfNotExists(key)
+}
+
+// open returns the bucket holding the elements of key, creating the key if
+// create is true. It returns nil if the key does not exist and create is false.
+func (tx *Tx) open(key []byte, typ string, create bool) (*bolt.Bucket, error) {
+	exists, err := tx.checkType(key, typ)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if !create || !tx.tx.Writable() {
+			return nil, nil
+		}
+		return tx.create(key, typ)
+	}
+	bucket, err := tx.bucket(typ)
+	if err != nil {
+		return nil, err
+	}
+	// elements of opened keys are written by the callers
+	tx.touch(key)
+	return bucket.Bucket(key), nil
+}
+
+func (tx *Tx) length(key []byte) (int64, error) {
+	lengthBucket, err := tx.bucket("length")
+	if err != nil || lengthBucket == nil {
+		return 0, err
+	}
+	return MustParseInt(lengthBucket.Get(key)), nil
+}
+
+// setLength records the number of elements of key, deleting the key once
+// it becomes empty
+func (tx *Tx) setLength(key []byte, typ string, n int64) error {
+	if n == 0 {
+		tx.Notify(EventGeneric, "del", key)
+		_, err := tx.delete(key, typ)
+		return err
+	}
+	return tx.putLength(key, n)
+}
+
+// putLength records the number of elements of key, even if it is zero
+func (tx *Tx) putLength(key []byte, n int64) error {
+	lengthBucket, err := tx.bucket("length")
+	if err != nil {
+		return err
+	}
+	return lengthBucket.Put(key, []byte(fmt.Sprintf("%d", n)))
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestExpiredListIsPurged(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+	info, err := db.Info(ctx)
+	g.Expect(err).To(BeNil())
+
+	err = db.Update(ctx, key, func(tx *Tx) error {
+		list, err := tx.OpenList(key, true)
+		if err != nil {
+			return err
+		}
+		err = list.Push(false, []byte("a"), []byte("b"))
+		if err != nil {
+			return err
+		}
+		exp := time.Now().Add(-time.Second)
+		return tx.SetExpiration(key, &exp)
+	})
+	g.Expect(err).To(BeNil())
+
+	err = db.View(ctx, key, func(tx *Tx) error {
+		typ, err := tx.Type(key)
+		g.Expect(typ).To(Equal(TypeNone))
+		return err
+	})
+	g.Expect(err).To(BeNil())
+
+	// a new list starts empty and the stats are not counted twice
+	err = db.Update(ctx, key, func(tx *Tx) error {
+		list, err := tx.OpenList(key, true)
+		if err != nil {
+			return err
+		}
+		g.Expect(list.Len()).To(Equal(int64(0)))
+		return list.Push(false, []byte("c"))
+	})
+	g.Expect(err).To(BeNil())
+	info2, err := db.Info(ctx)
+	g.Expect(err).To(BeNil())
+	g.Expect(info2.Keys).To(Equal(info.Keys + 1))
+	g.Expect(info2.Expires).To(Equal(info.Expires))
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Keys written by a read-write transaction are stamped with a version when
+// the write command completes:
+//
+//	versions: {
+//	    $key: "value of total_write_commands_processed when key was last written"
+//	}
+//
+//	system: {
+//	    deletion_version: "value of total_write_commands_processed when a key was last deleted"
+//	}
+//
+// Versions of deleted keys are removed, so that the bucket does not grow
+// with keys which no longer exist.
+
+// touch records that key is written by the transaction
+func (tx *Tx) touch(key []byte) {
+	if !tx.tx.Writable() {
+		return
+	}
+	if tx.touched == nil {
+		tx.touched = map[string]bool{}
+	}
+	tx.touched[string(key)] = true
+}
+
+// written counts a write command and stamps the keys it touched with a new
+// version. It must be called once by every read-write command.
+func (tx *Tx) written() error {
+	tx.writes++
+	err := tx.incrStat("total_write_commands_processed", 1)
+	if err != nil {
+		return err
+	}
+	if len(tx.touched) == 0 {
+		return nil
+	}
+	systemBucket, err := tx.bucket("system")
+	if err != nil {
+		return err
+	}
+	version := append([]byte{}, systemBucket.Get([]byte("total_write_commands_processed"))...)
+	versionsBucket, err := tx.bucket("versions")
+	if err != nil {
+		return err
+	}
+	if tx.dirty == nil {
+		tx.dirty = map[string]bool{}
+	}
+	for key := range tx.touched {
+		tx.dirty[key] = true
+		typ, err := tx.rawType([]byte(key))
+		if err != nil {
+			return err
+		}
+		if typ != TypeNone {
+			err = versionsBucket.Put([]byte(key), version)
+		} else {
+			err = versionsBucket.Delete([]byte(key))
+			if err == nil {
+				err = systemBucket.Put([]byte("deletion_version"), version)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	tx.touched = nil
+	return nil
+}
+
+// Version returns an opaque token which changes whenever key is written,
+// created, deleted or expires. The token of a missing key also changes when
+// another key of its partition is deleted, which is harmless for optimistic
+// locking.
+func (tx *Tx) Version(key []byte) (string, error) {
+	exists, err := tx.Exists(key)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		systemBucket, err := tx.bucket("system")
+		if err != nil || systemBucket == nil {
+			return "-0", err
+		}
+		return fmt.Sprintf("-%d", MustParseInt(systemBucket.Get([]byte("deletion_version")))), nil
+	}
+	versionsBucket, err := tx.bucket("versions")
+	if err != nil || versionsBucket == nil {
+		return "0", err
+	}
+	return strconv.FormatInt(MustParseInt(versionsBucket.Get(key)), 10), nil
+}
@@ -0,0 +1,477 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Z is a member of a sorted set with its score.
+type Z struct {
+	Score  float64
+	Member []byte
+}
+
+// ScoreBound is a bound of a score range, -inf and +inf are represented by
+// infinite values.
+type ScoreBound struct {
+	Value     float64
+	Exclusive bool
+}
+
+// LexBound is a bound of a lexicographical range of members, Inf is -1 for
+// the "-" bound, 1 for the "+" bound and 0 otherwise.
+type LexBound struct {
+	Value     []byte
+	Exclusive bool
+	Inf       int
+}
+
+// ZSet is a handle on the members of a sorted set key.
+//
+// The bucket of the key holds two buckets:
+//
+//	score: {
+//	    memberKey($member): "score as 8 bytes IEEE 754"
+//	}
+//
+//	index: {
+//	    $score$member: ""
+//	}
+//
+// where index keys start with the score encoded so that byte order matches
+// numerical order, so that ranges by score or rank are cursor scans.
+type ZSet struct {
+	tx     *Tx
+	key    []byte
+	scores *bolt.Bucket
+	index  *bolt.Bucket
+	len    int64
+}
+
+// OpenZSet returns the sorted set stored at key, creating an empty one if
+// create is true. It returns nil if the key does not exist and create is
+// false, and ErrWrongType if the key holds another type.
+func (tx *Tx) OpenZSet(key []byte, create bool) (*ZSet, error) {
+	bucket, err := tx.open(key, TypeZSet, create)
+	if err != nil || bucket == nil {
+		return nil, err
+	}
+	z := &ZSet{
+		tx:     tx,
+		key:    key,
+		scores: bucket.Bucket([]byte("score")),
+		index:  bucket.Bucket([]byte("index")),
+	}
+	if z.scores == nil {
+		z.scores, err = bucket.CreateBucket([]byte("score"))
+		if err != nil {
+			return nil, err
+		}
+		z.index, err = bucket.CreateBucket([]byte("index"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	z.len, err = tx.length(key)
+	if err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// EncodeScore encodes score into 8 bytes whose byte order matches the
+// numerical order of scores.
+func EncodeScore(score float64) []byte {
+	bits := math.Float64bits(score)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, bits)
+	return b
+}
+
+// DecodeScore is the inverse of EncodeScore.
+func DecodeScore(b []byte) float64 {
+	bits := binary.BigEndian.Uint64(b)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
+
+func indexKey(score float64, member []byte) []byte {
+	return append(EncodeScore(score), member...)
+}
+
+func decodeIndexKey(k []byte) Z {
+	return Z{
+		Score:  DecodeScore(k[:8]),
+		Member: append([]byte{}, k[8:]...),
+	}
+}
+
+// Len returns the number of members of the sorted set.
+func (z *ZSet) Len() int64 {
+	return z.len
+}
+
+func (z *ZSet) setLen(n int64) error {
+	z.len = n
+	return z.tx.setLength(z.key, TypeZSet, n)
+}
+
+// Score returns the score of member, or false if it is not a member.
+func (z *ZSet) Score(member []byte) (float64, bool) {
+	b := z.scores.Get(memberKey(member))
+	if b == nil {
+		return 0, false
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b)), true
+}
+
+// Add sets the score of member, adding it if needed, and reports whether
+// it was added. Callers notify the event of the command, zadd or zincr, once
+// for all its members.
+func (z *ZSet) Add(member []byte, score float64) (bool, error) {
+	if score == 0 {
+		// -0 and 0 are the same score
+		score = 0
+	}
+	prev, exists := z.Score(member)
+	if exists {
+		if prev == score {
+			return false, nil
+		}
+		err := z.index.Delete(indexKey(prev, member))
+		if err != nil {
+			return false, err
+		}
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(score))
+	err := z.scores.Put(memberKey(member), b)
+	if err != nil {
+		return false, err
+	}
+	err = z.index.Put(indexKey(score, member), []byte{})
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+	return true, z.setLen(z.len + 1)
+}
+
+// Rem removes members and returns the number of removed members.
+func (z *ZSet) Rem(members ...[]byte) (int64, error) {
+	removed, err := z.remove(members)
+	if err != nil || removed == 0 {
+		return 0, err
+	}
+	z.tx.Notify(EventZSet, "zrem", z.key)
+	return removed, z.setLen(z.len - removed)
+}
+
+// remove removes members without updating the length of the sorted set, and
+// returns the number of removed members
+func (z *ZSet) remove(members [][]byte) (int64, error) {
+	removed := int64(0)
+	for _, member := range members {
+		score, ok := z.Score(member)
+		if !ok {
+			continue
+		}
+		err := z.index.Delete(indexKey(score, member))
+		if err != nil {
+			return 0, err
+		}
+		err = z.scores.Delete(memberKey(member))
+		if err != nil {
+			return 0, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Rank returns the rank of member, from the lowest score or from the highest
+// if rev is true, or false if it is not a member.
+func (z *ZSet) Rank(member []byte, rev bool) (int64, bool) {
+	score, ok := z.Score(member)
+	if !ok {
+		return 0, false
+	}
+	target := indexKey(score, member)
+	rank := int64(0)
+	c := z.index.Cursor()
+	for k, _ := c.First(); k != nil && !bytes.Equal(k, target); k, _ = c.Next() {
+		rank++
+	}
+	if rev {
+		return z.len - 1 - rank, true
+	}
+	return rank, true
+}
+
+// scan iterates over the index from the lowest score, or from the highest
+// if rev is true, starting at seek if it is not nil, until fn returns false
+func (z *ZSet) scan(rev bool, seek []byte, fn func(k []byte) bool) {
+	c := z.index.Cursor()
+	var k []byte
+	switch {
+	case seek == nil && !rev:
+		k, _ = c.First()
+	case seek == nil && rev:
+		k, _ = c.Last()
+	case !rev:
+		k, _ = c.Seek(seek)
+	default:
+		// the last key lower than or equal to seek
+		k, _ = c.Seek(seek)
+		if k == nil {
+			k, _ = c.Last()
+		} else if bytes.Compare(k, seek) > 0 {
+			k, _ = c.Prev()
+		}
+	}
+	for ; k != nil && fn(k); k = nextKey(c, rev) {
+	}
+}
+
+func nextKey(c *bolt.Cursor, rev bool) []byte {
+	var k []byte
+	if rev {
+		k, _ = c.Prev()
+	} else {
+		k, _ = c.Next()
+	}
+	return k
+}
+
+// RangeByRank returns the members with ranks between start and stop,
+// inclusive, with negative ranks counting from the end as in ZRANGE.
+func (z *ZSet) RangeByRank(start, stop int64, rev bool) []Z {
+	res := []Z{}
+	if start < 0 {
+		start += z.len
+	}
+	if stop < 0 {
+		stop += z.len
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= z.len {
+		stop = z.len - 1
+	}
+	if start > stop || start >= z.len {
+		return res
+	}
+	rank := int64(0)
+	z.scan(rev, nil, func(k []byte) bool {
+		if rank >= start {
+			res = append(res, decodeIndexKey(k))
+		}
+		rank++
+		return rank <= stop
+	})
+	return res
+}
+
+func (b ScoreBound) lowerThan(score float64) bool {
+	if b.Exclusive {
+		return b.Value < score
+	}
+	return b.Value <= score
+}
+
+func (b ScoreBound) greaterThan(score float64) bool {
+	if b.Exclusive {
+		return b.Value > score
+	}
+	return b.Value >= score
+}
+
+// limit applies offset and count to a scan, a negative count means no limit
+type limit struct {
+	offset int64
+	count  int64
+}
+
+// accept reports whether the next matching element is part of the result,
+// and whether the scan should go on after it
+func (l *limit) accept() (bool, bool) {
+	if l.offset > 0 {
+		l.offset--
+		return false, true
+	}
+	if l.count == 0 {
+		return false, false
+	}
+	if l.count > 0 {
+		l.count--
+	}
+	return true, l.count != 0
+}
+
+// RangeByScore returns the members with scores between min and max, from
+// the lowest score or from the highest if rev is true, skipping offset
+// members and returning at most count members if count is not negative.
+func (z *ZSet) RangeByScore(min, max ScoreBound, rev bool, offset, count int64) []Z {
+	res := []Z{}
+	l := &limit{offset: offset, count: count}
+	if count == 0 {
+		return res
+	}
+	seek := EncodeScore(min.Value)
+	if rev {
+		// members scored above max are skipped below
+		seek = EncodeScore(math.Nextafter(max.Value, math.Inf(1)))
+		if math.IsInf(max.Value, 1) {
+			seek = nil
+		}
+	}
+	z.scan(rev, seek, func(k []byte) bool {
+		score := DecodeScore(k[:8])
+		if !rev && !max.greaterThan(score) || rev && !min.lowerThan(score) {
+			return false
+		}
+		if !min.lowerThan(score) || !max.greaterThan(score) {
+			return true
+		}
+		ok, more := l.accept()
+		if ok {
+			res = append(res, decodeIndexKey(k))
+		}
+		return more
+	})
+	return res
+}
+
+func (b LexBound) lowerThan(member []byte) bool {
+	switch b.Inf {
+	case -1:
+		return true
+	case 1:
+		return false
+	}
+	c := bytes.Compare(b.Value, member)
+	return c < 0 || c == 0 && !b.Exclusive
+}
+
+func (b LexBound) greaterThan(member []byte) bool {
+	switch b.Inf {
+	case -1:
+		return false
+	case 1:
+		return true
+	}
+	c := bytes.Compare(b.Value, member)
+	return c > 0 || c == 0 && !b.Exclusive
+}
+
+// RangeByLex returns the members between min and max in lexicographical
+// order, or reverse order if rev is true, with offset and count as in
+// RangeByScore. As in Redis, all members are expected to have the same
+// score.
+func (z *ZSet) RangeByLex(min, max LexBound, rev bool, offset, count int64) []Z {
+	res := []Z{}
+	l := &limit{offset: offset, count: count}
+	if count == 0 {
+		return res
+	}
+	var seek []byte
+	if first, _ := z.index.Cursor().First(); first != nil {
+		// all members share the score of the first one
+		if !rev && min.Inf == 0 {
+			seek = append(append([]byte{}, first[:8]...), min.Value...)
+		}
+		if rev && max.Inf == 0 {
+			seek = append(append([]byte{}, first[:8]...), max.Value...)
+		}
+	}
+	z.scan(rev, seek, func(k []byte) bool {
+		member := k[8:]
+		if !rev && !max.greaterThan(member) || rev && !min.lowerThan(member) {
+			return false
+		}
+		if !min.lowerThan(member) || !max.greaterThan(member) {
+			return true
+		}
+		ok, more := l.accept()
+		if ok {
+			res = append(res, decodeIndexKey(k))
+		}
+		return more
+	})
+	return res
+}
+
+// Pop removes and returns up to count members with the lowest scores, or the
+// highest if max is true.
+func (z *ZSet) Pop(max bool, count int64) ([]Z, error) {
+	res := z.RangeByRank(0, count-1, max)
+	if len(res) == 0 {
+		return res, nil
+	}
+	members := make([][]byte, len(res))
+	for i, m := range res {
+		members[i] = m.Member
+	}
+	removed, err := z.remove(members)
+	if err != nil {
+		return nil, err
+	}
+	z.tx.Notify(EventZSet, sideEvent(!max, "zpopmin", "zpopmax"), z.key)
+	return res, z.setLen(z.len - removed)
+}
+
+// RandMembers returns count random members. Members are distinct if count is
+// positive, and may repeat if it is negative, as in ZRANDMEMBER.
+func (z *ZSet) RandMembers(count int64) []Z {
+	ranks := []int64{}
+	if count >= 0 {
+		if count > z.len {
+			count = z.len
+		}
+		picked := map[int64]bool{}
+		for int64(len(picked)) < count {
+			picked[rand.Int63n(z.len)] = true
+		}
+		for rank := range picked {
+			ranks = append(ranks, rank)
+		}
+	} else {
+		for i := int64(0); i < -count && z.len > 0; i++ {
+			ranks = append(ranks, rand.Int63n(z.len))
+		}
+	}
+	sort.Slice(ranks, func(i, j int) bool { return ranks[i] < ranks[j] })
+	res := []Z{}
+	rank := int64(0)
+	z.scan(false, nil, func(k []byte) bool {
+		for len(res) < len(ranks) && ranks[len(res)] == rank {
+			res = append(res, decodeIndexKey(k))
+		}
+		rank++
+		return len(res) < len(ranks)
+	})
+	rand.Shuffle(len(res), func(i, j int) { res[i], res[j] = res[j], res[i] })
+	return res
+}
+
+// Members returns all members with their scores, from the lowest score.
+func (z *ZSet) Members() []Z {
+	return z.RangeByRank(0, -1, false)
+}
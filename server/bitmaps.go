@@ -0,0 +1,512 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+// maxBitOffset is the largest bit offset of a string of 512MB, the maximum
+// size of a Redis string
+const maxBitOffset = 512*1024*1024*8 - 1
+
+var errBitOffset = fmt.Errorf("ERR bit offset is not an integer or out of range")
+
+// getBit returns the bit at offset, bit 0 being the most significant bit of
+// the first byte as in Redis
+func getBit(val []byte, offset int64) int64 {
+	if offset/8 >= int64(len(val)) {
+		return 0
+	}
+	return int64(val[offset/8]>>(7-offset%8)) & 1
+}
+
+func setBit(val []byte, offset int64, bit int64) {
+	if bit == 0 {
+		val[offset/8] &^= 1 << (7 - offset%8)
+	} else {
+		val[offset/8] |= 1 << (7 - offset%8)
+	}
+}
+
+// grow pads val with zero bytes so that it holds at least n bits
+func grow(val []byte, n int64) []byte {
+	size := (n + 7) / 8
+	if int64(len(val)) >= size {
+		return val
+	}
+	return append(val, make([]byte, size-int64(len(val)))...)
+}
+
+// SetBit sets the bit at offset of the string stored at key, growing the
+// string as needed, and returns the previous bit.
+func (c *Server) SetBit(ctx context.Context, key []byte, offset int64, value int64) (int64, error) {
+	ctx = withCommand(ctx, "SETBIT", key, offset, value)
+	if offset < 0 || offset > math.MaxUint32 {
+		return 0, errBitOffset
+	}
+	if value != 0 && value != 1 {
+		return 0, fmt.Errorf("ERR bit is not an integer or out of range")
+	}
+	prev := int64(0)
+	err := c.update(ctx, key, func(tx *db.Tx) error {
+		val, _, err := tx.Get(key)
+		if err != nil {
+			return err
+		}
+		prev = getBit(val, offset)
+		if val != nil && prev == value && offset/8 < int64(len(val)) {
+			return errNoop
+		}
+		tx.Notify(db.EventString, "setbit", key)
+		return tx.Set(key, func(val []byte, exp *time.Time) ([]byte, *time.Time, error) {
+			val = grow(val, offset+1)
+			setBit(val, offset, value)
+			return val, exp, nil
+		})
+	})
+	return prev, err
+}
+
+// GetBit returns the bit at offset of the string stored at key.
+func (c *Server) GetBit(ctx context.Context, key []byte, offset int64) (int64, error) {
+	if offset < 0 || offset > math.MaxUint32 {
+		return 0, errBitOffset
+	}
+	val, err := c.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return getBit(val, offset), nil
+}
+
+// BitRange restricts BITCOUNT and BITPOS to the bytes, or bits if Bit is
+// true, between Start and End inclusive. Negative indexes count from the
+// end of the string. A nil End means the end of the string.
+type BitRange struct {
+	Start int64
+	End   *int64
+	Bit   bool
+}
+
+// bounds returns the first and last bit of the range in a string of size
+// bytes, or false if the range is empty
+func (r *BitRange) bounds(size int64) (int64, int64, bool) {
+	if r == nil {
+		return 0, size*8 - 1, size > 0
+	}
+	n := size
+	if r.Bit {
+		n = size * 8
+	}
+	start := r.Start
+	end := n - 1
+	if r.End != nil {
+		end = *r.End
+	}
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+	if start > end || n == 0 {
+		return 0, 0, false
+	}
+	if r.Bit {
+		return start, end, true
+	}
+	return start * 8, end*8 + 7, true
+}
+
+// BitCount returns the number of set bits of the string stored at key,
+// within r if it is not nil.
+func (c *Server) BitCount(ctx context.Context, key []byte, r *BitRange) (int64, error) {
+	val, err := c.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	start, end, ok := r.bounds(int64(len(val)))
+	if !ok {
+		return 0, nil
+	}
+	n := int64(0)
+	for i := start; i <= end; {
+		if i%8 == 0 && i+7 <= end {
+			n += int64(bits.OnesCount8(val[i/8]))
+			i += 8
+			continue
+		}
+		n += getBit(val, i)
+		i++
+	}
+	return n, nil
+}
+
+// BitPos returns the position of the first bit set to bit in the string
+// stored at key, within r if it is not nil, or -1 if there is none. As in
+// Redis, a string is considered padded with zeros on the right when looking
+// for a clear bit without an explicit end.
+func (c *Server) BitPos(ctx context.Context, key []byte, bit int64, r *BitRange) (int64, error) {
+	if bit != 0 && bit != 1 {
+		return 0, fmt.Errorf("ERR The bit argument must be 1 or 0.")
+	}
+	val, err := c.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if val == nil {
+		if bit == 0 {
+			return 0, nil
+		}
+		return -1, nil
+	}
+	start, end, ok := r.bounds(int64(len(val)))
+	if !ok {
+		return -1, nil
+	}
+	// the byte which holds only bits that do not match
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xff
+	}
+	for i := start; i <= end; {
+		if i%8 == 0 && i+7 <= end && val[i/8] == skip {
+			i += 8
+			continue
+		}
+		if getBit(val, i) == bit {
+			return i, nil
+		}
+		i++
+	}
+	if bit == 0 && (r == nil || r.End == nil) {
+		return end + 1, nil
+	}
+	return -1, nil
+}
+
+// BitOp performs the bitwise operation op, one of AND, OR, XOR and NOT,
+// between the strings stored at keys and stores the result in destination.
+// Shorter strings are padded with zeros. It returns the size of the result,
+// and deletes destination if it is empty.
+func (c *Server) BitOp(ctx context.Context, op string, destination []byte, keys ...[]byte) (int64, error) {
+	ctx = withCommand(ctx, "BITOP", op, destination, keys)
+	op = strings.ToUpper(op)
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(keys) != 1 {
+			return 0, fmt.Errorf("ERR BITOP NOT must be called with a single source key.")
+		}
+	default:
+		return 0, errSyntax
+	}
+	if len(keys) == 0 {
+		return 0, fmt.Errorf("ERR wrong number of arguments for 'bitop' command")
+	}
+	n := int64(0)
+	err := c.updateKeys(ctx, append([][]byte{destination}, keys...), func(m *db.MultiTx) error {
+		values := [][]byte{}
+		for _, key := range keys {
+			val, _, err := m.Tx(key).Get(key)
+			if err != nil {
+				return err
+			}
+			values = append(values, val)
+			if int64(len(val)) > n {
+				n = int64(len(val))
+			}
+		}
+		res := make([]byte, n)
+		for i := range res {
+			b := byteAt(values[0], i)
+			for _, val := range values[1:] {
+				switch op {
+				case "AND":
+					b &= byteAt(val, i)
+				case "OR":
+					b |= byteAt(val, i)
+				case "XOR":
+					b ^= byteAt(val, i)
+				}
+			}
+			if op == "NOT" {
+				b = ^b
+			}
+			res[i] = b
+		}
+		tx := m.Tx(destination)
+		if n == 0 {
+			_, err := tx.Delete(destination)
+			return err
+		}
+		return tx.Put(destination, res, nil)
+	})
+	return n, err
+}
+
+func byteAt(val []byte, i int) byte {
+	if i < len(val) {
+		return val[i]
+	}
+	return 0
+}
+
+// BitFieldOp is an operation of BITFIELD.
+//
+// Op is one of GET, SET, INCRBY and OVERFLOW. Encoding is a signed or
+// unsigned integer type such as i5 or u16, and Offset is a bit offset, or a
+// multiple of the width of the encoding if prefixed by #. Value is the value
+// of SET or the increment of INCRBY. Overflow is one of WRAP, SAT and FAIL,
+// and applies to the following SET and INCRBY operations.
+type BitFieldOp struct {
+	Op       string
+	Encoding string
+	Offset   string
+	Value    int64
+	Overflow string
+}
+
+// bitField is a parsed BitFieldOp
+type bitField struct {
+	op       string
+	signed   bool
+	bits     uint
+	offset   int64
+	value    int64
+	overflow string
+}
+
+func parseBitField(op BitFieldOp) (*bitField, error) {
+	f := &bitField{op: strings.ToUpper(op.Op), value: op.Value}
+	switch f.op {
+	case "GET", "SET", "INCRBY":
+	case "OVERFLOW":
+		f.overflow = strings.ToUpper(op.Overflow)
+		switch f.overflow {
+		case "WRAP", "SAT", "FAIL":
+			return f, nil
+		}
+		return nil, fmt.Errorf("ERR Invalid OVERFLOW type specified")
+	default:
+		return nil, errSyntax
+	}
+	errType := fmt.Errorf("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	if len(op.Encoding) < 2 {
+		return nil, errType
+	}
+	width, err := strconv.ParseUint(op.Encoding[1:], 10, 8)
+	if err != nil {
+		return nil, errType
+	}
+	switch op.Encoding[0] {
+	case 'i', 'I':
+		f.signed = true
+		if width < 1 || width > 64 {
+			return nil, errType
+		}
+	case 'u', 'U':
+		if width < 1 || width > 63 {
+			return nil, errType
+		}
+	default:
+		return nil, errType
+	}
+	f.bits = uint(width)
+	offset := op.Offset
+	multiply := strings.HasPrefix(offset, "#")
+	if multiply {
+		offset = offset[1:]
+	}
+	f.offset, err = strconv.ParseInt(offset, 10, 64)
+	if err != nil || f.offset < 0 {
+		return nil, errBitOffset
+	}
+	if multiply {
+		if f.offset > maxBitOffset/int64(f.bits) {
+			return nil, errBitOffset
+		}
+		f.offset *= int64(f.bits)
+	}
+	if f.offset > maxBitOffset-int64(f.bits)+1 {
+		return nil, errBitOffset
+	}
+	return f, nil
+}
+
+// get returns the value of the field in val
+func (f *bitField) get(val []byte) int64 {
+	u := uint64(0)
+	for i := int64(0); i < int64(f.bits); i++ {
+		u = u<<1 | uint64(getBit(val, f.offset+i))
+	}
+	if f.signed && f.bits < 64 && u&(1<<(f.bits-1)) != 0 {
+		u |= math.MaxUint64 << f.bits
+	}
+	return int64(u)
+}
+
+// set writes v into the field, val must be large enough
+func (f *bitField) set(val []byte, v int64) {
+	u := uint64(v)
+	for i := int64(0); i < int64(f.bits); i++ {
+		setBit(val, f.offset+i, int64(u>>(int64(f.bits)-1-i))&1)
+	}
+}
+
+// add returns value+incr according to the overflow mode, or false if it
+// overflows in FAIL mode. It follows the overflow checks of Redis.
+func (f *bitField) add(value, incr int64, overflow string) (int64, bool) {
+	wrapped := uint64(value) + uint64(incr)
+	var max, min int64
+	var over, under bool
+	if f.signed {
+		max = int64(1)<<(f.bits-1) - 1
+		if f.bits == 64 {
+			max = math.MaxInt64
+		}
+		min = -max - 1
+		maxIncr := max - value
+		minIncr := min - value
+		over = value > max || f.bits != 64 && incr > maxIncr || value >= 0 && incr > 0 && incr > maxIncr
+		under = value < min || f.bits != 64 && incr < minIncr || value < 0 && incr < 0 && incr < minIncr
+		if f.bits < 64 {
+			mask := uint64(math.MaxUint64) << f.bits
+			if wrapped&(1<<(f.bits-1)) != 0 {
+				wrapped |= mask
+			} else {
+				wrapped &^= mask
+			}
+		}
+	} else {
+		max = int64(1)<<f.bits - 1
+		// value is unsigned and below 2^63, the increment may be negative
+		over = uint64(value) > uint64(max) || incr > 0 && incr > max-value
+		under = incr < 0 && incr < -value
+		wrapped &= uint64(max)
+	}
+	if !over && !under {
+		return value + incr, true
+	}
+	switch overflow {
+	case "FAIL":
+		return 0, false
+	case "SAT":
+		if over {
+			return max, true
+		}
+		return min, true
+	}
+	return int64(wrapped), true
+}
+
+// BitField runs operations on integer fields of arbitrary width of the
+// string stored at key, and returns the result of each GET, SET and INCRBY
+// operation, nil for operations which failed with OVERFLOW FAIL.
+func (c *Server) BitField(ctx context.Context, key []byte, ops ...BitFieldOp) ([]*int64, error) {
+	ctx = withCommand(ctx, "BITFIELD", key, bitFieldArgs(ops))
+	fields := []*bitField{}
+	write := false
+	for _, op := range ops {
+		f, err := parseBitField(op)
+		if err != nil {
+			return nil, err
+		}
+		write = write || f.op == "SET" || f.op == "INCRBY"
+		fields = append(fields, f)
+	}
+	res := []*int64{}
+	run := func(val []byte) []byte {
+		overflow := "WRAP"
+		for _, f := range fields {
+			if f.op == "OVERFLOW" {
+				overflow = f.overflow
+				continue
+			}
+			if f.op != "GET" {
+				val = grow(val, f.offset+int64(f.bits))
+			}
+			old := f.get(val)
+			switch f.op {
+			case "GET":
+				res = append(res, &old)
+			case "SET":
+				v, ok := f.add(f.value, 0, overflow)
+				if !ok {
+					res = append(res, nil)
+					continue
+				}
+				f.set(val, v)
+				res = append(res, &old)
+			case "INCRBY":
+				v, ok := f.add(old, f.value, overflow)
+				if !ok {
+					res = append(res, nil)
+					continue
+				}
+				f.set(val, v)
+				res = append(res, &v)
+			}
+		}
+		return val
+	}
+	if !write {
+		val, err := c.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		run(val)
+		return res, nil
+	}
+	err := c.update(ctx, key, func(tx *db.Tx) error {
+		tx.Notify(db.EventString, "setbit", key)
+		return tx.Set(key, func(val []byte, exp *time.Time) ([]byte, *time.Time, error) {
+			return run(val), exp, nil
+		})
+	})
+	return res, err
+}
+
+// BitFieldRO is the read-only variant of BitField, which only accepts GET
+// operations.
+func (c *Server) BitFieldRO(ctx context.Context, key []byte, ops ...BitFieldOp) ([]*int64, error) {
+	for _, op := range ops {
+		if strings.ToUpper(op.Op) != "GET" {
+			return nil, fmt.Errorf("ERR BITFIELD_RO only supports the GET subcommand")
+		}
+	}
+	return c.BitField(ctx, key, ops...)
+}
+
+// bitFieldArgs returns ops as the arguments of BITFIELD following the key
+func bitFieldArgs(ops []BitFieldOp) [][]byte {
+	args := [][]byte{}
+	for _, op := range ops {
+		args = append(args, []byte(op.Op))
+		switch strings.ToUpper(op.Op) {
+		case "OVERFLOW":
+			args = append(args, []byte(op.Overflow))
+		case "GET":
+			args = append(args, []byte(op.Encoding), []byte(op.Offset))
+		default:
+			args = append(args, []byte(op.Encoding), []byte(op.Offset), []byte(strconv.FormatInt(op.Value, 10)))
+		}
+	}
+	return args
+}
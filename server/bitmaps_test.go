@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func int64s(res []*int64) []interface{} {
+	values := []interface{}{}
+	for _, v := range res {
+		if v == nil {
+			values = append(values, nil)
+		} else {
+			values = append(values, *v)
+		}
+	}
+	return values
+}
+
+func TestBitmaps(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	prev, err := server.SetBit(ctx, key, 7, 1)
+	g.Expect(err).To(BeNil())
+	g.Expect(prev).To(Equal(int64(0)))
+	prev, err = server.SetBit(ctx, key, 7, 1)
+	g.Expect(err).To(BeNil())
+	g.Expect(prev).To(Equal(int64(1)))
+	_, err = server.SetBit(ctx, key, 17, 1)
+	g.Expect(err).To(BeNil())
+	val, err := server.Get(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(val).To(Equal([]byte{0x01, 0x00, 0x40}))
+	bit, err := server.GetBit(ctx, key, 17)
+	g.Expect(err).To(BeNil())
+	g.Expect(bit).To(Equal(int64(1)))
+	_, err = server.SetBit(ctx, key, -1, 1)
+	g.Expect(err).NotTo(BeNil())
+
+	err = server.Set(ctx, key, []byte("foobar"), nil)
+	g.Expect(err).To(BeNil())
+	n, err := server.BitCount(ctx, key, nil)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(26)))
+	end := int64(1)
+	n, err = server.BitCount(ctx, key, &BitRange{Start: 1, End: &end})
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(6)))
+	end = 30
+	n, err = server.BitCount(ctx, key, &BitRange{Start: 5, End: &end, Bit: true})
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(17)))
+
+	err = server.Set(ctx, key, []byte{0xff, 0xf0, 0x00}, nil)
+	g.Expect(err).To(BeNil())
+	pos, err := server.BitPos(ctx, key, 0, nil)
+	g.Expect(err).To(BeNil())
+	g.Expect(pos).To(Equal(int64(12)))
+	pos, err = server.BitPos(ctx, key, 1, &BitRange{Start: 2})
+	g.Expect(err).To(BeNil())
+	g.Expect(pos).To(Equal(int64(-1)))
+	err = server.Set(ctx, key, []byte{0xff, 0xff}, nil)
+	g.Expect(err).To(BeNil())
+	pos, err = server.BitPos(ctx, key, 0, nil)
+	g.Expect(err).To(BeNil())
+	g.Expect(pos).To(Equal(int64(16)))
+	end = -1
+	pos, err = server.BitPos(ctx, key, 0, &BitRange{End: &end})
+	g.Expect(err).To(BeNil())
+	g.Expect(pos).To(Equal(int64(-1)))
+}
+
+func TestBitOp(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	a := []byte(uuid.NewString())
+	b := []byte(uuid.NewString())
+	dst := []byte(uuid.NewString())
+
+	g.Expect(server.Set(ctx, a, []byte("foobar"), nil)).To(BeNil())
+	g.Expect(server.Set(ctx, b, []byte("abcdef"), nil)).To(BeNil())
+	n, err := server.BitOp(ctx, "AND", dst, a, b)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(6)))
+	val, err := server.Get(ctx, dst)
+	g.Expect(err).To(BeNil())
+	g.Expect(string(val)).To(Equal("`bc`ab"))
+	_, err = server.BitOp(ctx, "NOT", dst, a, b)
+	g.Expect(err).To(Equal(fmt.Errorf("ERR BITOP NOT must be called with a single source key.")))
+	_, err = server.BitOp(ctx, "NAND", dst, a, b)
+	g.Expect(err).To(Equal(errSyntax))
+	n, err = server.BitOp(ctx, "OR", dst, []byte(uuid.NewString()))
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(0)))
+	val, err = server.Get(ctx, dst)
+	g.Expect(err).To(BeNil())
+	g.Expect(val).To(BeNil())
+}
+
+func TestBitField(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	res, err := server.BitField(ctx, key,
+		BitFieldOp{Op: "SET", Encoding: "i8", Offset: "0", Value: 100},
+		BitFieldOp{Op: "GET", Encoding: "u4", Offset: "0"},
+		BitFieldOp{Op: "INCRBY", Encoding: "i8", Offset: "0", Value: 100},
+		BitFieldOp{Op: "OVERFLOW", Overflow: "SAT"},
+		BitFieldOp{Op: "INCRBY", Encoding: "u2", Offset: "#4", Value: 7},
+		BitFieldOp{Op: "OVERFLOW", Overflow: "FAIL"},
+		BitFieldOp{Op: "INCRBY", Encoding: "i8", Offset: "0", Value: -100},
+		BitFieldOp{Op: "INCRBY", Encoding: "u2", Offset: "#4", Value: 1},
+	)
+	g.Expect(err).To(BeNil())
+	g.Expect(int64s(res)).To(Equal([]interface{}{int64(0), int64(6), int64(-56), int64(3), nil, nil}))
+	val, err := server.Get(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(val).To(Equal([]byte{0xc8, 0xc0}))
+
+	res, err = server.BitFieldRO(ctx, key, BitFieldOp{Op: "GET", Encoding: "i64", Offset: "0"})
+	g.Expect(err).To(BeNil())
+	g.Expect(int64s(res)).To(Equal([]interface{}{int64(-0x3740000000000000)}))
+	_, err = server.BitFieldRO(ctx, key, BitFieldOp{Op: "SET", Encoding: "i8", Offset: "0"})
+	g.Expect(err).NotTo(BeNil())
+	_, err = server.BitField(ctx, key, BitFieldOp{Op: "GET", Encoding: "u64", Offset: "0"})
+	g.Expect(err).NotTo(BeNil())
+}
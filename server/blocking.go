@@ -0,0 +1,381 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+// blockingPollInterval is how often blocked clients check their keys when
+// other processes may write them, in case the fan-out missed a write
+const blockingPollInterval = time.Second
+
+// unblockingEvents are the events which may serve a blocked client
+var unblockingEvents = map[string]bool{
+	"lpush":     true,
+	"rpush":     true,
+	"zadd":      true,
+	"zincr":     true,
+	"xadd":      true,
+	"rename_to": true,
+	"move_to":   true,
+	"copy_to":   true,
+}
+
+// blockedKey is a key of a logical database on which clients are blocked
+type blockedKey struct {
+	db  int
+	key string
+}
+
+// waiter is a client blocked on keys
+type waiter struct {
+	db   int
+	keys [][]byte
+	wake chan struct{}
+}
+
+// blocking holds the clients blocked on keys by BLPOP and the like, in the
+// order they blocked. A write to a key wakes the first of them, which wakes
+// the next one once served, so that clients are served in FIFO order.
+type blocking struct {
+	mu      sync.Mutex
+	waiters map[blockedKey][]*waiter
+	poll    time.Duration // zero if no other process writes
+}
+
+func newBlocking(poll time.Duration) *blocking {
+	return &blocking{waiters: map[blockedKey][]*waiter{}, poll: poll}
+}
+
+func (b *blocking) park(index int, keys [][]byte) *waiter {
+	w := &waiter{db: index, keys: keys, wake: make(chan struct{}, 1)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, key := range keys {
+		k := blockedKey{index, string(key)}
+		b.waiters[k] = append(b.waiters[k], w)
+	}
+	return w
+}
+
+// leave removes a waiter, and passes the wake-up on to the next waiters if it
+// was served or if it was woken in vain
+func (b *blocking) leave(w *waiter, served bool) {
+	b.mu.Lock()
+	for _, key := range w.keys {
+		k := blockedKey{w.db, string(key)}
+		waiters := b.waiters[k]
+		for i, other := range waiters {
+			if other == w {
+				waiters = append(waiters[:i:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(b.waiters, k)
+		} else {
+			b.waiters[k] = waiters
+		}
+	}
+	b.mu.Unlock()
+	if served || len(w.wake) > 0 {
+		for _, key := range w.keys {
+			b.signal(w.db, key)
+		}
+	}
+}
+
+// signal wakes the first client blocked on key
+func (b *blocking) signal(index int, key []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	waiters := b.waiters[blockedKey{index, string(key)}]
+	if len(waiters) == 0 {
+		return
+	}
+	select {
+	case waiters[0].wake <- struct{}{}:
+	default:
+	}
+}
+
+// onWrite invalidates the key of an event in the client side caches, wakes
+// the clients blocked on it, and forwards the event to the other processes
+// for their clients
+func (c *Server) onWrite(e db.Event) {
+	if e.Class == db.EventNew {
+		// the write creating the key has its own event
+		return
+	}
+	c.invalidateKey(e.Key)
+	if !unblockingEvents[e.Name] {
+		if c.pubsub.fanout != nil {
+			c.pubsub.fanout.send(context.Background(), [][]byte{[]byte("s3dis.invalidate"), e.Key})
+		}
+		return
+	}
+	c.blocking.signal(e.DB, e.Key)
+	if c.pubsub.fanout != nil {
+		index := []byte(strconv.Itoa(e.DB))
+		c.pubsub.fanout.send(context.Background(), [][]byte{[]byte("s3dis.signal"), index, e.Key})
+	}
+}
+
+// cmdSignal implements S3DIS.SIGNAL db key, sent by the other processes
+// when they write a key, which wakes the clients of this process blocked on
+// it and invalidates it like S3DIS.INVALIDATE
+func cmdSignal(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	index, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return errNotInteger
+	}
+	c.invalidateKey(args[1])
+	c.blocking.signal(index, args[1])
+	cl.w.writeSimple("OK")
+	return nil
+}
+
+// block calls try until it succeeds, waiting for writes to keys between
+// attempts, and reports whether try succeeded before timeout, zero waiting
+// forever. Within MULTI or scripts try is only called once, like in Redis.
+func (c *Server) block(ctx context.Context, keys [][]byte, timeout time.Duration, try func() (bool, error)) (bool, error) {
+	if inTransaction(ctx) {
+		return try()
+	}
+	// other clients may run transactions while this one waits
+	if ctx.Value(keyspaceContextKey{}) != nil {
+		c.keyspace.RUnlock()
+		defer c.keyspace.RLock()
+	}
+	b := c.blocking
+	w := b.park(c.db.Index(), keys)
+	served := false
+	defer func() {
+		b.leave(w, served)
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var poll <-chan time.Time
+	if b.poll > 0 {
+		ticker := time.NewTicker(b.poll)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	for {
+		var err error
+		served, err = try()
+		if served || err != nil {
+			return served, err
+		}
+		select {
+		case <-w.wake:
+		case <-poll:
+		case <-expired:
+			return false, nil
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// whileBlocked returns a context which is canceled if the client disconnects
+// while a command blocks. The returned function must be called before the
+// next command is read.
+func (cl *client) whileBlocked(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	if inTransaction(ctx) {
+		return ctx, cancel
+	}
+	cl.setBlocked(true)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// pipelined commands are left buffered for the next reads
+		_, err := cl.r.Peek(1)
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+	}()
+	return ctx, func() {
+		cl.conn.SetReadDeadline(time.Now())
+		<-done
+		cl.conn.SetReadDeadline(time.Time{})
+		cancel()
+		cl.setBlocked(false)
+	}
+}
+
+// parseTimeout parses the timeout of a blocking command in seconds
+func parseTimeout(arg []byte) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil {
+		return 0, errors.New("ERR timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return 0, errors.New("ERR timeout is negative")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func cmdBLPop(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	return c.cmdBPop(ctx, cl, args, true)
+}
+
+func cmdBRPop(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	return c.cmdBPop(ctx, cl, args, false)
+}
+
+func (c *Server) cmdBPop(ctx context.Context, cl *client, args [][]byte, left bool) error {
+	timeout, err := parseTimeout(args[len(args)-1])
+	if err != nil {
+		return err
+	}
+	ctx, done := cl.whileBlocked(ctx)
+	defer done()
+	key, val, err := c.bpop(ctx, args[:len(args)-1], left, timeout)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		cl.w.writeNullArray()
+		return nil
+	}
+	cl.w.writeBulks([][]byte{key, val})
+	return nil
+}
+
+func cmdBLMove(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	timeout, err := parseTimeout(args[4])
+	if err != nil {
+		return err
+	}
+	ctx, done := cl.whileBlocked(ctx)
+	defer done()
+	val, err := c.BLMove(ctx, args[0], args[1], string(args[2]), string(args[3]), timeout)
+	if err != nil {
+		return err
+	}
+	cl.w.writeBulk(val)
+	return nil
+}
+
+func cmdBZPopMin(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	return c.cmdBZPop(ctx, cl, args, false)
+}
+
+func cmdBZPopMax(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	return c.cmdBZPop(ctx, cl, args, true)
+}
+
+func (c *Server) cmdBZPop(ctx context.Context, cl *client, args [][]byte, max bool) error {
+	timeout, err := parseTimeout(args[len(args)-1])
+	if err != nil {
+		return err
+	}
+	ctx, done := cl.whileBlocked(ctx)
+	defer done()
+	key, z, err := c.bzpop(ctx, args[:len(args)-1], max, timeout)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		cl.w.writeNullArray()
+		return nil
+	}
+	cl.w.writeArray(3)
+	cl.w.writeBulk(key)
+	cl.w.writeBulk(z.Member)
+	cl.w.writeDouble(z.Score)
+	return nil
+}
+
+// parseXReadArgs parses [COUNT count] [BLOCK milliseconds] STREAMS key [key
+// ...] id [id ...]
+func parseXReadArgs(args [][]byte) (*XReadArgs, error) {
+	xargs := &XReadArgs{}
+	for i := 0; i < len(args); i++ {
+		switch name := strings.ToLower(string(args[i])); {
+		case name == "count" && i+1 < len(args):
+			n, err := parseInt(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			xargs.Count = n
+			i++
+		case name == "block" && i+1 < len(args):
+			ms, err := parseInt(args[i+1])
+			if err != nil {
+				return nil, errors.New("ERR timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return nil, errors.New("ERR timeout is negative")
+			}
+			xargs.Block = true
+			xargs.Timeout = time.Duration(ms) * time.Millisecond
+			i++
+		case name == "streams":
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return nil, errors.New("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+			}
+			xargs.Streams = rest[:len(rest)/2]
+			for _, id := range rest[len(rest)/2:] {
+				xargs.IDs = append(xargs.IDs, string(id))
+			}
+			return xargs, nil
+		default:
+			return nil, errSyntax
+		}
+	}
+	return nil, errSyntax
+}
+
+func cmdXRead(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	xargs, err := parseXReadArgs(args)
+	if err != nil {
+		return err
+	}
+	if xargs.Block {
+		var done func()
+		ctx, done = cl.whileBlocked(ctx)
+		defer done()
+	}
+	res, err := c.XRead(ctx, xargs)
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		cl.w.writeNullArray()
+		return nil
+	}
+	// the streams are a map in RESP3, an array of pairs in RESP2
+	if cl.w.resp3 {
+		cl.w.writeMap(len(res))
+	} else {
+		cl.w.writeArray(len(res))
+	}
+	for _, stream := range res {
+		if !cl.w.resp3 {
+			cl.w.writeArray(2)
+		}
+		cl.w.writeBulk(stream.Stream)
+		cl.w.writeArray(len(stream.Messages))
+		for _, msg := range stream.Messages {
+			cl.w.writeArray(2)
+			cl.w.writeBulk([]byte(msg.ID.String()))
+			cl.w.writeBulks(msg.Fields)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestServeBLPop(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	addr := listen(t, server)
+	key, other := uuid.NewString(), uuid.NewString()
+
+	send, receive := connect(t, addr)
+	send("BLPOP", key, "0.1")
+	g.Expect(receive()).To(BeNil())
+	send("BLPOP", key, "-1")
+	g.Expect(receive()).To(Equal(fmt.Errorf("ERR timeout is negative")))
+	// blocking commands do not wait within MULTI
+	send("MULTI")
+	send("BLPOP", key, "0")
+	send("EXEC")
+	g.Expect(receive()).To(Equal("OK"))
+	g.Expect(receive()).To(Equal("QUEUED"))
+	g.Expect(receive()).To(Equal([]interface{}{nil}))
+
+	// clients are served in the order they blocked
+	first, firstReceive := connect(t, addr)
+	second, secondReceive := connect(t, addr)
+	first("BLPOP", other, key, "0")
+	time.Sleep(100 * time.Millisecond)
+	second("BRPOP", key, "5")
+	time.Sleep(100 * time.Millisecond)
+	_, err := server.RPush(ctx, []byte(key), []byte("a"), []byte("b"))
+	g.Expect(err).To(BeNil())
+	g.Expect(firstReceive()).To(Equal([]interface{}{key, "a"}))
+	g.Expect(secondReceive()).To(Equal([]interface{}{key, "b"}))
+
+	// pipelined commands run once the blocking command is served
+	send("BLMOVE", key, other, "LEFT", "RIGHT", "0")
+	send("PING")
+	time.Sleep(100 * time.Millisecond)
+	_, err = server.RPush(ctx, []byte(key), []byte("c"))
+	g.Expect(err).To(BeNil())
+	g.Expect(receive()).To(Equal("c"))
+	g.Expect(receive()).To(Equal("PONG"))
+	g.Expect(server.LRange(ctx, []byte(other), 0, -1)).To(Equal([][]byte{[]byte("c")}))
+
+	// clients which disconnect stop waiting
+	conn, err := net.Dial("tcp", addr)
+	g.Expect(err).To(BeNil())
+	_, err = conn.Write([]byte("BLPOP " + key + " 0\r\n"))
+	g.Expect(err).To(BeNil())
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	_, err = server.RPush(ctx, []byte(key), []byte("d"))
+	g.Expect(err).To(BeNil())
+	time.Sleep(100 * time.Millisecond)
+	g.Expect(server.LRange(ctx, []byte(key), 0, -1)).To(Equal([][]byte{[]byte("d")}))
+}
+
+func TestServeBlockingProducers(t *testing.T) {
+	g := NewWithT(t)
+	addr := listen(t, server)
+	list, zset, stream := uuid.NewString(), uuid.NewString(), uuid.NewString()
+	send, receive := connect(t, addr)
+	produce, reply := connect(t, addr)
+
+	// the blocked client is served by the write of another client
+	send("BLPOP", list, "5")
+	time.Sleep(100 * time.Millisecond)
+	produce("LPUSH", list, "a")
+	g.Expect(reply()).To(Equal(int64(1)))
+	g.Expect(receive()).To(Equal([]interface{}{list, "a"}))
+	send("BRPOP", list, "5")
+	time.Sleep(100 * time.Millisecond)
+	produce("RPUSH", list, "b", "c")
+	g.Expect(reply()).To(Equal(int64(2)))
+	g.Expect(receive()).To(Equal([]interface{}{list, "c"}))
+
+	send("BZPOPMIN", zset, "5")
+	time.Sleep(100 * time.Millisecond)
+	produce("ZADD", zset, "2", "b", "1", "a")
+	g.Expect(reply()).To(Equal(int64(2)))
+	g.Expect(receive()).To(Equal([]interface{}{zset, "a", "1"}))
+	produce("ZADD", zset, "XX", "INCR", "2", "b")
+	g.Expect(reply()).To(Equal("4"))
+	produce("ZADD", zset, "NX", "1")
+	g.Expect(reply()).To(Equal(fmt.Errorf("ERR syntax error")))
+
+	send("XREAD", "BLOCK", "5000", "STREAMS", stream, "$")
+	time.Sleep(100 * time.Millisecond)
+	produce("XADD", stream, "MAXLEN", "~", "10", "1-1", "f", "v")
+	g.Expect(reply()).To(Equal("1-1"))
+	entries := []interface{}{[]interface{}{"1-1", []interface{}{"f", "v"}}}
+	g.Expect(receive()).To(Equal([]interface{}{[]interface{}{stream, entries}}))
+	produce("XADD", uuid.NewString(), "NOMKSTREAM", "*", "f", "v")
+	g.Expect(reply()).To(BeNil())
+}
+
+func TestBlocking(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		server.ZAdd(ctx, key, nil, Z{Score: 2, Member: []byte("b")}, Z{Score: 1, Member: []byte("a")})
+	}()
+	popped, z, err := server.BZPopMin(ctx, 5*time.Second, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(popped).To(Equal(key))
+	g.Expect(*z).To(Equal(Z{Score: 1, Member: []byte("a")}))
+	popped, _, err = server.BZPopMax(ctx, 10*time.Millisecond, []byte(uuid.NewString()))
+	g.Expect(err).To(BeNil())
+	g.Expect(popped).To(BeNil())
+
+	// XREAD BLOCK reads the entries added after $
+	stream := []byte(uuid.NewString())
+	_, err = server.XAdd(ctx, stream, &XAddArgs{ID: "*", Fields: [][]byte{[]byte("f"), []byte("1")}})
+	g.Expect(err).To(BeNil())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		server.XAdd(ctx, stream, &XAddArgs{ID: "*", Fields: [][]byte{[]byte("f"), []byte("2")}})
+	}()
+	res, err := server.XRead(ctx, &XReadArgs{Streams: [][]byte{stream}, IDs: []string{"$"}, Block: true})
+	g.Expect(err).To(BeNil())
+	g.Expect(len(res)).To(Equal(1))
+	g.Expect(res[0].Messages[0].Fields).To(Equal([][]byte{[]byte("f"), []byte("2")}))
+
+	// a canceled context stops waiting
+	canceled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, _, err = server.BLPop(canceled, 0, []byte(uuid.NewString()))
+	g.Expect(err).To(Equal(context.DeadlineExceeded))
+}
+
+func TestServeXReadFromOtherProcess(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	// processes sharing the object storage, which are not the leader
+	newServer := func(fanout bool) (string, string) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &ServerConfig{
+			CacheDir:        os.Getenv("S3DIS_TEST_CACHE_DIR"),
+			MaxPartitionNum: 1024,
+		}
+		if fanout {
+			config.PubSubAddr = l.Addr().String()
+		}
+		s := NewServer(objectStorage, config)
+		go s.ServePeers(l)
+		t.Cleanup(func() {
+			s.Close(context.Background())
+			l.Close()
+		})
+		return listen(t, s), l.Addr().String()
+	}
+	key := uuid.NewString()
+	xadd := func(val string) string {
+		id, err := server.XAdd(ctx, []byte(key), &XAddArgs{ID: "*", Fields: [][]byte{[]byte("f"), []byte(val)}})
+		g.Expect(err).To(BeNil())
+		return id
+	}
+	xadd("0")
+
+	// woken by the signal which the leader sends through the fan-out
+	addr, peerAddr := newServer(true)
+	send, receive := connect(t, addr)
+	send("XREAD", "BLOCK", "0", "STREAMS", key, "$")
+	time.Sleep(100 * time.Millisecond)
+	id := xadd("1")
+	signal, reply := connect(t, peerAddr)
+	start := time.Now()
+	signal("S3DIS.SIGNAL", "0", key)
+	g.Expect(reply()).To(Equal("OK"))
+	entries := []interface{}{[]interface{}{id, []interface{}{"f", "1"}}}
+	g.Expect(receive()).To(Equal([]interface{}{[]interface{}{key, entries}}))
+	g.Expect(time.Since(start) < blockingPollInterval/2).To(Equal(true))
+
+	// found by polling without the fan-out
+	addr, _ = newServer(false)
+	send, receive = connect(t, addr)
+	send("XREAD", "COUNT", "1", "BLOCK", "5000", "STREAMS", key, id)
+	time.Sleep(100 * time.Millisecond)
+	id = xadd("2")
+	entries = []interface{}{[]interface{}{id, []interface{}{"f", "2"}}}
+	g.Expect(receive()).To(Equal([]interface{}{[]interface{}{key, entries}}))
+}
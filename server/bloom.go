@@ -0,0 +1,394 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+// Defaults of RedisBloom for filters created by BF.ADD and BF.INSERT.
+const (
+	bloomDefaultErrorRate = 0.01
+	bloomDefaultCapacity  = 100
+	bloomDefaultExpansion = 2
+	// each new sub-filter has half the error rate of the previous one
+	bloomTighteningRatio = 0.5
+)
+
+var (
+	errFilterExists   = fmt.Errorf("ERR item exists")
+	errFilterNotFound = fmt.Errorf("ERR not found")
+)
+
+// bloomSub is a sub-filter of a scalable Bloom filter
+type bloomSub struct {
+	capacity  uint64
+	count     uint64
+	bits      uint64
+	hashes    uint64
+	errorRate float64
+}
+
+func newBloomSub(capacity uint64, errorRate float64) bloomSub {
+	bpe := -math.Log(errorRate) / (math.Ln2 * math.Ln2)
+	return bloomSub{
+		capacity:  capacity,
+		bits:      uint64(math.Ceil(float64(capacity) * bpe)),
+		hashes:    uint64(math.Ceil(math.Ln2 * bpe)),
+		errorRate: errorRate,
+	}
+}
+
+func (s bloomSub) encode() []byte {
+	b := make([]byte, 40)
+	binary.BigEndian.PutUint64(b, s.capacity)
+	binary.BigEndian.PutUint64(b[8:], s.count)
+	binary.BigEndian.PutUint64(b[16:], s.bits)
+	binary.BigEndian.PutUint64(b[24:], s.hashes)
+	binary.BigEndian.PutUint64(b[32:], math.Float64bits(s.errorRate))
+	return b
+}
+
+func decodeBloomSub(b []byte) bloomSub {
+	return bloomSub{
+		capacity:  binary.BigEndian.Uint64(b),
+		count:     binary.BigEndian.Uint64(b[8:]),
+		bits:      binary.BigEndian.Uint64(b[16:]),
+		hashes:    binary.BigEndian.Uint64(b[24:]),
+		errorRate: math.Float64frombits(binary.BigEndian.Uint64(b[32:])),
+	}
+}
+
+// bloomFilter is a scalable Bloom filter: once the last sub-filter holds as
+// many items as its capacity, a larger one with a lower error rate is added
+type bloomFilter struct {
+	f          *db.Filter
+	expansion  uint64
+	nonScaling bool
+	subs       []bloomSub
+}
+
+// bloomHash returns the two hashes from which the positions of item in a
+// sub-filter are derived, as in RedisBloom
+func bloomHash(item []byte) (uint64, uint64) {
+	h1 := murmurHash64A(item, 0xc6a4a7935bd1e995)
+	return h1, murmurHash64A(item, h1)
+}
+
+func openBloom(tx *db.Tx, key []byte) (*bloomFilter, error) {
+	f, err := tx.OpenFilter(key, db.TypeBloom, false)
+	if err != nil || f == nil {
+		return nil, err
+	}
+	b := &bloomFilter{
+		f:          f,
+		expansion:  binary.BigEndian.Uint64(f.Meta("expansion")),
+		nonScaling: f.Meta("nonscaling") != nil,
+	}
+	for _, sub := range f.Subs() {
+		b.subs = append(b.subs, decodeBloomSub(sub))
+	}
+	return b, nil
+}
+
+// BFReserveOptions mirrors the options of BF.RESERVE.
+type BFReserveOptions struct {
+	Expansion  int64 // growth factor of the capacity of sub-filters, 2 if zero
+	NonScaling bool  // fail once the filter is full instead of growing
+}
+
+func validateBloom(errorRate float64, capacity int64, opts *BFReserveOptions) error {
+	if !(errorRate > 0 && errorRate < 1) {
+		return fmt.Errorf("ERR (0 < error rate range < 1)")
+	}
+	if capacity <= 0 {
+		return fmt.Errorf("ERR (capacity should be larger than 0)")
+	}
+	if opts.NonScaling && opts.Expansion != 0 {
+		return fmt.Errorf("ERR Nonscaling filters cannot expand")
+	}
+	if opts.Expansion < 0 {
+		return fmt.Errorf("ERR expansion should be greater or equal to 1")
+	}
+	return nil
+}
+
+// createBloom creates an empty Bloom filter at key
+func createBloom(tx *db.Tx, key []byte, errorRate float64, capacity int64, opts *BFReserveOptions) (*bloomFilter, error) {
+	f, err := tx.OpenFilter(key, db.TypeBloom, true)
+	if err != nil {
+		return nil, err
+	}
+	b := &bloomFilter{
+		f:          f,
+		expansion:  uint64(opts.Expansion),
+		nonScaling: opts.NonScaling,
+		subs:       []bloomSub{newBloomSub(uint64(capacity), errorRate)},
+	}
+	if b.expansion == 0 {
+		b.expansion = bloomDefaultExpansion
+	}
+	err = f.SetMeta("expansion", encodeUint64(b.expansion))
+	if err != nil {
+		return nil, err
+	}
+	if b.nonScaling {
+		err = f.SetMeta("nonscaling", []byte{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, f.SetSub(0, b.subs[0].encode())
+}
+
+func encodeUint64(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+func (b *bloomFilter) subHas(i int, h1, h2 uint64) bool {
+	sub := b.subs[i]
+	for j := uint64(0); j < sub.hashes; j++ {
+		bit := (h1 + j*h2) % sub.bits
+		if b.f.Byte(i, bit/8)&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) exists(item []byte) bool {
+	h1, h2 := bloomHash(item)
+	for i := range b.subs {
+		if b.subHas(i, h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds item and reports whether it was not already present
+func (b *bloomFilter) add(item []byte) (bool, error) {
+	if b.exists(item) {
+		return false, nil
+	}
+	last := len(b.subs) - 1
+	if b.subs[last].count >= b.subs[last].capacity {
+		if b.nonScaling {
+			return false, fmt.Errorf("ERR non scaling filter is full")
+		}
+		prev := b.subs[last]
+		b.subs = append(b.subs, newBloomSub(prev.capacity*b.expansion, prev.errorRate*bloomTighteningRatio))
+		last++
+	}
+	sub := &b.subs[last]
+	h1, h2 := bloomHash(item)
+	for j := uint64(0); j < sub.hashes; j++ {
+		bit := (h1 + j*h2) % sub.bits
+		byt := b.f.Byte(last, bit/8)
+		if byt&(1<<(bit%8)) != 0 {
+			continue
+		}
+		err := b.f.SetByte(last, bit/8, byt|1<<(bit%8))
+		if err != nil {
+			return false, err
+		}
+	}
+	sub.count++
+	return true, b.f.SetSub(last, sub.encode())
+}
+
+// BFReserve creates an empty Bloom filter at key for capacity items with the
+// given false positive rate.
+func (c *Server) BFReserve(ctx context.Context, key []byte, errorRate float64, capacity int64, opts *BFReserveOptions) error {
+	if opts == nil {
+		opts = &BFReserveOptions{}
+	}
+	ctx = withCommand(ctx, "BF.RESERVE", key, errorRate, capacity, optionalInt("EXPANSION", opts.Expansion), flag(opts.NonScaling, "NONSCALING"))
+	err := validateBloom(errorRate, capacity, opts)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(ctx, key, func(tx *db.Tx) error {
+		exists, err := tx.Exists(key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errFilterExists
+		}
+		_, err = createBloom(tx, key, errorRate, capacity, opts)
+		return err
+	})
+}
+
+// BFInsertOptions mirrors the options of BF.INSERT, which apply when the
+// filter is created. Zero values select the defaults of RedisBloom.
+type BFInsertOptions struct {
+	Capacity   int64
+	ErrorRate  float64
+	Expansion  int64
+	NoCreate   bool
+	NonScaling bool
+}
+
+// BFInsert adds items to the Bloom filter stored at key, creating it unless
+// NoCreate is set, and reports for each item whether it was newly added.
+func (c *Server) BFInsert(ctx context.Context, key []byte, opts *BFInsertOptions, items ...[]byte) ([]bool, error) {
+	if opts == nil {
+		opts = &BFInsertOptions{}
+	}
+	ctx = withCommand(ctx, "BF.INSERT", key, opts.args(), "ITEMS", items)
+	capacity, errorRate := opts.Capacity, opts.ErrorRate
+	if capacity == 0 {
+		capacity = bloomDefaultCapacity
+	}
+	if errorRate == 0 {
+		errorRate = bloomDefaultErrorRate
+	}
+	reserve := &BFReserveOptions{Expansion: opts.Expansion, NonScaling: opts.NonScaling}
+	err := validateBloom(errorRate, capacity, reserve)
+	if err != nil {
+		return nil, err
+	}
+	res := []bool{}
+	err = c.update(ctx, key, func(tx *db.Tx) error {
+		b, err := openBloom(tx, key)
+		if err != nil {
+			return err
+		}
+		created := b == nil
+		if created {
+			if opts.NoCreate {
+				return errFilterNotFound
+			}
+			b, err = createBloom(tx, key, errorRate, capacity, reserve)
+			if err != nil {
+				return err
+			}
+		}
+		added := false
+		for _, item := range items {
+			ok, err := b.add(item)
+			if err != nil {
+				return err
+			}
+			added = added || ok
+			res = append(res, ok)
+		}
+		if !added && !created {
+			return errNoop
+		}
+		return nil
+	})
+	return res, err
+}
+
+// BFAdd adds item to the Bloom filter stored at key, creating it with the
+// default parameters if needed, and reports whether it was newly added.
+func (c *Server) BFAdd(ctx context.Context, key []byte, item []byte) (bool, error) {
+	ctx = withCommand(ctx, "BF.ADD", key, item)
+	res, err := c.BFInsert(ctx, key, nil, item)
+	if err != nil {
+		return false, err
+	}
+	return res[0], nil
+}
+
+// BFMAdd is like BFAdd for several items.
+func (c *Server) BFMAdd(ctx context.Context, key []byte, items ...[]byte) ([]bool, error) {
+	ctx = withCommand(ctx, "BF.MADD", key, items)
+	return c.BFInsert(ctx, key, nil, items...)
+}
+
+// BFMExists reports for each item whether it may have been added to the
+// Bloom filter stored at key.
+func (c *Server) BFMExists(ctx context.Context, key []byte, items ...[]byte) ([]bool, error) {
+	res := make([]bool, len(items))
+	err := c.db.View(ctx, key, func(tx *db.Tx) error {
+		b, err := openBloom(tx, key)
+		if err != nil || b == nil {
+			return err
+		}
+		for i, item := range items {
+			res[i] = b.exists(item)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// BFExists reports whether item may have been added to the Bloom filter
+// stored at key.
+func (c *Server) BFExists(ctx context.Context, key []byte, item []byte) (bool, error) {
+	res, err := c.BFMExists(ctx, key, item)
+	if err != nil {
+		return false, err
+	}
+	return res[0], nil
+}
+
+// BFInfo describes a Bloom filter.
+type BFInfo struct {
+	Capacity  int64 // total capacity of the sub-filters
+	Size      int64 // size of the stored pages, in bytes
+	Filters   int64
+	Items     int64
+	Expansion int64 // 0 for non scaling filters
+}
+
+// BFInfo returns information about the Bloom filter stored at key.
+func (c *Server) BFInfo(ctx context.Context, key []byte) (*BFInfo, error) {
+	var res *BFInfo
+	err := c.db.View(ctx, key, func(tx *db.Tx) error {
+		b, err := openBloom(tx, key)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			return errFilterNotFound
+		}
+		res = &BFInfo{
+			Size:    int64(b.f.Pages()) * db.FilterPageSize,
+			Filters: int64(len(b.subs)),
+		}
+		if !b.nonScaling {
+			res.Expansion = int64(b.expansion)
+		}
+		for _, sub := range b.subs {
+			res.Capacity += int64(sub.capacity)
+			res.Items += int64(sub.count)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// BFCard returns the number of items added to the Bloom filter stored at
+// key, 0 if the key does not exist.
+func (c *Server) BFCard(ctx context.Context, key []byte) (int64, error) {
+	info, err := c.BFInfo(ctx, key)
+	if err == errFilterNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Items, nil
+}
+
+// args returns the options as arguments of BF.INSERT
+func (opts *BFInsertOptions) args() [][]byte {
+	args := optionalInt("CAPACITY", opts.Capacity)
+	if opts.ErrorRate != 0 {
+		args = append(args, []byte("ERROR"), []byte(strconv.FormatFloat(opts.ErrorRate, 'f', -1, 64)))
+	}
+	args = append(args, optionalInt("EXPANSION", opts.Expansion)...)
+	args = append(args, flag(opts.NoCreate, "NOCREATE")...)
+	return append(args, flag(opts.NonScaling, "NONSCALING")...)
+}
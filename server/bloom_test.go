@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/zenozeng/s3dis/db"
+)
+
+func TestBloomFilter(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	err := server.BFReserve(ctx, key, 0.01, 10, nil)
+	g.Expect(err).To(BeNil())
+	err = server.BFReserve(ctx, key, 0.01, 10, nil)
+	g.Expect(err).To(Equal(errFilterExists))
+	err = server.BFReserve(ctx, []byte(uuid.NewString()), 1.5, 10, nil)
+	g.Expect(err).NotTo(BeNil())
+
+	added, err := server.BFAdd(ctx, key, []byte("a"))
+	g.Expect(err).To(BeNil())
+	g.Expect(added).To(Equal(true))
+	added, err = server.BFAdd(ctx, key, []byte("a"))
+	g.Expect(err).To(BeNil())
+	g.Expect(added).To(Equal(false))
+	exists, err := server.BFExists(ctx, key, []byte("a"))
+	g.Expect(err).To(BeNil())
+	g.Expect(exists).To(Equal(true))
+	res, err := server.BFMExists(ctx, key, []byte("a"), []byte("b"))
+	g.Expect(err).To(BeNil())
+	g.Expect(res).To(Equal([]bool{true, false}))
+
+	// the filter scales past its capacity
+	items := [][]byte{}
+	for i := 0; i < 50; i++ {
+		items = append(items, []byte(fmt.Sprintf("item-%d", i)))
+	}
+	_, err = server.BFMAdd(ctx, key, items...)
+	g.Expect(err).To(BeNil())
+	res, err = server.BFMExists(ctx, key, items...)
+	g.Expect(err).To(BeNil())
+	for _, ok := range res {
+		g.Expect(ok).To(Equal(true))
+	}
+	info, err := server.BFInfo(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(info.Filters > 1).To(Equal(true))
+	g.Expect(info.Expansion).To(Equal(int64(2)))
+	n, err := server.BFCard(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(info.Items))
+
+	err = server.db.View(ctx, key, func(tx *db.Tx) error {
+		typ, err := tx.Type(key)
+		g.Expect(typ).To(Equal(db.TypeBloom))
+		return err
+	})
+	g.Expect(err).To(BeNil())
+
+	exists, err = server.BFExists(ctx, []byte(uuid.NewString()), []byte("a"))
+	g.Expect(err).To(BeNil())
+	g.Expect(exists).To(Equal(false))
+	_, err = server.BFInfo(ctx, []byte(uuid.NewString()))
+	g.Expect(err).To(Equal(errFilterNotFound))
+}
+
+func TestBloomFilterNonScaling(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	_, err := server.BFInsert(ctx, key, &BFInsertOptions{NoCreate: true}, []byte("a"))
+	g.Expect(err).To(Equal(errFilterNotFound))
+	res, err := server.BFInsert(ctx, key, &BFInsertOptions{Capacity: 2, NonScaling: true}, []byte("a"), []byte("b"))
+	g.Expect(err).To(BeNil())
+	g.Expect(res).To(Equal([]bool{true, true}))
+	_, err = server.BFAdd(ctx, key, []byte("c"))
+	g.Expect(err).NotTo(BeNil())
+	info, err := server.BFInfo(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(info.Capacity).To(Equal(int64(2)))
+	g.Expect(info.Items).To(Equal(int64(2)))
+	g.Expect(info.Expansion).To(Equal(int64(0)))
+
+	str := []byte(uuid.NewString())
+	err = server.Set(ctx, str, []byte("a"), nil)
+	g.Expect(err).To(BeNil())
+	_, err = server.BFAdd(ctx, str, []byte("a"))
+	g.Expect(err).To(Equal(db.ErrWrongType))
+}
@@ -0,0 +1,577 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNoSuchClient = errors.New("ERR No such client")
+
+// clientState is what CLIENT LIST shows of a connection. The connection
+// copies it around every command, since the other connections read it while
+// this one runs a command.
+type clientState struct {
+	name     string
+	db       int
+	cmd      string    // name of the last command
+	active   time.Time // start of the last command
+	blocked  bool
+	noEvict  bool
+	subs     [subscriptionKinds]int
+	multi    int // queued commands, -1 outside MULTI
+	watch    int
+	qbuf     int // bytes of pipelined commands not read yet
+	obl      int // bytes of replies not written yet
+	resp3    bool
+	tracking bool
+}
+
+// clients is the registry of the connections served by this process, and
+// the state of CLIENT PAUSE
+type clients struct {
+	mu     sync.Mutex
+	byId   map[int64]*client
+	nextId int64
+
+	pauseMu  sync.Mutex
+	pauseEnd time.Time
+	pauseAll bool          // pauses every command, writes only otherwise
+	unpaused chan struct{} // closed by CLIENT UNPAUSE
+}
+
+func newClients() *clients {
+	return &clients{byId: map[int64]*client{}, unpaused: make(chan struct{})}
+}
+
+// add registers a new connection and assigns its id
+func (r *clients) add(cl *client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextId++
+	cl.id = r.nextId
+	cl.created = time.Now()
+	cl.state = clientState{active: cl.created, multi: -1}
+	r.byId[cl.id] = cl
+}
+
+func (r *clients) remove(cl *client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.byId, cl.id)
+}
+
+// get returns the connection of id, nil if it is gone
+func (r *clients) get(id int64) *client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.byId[id]
+}
+
+// list returns the connections in the order of their ids
+func (r *clients) list() []*client {
+	r.mu.Lock()
+	res := make([]*client, 0, len(r.byId))
+	for _, cl := range r.byId {
+		res = append(res, cl)
+	}
+	r.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].id < res[j].id
+	})
+	return res
+}
+
+// count returns the number of connections, and of those blocked
+func (r *clients) count() (int, int) {
+	connected := r.list()
+	blocked := 0
+	for _, cl := range connected {
+		cl.stateMu.Lock()
+		if cl.state.blocked {
+			blocked++
+		}
+		cl.stateMu.Unlock()
+	}
+	return len(connected), blocked
+}
+
+// beginCommand records the command a connection is about to run
+func (cl *client) beginCommand(name []byte) {
+	cl.stateMu.Lock()
+	defer cl.stateMu.Unlock()
+	cl.state.cmd = strings.ToLower(string(name))
+	cl.state.active = time.Now()
+}
+
+// endCommand copies the state of the connection once a command ran, the
+// caller must hold cl.mu
+func (cl *client) endCommand() {
+	cl.stateMu.Lock()
+	defer cl.stateMu.Unlock()
+	cl.state.db = cl.db
+	for kind, names := range cl.subscriptions {
+		cl.state.subs[kind] = len(names)
+	}
+	cl.state.multi = -1
+	if cl.multi {
+		cl.state.multi = len(cl.queued)
+	}
+	cl.state.watch = len(cl.watched)
+	cl.state.qbuf = cl.r.Buffered()
+	cl.state.obl = cl.w.Buffered()
+	cl.state.resp3 = cl.w.resp3
+	cl.state.tracking = cl.tracking != nil
+}
+
+// resp3 reports whether the connection speaks RESP3, as of its last command
+func (cl *client) resp3() bool {
+	cl.stateMu.Lock()
+	defer cl.stateMu.Unlock()
+	return cl.state.resp3
+}
+
+func (cl *client) setBlocked(blocked bool) {
+	cl.stateMu.Lock()
+	defer cl.stateMu.Unlock()
+	cl.state.blocked = blocked
+}
+
+// pubsub reports whether the connection has subscriptions, as of its last
+// command
+func (s *clientState) pubsub() bool {
+	for _, n := range s.subs {
+		if n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// describe formats the connection like a line of CLIENT LIST
+func (cl *client) describe() string {
+	cl.stateMu.Lock()
+	s := cl.state
+	cl.stateMu.Unlock()
+	flags := ""
+	if s.pubsub() {
+		flags += "P"
+	}
+	if s.multi >= 0 {
+		flags += "x"
+	}
+	if s.blocked {
+		flags += "b"
+	}
+	if s.noEvict {
+		flags += "e"
+	}
+	if s.tracking {
+		flags += "t"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	resp := 2
+	if s.resp3 {
+		resp = 3
+	}
+	now := time.Now()
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d ssub=%d multi=%d watch=%d qbuf=%d qbuf-free=%d obl=%d oll=%d events=r cmd=%s user=default resp=%d",
+		cl.id, cl.conn.RemoteAddr(), cl.conn.LocalAddr(), s.name,
+		int64(now.Sub(cl.created).Seconds()), int64(now.Sub(s.active).Seconds()),
+		flags, s.db, s.subs[channelSubscription], s.subs[patternSubscription], s.subs[shardSubscription],
+		s.multi, s.watch, s.qbuf, maxInlineLen-s.qbuf, s.obl, len(cl.messages), s.cmd, resp)
+}
+
+// pause pauses the commands of every connection, or their writes only, until
+// end or unpause. A new pause replaces the one in effect.
+func (r *clients) pause(end time.Time, all bool) {
+	r.pauseMu.Lock()
+	defer r.pauseMu.Unlock()
+	r.pauseEnd = end
+	r.pauseAll = all
+}
+
+func (r *clients) unpause() {
+	r.pauseMu.Lock()
+	defer r.pauseMu.Unlock()
+	r.pauseEnd = time.Time{}
+	close(r.unpaused)
+	r.unpaused = make(chan struct{})
+}
+
+// waitPause waits until the command of cl is no longer paused by CLIENT
+// PAUSE. CLIENT itself is never paused, so that CLIENT UNPAUSE can end the
+// pause.
+func (r *clients) waitPause(ctx context.Context, cl *client, cmd command, name string) {
+	if name == "client" {
+		return
+	}
+	for {
+		r.pauseMu.Lock()
+		end, all, unpaused := r.pauseEnd, r.pauseAll, r.unpaused
+		r.pauseMu.Unlock()
+		wait := time.Until(end)
+		if wait <= 0 || !all && !cl.mayWrite(cmd, name) {
+			return
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-unpaused:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// mayWrite reports whether a command may write, EXEC being a write if one of
+// the commands it runs is
+func (cl *client) mayWrite(cmd command, name string) bool {
+	if cmd.flags&flagWrite != 0 {
+		return true
+	}
+	if name != "exec" || !cl.multi {
+		return false
+	}
+	for _, args := range cl.queued {
+		queued, err := lookupCommand(args)
+		if err == nil && queued.flags&flagWrite != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// clientFilter is a filter of CLIENT KILL and CLIENT LIST, zero values
+// match every connection
+type clientFilter struct {
+	ids    map[int64]bool
+	addr   string
+	laddr  string
+	typ    string // normal or pubsub
+	maxAge time.Duration
+	skipMe bool
+}
+
+func (f *clientFilter) match(cl *client, self *client) bool {
+	if f.ids != nil && !f.ids[cl.id] {
+		return false
+	}
+	if f.addr != "" && cl.conn.RemoteAddr().String() != f.addr {
+		return false
+	}
+	if f.laddr != "" && cl.conn.LocalAddr().String() != f.laddr {
+		return false
+	}
+	switch f.typ {
+	case "":
+	case "master", "replica", "slave":
+		return false
+	default:
+		cl.stateMu.Lock()
+		pubsub := cl.state.pubsub()
+		cl.stateMu.Unlock()
+		if pubsub != (f.typ == "pubsub") {
+			return false
+		}
+	}
+	if f.maxAge > 0 && time.Since(cl.created) < f.maxAge {
+		return false
+	}
+	return !f.skipMe || cl != self
+}
+
+// parseClientType parses the TYPE of CLIENT KILL and CLIENT LIST, replicas
+// and masters match no connection
+func parseClientType(arg []byte) (string, error) {
+	typ := strings.ToLower(string(arg))
+	switch typ {
+	case "normal", "pubsub", "master", "replica", "slave":
+		return typ, nil
+	}
+	return "", fmt.Errorf("ERR Unknown client type '%s'", arg)
+}
+
+func parseClientId(arg []byte) (int64, error) {
+	id, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("ERR client-id should be greater than 0")
+	}
+	return id, nil
+}
+
+// parseKillFilter parses the filters of CLIENT KILL, SKIPME defaults to yes
+func parseKillFilter(args [][]byte) (*clientFilter, error) {
+	f := &clientFilter{skipMe: true}
+	if len(args)%2 != 0 {
+		return nil, errSyntax
+	}
+	for i := 0; i < len(args); i += 2 {
+		val := args[i+1]
+		switch strings.ToLower(string(args[i])) {
+		case "id":
+			id, err := parseClientId(val)
+			if err != nil {
+				return nil, err
+			}
+			f.ids = map[int64]bool{id: true}
+		case "addr":
+			f.addr = string(val)
+		case "laddr":
+			f.laddr = string(val)
+		case "type":
+			typ, err := parseClientType(val)
+			if err != nil {
+				return nil, err
+			}
+			f.typ = typ
+		case "user":
+			if string(val) != "default" {
+				f.ids = map[int64]bool{}
+			}
+		case "skipme":
+			switch strings.ToLower(string(val)) {
+			case "yes":
+				f.skipMe = true
+			case "no":
+				f.skipMe = false
+			default:
+				return nil, errSyntax
+			}
+		case "maxage":
+			seconds, err := parseInt(val)
+			if err != nil {
+				return nil, err
+			}
+			f.maxAge = time.Duration(seconds) * time.Second
+		default:
+			return nil, errSyntax
+		}
+	}
+	return f, nil
+}
+
+// setName names the connection, for CLIENT SETNAME and HELLO
+func (cl *client) setName(name []byte) error {
+	for _, b := range name {
+		if b <= ' ' || b > '~' {
+			return fmt.Errorf("ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+	}
+	cl.stateMu.Lock()
+	cl.state.name = string(name)
+	cl.stateMu.Unlock()
+	return nil
+}
+
+// kill closes the connection of cl, or the connection of self once its
+// reply is written
+func (cl *client) kill(self *client) {
+	if cl == self {
+		cl.quit = true
+		return
+	}
+	cl.conn.Close()
+}
+
+// cmdClient implements CLIENT, for the connections served by this process
+func cmdClient(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	sub := strings.ToLower(string(args[0]))
+	switch {
+	case sub == "id" && len(args) == 1:
+		cl.w.writeInt(cl.id)
+	case sub == "getname" && len(args) == 1:
+		cl.stateMu.Lock()
+		name := cl.state.name
+		cl.stateMu.Unlock()
+		if name == "" {
+			cl.w.writeBulk(nil)
+		} else {
+			cl.w.writeBulk([]byte(name))
+		}
+	case sub == "setname" && len(args) == 2:
+		err := cl.setName(args[1])
+		if err != nil {
+			return err
+		}
+		cl.w.writeSimple("OK")
+	case sub == "info" && len(args) == 1:
+		cl.endCommand()
+		cl.w.writeBulk([]byte(cl.describe() + "\n"))
+	case sub == "list":
+		f := &clientFilter{}
+		for i := 1; i < len(args); i++ {
+			switch name := strings.ToLower(string(args[i])); {
+			case name == "type" && i+1 < len(args):
+				typ, err := parseClientType(args[i+1])
+				if err != nil {
+					return err
+				}
+				f.typ = typ
+				i++
+			case name == "id" && i+1 < len(args):
+				f.ids = map[int64]bool{}
+				for _, arg := range args[i+1:] {
+					id, err := parseClientId(arg)
+					if err != nil {
+						return err
+					}
+					f.ids[id] = true
+				}
+				i = len(args)
+			default:
+				return errSyntax
+			}
+		}
+		cl.endCommand()
+		res := ""
+		for _, other := range c.clients.list() {
+			if f.match(other, cl) {
+				res += other.describe() + "\n"
+			}
+		}
+		cl.w.writeBulk([]byte(res))
+	case sub == "kill" && len(args) == 2:
+		for _, other := range c.clients.list() {
+			if other.conn.RemoteAddr().String() == string(args[1]) {
+				other.kill(cl)
+				cl.w.writeSimple("OK")
+				return nil
+			}
+		}
+		return errNoSuchClient
+	case sub == "kill" && len(args) > 2:
+		f, err := parseKillFilter(args[1:])
+		if err != nil {
+			return err
+		}
+		killed := 0
+		for _, other := range c.clients.list() {
+			if f.match(other, cl) {
+				other.kill(cl)
+				killed++
+			}
+		}
+		cl.w.writeInt(int64(killed))
+	case sub == "pause" && (len(args) == 2 || len(args) == 3):
+		ms, err := parseInt(args[1])
+		if err != nil || ms < 0 {
+			return fmt.Errorf("ERR timeout is not an integer or out of range")
+		}
+		all := true
+		if len(args) == 3 {
+			switch strings.ToLower(string(args[2])) {
+			case "all":
+			case "write":
+				all = false
+			default:
+				return errSyntax
+			}
+		}
+		c.clients.pause(time.Now().Add(time.Duration(ms)*time.Millisecond), all)
+		cl.w.writeSimple("OK")
+	case sub == "unpause" && len(args) == 1:
+		c.clients.unpause()
+		cl.w.writeSimple("OK")
+	case sub == "tracking" && len(args) >= 2:
+		return c.clientTracking(cl, args[1:])
+	case sub == "trackinginfo" && len(args) == 1:
+		cl.writeTrackingInfo()
+	case sub == "getredir" && len(args) == 1:
+		if cl.tracking == nil {
+			cl.w.writeInt(-1)
+		} else {
+			cl.w.writeInt(cl.tracking.redirect)
+		}
+	case sub == "no-evict" && len(args) == 2:
+		// keys are never evicted, the flag is only shown by CLIENT LIST
+		var noEvict bool
+		switch strings.ToLower(string(args[1])) {
+		case "on":
+			noEvict = true
+		case "off":
+		default:
+			return errSyntax
+		}
+		cl.stateMu.Lock()
+		cl.state.noEvict = noEvict
+		cl.stateMu.Unlock()
+		cl.w.writeSimple("OK")
+	default:
+		return fmt.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'", sub)
+	}
+	return nil
+}
+
+// helloVersion is the version of Redis replied by HELLO, the one whose
+// commands s3dis follows
+const helloVersion = "7.2.0"
+
+// cmdHello implements HELLO [protover [AUTH username password] [SETNAME
+// name]], which switches the connection to RESP3 with protover 3. There are
+// no passwords, AUTH only checks that the user is the default one.
+func cmdHello(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	resp3 := cl.w.resp3
+	if len(args) > 0 {
+		proto, err := strconv.ParseInt(string(args[0]), 10, 64)
+		if err != nil {
+			return fmt.Errorf("ERR Protocol version is not an integer or out of range")
+		}
+		if proto != 2 && proto != 3 {
+			return fmt.Errorf("NOPROTO unsupported protocol version")
+		}
+		resp3 = proto == 3
+		args = args[1:]
+	}
+	var name []byte
+	for i := 0; i < len(args); i++ {
+		switch opt := strings.ToLower(string(args[i])); {
+		case opt == "auth" && i+2 < len(args):
+			if string(args[i+1]) != "default" {
+				return fmt.Errorf("WRONGPASS invalid username-password pair or user is disabled.")
+			}
+			i += 2
+		case opt == "setname" && i+1 < len(args):
+			name = args[i+1]
+			i++
+		default:
+			return fmt.Errorf("ERR Syntax error in HELLO option '%s'", args[i])
+		}
+	}
+	if name != nil {
+		err := cl.setName(name)
+		if err != nil {
+			return err
+		}
+	}
+	cl.w.resp3 = resp3
+	proto := int64(2)
+	if resp3 {
+		proto = 3
+	}
+	cl.w.writeMap(7)
+	cl.w.writeBulk([]byte("server"))
+	cl.w.writeBulk([]byte("redis"))
+	cl.w.writeBulk([]byte("version"))
+	cl.w.writeBulk([]byte(helloVersion))
+	cl.w.writeBulk([]byte("proto"))
+	cl.w.writeInt(proto)
+	cl.w.writeBulk([]byte("id"))
+	cl.w.writeInt(cl.id)
+	cl.w.writeBulk([]byte("mode"))
+	cl.w.writeBulk([]byte("standalone"))
+	cl.w.writeBulk([]byte("role"))
+	cl.w.writeBulk([]byte("master"))
+	cl.w.writeBulk([]byte("modules"))
+	cl.w.writeArray(0)
+	return nil
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestServeClient(t *testing.T) {
+	g := NewWithT(t)
+	addr := listen(t, server)
+	send, receive := connect(t, addr)
+	do := func(args ...string) interface{} {
+		send(args...)
+		return receive()
+	}
+	other, otherReceive := connect(t, addr)
+
+	send("CLIENT", "ID")
+	id := receive().(int64)
+	other("CLIENT", "ID")
+	otherId := otherReceive().(int64)
+	g.Expect(otherId > id).To(Equal(true))
+
+	g.Expect(do("CLIENT", "GETNAME")).To(BeNil())
+	g.Expect(do("CLIENT", "SETNAME", "a b")).To(Equal(fmt.Errorf("ERR Client names cannot contain spaces, newlines or special characters.")))
+	g.Expect(do("CLIENT", "SETNAME", "worker")).To(Equal("OK"))
+	g.Expect(do("CLIENT", "GETNAME")).To(Equal("worker"))
+	g.Expect(do("SELECT", "2")).To(Equal("OK"))
+	info := do("CLIENT", "INFO").(string)
+	g.Expect(strings.HasPrefix(info, fmt.Sprintf("id=%d addr=", id))).To(Equal(true))
+	for _, field := range []string{" name=worker ", " flags=N ", " db=2 ", " multi=-1 ", " cmd=client "} {
+		g.Expect(strings.Contains(info, field)).To(Equal(true))
+	}
+
+	// the state of the other connections is the one of their last command
+	other("SUBSCRIBE", "news")
+	otherReceive()
+	list := do("CLIENT", "LIST", "ID", fmt.Sprint(id), fmt.Sprint(otherId)).(string)
+	lines := strings.Split(strings.TrimSuffix(list, "\n"), "\n")
+	g.Expect(len(lines)).To(Equal(2))
+	g.Expect(strings.Contains(lines[1], " flags=P db=0 sub=1 psub=0 ssub=0 ")).To(Equal(true))
+	g.Expect(strings.Contains(lines[1], " cmd=subscribe ")).To(Equal(true))
+	list = do("CLIENT", "LIST", "TYPE", "pubsub").(string)
+	g.Expect(strings.Contains(list, fmt.Sprintf("id=%d ", otherId))).To(Equal(true))
+	g.Expect(strings.Contains(list, fmt.Sprintf("id=%d ", id))).To(Equal(false))
+	g.Expect(do("CLIENT", "LIST", "TYPE", "nosuchtype")).To(Equal(fmt.Errorf("ERR Unknown client type 'nosuchtype'")))
+
+	// blocked connections are flagged and counted
+	blocked, _ := connect(t, addr)
+	blocked("BLPOP", uuid.NewString(), "0")
+	time.Sleep(100 * time.Millisecond)
+	list = do("CLIENT", "LIST").(string)
+	g.Expect(strings.Contains(list, " flags=b ")).To(Equal(true))
+	_, blockedCount := server.clients.count()
+	g.Expect(blockedCount).To(Equal(1))
+
+	// killed connections are closed
+	conn, err := net.Dial("tcp", addr)
+	g.Expect(err).To(BeNil())
+	defer conn.Close()
+	g.Expect(do("CLIENT", "KILL", conn.LocalAddr().String())).To(Equal("OK"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	g.Expect(err).To(Equal(io.EOF))
+	g.Expect(do("CLIENT", "KILL", conn.LocalAddr().String())).To(Equal(errNoSuchClient))
+	g.Expect(do("CLIENT", "KILL", "ID", fmt.Sprint(id))).To(Equal(int64(0)))
+	g.Expect(do("CLIENT", "KILL", "ID", fmt.Sprint(otherId), "SKIPME", "yes")).To(Equal(int64(1)))
+	g.Expect(do("CLIENT", "KILL", "ID", "0")).To(Equal(fmt.Errorf("ERR client-id should be greater than 0")))
+	g.Expect(do("CLIENT", "NOSUCHSUBCOMMAND")).To(Equal(fmt.Errorf("ERR unknown subcommand or wrong number of arguments for 'nosuchsubcommand'")))
+}
+
+func TestServeClientPause(t *testing.T) {
+	g := NewWithT(t)
+	addr := listen(t, server)
+	send, receive := connect(t, addr)
+	do := func(args ...string) interface{} {
+		send(args...)
+		return receive()
+	}
+	other, otherReceive := connect(t, addr)
+	key := uuid.NewString()
+
+	// writes wait until CLIENT UNPAUSE, reads run
+	g.Expect(do("CLIENT", "PAUSE", "10000", "WRITE")).To(Equal("OK"))
+	other("SET", key, "a")
+	time.Sleep(100 * time.Millisecond)
+	g.Expect(do("GET", key)).To(BeNil())
+	g.Expect(do("CLIENT", "UNPAUSE")).To(Equal("OK"))
+	g.Expect(otherReceive()).To(Equal("OK"))
+
+	// every command waits until the timeout with ALL
+	g.Expect(do("CLIENT", "PAUSE", "200")).To(Equal("OK"))
+	start := time.Now()
+	other("GET", key)
+	g.Expect(otherReceive()).To(Equal("a"))
+	g.Expect(time.Since(start) >= 150*time.Millisecond).To(Equal(true))
+	g.Expect(do("CLIENT", "PAUSE", "-1")).To(Equal(fmt.Errorf("ERR timeout is not an integer or out of range")))
+	g.Expect(do("CLIENT", "PAUSE", "1", "READ")).To(Equal(errSyntax))
+}
+
+func TestServeHello(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	addr := listen(t, server)
+	send, receive := connect(t, addr)
+	do := func(args ...string) interface{} {
+		send(args...)
+		return receive()
+	}
+	hash := uuid.NewString()
+	g.Expect(server.HSet(ctx, hash, "b", "2")).To(BeNil())
+	g.Expect(server.HSet(ctx, hash, "a", "1")).To(BeNil())
+	set := []byte(uuid.NewString())
+	_, err := server.SAdd(ctx, set, []byte("x"))
+	g.Expect(err).To(BeNil())
+	zset := []byte(uuid.NewString())
+	_, err = server.ZAdd(ctx, zset, nil, Z{Score: 1.5, Member: []byte("m")})
+	g.Expect(err).To(BeNil())
+
+	// RESP2 until HELLO 3
+	g.Expect(do("HGETALL", hash)).To(Equal([]interface{}{"a", "1", "b", "2"}))
+	g.Expect(do("ZSCORE", string(zset), "m")).To(Equal("1.5"))
+	g.Expect(do("HELLO", "4")).To(Equal(fmt.Errorf("NOPROTO unsupported protocol version")))
+	g.Expect(do("HELLO", "3", "AUTH", "admin", "secret")).To(Equal(fmt.Errorf("WRONGPASS invalid username-password pair or user is disabled.")))
+	hello := do("HELLO", "3", "AUTH", "default", "secret", "SETNAME", "cache").(map[string]interface{})
+	g.Expect(hello["proto"]).To(Equal(int64(3)))
+	g.Expect(hello["server"]).To(Equal("redis"))
+	g.Expect(hello["modules"]).To(Equal([]interface{}{}))
+	g.Expect(do("CLIENT", "GETNAME")).To(Equal("cache"))
+	g.Expect(strings.Contains(do("CLIENT", "INFO").(string), " resp=3")).To(Equal(true))
+
+	g.Expect(do("HGETALL", hash)).To(Equal(map[string]interface{}{"a": "1", "b": "2"}))
+	g.Expect(do("HGET", hash, "c")).To(BeNil())
+	g.Expect(do("SMEMBERS", string(set))).To(Equal(respSet{"x"}))
+	g.Expect(do("ZSCORE", string(zset), "m")).To(Equal(1.5))
+	config := do("CONFIG", "GET", "notify-keyspace-events").(map[string]interface{})
+	_, ok := config["notify-keyspace-events"]
+	g.Expect(ok).To(Equal(true))
+
+	// subscribed RESP3 connections get push messages and may run commands
+	g.Expect(do("SUBSCRIBE", "news")).To(Equal(respPush{"subscribe", "news", int64(1)}))
+	g.Expect(do("HGET", hash, "a")).To(Equal("1"))
+	publisher, publisherReceive := connect(t, addr)
+	publisher("PUBLISH", "news", "hi")
+	g.Expect(publisherReceive()).To(Equal(int64(1)))
+	g.Expect(receive()).To(Equal(respPush{"message", "news", "hi"}))
+	g.Expect(do("HELLO", "2").([]interface{})[5]).To(Equal(int64(2)))
+}
@@ -0,0 +1,1000 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errSyntax     = fmt.Errorf("ERR syntax error")
+	errNotInteger = fmt.Errorf("ERR value is not an integer or out of range")
+	errNotFloat   = fmt.Errorf("ERR value is not a valid float")
+)
+
+// command is an entry of the command table served over the wire
+type command struct {
+	// number of arguments including the command name, or the negated
+	// minimum number of arguments for variadic commands
+	arity int
+	fn    func(c *Server, ctx context.Context, cl *client, args [][]byte) error
+	keys  keySpec
+	flags commandFlags
+}
+
+// keySpec gives the positions of the key arguments like COMMAND INFO: the
+// first key, the last key, negative to count from the end, and the step
+// between keys. Commands without keys have a zero keySpec.
+type keySpec struct {
+	first, last, step int
+	// position of the argument giving the number of keys which follow it,
+	// instead of first and last, like in EVAL
+	numKeys int
+	// keys are the first half of the arguments following this keyword,
+	// instead of first and last, like in XREAD
+	keyword string
+}
+
+var (
+	noKeys  = keySpec{}
+	oneKey  = keySpec{first: 1, last: 1, step: 1}
+	twoKeys = keySpec{first: 1, last: 2, step: 1}
+	allKeys = keySpec{first: 1, last: -1, step: 1}
+	numKeys = keySpec{numKeys: 2}
+	streams = keySpec{keyword: "streams"}
+	// keys followed by a timeout, like in BLPOP
+	allButLast = keySpec{first: 1, last: -2, step: 1}
+)
+
+// keys returns the key arguments of args, which include the command name
+func (spec keySpec) keys(args [][]byte) [][]byte {
+	keys := [][]byte{}
+	if spec.keyword != "" {
+		for i := 1; i < len(args); i++ {
+			if strings.EqualFold(string(args[i]), spec.keyword) {
+				rest := args[i+1:]
+				return append(keys, rest[:len(rest)/2]...)
+			}
+		}
+		return keys
+	}
+	if spec.numKeys > 0 {
+		if spec.numKeys >= len(args) {
+			return keys
+		}
+		n, err := strconv.Atoi(string(args[spec.numKeys]))
+		for i := spec.numKeys + 1; err == nil && i <= spec.numKeys+n && i < len(args); i++ {
+			keys = append(keys, args[i])
+		}
+		return keys
+	}
+	if spec.first == 0 {
+		return keys
+	}
+	last := spec.last
+	if last < 0 {
+		last += len(args)
+	}
+	for i := spec.first; i <= last && i < len(args); i += spec.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+type commandFlags int
+
+const (
+	// flagNoQueue commands run at once within MULTI instead of being queued
+	flagNoQueue commandFlags = 1 << iota
+	// flagNoMulti commands change the state of the connection, and are
+	// refused within MULTI and scripts
+	flagNoMulti
+	// flagNoScript commands are refused within scripts
+	flagNoScript
+	// flagSubscribed commands are allowed to clients subscribed to channels
+	flagSubscribed
+	// flagWrite commands may write, they are paused by CLIENT PAUSE WRITE
+	flagWrite
+	// flagKeyspace commands read or write the whole keyspace of one or every
+	// database, EXEC holds the keyspace of this process to run them
+	flagKeyspace
+	// flagInternal commands are sent by the other processes sharing the
+	// object storage, they are only run by the connections of ServePeers
+	flagInternal
+)
+
+// commands maps lower case command names to their implementation
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":     {-1, cmdPing, noKeys, flagSubscribed},
+		"echo":     {2, cmdEcho, noKeys, 0},
+		"quit":     {1, cmdQuit, noKeys, flagNoQueue | flagSubscribed},
+		"get":      {2, cmdGet, oneKey, 0},
+		"set":      {-3, cmdSet, oneKey, flagWrite},
+		"mget":     {-2, cmdMGet, allKeys, 0},
+		"mset":     {-3, cmdMSet, keySpec{first: 1, last: -1, step: 2}, flagWrite},
+		"type":     {2, cmdType, oneKey, 0},
+		"scan":     {-2, cmdScan, noKeys, flagNoScript | flagKeyspace},
+		"keys":     {2, cmdKeys, noKeys, flagNoScript | flagKeyspace},
+		"info":     {-1, cmdInfo, noKeys, flagNoScript | flagKeyspace},
+		"dbsize":   {1, cmdDBSize, noKeys, flagNoScript | flagKeyspace},
+		"flushdb":  {-1, cmdFlushDB, noKeys, flagNoScript | flagKeyspace | flagWrite},
+		"flushall": {-1, cmdFlushAll, noKeys, flagNoScript | flagKeyspace | flagWrite},
+		"select":   {2, cmdSelect, noKeys, flagNoScript},
+		"move":     {3, cmdMove, oneKey, flagNoScript | flagWrite},
+		"swapdb":   {3, cmdSwapDB, noKeys, flagNoScript | flagKeyspace | flagWrite},
+		"rename":   {3, cmdRename, twoKeys, flagWrite},
+		"renamenx": {3, cmdRenameNX, twoKeys, flagWrite},
+		"copy":     {-3, cmdCopy, twoKeys, flagWrite},
+		"incr":     {2, cmdIncr, oneKey, flagWrite},
+		"incrby":   {3, cmdIncrBy, oneKey, flagWrite},
+		"decr":     {2, cmdDecr, oneKey, flagWrite},
+		"decrby":   {3, cmdDecrBy, oneKey, flagWrite},
+		"exists":   {-2, cmdExists, allKeys, 0},
+		"del":      {-2, cmdDel, allKeys, flagWrite},
+		"expire":   {3, cmdExpire, oneKey, flagWrite},
+		"pexpire":  {3, cmdPExpire, oneKey, flagWrite},
+		"ttl":      {2, cmdTTL, oneKey, 0},
+		"pttl":     {2, cmdPTTL, oneKey, 0},
+		"hset":     {-4, cmdHSet, oneKey, flagWrite},
+		"hget":     {3, cmdHGet, oneKey, 0},
+		"hgetall":  {2, cmdHGetAll, oneKey, 0},
+		"smembers": {2, cmdSMembers, oneKey, 0},
+		"zscore":   {3, cmdZScore, oneKey, 0},
+		"lpush":    {-3, cmdLPush, oneKey, flagWrite},
+		"rpush":    {-3, cmdRPush, oneKey, flagWrite},
+		"zadd":     {-4, cmdZAdd, oneKey, flagWrite},
+		"xadd":     {-5, cmdXAdd, oneKey, flagWrite},
+		"multi":    {1, cmdMulti, noKeys, flagNoQueue},
+		"exec":     {1, cmdExec, noKeys, flagNoQueue},
+		"discard":  {1, cmdDiscard, noKeys, flagNoQueue},
+		"watch":    {-2, cmdWatch, allKeys, flagNoQueue},
+		"unwatch":  {1, cmdUnwatch, noKeys, flagNoScript},
+		"eval":     {-3, cmdEval, numKeys, flagNoScript | flagWrite},
+		"evalsha":  {-3, cmdEvalSha, numKeys, flagNoScript | flagWrite},
+		"script":   {-2, cmdScript, noKeys, flagNoScript},
+		"function": {-2, cmdFunction, noKeys, flagNoScript | flagWrite},
+		"fcall":    {-3, cmdFCall, numKeys, flagNoScript | flagWrite},
+		"fcall_ro": {-3, cmdFCallRO, numKeys, flagNoScript},
+		"config":   {-2, cmdConfig, noKeys, flagNoScript},
+		"client":   {-2, cmdClient, noKeys, flagNoScript},
+		"hello":    {-1, cmdHello, noKeys, flagNoMulti | flagNoScript | flagSubscribed},
+
+		"sadd":      {-3, cmdSAdd, oneKey, flagWrite},
+		"srem":      {-3, cmdSRem, oneKey, flagWrite},
+		"sismember": {3, cmdSIsMember, oneKey, 0},
+		"scard":     {2, cmdSCard, oneKey, 0},
+		"lpop":      {-2, cmdLPop, oneKey, flagWrite},
+		"rpop":      {-2, cmdRPop, oneKey, flagWrite},
+		"llen":      {2, cmdLLen, oneKey, 0},
+		"lrange":    {4, cmdLRange, oneKey, 0},
+		"zrem":      {-3, cmdZRem, oneKey, flagWrite},
+		"zcard":     {2, cmdZCard, oneKey, 0},
+
+		"subscribe":     {-2, cmdSubscribe, noKeys, flagNoMulti | flagNoScript | flagSubscribed},
+		"unsubscribe":   {-1, cmdUnsubscribe, noKeys, flagNoMulti | flagNoScript | flagSubscribed},
+		"psubscribe":    {-2, cmdPSubscribe, noKeys, flagNoMulti | flagNoScript | flagSubscribed},
+		"punsubscribe":  {-1, cmdPUnsubscribe, noKeys, flagNoMulti | flagNoScript | flagSubscribed},
+		"ssubscribe":    {-2, cmdSSubscribe, noKeys, flagNoMulti | flagNoScript | flagSubscribed},
+		"sunsubscribe":  {-1, cmdSUnsubscribe, noKeys, flagNoMulti | flagNoScript | flagSubscribed},
+		"publish":       {3, cmdPublish, noKeys, flagWrite},
+		"spublish":      {3, cmdSPublish, noKeys, flagWrite},
+		"pubsub":        {-2, cmdPubSub, noKeys, 0},
+		"s3dis.publish": {-3, cmdForwardedPublish, noKeys, flagNoMulti | flagNoScript | flagInternal},
+
+		"blpop":        {-3, cmdBLPop, allButLast, flagWrite},
+		"brpop":        {-3, cmdBRPop, allButLast, flagWrite},
+		"blmove":       {6, cmdBLMove, twoKeys, flagWrite},
+		"bzpopmin":     {-3, cmdBZPopMin, allButLast, flagWrite},
+		"bzpopmax":     {-3, cmdBZPopMax, allButLast, flagWrite},
+		"xread":        {-4, cmdXRead, streams, 0},
+		"s3dis.signal": {3, cmdSignal, noKeys, flagNoMulti | flagNoScript | flagInternal},
+
+		"s3dis.invalidate": {-1, cmdInvalidate, noKeys, flagNoMulti | flagNoScript | flagInternal},
+	}
+}
+
+func parseInt(arg []byte) (int64, error) {
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	return n, nil
+}
+
+func parseFloat(arg []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+func cmdPing(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	if cl.subscribed() && !cl.w.resp3 && len(args) <= 1 {
+		// like in Redis, subscribed clients get a push-like reply
+		cl.w.writeArray(2)
+		cl.w.writeBulk([]byte("pong"))
+		if len(args) == 0 {
+			cl.w.writeBulk([]byte{})
+		} else {
+			cl.w.writeBulk(args[0])
+		}
+		return nil
+	}
+	switch len(args) {
+	case 0:
+		cl.w.writeSimple("PONG")
+	case 1:
+		cl.w.writeBulk(args[0])
+	default:
+		return fmt.Errorf("ERR wrong number of arguments for 'ping' command")
+	}
+	return nil
+}
+
+func cmdEcho(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	cl.w.writeBulk(args[0])
+	return nil
+}
+
+func cmdQuit(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	cl.quit = true
+	cl.w.writeSimple("OK")
+	return nil
+}
+
+func cmdGet(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	val, err := c.Get(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	cl.w.writeBulk(val)
+	return nil
+}
+
+// parseSetOptions parses the options of SET following the key and the value
+func parseSetOptions(args [][]byte) (*SetOptions, error) {
+	opts := &SetOptions{}
+	ttl := map[string]**int64{"ex": &opts.EX, "px": &opts.PX, "exat": &opts.EXAT, "pxat": &opts.PXAT}
+	for i := 0; i < len(args); i++ {
+		name := strings.ToLower(string(args[i]))
+		switch {
+		case name == "nx":
+			opts.NX = true
+		case name == "xx":
+			opts.XX = true
+		case name == "get":
+			opts.Get = true
+		case name == "keepttl":
+			opts.KeepTTL = true
+		case ttl[name] != nil && i+1 < len(args):
+			n, err := parseInt(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			*ttl[name] = &n
+			i++
+		default:
+			return nil, errSyntax
+		}
+	}
+	return opts, nil
+}
+
+func cmdSet(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	opts, err := parseSetOptions(args[2:])
+	if err != nil {
+		return err
+	}
+	res, err := c.SetWithOptions(ctx, args[0], args[1], opts)
+	if err != nil {
+		return err
+	}
+	switch {
+	case opts.Get:
+		cl.w.writeBulk(res.Old)
+	case res.Applied:
+		cl.w.writeSimple("OK")
+	default:
+		cl.w.writeBulk(nil)
+	}
+	return nil
+}
+
+func cmdMGet(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	values, err := c.MGet(ctx, args)
+	if err != nil {
+		return err
+	}
+	cl.w.writeBulks(values)
+	return nil
+}
+
+func cmdMSet(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	if len(args)%2 != 0 {
+		return fmt.Errorf("ERR wrong number of arguments for 'mset' command")
+	}
+	keys, values := [][]byte{}, [][]byte{}
+	for i := 0; i < len(args); i += 2 {
+		keys = append(keys, args[i])
+		values = append(values, args[i+1])
+	}
+	err := c.MSet(ctx, keys, values)
+	if err != nil {
+		return err
+	}
+	cl.w.writeSimple("OK")
+	return nil
+}
+
+func cmdType(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	typ, err := c.Type(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	cl.w.writeSimple(typ)
+	return nil
+}
+
+func cmdIncr(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	return incrBy(c, ctx, cl, args[0], 1)
+}
+
+func cmdIncrBy(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	n, err := parseInt(args[1])
+	if err != nil {
+		return err
+	}
+	return incrBy(c, ctx, cl, args[0], n)
+}
+
+func cmdDecr(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	return incrBy(c, ctx, cl, args[0], -1)
+}
+
+func cmdDecrBy(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	n, err := parseInt(args[1])
+	if err != nil {
+		return err
+	}
+	if n == math.MinInt64 {
+		return fmt.Errorf("ERR decrement would overflow")
+	}
+	return incrBy(c, ctx, cl, args[0], -n)
+}
+
+func incrBy(c *Server, ctx context.Context, cl *client, key []byte, increment int64) error {
+	n, err := c.IncrBy(ctx, key, increment)
+	if err != nil {
+		return err
+	}
+	cl.w.writeInt(n)
+	return nil
+}
+
+func cmdExists(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	n, err := c.Exists(ctx, args...)
+	if err != nil {
+		return err
+	}
+	cl.w.writeInt(n)
+	return nil
+}
+
+func cmdDel(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	n, err := c.Del(ctx, args...)
+	if err != nil {
+		return err
+	}
+	cl.w.writeInt(n)
+	return nil
+}
+
+func cmdExpire(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	return expire(c, ctx, cl, args, "expire", time.Second)
+}
+
+func cmdPExpire(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	return expire(c, ctx, cl, args, "pexpire", time.Millisecond)
+}
+
+func expire(c *Server, ctx context.Context, cl *client, args [][]byte, name string, unit time.Duration) error {
+	n, err := parseInt(args[1])
+	if err != nil {
+		return err
+	}
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return fmt.Errorf("ERR invalid expire time in '%s' command", name)
+	}
+	exists, err := c.Expire(ctx, args[0], time.Duration(n)*unit)
+	if err != nil {
+		return err
+	}
+	cl.w.writeBool(exists)
+	return nil
+}
+
+// cmdTTL rounds the time to live to the nearest second like Redis
+func cmdTTL(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	ttl, err := c.PTTL(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if ttl >= 0 {
+		ttl = (ttl + 500) / 1000
+	}
+	cl.w.writeInt(ttl)
+	return nil
+}
+
+func cmdPTTL(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	ttl, err := c.PTTL(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	cl.w.writeInt(ttl)
+	return nil
+}
+
+// parseScanOptions parses the MATCH, COUNT and TYPE options of SCAN
+func parseScanOptions(args [][]byte) (*ScanOptions, error) {
+	opts := &ScanOptions{}
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, errSyntax
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			opts.Match = string(args[i+1])
+		case "count":
+			n, err := parseInt(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			if n < 1 {
+				return nil, errSyntax
+			}
+			opts.Count = n
+		case "type":
+			opts.Type = string(args[i+1])
+		default:
+			return nil, errSyntax
+		}
+	}
+	return opts, nil
+}
+
+func cmdScan(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	opts, err := parseScanOptions(args[1:])
+	if err != nil {
+		return err
+	}
+	cursor, keys, err := c.Scan(ctx, string(args[0]), opts)
+	if err != nil {
+		return err
+	}
+	cl.w.writeArray(2)
+	cl.w.writeBulk([]byte(cursor))
+	cl.w.writeBulks(keys)
+	return nil
+}
+
+func cmdKeys(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	keys, err := c.Keys(ctx, string(args[0]))
+	if err != nil {
+		return err
+	}
+	cl.w.writeBulks(keys)
+	return nil
+}
+
+func cmdInfo(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	info, err := c.Info(ctx)
+	if err != nil {
+		return err
+	}
+	connected, blocked := c.clients.count()
+	clients := fmt.Sprintf("# Clients\r\nconnected_clients:%d\r\nblocked_clients:%d\r\n\r\n", connected, blocked)
+	cl.w.writeBulk([]byte(clients + "# Keyspace\r\n" + info + "\r\n"))
+	return nil
+}
+
+func cmdDBSize(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	n, err := c.DBSize(ctx)
+	if err != nil {
+		return err
+	}
+	cl.w.writeInt(n)
+	return nil
+}
+
+// parseFlushMode parses the optional ASYNC or SYNC argument of FLUSHDB and
+// FLUSHALL, and reports whether the flush is asynchronous
+func parseFlushMode(args [][]byte) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	if len(args) > 1 {
+		return false, errSyntax
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "async":
+		return true, nil
+	case "sync":
+		return false, nil
+	}
+	return false, errSyntax
+}
+
+func cmdFlushDB(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	async, err := parseFlushMode(args)
+	if err != nil {
+		return err
+	}
+	err = c.FlushDB(ctx, async)
+	if err != nil {
+		return err
+	}
+	cl.w.writeSimple("OK")
+	return nil
+}
+
+func cmdFlushAll(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	async, err := parseFlushMode(args)
+	if err != nil {
+		return err
+	}
+	err = c.FlushAll(ctx, async)
+	if err != nil {
+		return err
+	}
+	cl.w.writeSimple("OK")
+	return nil
+}
+
+// parseDBIndex parses the index of a logical database
+func parseDBIndex(arg []byte) (int, error) {
+	n, err := strconv.Atoi(string(arg))
+	if err != nil {
+		return 0, errNotInteger
+	}
+	return n, nil
+}
+
+func cmdSelect(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	index, err := parseDBIndex(args[0])
+	if err != nil {
+		return err
+	}
+	_, err = c.Select(index)
+	if err != nil {
+		return err
+	}
+	cl.db = index
+	cl.w.writeSimple("OK")
+	return nil
+}
+
+func cmdMove(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	index, err := parseDBIndex(args[1])
+	if err != nil {
+		return err
+	}
+	moved, err := c.Move(ctx, args[0], index)
+	if err != nil {
+		return err
+	}
+	cl.w.writeBool(moved)
+	return nil
+}
+
+func cmdSwapDB(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	a, err := parseDBIndex(args[0])
+	if err != nil {
+		return err
+	}
+	b, err := parseDBIndex(args[1])
+	if err != nil {
+		return err
+	}
+	err = c.SwapDB(ctx, a, b)
+	if err != nil {
+		return err
+	}
+	cl.w.writeSimple("OK")
+	return nil
+}
+
+func cmdRename(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	err := c.Rename(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	cl.w.writeSimple("OK")
+	return nil
+}
+
+func cmdRenameNX(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	renamed, err := c.RenameNX(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	cl.w.writeBool(renamed)
+	return nil
+}
+
+func cmdCopy(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	opts := &CopyOptions{}
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "replace":
+			opts.Replace = true
+		case "db":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			index, err := parseDBIndex(args[i+1])
+			if err != nil {
+				return err
+			}
+			opts.DB = &index
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	copied, err := c.Copy(ctx, args[0], args[1], opts)
+	if err != nil {
+		return err
+	}
+	cl.w.writeBool(copied)
+	return nil
+}
+
+func cmdHSet(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	fieldValues := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		fieldValues = append(fieldValues, string(arg))
+	}
+	n, err := c.HSetFields(ctx, string(args[0]), fieldValues...)
+	if err != nil {
+		return err
+	}
+	cl.w.writeInt(n)
+	return nil
+}
+
+func cmdHGet(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	hash, err := c.HGetAll(ctx, string(args[0]))
+	if err != nil {
+		return err
+	}
+	value, ok := hash[string(args[1])]
+	if !ok {
+		cl.w.writeBulk(nil)
+		return nil
+	}
+	cl.w.writeBulk([]byte(value))
+	return nil
+}
+
+// cmdHGetAll replies a map in RESP3, the fields in lexical order
+func cmdHGetAll(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	hash, err := c.HGetAll(ctx, string(args[0]))
+	if err != nil {
+		return err
+	}
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	cl.w.writeMap(len(fields))
+	for _, field := range fields {
+		cl.w.writeBulk([]byte(field))
+		cl.w.writeBulk([]byte(hash[field]))
+	}
+	return nil
+}
+
+func cmdSAdd(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	n, err := c.SAdd(ctx, args[0], args[1:]...)
+	if err != nil {
+		return err
+	}
+	cl.w.writeInt(n)
+	return nil
+}
+
+func cmdSRem(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	n, err := c.SRem(ctx, args[0], args[1:]...)
+	if err != nil {
+		return err
+	}
+	cl.w.writeInt(n)
+	return nil
+}
+
+func cmdSIsMember(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	ok, err := c.SIsMember(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	cl.w.writeBool(ok)
+	return nil
+}
+
+func cmdSCard(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	n, err := c.SCard(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	cl.w.writeInt(n)
+	return nil
+}
+
+func cmdSMembers(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	members, err := c.SMembers(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	cl.w.writeSet(len(members))
+	for _, member := range members {
+		cl.w.writeBulk(member)
+	}
+	return nil
+}
+
+func cmdZScore(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	score, ok, err := c.ZScore(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		cl.w.writeBulk(nil)
+		return nil
+	}
+	cl.w.writeDouble(score)
+	return nil
+}
+
+func cmdLPush(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	n, err := c.LPush(ctx, args[0], args[1:]...)
+	if err != nil {
+		return err
+	}
+	cl.w.writeInt(n)
+	return nil
+}
+
+func cmdRPush(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	n, err := c.RPush(ctx, args[0], args[1:]...)
+	if err != nil {
+		return err
+	}
+	cl.w.writeInt(n)
+	return nil
+}
+
+func cmdLPop(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	return pop(c, ctx, cl, args, true)
+}
+
+func cmdRPop(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	return pop(c, ctx, cl, args, false)
+}
+
+// pop replies an element without a count, an array of elements or a nil
+// array otherwise
+func pop(c *Server, ctx context.Context, cl *client, args [][]byte, left bool) error {
+	switch len(args) {
+	case 1:
+		values, err := c.pop(ctx, args[0], left, 1)
+		if err != nil {
+			return err
+		}
+		if len(values) == 0 {
+			cl.w.writeBulk(nil)
+			return nil
+		}
+		cl.w.writeBulk(values[0])
+		return nil
+	case 2:
+		count, err := parseInt(args[1])
+		if err != nil {
+			return err
+		}
+		values, err := c.pop(ctx, args[0], left, count)
+		if err != nil {
+			return err
+		}
+		if values == nil {
+			cl.w.writeNullArray()
+			return nil
+		}
+		cl.w.writeBulks(values)
+		return nil
+	}
+	return errSyntax
+}
+
+func cmdLLen(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	n, err := c.LLen(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	cl.w.writeInt(n)
+	return nil
+}
+
+func cmdLRange(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	start, err := parseInt(args[1])
+	if err != nil {
+		return err
+	}
+	stop, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	values, err := c.LRange(ctx, args[0], start, stop)
+	if err != nil {
+		return err
+	}
+	cl.w.writeBulks(values)
+	return nil
+}
+
+// cmdZAdd replies the new score with INCR, the number of added or changed
+// members otherwise
+func cmdZAdd(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	opts := &ZAddOptions{}
+	incr := false
+	i := 1
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "nx":
+			opts.NX = true
+		case "xx":
+			opts.XX = true
+		case "gt":
+			opts.GT = true
+		case "lt":
+			opts.LT = true
+		case "ch":
+			opts.CH = true
+		case "incr":
+			incr = true
+		default:
+			break options
+		}
+	}
+	rest := args[i:]
+	if len(rest) == 0 || len(rest)%2 != 0 {
+		return errSyntax
+	}
+	members := []Z{}
+	for j := 0; j < len(rest); j += 2 {
+		score, err := parseFloat(rest[j])
+		if err != nil {
+			return err
+		}
+		members = append(members, Z{Score: score, Member: rest[j+1]})
+	}
+	if incr {
+		if len(members) != 1 {
+			return fmt.Errorf("ERR INCR option supports a single increment-element pair")
+		}
+		score, ok, err := c.ZAddIncr(ctx, args[0], opts, members[0])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			cl.w.writeBulk(nil)
+			return nil
+		}
+		cl.w.writeDouble(score)
+		return nil
+	}
+	n, err := c.ZAdd(ctx, args[0], opts, members...)
+	if err != nil {
+		return err
+	}
+	cl.w.writeInt(n)
+	return nil
+}
+
+func cmdZRem(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	n, err := c.ZRem(ctx, args[0], args[1:]...)
+	if err != nil {
+		return err
+	}
+	cl.w.writeInt(n)
+	return nil
+}
+
+func cmdZCard(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	n, err := c.ZCard(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	cl.w.writeInt(n)
+	return nil
+}
+
+// parseXTrimArgs parses the trimming options of XADD and XTRIM starting with
+// MAXLEN or MINID, and returns the number of arguments parsed
+func parseXTrimArgs(args [][]byte) (*XTrimArgs, int, error) {
+	trim := &XTrimArgs{}
+	i := 1
+	if i < len(args) && (string(args[i]) == "~" || string(args[i]) == "=") {
+		trim.Approx = string(args[i]) == "~"
+		i++
+	}
+	if i >= len(args) {
+		return nil, 0, errSyntax
+	}
+	if strings.EqualFold(string(args[0]), "maxlen") {
+		n, err := parseInt(args[i])
+		if err != nil {
+			return nil, 0, err
+		}
+		trim.MaxLen = n
+	} else {
+		trim.MinID = string(args[i])
+	}
+	i++
+	if i+1 < len(args) && strings.EqualFold(string(args[i]), "limit") {
+		n, err := parseInt(args[i+1])
+		if err != nil {
+			return nil, 0, err
+		}
+		trim.Limit = n
+		i += 2
+	}
+	return trim, i, nil
+}
+
+func cmdXAdd(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	xargs := &XAddArgs{}
+	i := 1
+options:
+	for i < len(args) {
+		switch strings.ToLower(string(args[i])) {
+		case "nomkstream":
+			xargs.NoMkStream = true
+			i++
+		case "maxlen", "minid":
+			trim, n, err := parseXTrimArgs(args[i:])
+			if err != nil {
+				return err
+			}
+			xargs.Trim = trim
+			i += n
+		default:
+			break options
+		}
+	}
+	if i >= len(args) {
+		return errSyntax
+	}
+	xargs.ID = string(args[i])
+	xargs.Fields = args[i+1:]
+	id, err := c.XAdd(ctx, args[0], xargs)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		cl.w.writeBulk(nil)
+		return nil
+	}
+	cl.w.writeBulk([]byte(id))
+	return nil
+}
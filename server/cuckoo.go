@@ -0,0 +1,501 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+// Defaults of RedisBloom for Cuckoo filters.
+const (
+	cuckooDefaultCapacity      = 1024
+	cuckooDefaultBucketSize    = 2
+	cuckooDefaultMaxIterations = 20
+	cuckooDefaultExpansion     = 1
+)
+
+// cuckooFilter is a scalable Cuckoo filter of 8 bits fingerprints. Every
+// sub-filter has a power of two number of buckets of bucketSize slots, and
+// once an item can not be placed in the last one, a sub-filter expansion
+// times larger is added.
+type cuckooFilter struct {
+	f             *db.Filter
+	bucketSize    uint64
+	maxIterations uint64
+	expansion     uint64
+	items         uint64
+	deletes       uint64
+	buckets       []uint64 // number of buckets of each sub-filter
+}
+
+func nextPowerOfTwo(n uint64) uint64 {
+	p := uint64(1)
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// cuckooHash returns the fingerprint of item, never zero since zero marks
+// empty slots, and its primary bucket hash
+func cuckooHash(item []byte) (byte, uint64) {
+	h := murmurHash64A(item, 0)
+	return byte(h%255 + 1), h
+}
+
+// altIndex returns the other bucket of a fingerprint
+func altIndex(fp byte, i uint64, buckets uint64) uint64 {
+	return (i ^ uint64(fp)*0x5bd1e995) % buckets
+}
+
+func (c *cuckooFilter) meta(name string) uint64 {
+	return binary.BigEndian.Uint64(c.f.Meta(name))
+}
+
+func openCuckoo(tx *db.Tx, key []byte) (*cuckooFilter, error) {
+	f, err := tx.OpenFilter(key, db.TypeCuckoo, false)
+	if err != nil || f == nil {
+		return nil, err
+	}
+	c := &cuckooFilter{f: f}
+	c.bucketSize = c.meta("bucket_size")
+	c.maxIterations = c.meta("max_iterations")
+	c.expansion = c.meta("expansion")
+	c.items = c.meta("items")
+	c.deletes = c.meta("deletes")
+	for _, sub := range f.Subs() {
+		c.buckets = append(c.buckets, binary.BigEndian.Uint64(sub))
+	}
+	return c, nil
+}
+
+// CFReserveOptions mirrors the options of CF.RESERVE. Zero values select
+// the defaults of RedisBloom.
+type CFReserveOptions struct {
+	BucketSize    int64
+	MaxIterations int64
+	Expansion     int64
+}
+
+func (opts *CFReserveOptions) validate(capacity int64) error {
+	if opts.BucketSize == 0 {
+		opts.BucketSize = cuckooDefaultBucketSize
+	}
+	if opts.MaxIterations == 0 {
+		opts.MaxIterations = cuckooDefaultMaxIterations
+	}
+	if opts.Expansion == 0 {
+		opts.Expansion = cuckooDefaultExpansion
+	}
+	if capacity < 2*opts.BucketSize {
+		return fmt.Errorf("ERR Capacity must be at least (BucketSize * 2)")
+	}
+	if opts.BucketSize < 1 || opts.BucketSize > 255 {
+		return fmt.Errorf("ERR Bucket size must be between 1 and 255")
+	}
+	if opts.MaxIterations < 1 || opts.MaxIterations > 65535 {
+		return fmt.Errorf("ERR Max iterations must be between 1 and 65535")
+	}
+	if opts.Expansion < 0 || opts.Expansion > 32768 {
+		return fmt.Errorf("ERR Expansion must be between 0 and 32768")
+	}
+	return nil
+}
+
+// createCuckoo creates an empty Cuckoo filter at key
+func createCuckoo(tx *db.Tx, key []byte, capacity int64, opts *CFReserveOptions) (*cuckooFilter, error) {
+	f, err := tx.OpenFilter(key, db.TypeCuckoo, true)
+	if err != nil {
+		return nil, err
+	}
+	c := &cuckooFilter{
+		f:             f,
+		bucketSize:    uint64(opts.BucketSize),
+		maxIterations: uint64(opts.MaxIterations),
+		expansion:     nextPowerOfTwo(uint64(opts.Expansion)),
+	}
+	for name, v := range map[string]uint64{
+		"bucket_size":    c.bucketSize,
+		"max_iterations": c.maxIterations,
+		"expansion":      c.expansion,
+		"items":          0,
+		"deletes":        0,
+	} {
+		err = f.SetMeta(name, encodeUint64(v))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, c.grow(nextPowerOfTwo(uint64(capacity) / c.bucketSize))
+}
+
+// grow adds a sub-filter of n buckets
+func (c *cuckooFilter) grow(n uint64) error {
+	c.buckets = append(c.buckets, n)
+	return c.f.SetSub(len(c.buckets)-1, encodeUint64(n))
+}
+
+func (c *cuckooFilter) saveCounts() error {
+	err := c.f.SetMeta("items", encodeUint64(c.items))
+	if err != nil {
+		return err
+	}
+	return c.f.SetMeta("deletes", encodeUint64(c.deletes))
+}
+
+func (c *cuckooFilter) slot(sub int, bucket uint64, i uint64) byte {
+	return c.f.Byte(sub, bucket*c.bucketSize+i)
+}
+
+func (c *cuckooFilter) setSlot(sub int, bucket uint64, i uint64, fp byte) error {
+	return c.f.SetByte(sub, bucket*c.bucketSize+i, fp)
+}
+
+// place stores fp in a free slot of bucket, and reports whether one was free
+func (c *cuckooFilter) place(sub int, bucket uint64, fp byte) (bool, error) {
+	for i := uint64(0); i < c.bucketSize; i++ {
+		if c.slot(sub, bucket, i) == 0 {
+			return true, c.setSlot(sub, bucket, i, fp)
+		}
+	}
+	return false, nil
+}
+
+// insertSub inserts fp in the sub-filter sub, relocating fingerprints up to
+// maxIterations times. Relocations are undone if no free slot is found.
+func (c *cuckooFilter) insertSub(sub int, fp byte, h uint64) (bool, error) {
+	n := c.buckets[sub]
+	i1 := h % n
+	i2 := altIndex(fp, i1, n)
+	for _, i := range []uint64{i1, i2} {
+		ok, err := c.place(sub, i, fp)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	type swap struct {
+		bucket, slot uint64
+		fp           byte
+	}
+	swaps := []swap{}
+	bucket := i2
+	for iter := uint64(0); iter < c.maxIterations; iter++ {
+		slot := iter % c.bucketSize
+		victim := c.slot(sub, bucket, slot)
+		err := c.setSlot(sub, bucket, slot, fp)
+		if err != nil {
+			return false, err
+		}
+		swaps = append(swaps, swap{bucket: bucket, slot: slot, fp: victim})
+		fp = victim
+		bucket = altIndex(fp, bucket, n)
+		ok, err := c.place(sub, bucket, fp)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	for i := len(swaps) - 1; i >= 0; i-- {
+		err := c.setSlot(sub, swaps[i].bucket, swaps[i].slot, swaps[i].fp)
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func (c *cuckooFilter) insert(item []byte) error {
+	fp, h := cuckooHash(item)
+	last := len(c.buckets) - 1
+	ok, err := c.insertSub(last, fp, h)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if c.expansion == 0 {
+			return fmt.Errorf("ERR Filter is full")
+		}
+		err = c.grow(c.buckets[last] * c.expansion)
+		if err != nil {
+			return err
+		}
+		_, err = c.insertSub(last+1, fp, h)
+		if err != nil {
+			return err
+		}
+	}
+	c.items++
+	return c.saveCounts()
+}
+
+// count returns the number of occurrences of the fingerprint of item
+func (c *cuckooFilter) count(item []byte) int64 {
+	fp, h := cuckooHash(item)
+	n := int64(0)
+	for sub, buckets := range c.buckets {
+		i1 := h % buckets
+		i2 := altIndex(fp, i1, buckets)
+		for _, bucket := range []uint64{i1, i2} {
+			for i := uint64(0); i < c.bucketSize; i++ {
+				if c.slot(sub, bucket, i) == fp {
+					n++
+				}
+			}
+			if i1 == i2 {
+				break
+			}
+		}
+	}
+	return n
+}
+
+// delete removes one occurrence of item, from the newest sub-filter first
+func (c *cuckooFilter) delete(item []byte) (bool, error) {
+	fp, h := cuckooHash(item)
+	for sub := len(c.buckets) - 1; sub >= 0; sub-- {
+		i1 := h % c.buckets[sub]
+		i2 := altIndex(fp, i1, c.buckets[sub])
+		for _, bucket := range []uint64{i1, i2} {
+			for i := uint64(0); i < c.bucketSize; i++ {
+				if c.slot(sub, bucket, i) != fp {
+					continue
+				}
+				err := c.setSlot(sub, bucket, i, 0)
+				if err != nil {
+					return false, err
+				}
+				c.items--
+				c.deletes++
+				return true, c.saveCounts()
+			}
+		}
+	}
+	return false, nil
+}
+
+// CFReserve creates an empty Cuckoo filter at key for capacity items.
+func (c *Server) CFReserve(ctx context.Context, key []byte, capacity int64, opts *CFReserveOptions) error {
+	if opts == nil {
+		opts = &CFReserveOptions{}
+	}
+	ctx = withCommand(ctx, "CF.RESERVE", key, capacity, optionalInt("BUCKETSIZE", opts.BucketSize), optionalInt("MAXITERATIONS", opts.MaxIterations), optionalInt("EXPANSION", opts.Expansion))
+	err := opts.validate(capacity)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(ctx, key, func(tx *db.Tx) error {
+		exists, err := tx.Exists(key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errFilterExists
+		}
+		_, err = createCuckoo(tx, key, capacity, opts)
+		return err
+	})
+}
+
+// CFInsertOptions mirrors the options of CF.INSERT. Capacity applies when the
+// filter is created, 1024 if zero.
+type CFInsertOptions struct {
+	Capacity int64
+	NoCreate bool
+}
+
+// cfInsert adds items to the Cuckoo filter stored at key. If nx is true items
+// which may already be present are skipped. It reports for each item
+// whether it was added.
+func (c *Server) cfInsert(ctx context.Context, key []byte, opts *CFInsertOptions, nx bool, items ...[]byte) ([]bool, error) {
+	if opts == nil {
+		opts = &CFInsertOptions{}
+	}
+	capacity := opts.Capacity
+	if capacity == 0 {
+		capacity = cuckooDefaultCapacity
+	}
+	reserve := &CFReserveOptions{}
+	err := reserve.validate(capacity)
+	if err != nil {
+		return nil, err
+	}
+	res := []bool{}
+	err = c.update(ctx, key, func(tx *db.Tx) error {
+		cf, err := openCuckoo(tx, key)
+		if err != nil {
+			return err
+		}
+		created := cf == nil
+		if created {
+			if opts.NoCreate {
+				return errFilterNotFound
+			}
+			cf, err = createCuckoo(tx, key, capacity, reserve)
+			if err != nil {
+				return err
+			}
+		}
+		added := false
+		for _, item := range items {
+			if nx && cf.count(item) > 0 {
+				res = append(res, false)
+				continue
+			}
+			err = cf.insert(item)
+			if err != nil {
+				return err
+			}
+			added = true
+			res = append(res, true)
+		}
+		if !added && !created {
+			return errNoop
+		}
+		return nil
+	})
+	return res, err
+}
+
+// CFInsert adds items to the Cuckoo filter stored at key, creating it unless
+// NoCreate is set. Items may be added several times.
+func (c *Server) CFInsert(ctx context.Context, key []byte, opts *CFInsertOptions, items ...[]byte) ([]bool, error) {
+	ctx = withCommand(ctx, "CF.INSERT", key, opts.args(), "ITEMS", items)
+	return c.cfInsert(ctx, key, opts, false, items...)
+}
+
+// CFInsertNX is like CFInsert but skips items which may already be present.
+func (c *Server) CFInsertNX(ctx context.Context, key []byte, opts *CFInsertOptions, items ...[]byte) ([]bool, error) {
+	ctx = withCommand(ctx, "CF.INSERTNX", key, opts.args(), "ITEMS", items)
+	return c.cfInsert(ctx, key, opts, true, items...)
+}
+
+// CFAdd adds item to the Cuckoo filter stored at key, creating it with the
+// default parameters if needed.
+func (c *Server) CFAdd(ctx context.Context, key []byte, item []byte) error {
+	ctx = withCommand(ctx, "CF.ADD", key, item)
+	_, err := c.cfInsert(ctx, key, nil, false, item)
+	return err
+}
+
+// CFAddNX adds item to the Cuckoo filter stored at key unless it may already
+// be present, and reports whether it was added.
+func (c *Server) CFAddNX(ctx context.Context, key []byte, item []byte) (bool, error) {
+	ctx = withCommand(ctx, "CF.ADDNX", key, item)
+	res, err := c.cfInsert(ctx, key, nil, true, item)
+	if err != nil {
+		return false, err
+	}
+	return res[0], nil
+}
+
+// viewCuckoo runs fn with the Cuckoo filter stored at key, fn is not called
+// if the key does not exist
+func (c *Server) viewCuckoo(ctx context.Context, key []byte, fn func(cf *cuckooFilter) error) error {
+	return c.db.View(ctx, key, func(tx *db.Tx) error {
+		cf, err := openCuckoo(tx, key)
+		if err != nil || cf == nil {
+			return err
+		}
+		return fn(cf)
+	})
+}
+
+// CFMExists reports for each item whether it may be in the Cuckoo filter
+// stored at key.
+func (c *Server) CFMExists(ctx context.Context, key []byte, items ...[]byte) ([]bool, error) {
+	res := make([]bool, len(items))
+	err := c.viewCuckoo(ctx, key, func(cf *cuckooFilter) error {
+		for i, item := range items {
+			res[i] = cf.count(item) > 0
+		}
+		return nil
+	})
+	return res, err
+}
+
+// CFExists reports whether item may be in the Cuckoo filter stored at key.
+func (c *Server) CFExists(ctx context.Context, key []byte, item []byte) (bool, error) {
+	res, err := c.CFMExists(ctx, key, item)
+	if err != nil {
+		return false, err
+	}
+	return res[0], nil
+}
+
+// CFCount returns an estimate of the number of times item was added to the
+// Cuckoo filter stored at key.
+func (c *Server) CFCount(ctx context.Context, key []byte, item []byte) (int64, error) {
+	n := int64(0)
+	err := c.viewCuckoo(ctx, key, func(cf *cuckooFilter) error {
+		n = cf.count(item)
+		return nil
+	})
+	return n, err
+}
+
+// CFDel removes one occurrence of item from the Cuckoo filter stored at key,
+// and reports whether it was found.
+func (c *Server) CFDel(ctx context.Context, key []byte, item []byte) (bool, error) {
+	ctx = withCommand(ctx, "CF.DEL", key, item)
+	deleted := false
+	err := c.update(ctx, key, func(tx *db.Tx) error {
+		cf, err := openCuckoo(tx, key)
+		if err != nil {
+			return err
+		}
+		if cf == nil {
+			return errFilterNotFound
+		}
+		deleted, err = cf.delete(item)
+		if err == nil && !deleted {
+			return errNoop
+		}
+		return err
+	})
+	return deleted, err
+}
+
+// CFInfo describes a Cuckoo filter.
+type CFInfo struct {
+	Size          int64 // size of the stored pages, in bytes
+	Buckets       int64
+	Filters       int64
+	Items         int64
+	Deletes       int64
+	BucketSize    int64
+	Expansion     int64
+	MaxIterations int64
+}
+
+// CFInfo returns information about the Cuckoo filter stored at key.
+func (c *Server) CFInfo(ctx context.Context, key []byte) (*CFInfo, error) {
+	var res *CFInfo
+	err := c.viewCuckoo(ctx, key, func(cf *cuckooFilter) error {
+		res = &CFInfo{
+			Size:          int64(cf.f.Pages()) * db.FilterPageSize,
+			Filters:       int64(len(cf.buckets)),
+			Items:         int64(cf.items),
+			Deletes:       int64(cf.deletes),
+			BucketSize:    int64(cf.bucketSize),
+			Expansion:     int64(cf.expansion),
+			MaxIterations: int64(cf.maxIterations),
+		}
+		for _, n := range cf.buckets {
+			res.Buckets += int64(n)
+		}
+		return nil
+	})
+	if err == nil && res == nil {
+		return nil, errFilterNotFound
+	}
+	return res, err
+}
+
+// args returns the options as arguments of CF.INSERT
+func (opts *CFInsertOptions) args() [][]byte {
+	if opts == nil {
+		return nil
+	}
+	return append(optionalInt("CAPACITY", opts.Capacity), flag(opts.NoCreate, "NOCREATE")...)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/zenozeng/s3dis/db"
+)
+
+func TestCuckooFilter(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	err := server.CFReserve(ctx, key, 8, nil)
+	g.Expect(err).To(BeNil())
+	err = server.CFReserve(ctx, key, 8, nil)
+	g.Expect(err).To(Equal(errFilterExists))
+	err = server.CFReserve(ctx, []byte(uuid.NewString()), 8, &CFReserveOptions{BucketSize: 300})
+	g.Expect(err).NotTo(BeNil())
+
+	err = server.CFAdd(ctx, key, []byte("a"))
+	g.Expect(err).To(BeNil())
+	err = server.CFAdd(ctx, key, []byte("a"))
+	g.Expect(err).To(BeNil())
+	n, err := server.CFCount(ctx, key, []byte("a"))
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(2)))
+	added, err := server.CFAddNX(ctx, key, []byte("a"))
+	g.Expect(err).To(BeNil())
+	g.Expect(added).To(Equal(false))
+
+	deleted, err := server.CFDel(ctx, key, []byte("a"))
+	g.Expect(err).To(BeNil())
+	g.Expect(deleted).To(Equal(true))
+	exists, err := server.CFExists(ctx, key, []byte("a"))
+	g.Expect(err).To(BeNil())
+	g.Expect(exists).To(Equal(true))
+	deleted, err = server.CFDel(ctx, key, []byte("a"))
+	g.Expect(err).To(BeNil())
+	g.Expect(deleted).To(Equal(true))
+	deleted, err = server.CFDel(ctx, key, []byte("a"))
+	g.Expect(err).To(BeNil())
+	g.Expect(deleted).To(Equal(false))
+	res, err := server.CFMExists(ctx, key, []byte("a"), []byte("b"))
+	g.Expect(err).To(BeNil())
+	g.Expect(res).To(Equal([]bool{false, false}))
+
+	// the filter grows once its buckets are full
+	items := [][]byte{}
+	for i := 0; i < 40; i++ {
+		items = append(items, []byte(fmt.Sprintf("item-%d", i)))
+	}
+	_, err = server.CFInsert(ctx, key, nil, items...)
+	g.Expect(err).To(BeNil())
+	res, err = server.CFMExists(ctx, key, items...)
+	g.Expect(err).To(BeNil())
+	for _, ok := range res {
+		g.Expect(ok).To(Equal(true))
+	}
+	info, err := server.CFInfo(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(info.Filters > 1).To(Equal(true))
+	g.Expect(info.Items).To(Equal(int64(40)))
+	g.Expect(info.Deletes).To(Equal(int64(2)))
+	g.Expect(info.BucketSize).To(Equal(int64(2)))
+
+	_, err = server.CFDel(ctx, []byte(uuid.NewString()), []byte("a"))
+	g.Expect(err).To(Equal(errFilterNotFound))
+	_, err = server.CFInsert(ctx, []byte(uuid.NewString()), &CFInsertOptions{NoCreate: true}, []byte("a"))
+	g.Expect(err).To(Equal(errFilterNotFound))
+
+	err = server.db.View(ctx, key, func(tx *db.Tx) error {
+		typ, err := tx.Type(key)
+		g.Expect(typ).To(Equal(db.TypeCuckoo))
+		return err
+	})
+	g.Expect(err).To(BeNil())
+	_, err = server.BFAdd(ctx, key, []byte("a"))
+	g.Expect(err).To(Equal(db.ErrWrongType))
+}
+
+func TestCuckooFilterFull(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	err := server.CFReserve(ctx, key, 4, &CFReserveOptions{MaxIterations: 1, Expansion: -1})
+	g.Expect(err).NotTo(BeNil())
+	err = server.CFReserve(ctx, key, 2, &CFReserveOptions{BucketSize: 1, MaxIterations: 1})
+	g.Expect(err).To(BeNil())
+	for i := 0; i < 20; i++ {
+		err = server.CFAdd(ctx, key, []byte(fmt.Sprintf("item-%d", i)))
+		g.Expect(err).To(BeNil())
+	}
+	info, err := server.CFInfo(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(info.Items).To(Equal(int64(20)))
+	g.Expect(info.Buckets >= 20).To(Equal(true))
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+const (
+	// nodesRefreshInterval is how often the fan-out reads the processes
+	// registered in object storage
+	nodesRefreshInterval = 10 * time.Second
+	// heartbeatInterval is how often this process renews its registration,
+	// well within db.NodeTTL
+	heartbeatInterval = db.NodeTTL / 3
+	// peerTimeout bounds the time taken to connect to another process and to
+	// forward a message to it
+	peerTimeout = time.Second
+	// peerRetryInterval is how long the messages to a process are dropped
+	// after failing to reach it
+	peerRetryInterval = time.Second
+	// peerBufferLen is the number of messages which may wait to be forwarded
+	// to another process, messages are dropped beyond
+	peerBufferLen = 1024
+)
+
+// fanout forwards the messages published on this process to the other
+// processes registered in object storage, see db.RegisterNode. Delivery is
+// best effort: messages to a process which can not be reached are dropped.
+type fanout struct {
+	db   *db.Database
+	addr string // of this process
+
+	mu    sync.Mutex
+	peers map[string]*peer // by address
+}
+
+func newFanout(d *db.Database, addr string) *fanout {
+	return &fanout{db: d, addr: addr, peers: map[string]*peer{}}
+}
+
+// refresh updates the peers from the registered processes
+func (f *fanout) refresh(ctx context.Context) error {
+	addrs, err := f.db.Nodes(ctx)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	peers := map[string]*peer{}
+	for _, addr := range addrs {
+		if addr == f.addr {
+			continue
+		}
+		p, ok := f.peers[addr]
+		if !ok {
+			p = newPeer(addr)
+		}
+		peers[addr] = p
+	}
+	for addr, p := range f.peers {
+		if peers[addr] == nil {
+			close(p.messages)
+		}
+	}
+	f.peers = peers
+	return nil
+}
+
+// refreshPeers refreshes the peers every nodesRefreshInterval until ctx is
+// done, then closes them. The previous peers are kept until object storage
+// can be read.
+func (f *fanout) refreshPeers(ctx context.Context) {
+	ticker := time.NewTicker(nodesRefreshInterval)
+	defer ticker.Stop()
+	for {
+		f.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			for _, p := range f.peers {
+				close(p.messages)
+			}
+			f.peers = map[string]*peer{}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// heartbeat renews the registration of this process until ctx is done, a
+// failed renewal is retried on the next tick
+func (f *fanout) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		f.db.RegisterNode(ctx, f.addr)
+	}
+}
+
+// forward sends a published message to the other processes, which publish
+// it to their subscribers with S3DIS.PUBLISH
+func (f *fanout) forward(ctx context.Context, channel []byte, message []byte, shard bool) {
+	args := [][]byte{[]byte("s3dis.publish"), channel, message}
+	if shard {
+		args = append(args, []byte("shard"))
+	}
+	f.send(ctx, args)
+}
+
+// send sends an internal command to the other processes, without waiting
+// for them
+func (f *fanout) send(ctx context.Context, args [][]byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range f.peers {
+		select {
+		case p.messages <- args:
+		default:
+		}
+	}
+}
+
+// peer is the connection to another process, messages are forwarded in the
+// order they are published
+type peer struct {
+	addr     string
+	messages chan [][]byte
+}
+
+func newPeer(addr string) *peer {
+	p := &peer{addr: addr, messages: make(chan [][]byte, peerBufferLen)}
+	go p.run()
+	return p
+}
+
+// run forwards the messages until the peer is removed
+func (p *peer) run() {
+	var conn net.Conn
+	var r *bufio.Reader
+	var w *respWriter
+	var retryAt time.Time
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for args := range p.messages {
+		if conn == nil {
+			if time.Now().Before(retryAt) {
+				continue
+			}
+			var err error
+			conn, err = net.DialTimeout("tcp", p.addr, peerTimeout)
+			if err != nil {
+				conn = nil
+				retryAt = time.Now().Add(peerRetryInterval)
+				continue
+			}
+			r, w = bufio.NewReader(conn), &respWriter{Writer: bufio.NewWriter(conn)}
+		}
+		conn.SetDeadline(time.Now().Add(peerTimeout))
+		w.writeBulks(args)
+		err := w.Flush()
+		if err == nil {
+			// the reply, e.g. the number of receivers, is ignored
+			_, err = readLine(r)
+		}
+		if err != nil {
+			conn.Close()
+			conn = nil
+			retryAt = time.Now().Add(peerRetryInterval)
+		}
+	}
+}
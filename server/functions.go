@@ -0,0 +1,489 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/zenozeng/s3dis/db"
+)
+
+// functionLoadTimeout bounds the time taken by the code of a library to
+// register its functions, like in Redis
+const functionLoadTimeout = 500 * time.Millisecond
+
+var (
+	errFunctionNotFound = fmt.Errorf("ERR Function not found")
+	errLibraryNotFound  = fmt.Errorf("ERR Library not found")
+	functionNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+	functionFlags       = map[string]bool{
+		"no-writes":             true,
+		"allow-oom":             true,
+		"allow-stale":           true,
+		"no-cluster":            true,
+		"allow-cross-slot-keys": true,
+	}
+)
+
+// luaLibrary is a library of functions, compiled and with the functions it
+// registers
+type luaLibrary struct {
+	name      string
+	proto     *lua.FunctionProto
+	functions []luaFunction // in registration order
+}
+
+type luaFunction struct {
+	name        string
+	description string
+	flags       []string
+}
+
+func (f *luaFunction) hasFlag(flag string) bool {
+	for _, f := range f.flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (lib *luaLibrary) function(name string) *luaFunction {
+	for i := range lib.functions {
+		if lib.functions[i].name == name {
+			return &lib.functions[i]
+		}
+	}
+	return nil
+}
+
+// functionCache holds the libraries already compiled by this process, by
+// SHA1 digest of their code. The libraries themselves are stored in object
+// storage, see db.Libraries.
+type functionCache struct {
+	mu        sync.Mutex
+	libraries map[string]*luaLibrary
+}
+
+func newFunctionCache() *functionCache {
+	return &functionCache{libraries: map[string]*luaLibrary{}}
+}
+
+// parse compiles the code of a library, starting with a line like
+// "#!lua name=mylib", and runs it to find the functions it registers
+func (fc *functionCache) parse(code string) (*luaLibrary, error) {
+	sha := sha1hex([]byte(code))
+	fc.mu.Lock()
+	lib, ok := fc.libraries[sha]
+	fc.mu.Unlock()
+	if ok {
+		return lib, nil
+	}
+
+	header, _, _ := strings.Cut(code, "\n")
+	if !strings.HasPrefix(header, "#!") {
+		return nil, fmt.Errorf("ERR Missing library metadata")
+	}
+	fields := strings.Fields(header[2:])
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "lua") {
+		engine := ""
+		if len(fields) > 0 {
+			engine = fields[0]
+		}
+		return nil, fmt.Errorf("ERR Engine '%s' not found", engine)
+	}
+	lib = &luaLibrary{}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		if key != "name" {
+			return nil, fmt.Errorf("ERR Invalid metadata value given: %s", field)
+		}
+		lib.name = value
+	}
+	if lib.name == "" {
+		return nil, fmt.Errorf("ERR Library name was not given")
+	}
+	if !functionNamePattern.MatchString(lib.name) {
+		return nil, fmt.Errorf("ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+
+	// the header becomes a comment, so that line numbers are kept
+	var err error
+	lib.proto, err = compileLua([]byte("--"+code[2:]), "@user_function")
+	if err != nil {
+		return nil, fmt.Errorf("ERR Error compiling function: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), functionLoadTimeout)
+	defer cancel()
+	L := newLuaState(ctx)
+	defer L.Close()
+	redis := luaRedisLib(L)
+	registered := registerFunctions(L, redis)
+	L.SetGlobal("redis", redis)
+	L.Push(L.NewFunctionFromProto(lib.proto))
+	err = L.PCall(0, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ERR Error registering functions: %s", err)
+	}
+	if len(registered.functions) == 0 {
+		return nil, fmt.Errorf("ERR No functions registered")
+	}
+	lib.functions = registered.functions
+
+	fc.mu.Lock()
+	fc.libraries[sha] = lib
+	fc.mu.Unlock()
+	return lib, nil
+}
+
+// registeredFunctions collects the functions registered by the code of a
+// library
+type registeredFunctions struct {
+	functions []luaFunction
+	callbacks map[string]*lua.LFunction
+}
+
+// registerFunctions adds redis.register_function to the redis table, which
+// accepts a name and a callback, or a table with the fields function_name,
+// callback, and optionally description and flags
+func registerFunctions(L *lua.LState, redis *lua.LTable) *registeredFunctions {
+	registered := &registeredFunctions{callbacks: map[string]*lua.LFunction{}}
+	L.SetField(redis, "register_function", L.NewFunction(func(L *lua.LState) int {
+		f := luaFunction{flags: []string{}}
+		var callback *lua.LFunction
+		if t, ok := L.Get(1).(*lua.LTable); ok && L.GetTop() == 1 {
+			var err error
+			t.ForEach(func(k, v lua.LValue) {
+				switch k.String() {
+				case "function_name":
+					f.name = v.String()
+				case "callback":
+					callback, _ = v.(*lua.LFunction)
+				case "description":
+					f.description = v.String()
+				case "flags":
+					flags, ok := v.(*lua.LTable)
+					if !ok {
+						err = fmt.Errorf("flags argument to redis.register_function must be a table representing function flags")
+						return
+					}
+					flags.ForEach(func(_, flag lua.LValue) {
+						f.flags = append(f.flags, flag.String())
+					})
+				default:
+					err = fmt.Errorf("unknown argument given to redis.register_function")
+				}
+			})
+			if err != nil {
+				L.RaiseError(err.Error())
+				return 0
+			}
+			if callback == nil {
+				L.RaiseError("redis.register_function must get a callback argument")
+				return 0
+			}
+		} else {
+			f.name = L.CheckString(1)
+			callback = L.CheckFunction(2)
+		}
+		if !functionNamePattern.MatchString(f.name) {
+			L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+			return 0
+		}
+		if registered.callbacks[f.name] != nil {
+			L.RaiseError("Function already exists in the library")
+			return 0
+		}
+		for _, flag := range f.flags {
+			if !functionFlags[flag] {
+				L.RaiseError("unknown flag given")
+				return 0
+			}
+		}
+		registered.functions = append(registered.functions, f)
+		registered.callbacks[f.name] = callback
+		return 0
+	}))
+	return registered
+}
+
+// loadLibraries returns the compiled libraries stored in object storage
+func (c *Server) loadLibraries(ctx context.Context) ([]*luaLibrary, error) {
+	list, err := c.db.Libraries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	libs := make([]*luaLibrary, len(list))
+	for i, l := range list {
+		libs[i], err = c.functions.parse(l.Code)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return libs, nil
+}
+
+// addLibraries adds the libraries of codes to list, replacing the libraries
+// of the same name if replace is true. Function names must be unique across
+// libraries.
+func (c *Server) addLibraries(list []db.Library, codes []string, replace bool) ([]db.Library, []string, error) {
+	names := []string{}
+	for _, code := range codes {
+		lib, err := c.functions.parse(code)
+		if err != nil {
+			return nil, nil, err
+		}
+		kept := []db.Library{}
+		for _, l := range list {
+			if l.Name != lib.name {
+				kept = append(kept, l)
+			} else if !replace {
+				return nil, nil, fmt.Errorf("ERR Library '%s' already exists", lib.name)
+			}
+		}
+		for _, l := range kept {
+			other, err := c.functions.parse(l.Code)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, f := range lib.functions {
+				if other.function(f.name) != nil {
+					return nil, nil, fmt.Errorf("ERR Function %s already exists", f.name)
+				}
+			}
+		}
+		list = append(kept, db.Library{Name: lib.name, Engine: "LUA", Code: code})
+		names = append(names, lib.name)
+	}
+	return list, names, nil
+}
+
+// fcall runs a function with FCALL, or FCALL_RO if readOnly is true.
+// Functions flagged no-writes can not write, and are the only ones allowed
+// by FCALL_RO.
+func (c *Server) fcall(ctx context.Context, cl *client, args [][]byte, readOnly bool) error {
+	keys, argv, err := parseNumKeys(args[1:])
+	if err != nil {
+		return err
+	}
+	name := string(args[0])
+	libs, err := c.loadLibraries(ctx)
+	if err != nil {
+		return err
+	}
+	var lib *luaLibrary
+	var f *luaFunction
+	for _, l := range libs {
+		if f = l.function(name); f != nil {
+			lib = l
+			break
+		}
+	}
+	if f == nil {
+		return errFunctionNotFound
+	}
+	if f.hasFlag("no-writes") {
+		ctx = db.ReadOnly(ctx)
+	} else if readOnly {
+		return fmt.Errorf("ERR Can not execute a script with write flag using *_ro command.")
+	}
+	return c.eval(ctx, cl, keys, func(L *lua.LState) (lua.LValue, error) {
+		registered := registerFunctions(L, L.GetGlobal("redis").(*lua.LTable))
+		L.Push(L.NewFunctionFromProto(lib.proto))
+		err := L.PCall(0, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		L.Push(registered.callbacks[name])
+		L.Push(luaStrings(L, keys))
+		L.Push(luaStrings(L, argv))
+		err = L.PCall(2, 1, nil)
+		if err != nil {
+			return nil, err
+		}
+		return L.Get(-1), nil
+	})
+}
+
+func cmdFCall(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	return c.fcall(ctx, cl, args, false)
+}
+
+func cmdFCallRO(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	return c.fcall(ctx, cl, args, true)
+}
+
+func cmdFunction(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	sub := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch {
+	case sub == "load" && len(args) >= 1 && len(args) <= 2:
+		replace := len(args) == 2
+		if replace && !strings.EqualFold(string(args[0]), "replace") {
+			return errSyntax
+		}
+		var names []string
+		err := c.db.UpdateLibraries(ctx, func(list []db.Library) ([]db.Library, error) {
+			var err error
+			list, names, err = c.addLibraries(list, []string{string(args[len(args)-1])}, replace)
+			return list, err
+		})
+		if err != nil {
+			return err
+		}
+		cl.w.writeBulk([]byte(names[0]))
+	case sub == "delete" && len(args) == 1:
+		err := c.db.UpdateLibraries(ctx, func(list []db.Library) ([]db.Library, error) {
+			for i, l := range list {
+				if l.Name == string(args[0]) {
+					return append(list[:i], list[i+1:]...), nil
+				}
+			}
+			return nil, errLibraryNotFound
+		})
+		if err != nil {
+			return err
+		}
+		cl.w.writeSimple("OK")
+	case sub == "flush" && len(args) <= 1:
+		_, err := parseFlushMode(args)
+		if err != nil {
+			return err
+		}
+		err = c.db.UpdateLibraries(ctx, func(list []db.Library) ([]db.Library, error) {
+			return []db.Library{}, nil
+		})
+		if err != nil {
+			return err
+		}
+		cl.w.writeSimple("OK")
+	case sub == "list":
+		return c.functionList(ctx, cl, args)
+	case sub == "dump" && len(args) == 0:
+		list, err := c.db.Libraries(ctx)
+		if err != nil {
+			return err
+		}
+		payload, err := json.Marshal(list)
+		if err != nil {
+			return err
+		}
+		cl.w.writeBulk(payload)
+	case sub == "restore" && len(args) >= 1 && len(args) <= 2:
+		return c.functionRestore(ctx, cl, args)
+	default:
+		return fmt.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'", sub)
+	}
+	return nil
+}
+
+// functionList implements FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]
+func (c *Server) functionList(ctx context.Context, cl *client, args [][]byte) error {
+	pattern := ""
+	withCode := false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "withcode":
+			withCode = true
+		case "libraryname":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			i++
+			pattern = string(args[i])
+		default:
+			return errSyntax
+		}
+	}
+	list, err := c.db.Libraries(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	matched := []db.Library{}
+	for _, l := range list {
+		if pattern == "" || db.MatchGlob([]byte(pattern), []byte(l.Name)) {
+			matched = append(matched, l)
+		}
+	}
+	cl.w.writeArray(len(matched))
+	for _, l := range matched {
+		lib, err := c.functions.parse(l.Code)
+		if err != nil {
+			return err
+		}
+		if withCode {
+			cl.w.writeMap(4)
+		} else {
+			cl.w.writeMap(3)
+		}
+		cl.w.writeBulk([]byte("library_name"))
+		cl.w.writeBulk([]byte(l.Name))
+		cl.w.writeBulk([]byte("engine"))
+		cl.w.writeBulk([]byte(l.Engine))
+		cl.w.writeBulk([]byte("functions"))
+		cl.w.writeArray(len(lib.functions))
+		for _, f := range lib.functions {
+			cl.w.writeMap(3)
+			cl.w.writeBulk([]byte("name"))
+			cl.w.writeBulk([]byte(f.name))
+			cl.w.writeBulk([]byte("description"))
+			if f.description == "" {
+				cl.w.writeBulk(nil)
+			} else {
+				cl.w.writeBulk([]byte(f.description))
+			}
+			cl.w.writeBulk([]byte("flags"))
+			cl.w.writeSet(len(f.flags))
+			for _, flag := range f.flags {
+				cl.w.writeSimple(flag)
+			}
+		}
+		if withCode {
+			cl.w.writeBulk([]byte("library_code"))
+			cl.w.writeBulk([]byte(l.Code))
+		}
+	}
+	return nil
+}
+
+// functionRestore implements FUNCTION RESTORE payload [FLUSH|APPEND|REPLACE],
+// the payload being the one of FUNCTION DUMP
+func (c *Server) functionRestore(ctx context.Context, cl *client, args [][]byte) error {
+	policy := "append"
+	if len(args) == 2 {
+		policy = strings.ToLower(string(args[1]))
+		if policy != "flush" && policy != "append" && policy != "replace" {
+			return errSyntax
+		}
+	}
+	restored := []db.Library{}
+	err := json.Unmarshal(args[0], &restored)
+	if err != nil {
+		return fmt.Errorf("ERR payload version or checksum are wrong")
+	}
+	codes := make([]string, len(restored))
+	for i, l := range restored {
+		codes[i] = l.Code
+	}
+	err = c.db.UpdateLibraries(ctx, func(list []db.Library) ([]db.Library, error) {
+		if policy == "flush" {
+			list = []db.Library{}
+		}
+		list, _, err := c.addLibraries(list, codes, policy == "replace")
+		return list, err
+	})
+	if err != nil {
+		return err
+	}
+	cl.w.writeSimple("OK")
+	return nil
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestServeFunction(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	// libraries are shared by the tests, so names are unique
+	suffix := strings.ReplaceAll(uuid.NewString(), "-", "")
+	lib, get, set := "lib"+suffix, "get"+suffix, "set"+suffix
+	key := uuid.NewString()
+	code := fmt.Sprintf(`#!lua name=%s
+redis.register_function{function_name = '%s', callback = function(keys, args)
+	return redis.call('GET', keys[1])
+end, flags = {'no-writes'}, description = 'gets a key'}
+redis.register_function('%s', function(keys, args)
+	return redis.call('SET', keys[1], args[1])
+end)`, lib, get, set)
+
+	g.Expect(do("FUNCTION", "LOAD", code)).To(Equal(lib))
+	g.Expect(do("FUNCTION", "LOAD", code)).To(Equal(fmt.Errorf("ERR Library '%s' already exists", lib)))
+	g.Expect(do("FUNCTION", "LOAD", "REPLACE", code)).To(Equal(lib))
+	g.Expect(do("FCALL", set, "1", key, "v")).To(Equal("OK"))
+	g.Expect(do("FCALL", get, "1", key)).To(Equal("v"))
+	g.Expect(do("FCALL_RO", get, "1", key)).To(Equal("v"))
+	g.Expect(do("FCALL_RO", set, "1", key, "w")).To(Equal(fmt.Errorf("ERR Can not execute a script with write flag using *_ro command.")))
+	g.Expect(do("FCALL", "nosuchfunction"+suffix, "0")).To(Equal(errFunctionNotFound))
+	g.Expect(do("FCALL", get, "2", key)).To(Equal(fmt.Errorf("ERR Number of keys can't be greater than number of args")))
+
+	// functions flagged no-writes can not write
+	ro := "ro" + suffix
+	g.Expect(do("FUNCTION", "LOAD", fmt.Sprintf(`#!lua name=%s
+redis.register_function{function_name = '%s', callback = function(keys, args)
+	return redis.call('SET', keys[1], 'x')
+end, flags = {'no-writes'}}`, ro, ro))).To(Equal(ro))
+	g.Expect(do("FCALL", ro, "1", key)).To(Equal(fmt.Errorf("ERR Write commands are not allowed from read-only scripts.")))
+	g.Expect(do("GET", key)).To(Equal("v"))
+	g.Expect(do("FUNCTION", "DELETE", ro)).To(Equal("OK"))
+	g.Expect(do("FUNCTION", "DELETE", ro)).To(Equal(errLibraryNotFound))
+
+	g.Expect(do("FUNCTION", "LIST", "LIBRARYNAME", lib)).To(Equal([]interface{}{
+		[]interface{}{
+			"library_name", lib,
+			"engine", "LUA",
+			"functions", []interface{}{
+				[]interface{}{"name", get, "description", "gets a key", "flags", []interface{}{"no-writes"}},
+				[]interface{}{"name", set, "description", nil, "flags", []interface{}{}},
+			},
+		},
+	}))
+	list := do("FUNCTION", "LIST", "WITHCODE", "LIBRARYNAME", "lib"+suffix[:8]+"*").([]interface{})
+	g.Expect(len(list)).To(Equal(1))
+	g.Expect(list[0].([]interface{})[6:]).To(Equal([]interface{}{"library_code", code}))
+
+	// function names are unique across libraries
+	other := "other" + suffix
+	g.Expect(do("FUNCTION", "LOAD", fmt.Sprintf("#!lua name=%s\nredis.register_function('%s', function() end)", other, get))).To(Equal(fmt.Errorf("ERR Function %s already exists", get)))
+
+	for code, msg := range map[string]string{
+		"return 1":                             "ERR Missing library metadata",
+		"#!js name=x\nreturn 1":                "ERR Engine 'js' not found",
+		"#!lua\nreturn 1":                      "ERR Library name was not given",
+		"#!lua name=a-b\nreturn 1":             "ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long",
+		"#!lua name=x foo=bar\n":               "ERR Invalid metadata value given: foo=bar",
+		"#!lua name=x\nreturn 1":               "ERR No functions registered",
+		"#!lua name=x\nredis.call('GET', 'a')": "ERR Error registering functions",
+		"#!lua name=x\nreturn (":               "ERR Error compiling function",
+	} {
+		err, ok := do("FUNCTION", "LOAD", code).(error)
+		g.Expect(ok).To(Equal(true))
+		g.Expect(strings.HasPrefix(err.Error(), msg)).To(Equal(true), err.Error())
+	}
+	_, ok := do("FUNCTION", "LOAD", "#!lua name=x\nwhile true do end").(error)
+	g.Expect(ok).To(Equal(true))
+
+	g.Expect(do("FUNCTION", "NOSUCHSUBCOMMAND")).To(Equal(fmt.Errorf("ERR unknown subcommand or wrong number of arguments for 'nosuchsubcommand'")))
+	g.Expect(do("FUNCTION", "DELETE", lib)).To(Equal("OK"))
+}
+
+func TestServeFunctionDumpRestore(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	suffix := strings.ReplaceAll(uuid.NewString(), "-", "")
+	lib, echo := "lib"+suffix, "echo"+suffix
+	code := fmt.Sprintf("#!lua name=%s\nredis.register_function('%s', function(keys, args) return args[1] end)", lib, echo)
+	g.Expect(do("FUNCTION", "LOAD", code)).To(Equal(lib))
+
+	payload := do("FUNCTION", "DUMP").(string)
+	g.Expect(do("FUNCTION", "RESTORE", payload)).To(Equal(fmt.Errorf("ERR Library '%s' already exists", lib)))
+	g.Expect(do("FUNCTION", "RESTORE", payload, "REPLACE")).To(Equal("OK"))
+	g.Expect(do("FUNCTION", "DELETE", lib)).To(Equal("OK"))
+	g.Expect(do("FCALL", echo, "0", "x")).To(Equal(errFunctionNotFound))
+	g.Expect(do("FUNCTION", "RESTORE", payload)).To(Equal("OK"))
+	g.Expect(do("FCALL", echo, "0", "x")).To(Equal("x"))
+	g.Expect(do("FUNCTION", "RESTORE", "garbage")).To(Equal(fmt.Errorf("ERR payload version or checksum are wrong")))
+	g.Expect(do("FUNCTION", "RESTORE", payload, "NOSUCHPOLICY")).To(Equal(errSyntax))
+
+	g.Expect(do("FUNCTION", "FLUSH")).To(Equal("OK"))
+	g.Expect(do("FUNCTION", "LIST")).To(Equal([]interface{}{}))
+	g.Expect(do("FUNCTION", "RESTORE", payload, "FLUSH")).To(Equal("OK"))
+	g.Expect(do("FCALL", echo, "0", "y")).To(Equal("y"))
+	g.Expect(do("FUNCTION", "DELETE", lib)).To(Equal("OK"))
+}
@@ -3,12 +3,287 @@ package server
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenozeng/s3dis/db"
 )
 
+// Info returns a line per logical database like the keyspace section of
+// Redis, db0 is always listed and other databases only if they hold keys.
 func (c *Server) Info(ctx context.Context) (string, error) {
-	info, err := c.db.Info(ctx)
+	lines := []string{}
+	for index := 0; index < c.databases; index++ {
+		selected, err := c.Select(index)
+		if err != nil {
+			return "", err
+		}
+		info, err := selected.db.Info(ctx)
+		if err != nil {
+			return "", err
+		}
+		if index > 0 && info.Keys == 0 {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("db%d: keys=%d,expires=%d,total_write_commands_processed=%d", index, info.Keys, info.Expires, info.TotalWriteCommandsProcessed))
+	}
+	return strings.Join(lines, "\r\n"), nil
+}
+
+// ScanOptions mirrors the MATCH, COUNT and TYPE options of SCAN.
+type ScanOptions = db.ScanOptions
+
+// Scan iterates over the keys of every partition. Start with cursor "0" and
+// call Scan with the returned cursor, an unsigned integer, until it is "0"
+// again. Keys existing during the whole scan are returned exactly once,
+// unless the scan resumes on another process.
+func (c *Server) Scan(ctx context.Context, cursor string, opts *ScanOptions) (string, [][]byte, error) {
+	return c.db.Scan(ctx, cursor, opts)
+}
+
+// Keys returns all the keys matching the glob-style pattern. It reads every
+// partition and should only be used on small datasets, prefer Scan.
+func (c *Server) Keys(ctx context.Context, pattern string) ([][]byte, error) {
+	return c.db.Keys(ctx, pattern)
+}
+
+// Type returns the type of the value stored at key, "none" if the key does
+// not exist.
+func (c *Server) Type(ctx context.Context, key []byte) (string, error) {
+	typ := db.TypeNone
+	err := c.db.View(ctx, key, func(tx *db.Tx) error {
+		var err error
+		typ, err = tx.Type(key)
+		return err
+	})
+	return typ, err
+}
+
+// Exists returns how many of keys exist, counting a key as many times as it
+// is given.
+func (c *Server) Exists(ctx context.Context, keys ...[]byte) (int64, error) {
+	n := int64(0)
+	err := c.db.ViewKeys(ctx, keys, func(m *db.MultiTx) error {
+		for _, key := range keys {
+			exists, err := m.Tx(key).Exists(key)
+			if err != nil {
+				return err
+			}
+			if exists {
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Del removes keys whatever their type and returns how many were removed.
+func (c *Server) Del(ctx context.Context, keys ...[]byte) (int64, error) {
+	ctx = withCommand(ctx, "DEL", keys)
+	n := int64(0)
+	err := c.updateKeys(ctx, keys, func(m *db.MultiTx) error {
+		for _, key := range keys {
+			deleted, err := m.Tx(key).Delete(key)
+			if err != nil {
+				return err
+			}
+			if deleted {
+				n++
+			}
+		}
+		if n == 0 {
+			return errNoop
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Expire sets the time to live of key and reports whether key exists. A ttl
+// which is not positive deletes the key, like in Redis.
+func (c *Server) Expire(ctx context.Context, key []byte, ttl time.Duration) (bool, error) {
+	ctx = withCommand(ctx, "PEXPIRE", key, ttl.Milliseconds())
+	exists := false
+	err := c.update(ctx, key, func(tx *db.Tx) error {
+		var err error
+		exists, err = tx.Exists(key)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errNoop
+		}
+		if ttl <= 0 {
+			_, err = tx.Delete(key)
+			return err
+		}
+		exp := time.Now().Add(ttl)
+		return tx.SetExpiration(key, &exp)
+	})
+	return exists, err
+}
+
+// PTTL returns the time to live of key in milliseconds, -2 if key does not
+// exist and -1 if it has no expiration, like PTTL.
+func (c *Server) PTTL(ctx context.Context, key []byte) (int64, error) {
+	ttl := int64(-2)
+	err := c.db.View(ctx, key, func(tx *db.Tx) error {
+		exists, err := tx.Exists(key)
+		if err != nil || !exists {
+			return err
+		}
+		exp, err := tx.Expiration(key)
+		if err != nil {
+			return err
+		}
+		ttl = -1
+		if exp != nil {
+			ttl = time.Until(*exp).Milliseconds()
+			if ttl < 0 {
+				ttl = 0
+			}
+		}
+		return nil
+	})
+	return ttl, err
+}
+
+// DBSize returns the number of keys, expired keys excluded.
+func (c *Server) DBSize(ctx context.Context) (int64, error) {
+	return c.db.DBSize(ctx)
+}
+
+// FlushDB deletes all the keys of the selected database, all or nothing.
+// With async it returns once the flush is committed, and later commands
+// wait for it.
+func (c *Server) FlushDB(ctx context.Context, async bool) error {
+	err := c.db.Flush(ctx, async)
 	if err != nil {
-		return "", nil
+		return err
+	}
+	c.flushed(ctx)
+	return nil
+}
+
+// FlushAll deletes all the keys of every logical database at once, see
+// FlushDB.
+func (c *Server) FlushAll(ctx context.Context, async bool) error {
+	dbs := []*db.Database{}
+	for index := 0; index < c.databases; index++ {
+		selected, err := c.Select(index)
+		if err != nil {
+			return err
+		}
+		dbs = append(dbs, selected.db)
+	}
+	err := db.FlushAll(ctx, dbs, async)
+	if err != nil {
+		return err
+	}
+	c.flushed(ctx)
+	return nil
+}
+
+// Move moves key to the logical database index unless it does not exist or
+// the other database already holds it, and reports whether it was moved.
+func (c *Server) Move(ctx context.Context, key []byte, index int) (bool, error) {
+	ctx = withCommand(ctx, "MOVE", key, index)
+	dst, err := c.Select(index)
+	if err != nil {
+		return false, err
+	}
+	return c.db.Move(ctx, key, dst.db)
+}
+
+// SwapDB exchanges the content of the logical databases a and b, clients
+// which selected one of them see the content of the other one.
+func (c *Server) SwapDB(ctx context.Context, a, b int) error {
+	ctx = withCommand(ctx, "SWAPDB", a, b)
+	for _, index := range []int{a, b} {
+		if index < 0 || index >= c.databases {
+			return fmt.Errorf("ERR DB index is out of range")
+		}
+	}
+	return c.db.Swap(ctx, a, b)
+}
+
+// Rename renames key to newKey, replacing newKey, and keeps its type and
+// expiration. It returns an error if key does not exist.
+func (c *Server) Rename(ctx context.Context, key []byte, newKey []byte) error {
+	ctx = withCommand(ctx, "RENAME", key, newKey)
+	_, err := c.db.Rename(ctx, key, newKey, false)
+	return err
+}
+
+// RenameNX renames key to newKey unless newKey exists, and reports whether
+// the key was renamed. It returns an error if key does not exist.
+func (c *Server) RenameNX(ctx context.Context, key []byte, newKey []byte) (bool, error) {
+	ctx = withCommand(ctx, "RENAMENX", key, newKey)
+	return c.db.Rename(ctx, key, newKey, true)
+}
+
+// CopyOptions mirrors the options of COPY.
+type CopyOptions struct {
+	DB      *int // destination logical database, the selected one if nil
+	Replace bool // replace the destination key if it exists
+}
+
+// Copy copies the value of source to destination, with its type and
+// expiration, and reports whether it was copied. Nothing is copied if source
+// does not exist, or if destination exists without the Replace option.
+func (c *Server) Copy(ctx context.Context, source []byte, destination []byte, opts *CopyOptions) (bool, error) {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	ctx = withCommand(ctx, "COPY", source, destination, opts.args())
+	dst := c
+	if opts.DB != nil {
+		var err error
+		dst, err = c.Select(*opts.DB)
+		if err != nil {
+			return false, err
+		}
+	}
+	return c.db.Copy(ctx, source, dst.db, destination, opts.Replace)
+}
+
+// sweepExpired purges the expired keys of every logical database every
+// interval, so that their expired events are notified even if no write
+// looks them up. The first sweep of a database loads all its partitions,
+// the next ones only read the partitions loaded by this process, which
+// writes all the partitions. Failed sweeps are retried on the next tick.
+func (c *Server) sweepExpired(ctx context.Context, interval time.Duration) {
+	dbs := make([]*db.Database, c.databases)
+	swept := make([]bool, c.databases)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for index := range dbs {
+			if dbs[index] == nil {
+				selected, err := c.Select(index)
+				if err != nil {
+					continue
+				}
+				dbs[index] = selected.db
+			}
+			_, err := dbs[index].PurgeExpired(ctx, !swept[index])
+			swept[index] = swept[index] || err == nil
+		}
+	}
+}
+
+// args returns the options as arguments of COPY
+func (opts *CopyOptions) args() [][]byte {
+	args := [][]byte{}
+	if opts.DB != nil {
+		args = append(args, []byte("DB"), []byte(strconv.Itoa(*opts.DB)))
 	}
-	return fmt.Sprintf("db0: keys=%d,expires=%d,total_write_commands_processed=%d", info.Keys, info.Expires, info.TotalWriteCommandsProcessed), nil
+	return append(args, flag(opts.Replace, "REPLACE")...)
 }
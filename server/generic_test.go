@@ -1 +1,45 @@
 package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/zenozeng/s3dis/db"
+)
+
+func TestScan(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	prefix := uuid.NewString()
+	str := []byte(prefix + ":str")
+	list := []byte(prefix + ":list")
+	err := server.Set(ctx, str, []byte("a"), nil)
+	g.Expect(err).To(BeNil())
+	_, err = server.RPush(ctx, list, []byte("a"))
+	g.Expect(err).To(BeNil())
+
+	typ, err := server.Type(ctx, list)
+	g.Expect(err).To(BeNil())
+	g.Expect(typ).To(Equal(db.TypeList))
+	typ, err = server.Type(ctx, []byte(uuid.NewString()))
+	g.Expect(err).To(BeNil())
+	g.Expect(typ).To(Equal(db.TypeNone))
+
+	keys := [][]byte{}
+	cursor := "0"
+	for {
+		next, res, err := server.Scan(ctx, cursor, &ScanOptions{Match: prefix + ":*", Count: 100, Type: "string"})
+		g.Expect(err).To(BeNil())
+		keys = append(keys, res...)
+		if next == "0" {
+			break
+		}
+		cursor = next
+	}
+	g.Expect(keys).To(Equal([][]byte{str}))
+
+	keys, err = server.Keys(ctx, prefix+":*")
+	g.Expect(err).To(BeNil())
+	g.Expect(len(keys)).To(Equal(2))
+}
@@ -0,0 +1,482 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+// Geospatial indexes are sorted sets whose scores are 52 bits geohashes, as
+// in Redis: latitude and longitude bits are interleaved, so that members
+// within a geohash cell form a contiguous range of scores.
+const (
+	geoStep         = 26
+	geoLatMin       = -85.05112878
+	geoLatMax       = 85.05112878
+	geoLonMin       = -180.0
+	geoLonMax       = 180.0
+	geoEarthRadius  = 6372797.560856 // in meters, as in Redis
+	geoHashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+// GeoLocation is a member of a geospatial index. Dist and GeoHash are only
+// filled in by GEOSEARCH when requested.
+type GeoLocation struct {
+	Name      []byte
+	Longitude float64
+	Latitude  float64
+	Dist      float64
+	GeoHash   int64
+}
+
+// GeoPos is the position of a member of a geospatial index.
+type GeoPos struct {
+	Longitude float64
+	Latitude  float64
+}
+
+// interleave returns the bits of lat in even positions and the bits of lon
+// in odd positions
+func interleave(lat, lon uint32) uint64 {
+	res := uint64(0)
+	for i := 0; i < 32; i++ {
+		res |= uint64(lat>>i&1) << (2 * i)
+		res |= uint64(lon>>i&1) << (2*i + 1)
+	}
+	return res
+}
+
+func deinterleave(bits uint64) (uint32, uint32) {
+	lat, lon := uint32(0), uint32(0)
+	for i := 0; i < 32; i++ {
+		lat |= uint32(bits>>(2*i)&1) << i
+		lon |= uint32(bits>>(2*i+1)&1) << i
+	}
+	return lat, lon
+}
+
+// geohashEncode returns the geohash of a position with step bits per
+// coordinate, within the given latitude range
+func geohashEncode(lon, lat float64, latMin, latMax float64, step uint) uint64 {
+	latOffset := (lat - latMin) / (latMax - latMin) * float64(uint64(1)<<step)
+	lonOffset := (lon - geoLonMin) / (geoLonMax - geoLonMin) * float64(uint64(1)<<step)
+	return interleave(uint32(latOffset), uint32(lonOffset))
+}
+
+// geohashDecode returns the center of the cell of a 52 bits geohash score
+func geohashDecode(score float64) GeoPos {
+	lat, lon := deinterleave(uint64(score))
+	scale := float64(uint64(1) << geoStep)
+	latMin := geoLatMin + float64(lat)/scale*(geoLatMax-geoLatMin)
+	latMax := geoLatMin + float64(lat+1)/scale*(geoLatMax-geoLatMin)
+	lonMin := geoLonMin + float64(lon)/scale*(geoLonMax-geoLonMin)
+	lonMax := geoLonMin + float64(lon+1)/scale*(geoLonMax-geoLonMin)
+	return GeoPos{
+		Longitude: math.Max(geoLonMin, math.Min(geoLonMax, (lonMin+lonMax)/2)),
+		Latitude:  math.Max(geoLatMin, math.Min(geoLatMax, (latMin+latMax)/2)),
+	}
+}
+
+func validateGeoPos(lon, lat float64) error {
+	if lon < geoLonMin || lon > geoLonMax || lat < geoLatMin || lat > geoLatMax {
+		return fmt.Errorf("invalid longitude,latitude pair %f,%f", lon, lat)
+	}
+	return nil
+}
+
+func degRad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func radDeg(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+func geoLatDistance(lat1, lat2 float64) float64 {
+	return geoEarthRadius * math.Abs(degRad(lat2)-degRad(lat1))
+}
+
+// geoDistance returns the haversine distance in meters between two positions
+func geoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	v := math.Sin((degRad(lon2) - degRad(lon1)) / 2)
+	if v == 0 {
+		return geoLatDistance(lat1, lat2)
+	}
+	u := math.Sin((degRad(lat2) - degRad(lat1)) / 2)
+	a := u*u + math.Cos(degRad(lat1))*math.Cos(degRad(lat2))*v*v
+	return 2 * geoEarthRadius * math.Asin(math.Sqrt(a))
+}
+
+// geoUnit returns the number of meters of unit
+func geoUnit(unit string) (float64, error) {
+	switch strings.ToLower(unit) {
+	case "m", "":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+	return 0, fmt.Errorf("unsupported unit provided. please use M, KM, FT, MI")
+}
+
+// GeoAdd adds members to the geospatial index stored at key, or updates
+// their positions. Options are those of ZADD, except GT and LT.
+func (c *Server) GeoAdd(ctx context.Context, key []byte, opts *ZAddOptions, locations ...GeoLocation) (int64, error) {
+	ctx = withCommand(ctx, "GEOADD", key, opts.args(), geoArgs(locations))
+	if opts != nil && (opts.GT || opts.LT) {
+		return 0, fmt.Errorf("syntax error")
+	}
+	members := []Z{}
+	for _, l := range locations {
+		err := validateGeoPos(l.Longitude, l.Latitude)
+		if err != nil {
+			return 0, err
+		}
+		score := geohashEncode(l.Longitude, l.Latitude, geoLatMin, geoLatMax, geoStep)
+		members = append(members, Z{Score: float64(score), Member: l.Name})
+	}
+	return c.ZAdd(ctx, key, opts, members...)
+}
+
+// GeoPos returns the positions of members, nil for missing members.
+func (c *Server) GeoPos(ctx context.Context, key []byte, members ...[]byte) ([]*GeoPos, error) {
+	scores, err := c.ZMScore(ctx, key, members...)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*GeoPos, len(members))
+	for i, score := range scores {
+		if score != nil {
+			pos := geohashDecode(*score)
+			res[i] = &pos
+		}
+	}
+	return res, nil
+}
+
+// GeoDist returns the distance between two members in unit, or false if one
+// of them is missing.
+func (c *Server) GeoDist(ctx context.Context, key []byte, member1, member2 []byte, unit string) (float64, bool, error) {
+	factor, err := geoUnit(unit)
+	if err != nil {
+		return 0, false, err
+	}
+	pos, err := c.GeoPos(ctx, key, member1, member2)
+	if err != nil || pos[0] == nil || pos[1] == nil {
+		return 0, false, err
+	}
+	return geoDistance(pos[0].Longitude, pos[0].Latitude, pos[1].Longitude, pos[1].Latitude) / factor, true, nil
+}
+
+// GeoHash returns the standard 11 characters geohash strings of members, nil
+// for missing members.
+func (c *Server) GeoHash(ctx context.Context, key []byte, members ...[]byte) ([]*string, error) {
+	pos, err := c.GeoPos(ctx, key, members...)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*string, len(members))
+	for i, p := range pos {
+		if p == nil {
+			continue
+		}
+		// the standard geohash covers latitudes from -90 to 90
+		bits := geohashEncode(p.Longitude, p.Latitude, -90, 90, geoStep)
+		b := make([]byte, 11)
+		for j := range b {
+			idx := 0
+			if j < 10 {
+				idx = int(bits>>(52-(j+1)*5)) & 0x1f
+			}
+			b[j] = geoHashAlphabet[idx]
+		}
+		s := string(b)
+		res[i] = &s
+	}
+	return res, nil
+}
+
+// GeoSearchQuery mirrors the arguments of GEOSEARCH.
+//
+// The center is the position of Member if it is set, or Longitude and
+// Latitude otherwise. The shape is a circle of Radius if it is positive, or
+// a box of BoxWidth by BoxHeight otherwise, in Unit. Sort is "", ASC or
+// DESC. Count limits the number of results if positive, Any returning as
+// soon as Count matches are found.
+type GeoSearchQuery struct {
+	Member    []byte
+	Longitude float64
+	Latitude  float64
+	Radius    float64
+	BoxWidth  float64
+	BoxHeight float64
+	Unit      string
+	Sort      string
+	Count     int64
+	Any       bool
+	WithCoord bool
+	WithDist  bool
+	WithHash  bool
+}
+
+func (q *GeoSearchQuery) validate() error {
+	if q.Radius > 0 == (q.BoxWidth > 0 || q.BoxHeight > 0) {
+		return fmt.Errorf("exactly one of BYRADIUS and BYBOX arguments must be provided for GEOSEARCH")
+	}
+	if q.Radius <= 0 && (q.BoxWidth <= 0 || q.BoxHeight <= 0) {
+		return fmt.Errorf("height or width cannot be negative")
+	}
+	if q.Count < 0 {
+		return fmt.Errorf("COUNT must be > 0")
+	}
+	if q.Any && q.Count == 0 {
+		return fmt.Errorf("the ANY argument requires COUNT argument")
+	}
+	switch strings.ToUpper(q.Sort) {
+	case "", "ASC", "DESC":
+	default:
+		return fmt.Errorf("syntax error")
+	}
+	_, err := geoUnit(q.Unit)
+	return err
+}
+
+// geoShape is a search shape in meters around a center
+type geoShape struct {
+	lon, lat      float64
+	radius        float64
+	width, height float64
+}
+
+// distance returns the distance from the center to a position, or false if
+// the position is outside of the shape
+func (s *geoShape) distance(lon, lat float64) (float64, bool) {
+	if s.radius > 0 {
+		d := geoDistance(s.lon, s.lat, lon, lat)
+		return d, d <= s.radius
+	}
+	if geoLatDistance(lat, s.lat) > s.height/2 || geoDistance(lon, lat, s.lon, lat) > s.width/2 {
+		return 0, false
+	}
+	return geoDistance(s.lon, s.lat, lon, lat), true
+}
+
+// scoreRanges returns the ranges of scores of the geohash cells covering the
+// bounding box of the shape. The step is chosen so that the box spans at most
+// two cells in each direction.
+func (s *geoShape) scoreRanges() [][2]float64 {
+	halfHeight, halfWidth := s.radius, s.radius
+	if s.radius <= 0 {
+		halfHeight, halfWidth = s.height/2, s.width/2
+	}
+	latDelta := radDeg(halfHeight / geoEarthRadius)
+	minLat := math.Max(geoLatMin, s.lat-latDelta)
+	maxLat := math.Min(geoLatMax, s.lat+latDelta)
+	minLon, maxLon := geoLonMin, geoLonMax
+	widest := math.Max(math.Abs(minLat), math.Abs(maxLat))
+	if widest < 90 && halfWidth < geoEarthRadius*math.Cos(degRad(widest)) {
+		lonDelta := radDeg(halfWidth / geoEarthRadius / math.Cos(degRad(widest)))
+		minLon, maxLon = s.lon-lonDelta, s.lon+lonDelta
+	}
+	step := uint(geoStep)
+	for step > 0 && ((geoLatMax-geoLatMin)/float64(uint64(1)<<step) < maxLat-minLat ||
+		(geoLonMax-geoLonMin)/float64(uint64(1)<<step) < maxLon-minLon) {
+		step--
+	}
+	lons := [][2]float64{{minLon, maxLon}}
+	if minLon < geoLonMin {
+		lons = [][2]float64{{minLon + 360, geoLonMax}, {geoLonMin, maxLon}}
+	} else if maxLon > geoLonMax {
+		lons = [][2]float64{{minLon, geoLonMax}, {geoLonMin, maxLon - 360}}
+	}
+	cell := func(v, min, max float64) uint32 {
+		i := uint64((v - min) / (max - min) * float64(uint64(1)<<step))
+		if i >= uint64(1)<<step {
+			i = uint64(1)<<step - 1
+		}
+		return uint32(i)
+	}
+	shift := 2 * (geoStep - step)
+	ranges := [][2]float64{}
+	for _, lon := range lons {
+		for y := cell(minLat, geoLatMin, geoLatMax); y <= cell(maxLat, geoLatMin, geoLatMax); y++ {
+			for x := cell(lon[0], geoLonMin, geoLonMax); x <= cell(lon[1], geoLonMin, geoLonMax); x++ {
+				bits := interleave(y, x)
+				ranges = append(ranges, [2]float64{float64(bits << shift), float64((bits + 1) << shift)})
+			}
+		}
+	}
+	return ranges
+}
+
+// geoSearch returns the members of z within the shape described by q
+func geoSearch(z *db.ZSet, q *GeoSearchQuery) ([]GeoLocation, error) {
+	factor, _ := geoUnit(q.Unit)
+	shape := &geoShape{
+		lon:    q.Longitude,
+		lat:    q.Latitude,
+		radius: q.Radius * factor,
+		width:  q.BoxWidth * factor,
+		height: q.BoxHeight * factor,
+	}
+	if q.Member != nil {
+		score, ok := z.Score(q.Member)
+		if !ok {
+			return nil, fmt.Errorf("could not decode requested zset member")
+		}
+		pos := geohashDecode(score)
+		shape.lon, shape.lat = pos.Longitude, pos.Latitude
+	} else {
+		err := validateGeoPos(shape.lon, shape.lat)
+		if err != nil {
+			return nil, err
+		}
+	}
+	res := []GeoLocation{}
+	sortBy := strings.ToUpper(q.Sort)
+	if q.Count > 0 && !q.Any && sortBy == "" {
+		sortBy = "ASC"
+	}
+	for _, r := range shape.scoreRanges() {
+		members := z.RangeByScore(db.ScoreBound{Value: r[0]}, db.ScoreBound{Value: r[1], Exclusive: true}, false, 0, -1)
+		for _, m := range members {
+			pos := geohashDecode(m.Score)
+			d, ok := shape.distance(pos.Longitude, pos.Latitude)
+			if !ok {
+				continue
+			}
+			res = append(res, GeoLocation{
+				Name:      m.Member,
+				Longitude: pos.Longitude,
+				Latitude:  pos.Latitude,
+				Dist:      d / factor,
+				GeoHash:   int64(m.Score),
+			})
+			if q.Any && int64(len(res)) >= q.Count {
+				break
+			}
+		}
+		if q.Any && int64(len(res)) >= q.Count {
+			break
+		}
+	}
+	switch sortBy {
+	case "ASC":
+		sort.SliceStable(res, func(i, j int) bool { return res[i].Dist < res[j].Dist })
+	case "DESC":
+		sort.SliceStable(res, func(i, j int) bool { return res[i].Dist > res[j].Dist })
+	}
+	if q.Count > 0 && int64(len(res)) > q.Count {
+		res = res[:q.Count]
+	}
+	return res, nil
+}
+
+// GeoSearch returns the members of the geospatial index stored at key within
+// the shape described by q. Coordinates, distances and geohashes of results
+// are only filled in when requested.
+func (c *Server) GeoSearch(ctx context.Context, key []byte, q *GeoSearchQuery) ([]GeoLocation, error) {
+	err := q.validate()
+	if err != nil {
+		return nil, err
+	}
+	res := []GeoLocation{}
+	err = c.viewZSet(ctx, key, func(z *db.ZSet) error {
+		res, err = geoSearch(z, q)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range res {
+		if !q.WithCoord {
+			res[i].Longitude, res[i].Latitude = 0, 0
+		}
+		if !q.WithDist {
+			res[i].Dist = 0
+		}
+		if !q.WithHash {
+			res[i].GeoHash = 0
+		}
+	}
+	return res, nil
+}
+
+// GeoSearchStore is like GeoSearch but stores the results in destination,
+// with their geohashes as scores, or their distances if storeDist is true.
+// It returns the number of stored members.
+func (c *Server) GeoSearchStore(ctx context.Context, source []byte, destination []byte, q *GeoSearchQuery, storeDist bool) (int64, error) {
+	ctx = withCommand(ctx, "GEOSEARCHSTORE", destination, source, q.args(), flag(storeDist, "STOREDIST"))
+	err := q.validate()
+	if err != nil {
+		return 0, err
+	}
+	n := int64(0)
+	err = c.updateKeys(ctx, [][]byte{source, destination}, func(m *db.MultiTx) error {
+		z, err := m.Tx(source).OpenZSet(source, false)
+		if err != nil {
+			return err
+		}
+		res := []GeoLocation{}
+		if z != nil {
+			res, err = geoSearch(z, q)
+			if err != nil {
+				return err
+			}
+		}
+		members := []Z{}
+		for _, l := range res {
+			score := float64(l.GeoHash)
+			if storeDist {
+				score = l.Dist
+			}
+			members = append(members, Z{Score: score, Member: l.Name})
+		}
+		n = int64(len(members))
+		return storeZ(m.Tx(destination), destination, members)
+	})
+	return n, err
+}
+
+// geoArgs returns locations as the longitude, latitude and member arguments
+// of GEOADD
+func geoArgs(locations []GeoLocation) [][]byte {
+	args := make([][]byte, 0, 3*len(locations))
+	for _, l := range locations {
+		args = append(args, []byte(strconv.FormatFloat(l.Longitude, 'f', -1, 64)), []byte(strconv.FormatFloat(l.Latitude, 'f', -1, 64)), l.Name)
+	}
+	return args
+}
+
+// args returns the query as arguments of GEOSEARCHSTORE
+func (q *GeoSearchQuery) args() [][]byte {
+	float := func(f float64) []byte {
+		return []byte(strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	unit := q.Unit
+	if unit == "" {
+		unit = "m"
+	}
+	args := [][]byte{[]byte("FROMMEMBER"), q.Member}
+	if q.Member == nil {
+		args = [][]byte{[]byte("FROMLONLAT"), float(q.Longitude), float(q.Latitude)}
+	}
+	if q.Radius > 0 {
+		args = append(args, []byte("BYRADIUS"), float(q.Radius), []byte(unit))
+	} else {
+		args = append(args, []byte("BYBOX"), float(q.BoxWidth), float(q.BoxHeight), []byte(unit))
+	}
+	if q.Sort != "" {
+		args = append(args, []byte(q.Sort))
+	}
+	args = append(args, optionalInt("COUNT", q.Count)...)
+	return append(args, flag(q.Any, "ANY")...)
+}
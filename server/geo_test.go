@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func geoNames(res []GeoLocation) []string {
+	names := []string{}
+	for _, l := range res {
+		names = append(names, string(l.Name))
+	}
+	return names
+}
+
+func TestGeo(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	n, err := server.GeoAdd(ctx, key, nil,
+		GeoLocation{Name: []byte("Palermo"), Longitude: 13.361389, Latitude: 38.115556},
+		GeoLocation{Name: []byte("Catania"), Longitude: 15.087269, Latitude: 37.502669},
+	)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(2)))
+	_, err = server.GeoAdd(ctx, key, nil, GeoLocation{Name: []byte("x"), Longitude: 0, Latitude: 86})
+	g.Expect(err).NotTo(BeNil())
+
+	// values from the Redis documentation
+	score, _, err := server.ZScore(ctx, key, []byte("Palermo"))
+	g.Expect(err).To(BeNil())
+	g.Expect(score).To(Equal(3479099956230698.0))
+	d, ok, err := server.GeoDist(ctx, key, []byte("Palermo"), []byte("Catania"), "km")
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(true))
+	g.Expect(fmt.Sprintf("%.4f", d)).To(Equal("166.2742"))
+	_, ok, err = server.GeoDist(ctx, key, []byte("Palermo"), []byte("missing"), "m")
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(false))
+	hashes, err := server.GeoHash(ctx, key, []byte("Palermo"), []byte("Catania"), []byte("missing"))
+	g.Expect(err).To(BeNil())
+	g.Expect(*hashes[0]).To(Equal("sqc8b49rny0"))
+	g.Expect(*hashes[1]).To(Equal("sqdtr74hyu0"))
+	g.Expect(hashes[2]).To(BeNil())
+	pos, err := server.GeoPos(ctx, key, []byte("Palermo"))
+	g.Expect(err).To(BeNil())
+	g.Expect(fmt.Sprintf("%.6f %.6f", pos[0].Longitude, pos[0].Latitude)).To(Equal("13.361389 38.115556"))
+}
+
+func TestGeoSearch(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	_, err := server.GeoAdd(ctx, key, nil,
+		GeoLocation{Name: []byte("Palermo"), Longitude: 13.361389, Latitude: 38.115556},
+		GeoLocation{Name: []byte("Catania"), Longitude: 15.087269, Latitude: 37.502669},
+		GeoLocation{Name: []byte("edge1"), Longitude: 12.758489, Latitude: 38.788135},
+		GeoLocation{Name: []byte("edge2"), Longitude: 17.241510, Latitude: 38.788135},
+	)
+	g.Expect(err).To(BeNil())
+
+	res, err := server.GeoSearch(ctx, key, &GeoSearchQuery{Longitude: 15, Latitude: 37, Radius: 200, Unit: "km", Sort: "ASC", WithDist: true})
+	g.Expect(err).To(BeNil())
+	g.Expect(geoNames(res)).To(Equal([]string{"Catania", "Palermo"}))
+	g.Expect(fmt.Sprintf("%.4f", res[0].Dist)).To(Equal("56.4413"))
+	res, err = server.GeoSearch(ctx, key, &GeoSearchQuery{Longitude: 15, Latitude: 37, BoxWidth: 400, BoxHeight: 400, Unit: "km", Sort: "DESC"})
+	g.Expect(err).To(BeNil())
+	g.Expect(geoNames(res)).To(Equal([]string{"edge1", "edge2", "Palermo", "Catania"}))
+	g.Expect(res[0].Dist).To(Equal(0.0))
+	res, err = server.GeoSearch(ctx, key, &GeoSearchQuery{Member: []byte("Palermo"), Radius: 1000, Unit: "km", Count: 2})
+	g.Expect(err).To(BeNil())
+	g.Expect(geoNames(res)).To(Equal([]string{"Palermo", "edge1"}))
+	_, err = server.GeoSearch(ctx, key, &GeoSearchQuery{Member: []byte("missing"), Radius: 1})
+	g.Expect(err).NotTo(BeNil())
+	_, err = server.GeoSearch(ctx, key, &GeoSearchQuery{Radius: 1, BoxWidth: 1, BoxHeight: 1})
+	g.Expect(err).NotTo(BeNil())
+
+	dst := []byte(uuid.NewString())
+	n, err := server.GeoSearchStore(ctx, key, dst, &GeoSearchQuery{Longitude: 15, Latitude: 37, Radius: 100, Unit: "km"}, true)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(1)))
+	score, ok, err := server.ZScore(ctx, dst, []byte("Catania"))
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(true))
+	g.Expect(fmt.Sprintf("%.4f", score)).To(Equal("56.4413"))
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"strconv"
 	"time"
+
+	"github.com/zenozeng/s3dis/db"
 )
 
 type Hash struct {
@@ -14,24 +16,46 @@ type Hash struct {
 }
 
 func (c *Server) HSet(ctx context.Context, key string, field string, value string) error {
-	return c.db.Set(ctx, []byte(key), func(prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
-		hash := &Hash{
-			APIVersion: "v1",
-			Value:      map[string]string{},
-		}
-		if len(prevVal) > 0 {
-			err := json.Unmarshal(prevVal, hash)
-			if err != nil {
-				return nil, nil, err
+	_, err := c.HSetFields(ctx, key, field, value)
+	return err
+}
+
+// HSetFields sets fields of the hash stored at key, given as alternate field
+// names and values, and returns the number of fields which were added.
+func (c *Server) HSetFields(ctx context.Context, key string, fieldValues ...string) (int64, error) {
+	if len(fieldValues) == 0 || len(fieldValues)%2 != 0 {
+		return 0, fmt.Errorf("ERR wrong number of arguments for 'hset' command")
+	}
+	ctx = withCommand(ctx, "HSET", key, fieldValues)
+	added := int64(0)
+	err := c.update(ctx, []byte(key), func(tx *db.Tx) error {
+		tx.Notify(db.EventHash, "hset", []byte(key))
+		return tx.Set([]byte(key), func(prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
+			hash := &Hash{
+				APIVersion: "v1",
+				Value:      map[string]string{},
+			}
+			if len(prevVal) > 0 {
+				err := json.Unmarshal(prevVal, hash)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			if hash.Value == nil {
+				hash.Value = map[string]string{}
 			}
-		}
-		if hash.Value == nil {
-			hash.Value = map[string]string{}
-		}
-		hash.Value[field] = value
-		val, err := json.Marshal(hash)
-		return val, prevExp, err
+			added = 0
+			for i := 0; i < len(fieldValues); i += 2 {
+				if _, ok := hash.Value[fieldValues[i]]; !ok {
+					added++
+				}
+				hash.Value[fieldValues[i]] = fieldValues[i+1]
+			}
+			val, err := json.Marshal(hash)
+			return val, prevExp, err
+		})
 	})
+	return added, err
 }
 
 func (c *Server) HGet(ctx context.Context, key string, field string) (string, error) {
@@ -65,35 +89,39 @@ func (c *Server) HGetAll(ctx context.Context, key string) (map[string]string, er
 }
 
 func (c *Server) HIncrBy(ctx context.Context, key string, field string, increment int64) (int64, error) {
+	ctx = withCommand(ctx, "HINCRBY", key, field, increment)
 	num := int64(0)
-	err := c.db.Set(ctx, []byte(key), func(prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
-		hash := &Hash{
-			APIVersion: "v1",
-			Value:      map[string]string{},
-		}
-		if len(prevVal) > 0 {
-			err := json.Unmarshal(prevVal, hash)
+	err := c.update(ctx, []byte(key), func(tx *db.Tx) error {
+		tx.Notify(db.EventHash, "hincrby", []byte(key))
+		return tx.Set([]byte(key), func(prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
+			hash := &Hash{
+				APIVersion: "v1",
+				Value:      map[string]string{},
+			}
+			if len(prevVal) > 0 {
+				err := json.Unmarshal(prevVal, hash)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			if hash.Value == nil {
+				hash.Value = map[string]string{}
+			}
+
+			val := hash.Value[field]
+			if val == "" {
+				val = "0"
+			}
+			parsed, err := strconv.ParseInt(val, 10, 64)
 			if err != nil {
 				return nil, nil, err
 			}
-		}
-		if hash.Value == nil {
-			hash.Value = map[string]string{}
-		}
-
-		val := hash.Value[field]
-		if val == "" {
-			val = "0"
-		}
-		parsed, err := strconv.ParseInt(val, 10, 64)
-		if err != nil {
-			return nil, nil, err
-		}
-		num = parsed + increment
-		hash.Value[field] = fmt.Sprintf("%d", num)
+			num = parsed + increment
+			hash.Value[field] = fmt.Sprintf("%d", num)
 
-		data, err := json.Marshal(hash)
-		return data, prevExp, err
+			data, err := json.Marshal(hash)
+			return data, prevExp, err
+		})
 	})
 	return num, err
 }
@@ -0,0 +1,428 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+// HyperLogLogs are stored as string values using the Redis representation,
+// so that they can be moved between Redis and s3dis as plain strings:
+//
+//	+------+---+-----+----------+
+//	| HYLL | E | N/U | Cardin.  |
+//	+------+---+-----+----------+
+//
+// a 4 bytes magic, the encoding (0 dense, 1 sparse), 3 unused bytes and the
+// cached cardinality as 8 bytes little endian, whose most significant bit
+// marks the cache as invalid. The dense encoding holds 16384 registers of 6
+// bits, the sparse one holds run-length encoded registers.
+const (
+	hllP             = 14
+	hllQ             = 64 - hllP
+	hllRegisters     = 1 << hllP
+	hllBits          = 6
+	hllRegisterMax   = 1<<hllBits - 1
+	hllHeaderSize    = 16
+	hllDenseSize     = hllHeaderSize + (hllRegisters*hllBits+7)/8
+	hllDense         = 0
+	hllSparse        = 1
+	hllSparseValMax  = 32
+	hllSparseMaxSize = 3000 // hll-sparse-max-bytes
+	hllAlphaInf      = 0.721347520444481703680
+)
+
+var (
+	errNotHLL     = fmt.Errorf("WRONGTYPE Key is not a valid HyperLogLog string value.")
+	errCorruptHLL = fmt.Errorf("INVALIDOBJ Corrupted HLL object detected")
+)
+
+// murmurHash64A is the hash function Redis uses for HyperLogLogs
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ uint64(len(key))*m
+	for len(key) >= 8 {
+		k := binary.LittleEndian.Uint64(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		key = key[8:]
+	}
+	if len(key) > 0 {
+		for i := len(key) - 1; i >= 0; i-- {
+			h ^= uint64(key[i]) << (8 * i)
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// hllPatLen returns the register of element and the length of the run of
+// zeros, plus one, of its hash
+func hllPatLen(element []byte) (int, uint8) {
+	hash := murmurHash64A(element, 0xadc83b19)
+	index := int(hash & (hllRegisters - 1))
+	hash >>= hllP
+	hash |= 1 << hllQ
+	count := uint8(1)
+	for bit := uint64(1); hash&bit == 0; bit <<= 1 {
+		count++
+	}
+	return index, count
+}
+
+// hll holds the decoded registers of a HyperLogLog and its header
+type hll struct {
+	header    [hllHeaderSize]byte
+	registers [hllRegisters]uint8
+}
+
+func newHLL() *hll {
+	h := &hll{}
+	copy(h.header[:], "HYLL")
+	h.header[4] = hllSparse
+	return h
+}
+
+// decodeHLL decodes a HyperLogLog stored in the Redis representation
+func decodeHLL(val []byte) (*hll, error) {
+	if len(val) < hllHeaderSize || !bytes.Equal(val[:4], []byte("HYLL")) || val[4] > hllSparse {
+		return nil, errNotHLL
+	}
+	h := &hll{}
+	copy(h.header[:], val)
+	if val[4] == hllDense {
+		if len(val) != hllDenseSize {
+			return nil, errNotHLL
+		}
+		regs := val[hllHeaderSize:]
+		for i := range h.registers {
+			h.registers[i] = denseGet(regs, i)
+		}
+		return h, nil
+	}
+	i := 0
+	for p := hllHeaderSize; p < len(val); p++ {
+		op := val[p]
+		n, v := 0, uint8(0)
+		switch {
+		case op&0xc0 == 0:
+			// ZERO: 00xxxxxx
+			n = int(op&0x3f) + 1
+		case op&0xc0 == 0x40:
+			// XZERO: 01xxxxxx yyyyyyyy
+			if p+1 >= len(val) {
+				return nil, errCorruptHLL
+			}
+			n = int(op&0x3f)<<8 | int(val[p+1]) + 1
+			p++
+		default:
+			// VAL: 1vvvvvxx
+			v = (op>>2)&0x1f + 1
+			n = int(op&0x3) + 1
+		}
+		if i+n > hllRegisters {
+			return nil, errCorruptHLL
+		}
+		for ; n > 0; n-- {
+			h.registers[i] = v
+			i++
+		}
+	}
+	if i != hllRegisters {
+		return nil, errCorruptHLL
+	}
+	return h, nil
+}
+
+func denseGet(regs []byte, i int) uint8 {
+	b := i * hllBits / 8
+	fb := uint(i*hllBits) & 7
+	v := regs[b] >> fb
+	if b+1 < len(regs) {
+		v |= regs[b+1] << (8 - fb)
+	}
+	return v & hllRegisterMax
+}
+
+func denseSet(regs []byte, i int, v uint8) {
+	b := i * hllBits / 8
+	fb := uint(i*hllBits) & 7
+	regs[b] &^= hllRegisterMax << fb
+	regs[b] |= v << fb
+	if b+1 < len(regs) {
+		regs[b+1] &^= hllRegisterMax >> (8 - fb)
+		regs[b+1] |= v >> (8 - fb)
+	}
+}
+
+// encodeSparse returns the sparse representation of the registers, or false
+// if they can not be represented sparsely within hll-sparse-max-bytes
+func (h *hll) encodeSparse() ([]byte, bool) {
+	res := append([]byte{}, h.header[:]...)
+	res[4] = hllSparse
+	for i := 0; i < hllRegisters; {
+		v := h.registers[i]
+		if v > hllSparseValMax {
+			return nil, false
+		}
+		n := 1
+		for i+n < hllRegisters && h.registers[i+n] == v {
+			n++
+		}
+		i += n
+		for n > 0 {
+			switch {
+			case v == 0 && n > 64:
+				run := n
+				if run > hllRegisters {
+					run = hllRegisters
+				}
+				res = append(res, 0x40|byte((run-1)>>8), byte(run-1))
+				n -= run
+			case v == 0:
+				res = append(res, byte(n-1))
+				n = 0
+			default:
+				run := n
+				if run > 4 {
+					run = 4
+				}
+				res = append(res, 0x80|(v-1)<<2|byte(run-1))
+				n -= run
+			}
+		}
+		if len(res) > hllSparseMaxSize {
+			return nil, false
+		}
+	}
+	return res, true
+}
+
+func (h *hll) encodeDense() []byte {
+	res := make([]byte, hllDenseSize)
+	copy(res, h.header[:])
+	res[4] = hllDense
+	regs := res[hllHeaderSize:]
+	for i, v := range h.registers {
+		denseSet(regs, i, v)
+	}
+	return res
+}
+
+// encode returns the Redis representation of the HyperLogLog, keeping the
+// sparse encoding unless it is dense already or the registers do not fit it
+func (h *hll) encode() []byte {
+	if h.header[4] == hllSparse {
+		if res, ok := h.encodeSparse(); ok {
+			return res
+		}
+	}
+	return h.encodeDense()
+}
+
+// add adds element to the HyperLogLog and reports whether a register changed
+func (h *hll) add(element []byte) bool {
+	i, count := hllPatLen(element)
+	if h.registers[i] >= count {
+		return false
+	}
+	h.registers[i] = count
+	return true
+}
+
+// merge sets every register to the maximum of both HyperLogLogs
+func (h *hll) merge(other *hll) {
+	for i, v := range other.registers {
+		if v > h.registers[i] {
+			h.registers[i] = v
+		}
+	}
+}
+
+func (h *hll) invalidateCache() {
+	h.header[15] |= 1 << 7
+}
+
+// cachedCount returns the cached cardinality, or false if it is invalid
+func (h *hll) cachedCount() (int64, bool) {
+	if h.header[15]&(1<<7) != 0 {
+		return 0, false
+	}
+	return int64(binary.LittleEndian.Uint64(h.header[8:])), true
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if prev == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if prev == z {
+			return z / 3
+		}
+	}
+}
+
+// count estimates the cardinality with the estimator used by Redis, from
+// "New cardinality estimation algorithms for HyperLogLog sketches" by Otmar
+// Ertl
+func (h *hll) count() int64 {
+	m := float64(hllRegisters)
+	histogram := [64]int{}
+	for _, v := range h.registers {
+		histogram[v]++
+	}
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+	return int64(math.Round(hllAlphaInf * m * m / z))
+}
+
+// readHLL returns the HyperLogLog stored at key, or nil if the key does not
+// exist
+func readHLL(tx *db.Tx, key []byte) (*hll, *time.Time, error) {
+	val, exp, err := tx.Get(key)
+	if err != nil || val == nil {
+		return nil, nil, err
+	}
+	h, err := decodeHLL(val)
+	return h, exp, err
+}
+
+// PFAdd adds elements to the HyperLogLog stored at key, creating it if
+// needed, and reports whether its estimated cardinality may have changed.
+func (c *Server) PFAdd(ctx context.Context, key []byte, elements ...[]byte) (bool, error) {
+	ctx = withCommand(ctx, "PFADD", key, elements)
+	changed := false
+	err := c.update(ctx, key, func(tx *db.Tx) error {
+		h, exp, err := readHLL(tx, key)
+		if err != nil {
+			return err
+		}
+		created := h == nil
+		if created {
+			h = newHLL()
+		}
+		for _, element := range elements {
+			if h.add(element) {
+				changed = true
+			}
+		}
+		if changed {
+			h.invalidateCache()
+		}
+		if !changed && !created {
+			return errNoop
+		}
+		changed = true
+		tx.Notify(db.EventString, "pfadd", key)
+		return tx.Set(key, func([]byte, *time.Time) ([]byte, *time.Time, error) {
+			return h.encode(), exp, nil
+		})
+	})
+	return changed, err
+}
+
+// PFCount returns the estimated cardinality of the HyperLogLog stored at
+// key, or of the union of the HyperLogLogs stored at keys. The cardinality
+// cached in the value is used when valid, but unlike Redis it is not
+// updated, to keep PFCOUNT a read-only command.
+func (c *Server) PFCount(ctx context.Context, keys ...[]byte) (int64, error) {
+	if len(keys) == 0 {
+		return 0, fmt.Errorf("ERR wrong number of arguments for 'pfcount' command")
+	}
+	n := int64(0)
+	err := c.db.ViewKeys(ctx, keys, func(m *db.MultiTx) error {
+		union := newHLL()
+		for _, key := range keys {
+			h, _, err := readHLL(m.Tx(key), key)
+			if err != nil {
+				return err
+			}
+			if h == nil {
+				continue
+			}
+			if len(keys) == 1 {
+				if cached, ok := h.cachedCount(); ok {
+					n = cached
+					return nil
+				}
+			}
+			union.merge(h)
+		}
+		n = union.count()
+		return nil
+	})
+	return n, err
+}
+
+// PFMerge stores in destination the union of the HyperLogLogs stored at
+// destination and sources. The result is dense if any of them is dense.
+func (c *Server) PFMerge(ctx context.Context, destination []byte, sources ...[]byte) error {
+	ctx = withCommand(ctx, "PFMERGE", destination, sources)
+	return c.updateKeys(ctx, append([][]byte{destination}, sources...), func(m *db.MultiTx) error {
+		tx := m.Tx(destination)
+		res, exp, err := readHLL(tx, destination)
+		if err != nil {
+			return err
+		}
+		if res == nil {
+			res = newHLL()
+		}
+		for _, key := range sources {
+			h, _, err := readHLL(m.Tx(key), key)
+			if err != nil {
+				return err
+			}
+			if h == nil {
+				continue
+			}
+			res.merge(h)
+			if h.header[4] == hllDense {
+				res.header[4] = hllDense
+			}
+		}
+		res.invalidateCache()
+		tx.Notify(db.EventString, "pfadd", destination)
+		return tx.Set(destination, func([]byte, *time.Time) ([]byte, *time.Time, error) {
+			return res.encode(), exp, nil
+		})
+	})
+}
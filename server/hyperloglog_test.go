@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestPFAdd(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	changed, err := server.PFAdd(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(changed).To(Equal(true))
+	val, err := server.Get(ctx, key)
+	g.Expect(err).To(BeNil())
+	// an empty HyperLogLog as created by Redis
+	g.Expect(val).To(Equal([]byte("HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xff")))
+
+	changed, err = server.PFAdd(ctx, key, bytesList("a", "b", "c", "d", "e", "f", "g")...)
+	g.Expect(err).To(BeNil())
+	g.Expect(changed).To(Equal(true))
+	changed, err = server.PFAdd(ctx, key, []byte("a"))
+	g.Expect(err).To(BeNil())
+	g.Expect(changed).To(Equal(false))
+	n, err := server.PFCount(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(7)))
+
+	err = server.Set(ctx, key, []byte("HYLLx"), nil)
+	g.Expect(err).To(BeNil())
+	_, err = server.PFAdd(ctx, key, []byte("a"))
+	g.Expect(err).NotTo(BeNil())
+	list := []byte(uuid.NewString())
+	_, err = server.LPush(ctx, list, []byte("a"))
+	g.Expect(err).To(BeNil())
+	_, err = server.PFCount(ctx, list)
+	g.Expect(err).NotTo(BeNil())
+	_, err = server.PFCount(ctx)
+	g.Expect(err).To(Equal(fmt.Errorf("ERR wrong number of arguments for 'pfcount' command")))
+}
+
+func TestPFMerge(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	a := []byte(uuid.NewString())
+	b := []byte(uuid.NewString())
+	dst := []byte(uuid.NewString())
+
+	elements := [][]byte{}
+	for i := 0; i < 10000; i++ {
+		elements = append(elements, []byte(fmt.Sprint(i)))
+	}
+	_, err := server.PFAdd(ctx, a, elements[:6000]...)
+	g.Expect(err).To(BeNil())
+	_, err = server.PFAdd(ctx, b, elements[4000:]...)
+	g.Expect(err).To(BeNil())
+	val, err := server.Get(ctx, a)
+	g.Expect(err).To(BeNil())
+	// promoted to the dense encoding
+	g.Expect(len(val)).To(Equal(hllDenseSize))
+
+	err = server.PFMerge(ctx, dst, a, b)
+	g.Expect(err).To(BeNil())
+	merged, err := server.PFCount(ctx, dst)
+	g.Expect(err).To(BeNil())
+	g.Expect(merged > 9800 && merged < 10200).To(Equal(true))
+	n, err := server.PFCount(ctx, a, b)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(merged))
+
+	h := newHLL()
+	for _, element := range elements[:100] {
+		h.add(element)
+	}
+	sparse := h.encode()
+	g.Expect(sparse[4]).To(Equal(byte(hllSparse)))
+	decoded, err := decodeHLL(sparse)
+	g.Expect(err).To(BeNil())
+	g.Expect(decoded.registers).To(Equal(h.registers))
+	decoded, err = decodeHLL(h.encodeDense())
+	g.Expect(err).To(BeNil())
+	g.Expect(decoded.registers).To(Equal(h.registers))
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"os"
+	"time"
 
 	"github.com/zenozeng/s3dis/storage"
 
@@ -32,5 +33,6 @@ func init() {
 		CacheDir:  os.Getenv("S3DIS_TEST_CACHE_DIR"),
 		Singleton: true,
 		MaxPartitionNum: 1024,
+		ExpireSweepInterval: 100 * time.Millisecond,
 	})
 }
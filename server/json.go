@@ -0,0 +1,376 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+var errJSONNoKey = fmt.Errorf("ERR could not perform this operation on a key that doesn't exist")
+
+func errJSONPathMissing(path string) error {
+	return fmt.Errorf("ERR Path '%s' does not exist", path)
+}
+
+// readDocument returns the decoded JSON document stored at key, or nil if
+// the key does not exist
+func readDocument(tx *db.Tx, key []byte) (*db.Document, interface{}, error) {
+	doc, err := tx.OpenDocument(key, false)
+	if err != nil || doc == nil {
+		return nil, nil, err
+	}
+	root, err := parseJSON(doc.Get())
+	return doc, root, err
+}
+
+// JSONSetOptions mirrors the options of JSON.SET.
+type JSONSetOptions struct {
+	NX bool // only set the value if the path does not exist
+	XX bool // only set the value if the path exists
+}
+
+// JSONSet sets the JSON value at path in the document stored at key. New
+// documents must be created at the root path. A path which does not exist is
+// created if its parent is an object and its last element is a key. JSONSet
+// reports whether the value was set.
+func (c *Server) JSONSet(ctx context.Context, key []byte, path string, value []byte, opts *JSONSetOptions) (bool, error) {
+	if opts == nil {
+		opts = &JSONSetOptions{}
+	}
+	ctx = withCommand(ctx, "JSON.SET", key, path, value, flag(opts.NX, "NX"), flag(opts.XX, "XX"))
+	if opts.NX && opts.XX {
+		return false, fmt.Errorf("syntax error")
+	}
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return false, err
+	}
+	_, err = parseJSON(value)
+	if err != nil {
+		return false, err
+	}
+	applied := false
+	err = c.update(ctx, key, func(tx *db.Tx) error {
+		doc, root, err := readDocument(tx, key)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			if len(p.selectors) > 0 {
+				return fmt.Errorf("ERR new objects must be created at the root")
+			}
+			if opts.XX {
+				return errNoop
+			}
+			doc, err = tx.OpenDocument(key, true)
+			if err != nil {
+				return err
+			}
+			applied = true
+			return doc.Put(value)
+		}
+		if len(p.selectors) == 0 {
+			if opts.NX {
+				return errNoop
+			}
+			applied = true
+			return doc.Put(value)
+		}
+		nodes := p.match(root)
+		if len(nodes) > 0 {
+			if opts.NX {
+				return errNoop
+			}
+			for _, node := range nodes {
+				// every node gets its own copy of the value
+				v, _ := parseJSON(value)
+				node.replace(v)
+			}
+		} else {
+			last := p.selectors[len(p.selectors)-1]
+			if opts.XX || last.recursive || len(last.names) != 1 {
+				return errNoop
+			}
+			for _, parent := range p.eval(root, len(p.selectors)-1) {
+				if o, ok := parent.value.(*jsonObject); ok {
+					v, _ := parseJSON(value)
+					o.set(last.names[0], v)
+					nodes = append(nodes, parent)
+				}
+			}
+			if len(nodes) == 0 {
+				return errNoop
+			}
+		}
+		applied = true
+		return doc.Put(marshalJSON(root))
+	})
+	return applied, err
+}
+
+// jsonGetPath returns the serialized result of a path: the first match for
+// legacy paths, an array of matches otherwise
+func jsonGetPath(root interface{}, p *jsonPath) ([]byte, error) {
+	nodes := p.match(root)
+	if p.legacy {
+		if len(nodes) == 0 {
+			return nil, errJSONPathMissing(p.raw)
+		}
+		return marshalJSON(nodes[0].value), nil
+	}
+	res := &jsonArray{items: []interface{}{}}
+	for _, node := range nodes {
+		res.items = append(res.items, node.value)
+	}
+	return marshalJSON(res), nil
+}
+
+// JSONGet returns the serialized values at paths in the document stored at
+// key, or nil if the key does not exist. Without paths it returns the whole
+// document. With a single path it returns the value of a legacy path, or the
+// array of values matched by a JSONPath. With several paths it returns an
+// object mapping each path to its result.
+func (c *Server) JSONGet(ctx context.Context, key []byte, paths ...string) ([]byte, error) {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	parsed := []*jsonPath{}
+	legacy := true
+	for _, path := range paths {
+		p, err := parseJSONPath(path)
+		if err != nil {
+			return nil, err
+		}
+		legacy = legacy && p.legacy
+		parsed = append(parsed, p)
+	}
+	var res []byte
+	err := c.db.View(ctx, key, func(tx *db.Tx) error {
+		doc, root, err := readDocument(tx, key)
+		if err != nil || doc == nil {
+			return err
+		}
+		if len(parsed) == 1 {
+			res, err = jsonGetPath(root, parsed[0])
+			return err
+		}
+		buf := &bytes.Buffer{}
+		buf.WriteByte('{')
+		for i, p := range parsed {
+			if !legacy {
+				// all paths are answered as JSONPath once one of them is
+				p.legacy = false
+			}
+			val, err := jsonGetPath(root, p)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSON(buf, p.raw)
+			buf.WriteByte(':')
+			buf.Write(val)
+		}
+		buf.WriteByte('}')
+		res = buf.Bytes()
+		return nil
+	})
+	return res, err
+}
+
+// JSONDel deletes the values at path in the document stored at key, the
+// whole key for the root path, and returns the number of deleted values.
+func (c *Server) JSONDel(ctx context.Context, key []byte, path string) (int64, error) {
+	ctx = withCommand(ctx, "JSON.DEL", key, path)
+	if path == "" {
+		path = "$"
+	}
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return 0, err
+	}
+	n := int64(0)
+	err = c.update(ctx, key, func(tx *db.Tx) error {
+		doc, root, err := readDocument(tx, key)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			return errNoop
+		}
+		if len(p.selectors) == 0 {
+			n = 1
+			_, err = tx.Delete(key)
+			return err
+		}
+		n = deleteNodes(p.match(root))
+		if n == 0 {
+			return errNoop
+		}
+		return doc.Put(marshalJSON(root))
+	})
+	return n, err
+}
+
+// updateDocument runs fn with the nodes matched by path in the document
+// stored at key, and saves the document unless fn returns errNoop
+func (c *Server) updateDocument(ctx context.Context, key []byte, path string, fn func(root interface{}, p *jsonPath, nodes []jsonNode) (interface{}, error)) error {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return err
+	}
+	return c.update(ctx, key, func(tx *db.Tx) error {
+		doc, root, err := readDocument(tx, key)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			return errJSONNoKey
+		}
+		nodes := p.match(root)
+		if p.legacy && len(nodes) == 0 {
+			return errJSONPathMissing(path)
+		}
+		root, err = fn(root, p, nodes)
+		if err != nil {
+			return err
+		}
+		return doc.Put(marshalJSON(root))
+	})
+}
+
+// addNumbers adds two JSON numbers, keeping integers as integers
+func addNumbers(a json.Number, increment float64) (json.Number, error) {
+	if i, err := a.Int64(); err == nil && increment == math.Trunc(increment) && math.Abs(increment) < 1<<53 {
+		sum := i + int64(increment)
+		if (sum > i) == (increment > 0) || increment == 0 {
+			return json.Number(strconv.FormatInt(sum, 10)), nil
+		}
+	}
+	f, err := a.Float64()
+	if err != nil {
+		return "", err
+	}
+	f += increment
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", fmt.Errorf("ERR result is not a number or is infinite")
+	}
+	b, _ := json.Marshal(f)
+	if !bytes.ContainsAny(b, ".eE") {
+		// floats remain floats, as in RedisJSON
+		b = append(b, ".0"...)
+	}
+	return json.Number(b), nil
+}
+
+// JSONNumIncrBy increments the numbers at path in the document stored at
+// key. It returns the new value for a legacy path, or an array of new
+// values, null for values which are not numbers, for a JSONPath.
+func (c *Server) JSONNumIncrBy(ctx context.Context, key []byte, path string, increment float64) ([]byte, error) {
+	ctx = withCommand(ctx, "JSON.NUMINCRBY", key, path, increment)
+	var res []byte
+	err := c.updateDocument(ctx, key, path, func(root interface{}, p *jsonPath, nodes []jsonNode) (interface{}, error) {
+		results := &jsonArray{items: []interface{}{}}
+		for _, node := range nodes {
+			n, ok := node.value.(json.Number)
+			if !ok {
+				if p.legacy {
+					return nil, fmt.Errorf("ERR wrong type of path value - expected a number but found %s", jsonType(node.value))
+				}
+				results.items = append(results.items, nil)
+				continue
+			}
+			sum, err := addNumbers(n, increment)
+			if err != nil {
+				return nil, err
+			}
+			if node.parent == nil {
+				root = sum
+			} else {
+				node.replace(sum)
+			}
+			results.items = append(results.items, sum)
+		}
+		if p.legacy {
+			res = marshalJSON(results.items[len(results.items)-1])
+		} else {
+			res = marshalJSON(results)
+		}
+		return root, nil
+	})
+	return res, err
+}
+
+// JSONArrAppend appends JSON values to the arrays at path in the document
+// stored at key, and returns the new length of each array, nil for values
+// which are not arrays. A legacy path returns the length of its first match.
+func (c *Server) JSONArrAppend(ctx context.Context, key []byte, path string, values ...[]byte) ([]*int64, error) {
+	ctx = withCommand(ctx, "JSON.ARRAPPEND", key, path, values)
+	if len(values) == 0 {
+		return nil, fmt.Errorf("wrong number of arguments for 'json.arrappend' command")
+	}
+	for _, value := range values {
+		_, err := parseJSON(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	res := []*int64{}
+	err := c.updateDocument(ctx, key, path, func(root interface{}, p *jsonPath, nodes []jsonNode) (interface{}, error) {
+		if p.legacy {
+			nodes = nodes[:1]
+		}
+		for _, node := range nodes {
+			a, ok := node.value.(*jsonArray)
+			if !ok {
+				if p.legacy {
+					return nil, fmt.Errorf("ERR wrong type of path value - expected array but found %s", jsonType(node.value))
+				}
+				res = append(res, nil)
+				continue
+			}
+			for _, value := range values {
+				v, _ := parseJSON(value)
+				a.items = append(a.items, v)
+			}
+			n := int64(len(a.items))
+			res = append(res, &n)
+		}
+		return root, nil
+	})
+	return res, err
+}
+
+// JSONType returns the types of the values at path in the document stored
+// at key, only the first one for a legacy path.
+func (c *Server) JSONType(ctx context.Context, key []byte, path string) ([]string, error) {
+	if path == "" {
+		path = "."
+	}
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	err = c.db.View(ctx, key, func(tx *db.Tx) error {
+		doc, root, err := readDocument(tx, key)
+		if err != nil || doc == nil {
+			return err
+		}
+		nodes := p.match(root)
+		if p.legacy && len(nodes) > 1 {
+			nodes = nodes[:1]
+		}
+		for _, node := range nodes {
+			res = append(res, jsonType(node.value))
+		}
+		return nil
+	})
+	return res, err
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/zenozeng/s3dis/db"
+)
+
+func TestJSON(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	_, err := server.JSONSet(ctx, key, "$.a", []byte("1"), nil)
+	g.Expect(err).NotTo(BeNil())
+	ok, err := server.JSONSet(ctx, key, "$", []byte(`{"name": "s3dis", "tags": ["a", "b"], "stats": {"stars": 1, "forks": 2.5}}`), nil)
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(true))
+	val, err := server.JSONGet(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(string(val)).To(Equal(`{"name":"s3dis","tags":["a","b"],"stats":{"stars":1,"forks":2.5}}`))
+	types, err := server.JSONType(ctx, key, "$..*")
+	g.Expect(err).To(BeNil())
+	g.Expect(types).To(Equal([]string{"string", "array", "object", "string", "string", "integer", "number"}))
+	err = server.db.View(ctx, key, func(tx *db.Tx) error {
+		typ, err := tx.Type(key)
+		g.Expect(typ).To(Equal(db.TypeJSON))
+		return err
+	})
+	g.Expect(err).To(BeNil())
+
+	ok, err = server.JSONSet(ctx, key, "$.name", []byte(`"other"`), &JSONSetOptions{NX: true})
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(false))
+	ok, err = server.JSONSet(ctx, key, "$.stats.watchers", []byte(`3`), nil)
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(true))
+	ok, err = server.JSONSet(ctx, key, "$.missing.watchers", []byte(`3`), nil)
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(false))
+	val, err = server.JSONGet(ctx, key, "stats.watchers")
+	g.Expect(err).To(BeNil())
+	g.Expect(string(val)).To(Equal(`3`))
+	val, err = server.JSONGet(ctx, key, "$.tags[-1]", "$.stats[?(@ > 2)]")
+	g.Expect(err).To(BeNil())
+	g.Expect(string(val)).To(Equal(`{"$.tags[-1]":["b"],"$.stats[?(@ > 2)]":[2.5,3]}`))
+	_, err = server.JSONGet(ctx, key, ".nope")
+	g.Expect(err).NotTo(BeNil())
+
+	res, err := server.JSONNumIncrBy(ctx, key, "$.stats.*", 1)
+	g.Expect(err).To(BeNil())
+	g.Expect(string(res)).To(Equal(`[2,3.5,4]`))
+	res, err = server.JSONNumIncrBy(ctx, key, ".stats.forks", 0.5)
+	g.Expect(err).To(BeNil())
+	g.Expect(string(res)).To(Equal(`4.0`))
+	_, err = server.JSONNumIncrBy(ctx, key, ".name", 1)
+	g.Expect(err).NotTo(BeNil())
+
+	lengths, err := server.JSONArrAppend(ctx, key, "$..*", []byte(`"c"`))
+	g.Expect(err).To(BeNil())
+	g.Expect(len(lengths)).To(Equal(8))
+	g.Expect(*lengths[1]).To(Equal(int64(3)))
+	g.Expect(lengths[0]).To(BeNil())
+
+	n, err := server.JSONDel(ctx, key, "$.tags[0,1]")
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(2)))
+	n, err = server.JSONDel(ctx, key, "$..stars")
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(1)))
+	val, err = server.JSONGet(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(string(val)).To(Equal(`{"name":"s3dis","tags":["c"],"stats":{"forks":4.0,"watchers":4}}`))
+	n, err = server.JSONDel(ctx, key, "$")
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(1)))
+	val, err = server.JSONGet(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(val).To(BeNil())
+}
@@ -0,0 +1,746 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSON documents are decoded into the following values, so that the order of
+// object keys is preserved as in RedisJSON: nil, bool, json.Number, string,
+// *jsonArray and *jsonObject.
+type jsonObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+type jsonArray struct {
+	items []interface{}
+}
+
+func (o *jsonObject) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *jsonObject) delete(key string) {
+	if _, ok := o.values[key]; !ok {
+		return
+	}
+	delete(o.values, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// parseJSON decodes a JSON value
+func parseJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := decodeJSON(dec)
+	if err == nil {
+		if _, err = dec.Token(); err == io.EOF {
+			return v, nil
+		}
+		err = fmt.Errorf("trailing characters")
+	}
+	return nil, fmt.Errorf("ERR invalid JSON value: %v", err)
+}
+
+func decodeJSON(dec *json.Decoder) (interface{}, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case json.Delim('{'):
+		o := &jsonObject{values: map[string]interface{}{}}
+		for dec.More() {
+			k, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			o.set(k.(string), v)
+		}
+		_, err = dec.Token()
+		return o, err
+	case json.Delim('['):
+		a := &jsonArray{items: []interface{}{}}
+		for dec.More() {
+			v, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			a.items = append(a.items, v)
+		}
+		_, err = dec.Token()
+		return a, err
+	}
+	return t, nil
+}
+
+// writeJSON serializes v compactly
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		buf.WriteString(v.String())
+	case string:
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(v)
+		// Encode terminates the value with a newline
+		buf.Truncate(buf.Len() - 1)
+	case *jsonArray:
+		buf.WriteByte('[')
+		for i, item := range v.items {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSON(buf, item)
+		}
+		buf.WriteByte(']')
+	case *jsonObject:
+		buf.WriteByte('{')
+		for i, k := range v.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSON(buf, k)
+			buf.WriteByte(':')
+			writeJSON(buf, v.values[k])
+		}
+		buf.WriteByte('}')
+	}
+}
+
+func marshalJSON(v interface{}) []byte {
+	buf := &bytes.Buffer{}
+	writeJSON(buf, v)
+	return buf.Bytes()
+}
+
+// jsonType returns the RedisJSON name of the type of v
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			return "number"
+		}
+		return "integer"
+	case string:
+		return "string"
+	case *jsonArray:
+		return "array"
+	}
+	return "object"
+}
+
+// jsonPath is a parsed path. Legacy paths, which do not start with $, match
+// a single value in RedisJSON commands.
+type jsonPath struct {
+	raw       string
+	legacy    bool
+	selectors []*jsonSelector
+}
+
+// jsonSelector selects children of a value, or of the value and all its
+// descendants if recursive is true
+type jsonSelector struct {
+	recursive bool
+	wildcard  bool
+	names     []string
+	indexes   []int
+	slice     *jsonSlice
+	filter    *jsonFilter
+}
+
+type jsonSlice struct {
+	start, end *int
+	step       int
+}
+
+// jsonNode is a value matched by a path, with its location in the document
+type jsonNode struct {
+	value  interface{}
+	parent interface{} // *jsonObject, *jsonArray, or nil for the root
+	key    string
+	index  int
+}
+
+func parseJSONPath(s string) (*jsonPath, error) {
+	p := &jsonPath{raw: s}
+	rest := ""
+	switch {
+	case strings.HasPrefix(s, "$"):
+		rest = s[1:]
+	case s == ".":
+		p.legacy = true
+	case strings.HasPrefix(s, ".") || strings.HasPrefix(s, "["):
+		p.legacy = true
+		rest = s
+	default:
+		p.legacy = true
+		rest = "." + s
+	}
+	errPath := fmt.Errorf("ERR invalid JSON path '%s'", s)
+	for rest != "" {
+		sel := &jsonSelector{}
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			sel.recursive = true
+			rest = rest[2:]
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+		case strings.HasPrefix(rest, "["):
+		default:
+			return nil, errPath
+		}
+		if strings.HasPrefix(rest, "[") {
+			end := bracketEnd(rest)
+			if end < 0 {
+				return nil, errPath
+			}
+			err := sel.parseBracket(strings.TrimSpace(rest[1:end]))
+			if err != nil {
+				return nil, errPath
+			}
+			rest = rest[end+1:]
+		} else {
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			if name == "" {
+				return nil, errPath
+			}
+			if name == "*" {
+				sel.wildcard = true
+			} else {
+				sel.names = []string{name}
+			}
+			rest = rest[end:]
+		}
+		p.selectors = append(p.selectors, sel)
+	}
+	return p, nil
+}
+
+// bracketEnd returns the index of the bracket closing the one s starts with
+func bracketEnd(s string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitTopLevel splits s on commas outside of quotes
+func splitTopLevel(s string) []string {
+	parts := []string{}
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ',':
+			parts = append(parts, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+func unquote(s string) (string, error) {
+	if len(s) < 2 || s[0] != s[len(s)-1] || s[0] != '\'' && s[0] != '"' {
+		return "", fmt.Errorf("expected a quoted string")
+	}
+	if s[0] == '\'' {
+		s = `"` + strings.ReplaceAll(strings.ReplaceAll(s[1:len(s)-1], `\'`, `'`), `"`, `\"`) + `"`
+	}
+	return strconv.Unquote(s)
+}
+
+func (sel *jsonSelector) parseBracket(s string) error {
+	switch {
+	case s == "*":
+		sel.wildcard = true
+		return nil
+	case strings.HasPrefix(s, "?"):
+		s = strings.TrimSpace(s[1:])
+		if !strings.HasPrefix(s, "(") || !strings.HasSuffix(s, ")") {
+			return fmt.Errorf("invalid filter")
+		}
+		f, err := parseJSONFilter(s[1 : len(s)-1])
+		sel.filter = f
+		return err
+	case strings.HasPrefix(s, "'") || strings.HasPrefix(s, `"`):
+		for _, part := range splitTopLevel(s) {
+			name, err := unquote(part)
+			if err != nil {
+				return err
+			}
+			sel.names = append(sel.names, name)
+		}
+		return nil
+	case strings.Contains(s, ":"):
+		parts := strings.Split(s, ":")
+		if len(parts) > 3 {
+			return fmt.Errorf("invalid slice")
+		}
+		sel.slice = &jsonSlice{step: 1}
+		bounds := []**int{&sel.slice.start, &sel.slice.end}
+		for i, part := range parts {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return err
+			}
+			if i == 2 {
+				if n <= 0 {
+					return fmt.Errorf("invalid slice step")
+				}
+				sel.slice.step = n
+			} else {
+				*bounds[i] = &n
+			}
+		}
+		return nil
+	}
+	for _, part := range splitTopLevel(s) {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return err
+		}
+		sel.indexes = append(sel.indexes, n)
+	}
+	return nil
+}
+
+// children returns the direct children of a node
+func children(node jsonNode) []jsonNode {
+	res := []jsonNode{}
+	switch v := node.value.(type) {
+	case *jsonObject:
+		for _, k := range v.keys {
+			res = append(res, jsonNode{value: v.values[k], parent: v, key: k})
+		}
+	case *jsonArray:
+		for i, item := range v.items {
+			res = append(res, jsonNode{value: item, parent: v, index: i})
+		}
+	}
+	return res
+}
+
+// descendants returns node and all its descendants in pre-order
+func descendants(node jsonNode) []jsonNode {
+	res := []jsonNode{node}
+	for _, child := range children(node) {
+		res = append(res, descendants(child)...)
+	}
+	return res
+}
+
+func (sel *jsonSelector) selectChildren(node jsonNode) []jsonNode {
+	res := []jsonNode{}
+	switch {
+	case sel.wildcard:
+		return children(node)
+	case sel.names != nil:
+		if o, ok := node.value.(*jsonObject); ok {
+			for _, name := range sel.names {
+				if v, ok := o.values[name]; ok {
+					res = append(res, jsonNode{value: v, parent: o, key: name})
+				}
+			}
+		}
+	case sel.indexes != nil:
+		if a, ok := node.value.(*jsonArray); ok {
+			for _, i := range sel.indexes {
+				if i < 0 {
+					i += len(a.items)
+				}
+				if i >= 0 && i < len(a.items) {
+					res = append(res, jsonNode{value: a.items[i], parent: a, index: i})
+				}
+			}
+		}
+	case sel.slice != nil:
+		if a, ok := node.value.(*jsonArray); ok {
+			n := len(a.items)
+			start, end := 0, n
+			if sel.slice.start != nil {
+				start = *sel.slice.start
+			}
+			if sel.slice.end != nil {
+				end = *sel.slice.end
+			}
+			if start < 0 {
+				start += n
+			}
+			if end < 0 {
+				end += n
+			}
+			if start < 0 {
+				start = 0
+			}
+			if end > n {
+				end = n
+			}
+			for i := start; i < end; i += sel.slice.step {
+				res = append(res, jsonNode{value: a.items[i], parent: a, index: i})
+			}
+		}
+	case sel.filter != nil:
+		for _, child := range children(node) {
+			if sel.filter.match(child.value) {
+				res = append(res, child)
+			}
+		}
+	}
+	return res
+}
+
+// eval returns the nodes of root matched by the first n selectors of the path
+func (p *jsonPath) eval(root interface{}, n int) []jsonNode {
+	nodes := []jsonNode{{value: root}}
+	for _, sel := range p.selectors[:n] {
+		next := []jsonNode{}
+		for _, node := range nodes {
+			targets := []jsonNode{node}
+			if sel.recursive {
+				targets = descendants(node)
+			}
+			for _, target := range targets {
+				next = append(next, sel.selectChildren(target)...)
+			}
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+// match returns the nodes of root matched by the path
+func (p *jsonPath) match(root interface{}) []jsonNode {
+	return p.eval(root, len(p.selectors))
+}
+
+// replace sets the value of node in its parent
+func (node jsonNode) replace(v interface{}) {
+	switch parent := node.parent.(type) {
+	case *jsonObject:
+		parent.values[node.key] = v
+	case *jsonArray:
+		parent.items[node.index] = v
+	}
+}
+
+// deleteNodes removes nodes from their parents and returns the number of
+// removed nodes
+func deleteNodes(nodes []jsonNode) int64 {
+	n := int64(0)
+	indexes := map[*jsonArray][]int{}
+	for _, node := range nodes {
+		switch parent := node.parent.(type) {
+		case *jsonObject:
+			if _, ok := parent.values[node.key]; ok {
+				parent.delete(node.key)
+				n++
+			}
+		case *jsonArray:
+			indexes[parent] = append(indexes[parent], node.index)
+		}
+	}
+	for a, idx := range indexes {
+		// remove from the end so that indexes remain valid
+		sort.Sort(sort.Reverse(sort.IntSlice(idx)))
+		prev := -1
+		for _, i := range idx {
+			if i == prev {
+				continue
+			}
+			a.items = append(a.items[:i], a.items[i+1:]...)
+			prev = i
+			n++
+		}
+	}
+	return n
+}
+
+// jsonFilter is a filter expression such as @.price < 10 && @.tag == 'a',
+// a disjunction of conjunctions of comparisons
+type jsonFilter struct {
+	or [][]*jsonComparison
+}
+
+// jsonComparison compares two operands, or tests the existence of left if
+// op is empty
+type jsonComparison struct {
+	left, right *jsonOperand
+	op          string
+}
+
+// jsonOperand is a path relative to the filtered value, or a literal
+type jsonOperand struct {
+	path    *jsonPath
+	literal interface{}
+}
+
+// tokenizeFilter splits a filter expression into operands and operators
+func tokenizeFilter(s string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ':
+			i++
+		case strings.ContainsRune("=!<>&|", rune(c)):
+			j := i + 1
+			for j < len(s) && strings.ContainsRune("=&|", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		case c == '\'' || c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != c {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" =!<>&|", rune(s[j])) {
+				if s[j] == '[' {
+					end := bracketEnd(s[j:])
+					if end < 0 {
+						return nil, fmt.Errorf("unterminated bracket")
+					}
+					j += end
+				}
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func parseJSONOperand(s string) (*jsonOperand, error) {
+	if strings.HasPrefix(s, "@") {
+		p, err := parseJSONPath("$" + s[1:])
+		return &jsonOperand{path: p}, err
+	}
+	if strings.HasPrefix(s, "'") {
+		v, err := unquote(s)
+		return &jsonOperand{literal: v}, err
+	}
+	v, err := parseJSON([]byte(s))
+	if err != nil {
+		return nil, err
+	}
+	switch v.(type) {
+	case *jsonObject, *jsonArray:
+		return nil, fmt.Errorf("unsupported literal %s", s)
+	}
+	return &jsonOperand{literal: v}, nil
+}
+
+func parseJSONFilter(s string) (*jsonFilter, error) {
+	tokens, err := tokenizeFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	f := &jsonFilter{or: [][]*jsonComparison{{}}}
+	for len(tokens) > 0 {
+		cmp := &jsonComparison{}
+		cmp.left, err = parseJSONOperand(tokens[0])
+		if err != nil {
+			return nil, err
+		}
+		tokens = tokens[1:]
+		if len(tokens) > 0 && tokens[0] != "&&" && tokens[0] != "||" {
+			switch tokens[0] {
+			case "==", "!=", "<", "<=", ">", ">=":
+			default:
+				return nil, fmt.Errorf("unsupported operator %s", tokens[0])
+			}
+			if len(tokens) < 2 {
+				return nil, fmt.Errorf("missing operand")
+			}
+			cmp.op = tokens[0]
+			cmp.right, err = parseJSONOperand(tokens[1])
+			if err != nil {
+				return nil, err
+			}
+			tokens = tokens[2:]
+		}
+		last := len(f.or) - 1
+		f.or[last] = append(f.or[last], cmp)
+		if len(tokens) == 0 {
+			break
+		}
+		switch tokens[0] {
+		case "&&":
+		case "||":
+			f.or = append(f.or, []*jsonComparison{})
+		default:
+			return nil, fmt.Errorf("unexpected %s", tokens[0])
+		}
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("missing operand")
+		}
+	}
+	return f, nil
+}
+
+// value returns the value of the operand for v, or false if a path operand
+// matches nothing
+func (o *jsonOperand) value(v interface{}) (interface{}, bool) {
+	if o.path == nil {
+		return o.literal, true
+	}
+	nodes := o.path.match(v)
+	if len(nodes) == 0 {
+		return nil, false
+	}
+	return nodes[0].value, true
+}
+
+func (c *jsonComparison) match(v interface{}) bool {
+	left, ok := c.left.value(v)
+	if !ok {
+		return false
+	}
+	if c.op == "" {
+		return true
+	}
+	right, ok := c.right.value(v)
+	if !ok {
+		return false
+	}
+	cmp, comparable := compareJSON(left, right)
+	switch c.op {
+	case "==":
+		return comparable && cmp == 0
+	case "!=":
+		return !comparable || cmp != 0
+	case "<":
+		return comparable && cmp < 0
+	case "<=":
+		return comparable && cmp <= 0
+	case ">":
+		return comparable && cmp > 0
+	}
+	return comparable && cmp >= 0
+}
+
+// compareJSON compares two scalar values of the same type
+func compareJSON(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return 0, false
+		}
+		x, _ := a.Float64()
+		y, _ := b.Float64()
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	case bool:
+		b, ok := b.(bool)
+		if !ok || a != b {
+			return 1, ok
+		}
+		return 0, true
+	case nil:
+		return 0, b == nil
+	}
+	return 0, false
+}
+
+func (f *jsonFilter) match(v interface{}) bool {
+	for _, and := range f.or {
+		ok := true
+		for _, cmp := range and {
+			if !cmp.match(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestJSONPath(t *testing.T) {
+	g := NewWithT(t)
+	root, err := parseJSON([]byte(`{"store": {"book": [
+		{"title": "a", "price": 8, "tags": ["x"]},
+		{"title": "b", "price": 12.5},
+		{"title": "c", "price": 20, "isbn": "1"}
+	], "bicycle": {"price": 19.95}}}`))
+	g.Expect(err).To(BeNil())
+
+	for path, expected := range map[string]string{
+		"$":                                  `[{"store":{"book":[{"title":"a","price":8,"tags":["x"]},{"title":"b","price":12.5},{"title":"c","price":20,"isbn":"1"}],"bicycle":{"price":19.95}}}]`,
+		"$.store.book[*].title":              `["a","b","c"]`,
+		"$..price":                           `[8,12.5,20,19.95]`,
+		"$.store.book[-1].title":             `["c"]`,
+		"$.store.book[0:2].title":            `["a","b"]`,
+		"$.store.book[::2].title":            `["a","c"]`,
+		"$.store['bicycle','book'][0].title": `["a"]`,
+		"$.store.book[?(@.isbn)].title":      `["c"]`,
+		"$..book[?(@.price < 10 || @.price >= 20)].title":  `["a","c"]`,
+		"$..book[?(@.title != 'a' && @.price < 15)].title": `["b"]`,
+		"$..[?(@ == 'x')]": `["x"]`,
+		"$.missing":        `[]`,
+	} {
+		p, err := parseJSONPath(path)
+		g.Expect(err).To(BeNil(), path)
+		val, err := jsonGetPath(root, p)
+		g.Expect(err).To(BeNil(), path)
+		g.Expect(string(val)).To(Equal(expected), path)
+	}
+
+	p, err := parseJSONPath("store.bicycle")
+	g.Expect(err).To(BeNil())
+	g.Expect(p.legacy).To(Equal(true))
+	val, err := jsonGetPath(root, p)
+	g.Expect(err).To(BeNil())
+	g.Expect(string(val)).To(Equal(`{"price":19.95}`))
+
+	for _, path := range []string{"$.", "$[", "$[?(@.a ~ 1)]", "$[1:2:0]"} {
+		_, err = parseJSONPath(path)
+		g.Expect(err).NotTo(BeNil(), path)
+	}
+	_, err = parseJSON([]byte(`{"a": 1} x`))
+	g.Expect(err).NotTo(BeNil())
+}
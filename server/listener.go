@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+// client is the state of a RESP connection
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex // guards w, which also writes the published messages
+	w    *respWriter
+	db   int  // selected logical database
+	quit bool // close the connection once the reply is written
+	peer bool // accepted by ServePeers, runs the internal commands only
+
+	multi   bool         // commands are queued until EXEC
+	queued  [][][]byte   // commands queued since MULTI
+	aborted bool         // a command failed to queue, EXEC discards them
+	watched []watchedKey // keys watched by WATCH
+
+	subscriptions [subscriptionKinds]map[string]bool // by kind of subscription
+	messages      chan func(w *respWriter)           // messages waiting for delivery
+	tracking      *trackingOptions                   // nil unless CLIENT TRACKING is on
+
+	id      int64 // assigned by the registry of the connections
+	created time.Time
+	stateMu sync.Mutex // guards state, which other connections read
+	state   clientState
+}
+
+// ListenAndServe listens on the TCP address addr and serves RESP clients,
+// see Serve.
+func (c *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return c.Serve(l)
+}
+
+// Serve accepts connections on l and serves the commands of the command
+// table over the Redis protocol, until l is closed. The internal commands
+// of the processes sharing the object storage are only served by
+// ServePeers.
+func (c *Server) Serve(l net.Listener) error {
+	return c.accept(l, false)
+}
+
+// ServePeers accepts on l the connections of the other processes sharing
+// the object storage, which forward messages with the internal S3DIS.*
+// commands, until l is closed. l must listen at ServerConfig.PubSubAddr and
+// should only be reachable by these processes. Its connections can not run
+// the other commands.
+func (c *Server) ServePeers(l net.Listener) error {
+	return c.accept(l, true)
+}
+
+// ListenAndServePeers listens on the TCP address addr and serves the other
+// processes, see ServePeers.
+func (c *Server) ListenAndServePeers(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return c.ServePeers(l)
+}
+
+func (c *Server) accept(l net.Listener, peer bool) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go c.serveConn(conn, peer)
+	}
+}
+
+func (c *Server) serveConn(conn net.Conn, peer bool) {
+	defer conn.Close()
+	cl := &client{
+		conn: conn,
+		peer: peer,
+		r:    bufio.NewReaderSize(conn, maxInlineLen),
+		w:    &respWriter{Writer: bufio.NewWriter(conn)},
+		// messages are published, and invalidations sent, to any connection
+		messages: make(chan func(w *respWriter), pubsubBufferLen),
+	}
+	c.clients.add(cl)
+	defer c.clients.remove(cl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go deliver(ctx, cl)
+	defer c.pubsub.unsubscribeAll(cl)
+	defer c.tracking.disable(cl)
+	for !cl.quit {
+		args, err := readCommand(cl.r)
+		var protocolErr errProtocol
+		if errors.As(err, &protocolErr) {
+			cl.mu.Lock()
+			cl.w.writeError(err)
+			cl.w.Flush()
+			cl.mu.Unlock()
+			return
+		}
+		if err != nil {
+			return
+		}
+		cl.mu.Lock()
+		if len(args) > 0 {
+			cl.beginCommand(args[0])
+			c.dispatch(ctx, cl, args)
+			cl.endCommand()
+		}
+		// replies of pipelined commands are flushed together
+		if cl.r.Buffered() == 0 || cl.quit {
+			err = cl.w.Flush()
+		}
+		cl.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// lookupCommand returns the command named by args[0] after checking its
+// number of arguments
+func lookupCommand(args [][]byte) (command, error) {
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		return cmd, fmt.Errorf("ERR unknown command '%s'", args[0])
+	}
+	if cmd.arity > 0 && len(args) != cmd.arity || len(args) < -cmd.arity {
+		return cmd, fmt.Errorf("ERR wrong number of arguments for '%s' command", name)
+	}
+	return cmd, nil
+}
+
+// dispatch runs a command, or queues it within MULTI, and writes its reply
+// or its error
+func (c *Server) dispatch(ctx context.Context, cl *client, args [][]byte) {
+	cmd, err := lookupCommand(args)
+	if err == nil && (cmd.flags&flagInternal != 0) != cl.peer {
+		err = fmt.Errorf("ERR unknown command '%s'", args[0])
+	}
+	// RESP3 connections may run any command while subscribed, since
+	// messages are told apart from replies
+	if err == nil && cl.subscribed() && !cl.w.resp3 && cmd.flags&flagSubscribed == 0 {
+		err = fmt.Errorf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(string(args[0])))
+	}
+	if cl.multi && (err != nil || cmd.flags&flagNoQueue == 0) {
+		cl.queue(cmd, args, err)
+		return
+	}
+	if err != nil {
+		cl.w.writeError(err)
+		return
+	}
+	name := strings.ToLower(string(args[0]))
+	c.clients.waitPause(ctx, cl, cmd, name)
+	ctx, unlock := c.lockKeyspace(ctx, cl, name)
+	defer unlock()
+	c.run(ctx, cl, cmd, args)
+}
+
+// run runs a command and writes its reply, or its error
+func (c *Server) run(ctx context.Context, cl *client, cmd command, args [][]byte) {
+	// the database is selected for every command, to follow SWAPDB
+	selected, err := c.Select(cl.db)
+	if err == nil && cl.tracking != nil && cmd.flags&flagWrite == 0 {
+		// keys are tracked before they are read, so that a write racing with
+		// the read is invalidated
+		c.tracking.track(cl, cmd.keys.keys(args))
+	}
+	if err == nil {
+		// change data capture records the command of the writes
+		err = cmd.fn(selected, db.WithCommand(ctx, args), cl, args[1:])
+	}
+	if err != nil {
+		cl.w.writeError(err)
+	}
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// readReply parses a RESP2 or RESP3 reply: strings for simple strings and
+// bulk strings, errors, int64, float64, nil, []interface{} for arrays,
+// map[string]interface{} for maps, respSet and respPush
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return fmt.Errorf("%s", line[1:]), nil
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case ',':
+		return strconv.ParseFloat(string(line[1:]), 64)
+	case '_':
+		return nil, nil
+	case '$':
+		n, _ := strconv.Atoi(string(line[1:]))
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(r, b)
+		return string(b[:n]), err
+	case '*':
+		n, _ := strconv.Atoi(string(line[1:]))
+		if n < 0 {
+			return nil, nil
+		}
+		return readItems(r, n)
+	case '~':
+		n, _ := strconv.Atoi(string(line[1:]))
+		items, err := readItems(r, n)
+		return respSet(items), err
+	case '>':
+		n, _ := strconv.Atoi(string(line[1:]))
+		items, err := readItems(r, n)
+		return respPush(items), err
+	case '%':
+		n, _ := strconv.Atoi(string(line[1:]))
+		items, err := readItems(r, 2*n)
+		if err != nil {
+			return nil, err
+		}
+		m := map[string]interface{}{}
+		for i := 0; i < len(items); i += 2 {
+			m[fmt.Sprint(items[i])] = items[i+1]
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// respSet and respPush are the sets and push messages of RESP3, told apart
+// from arrays
+type (
+	respSet  []interface{}
+	respPush []interface{}
+)
+
+func readItems(r *bufio.Reader, n int) ([]interface{}, error) {
+	items := []interface{}{}
+	for i := 0; i < n; i++ {
+		item, err := readReply(r)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// dial starts serving on a random port and returns a function sending a
+// command and returning its reply
+func dial(t *testing.T) func(args ...string) interface{} {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		l.Close()
+	})
+	r := bufio.NewReader(conn)
+	return func(args ...string) interface{} {
+		req := fmt.Sprintf("*%d\r\n", len(args))
+		for _, arg := range args {
+			req += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+		}
+		_, err := conn.Write([]byte(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := readReply(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+}
+
+func TestServe(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	g.Expect(do("PING")).To(Equal("PONG"))
+	g.Expect(do("echo", "hello world")).To(Equal("hello world"))
+	g.Expect(do("NOSUCHCOMMAND")).To(Equal(fmt.Errorf("ERR unknown command 'NOSUCHCOMMAND'")))
+	g.Expect(do("GET")).To(Equal(fmt.Errorf("ERR wrong number of arguments for 'get' command")))
+
+	key := uuid.NewString()
+	g.Expect(do("GET", key)).To(BeNil())
+	g.Expect(do("SET", key, "a", "NX")).To(Equal("OK"))
+	g.Expect(do("SET", key, "b", "NX")).To(BeNil())
+	g.Expect(do("SET", key, "b", "GET")).To(Equal("a"))
+	g.Expect(do("SET", key, "b", "EX")).To(Equal(fmt.Errorf("ERR syntax error")))
+	g.Expect(do("SET", key, "b", "EX", "0")).To(Equal(fmt.Errorf("ERR invalid expire time in 'set' command")))
+	g.Expect(do("SET", key, "b", "PX", "-1")).To(Equal(fmt.Errorf("ERR invalid expire time in 'set' command")))
+	g.Expect(do("MGET", key, uuid.NewString())).To(Equal([]interface{}{"b", nil}))
+	g.Expect(do("TYPE", key)).To(Equal("string"))
+	g.Expect(do("QUIT")).To(Equal("OK"))
+}
+
+func TestServeInline(t *testing.T) {
+	g := NewWithT(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).To(BeNil())
+	defer l.Close()
+	go server.Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	g.Expect(err).To(BeNil())
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// pipelined inline commands
+	_, err = conn.Write([]byte("PING\r\nECHO \"a b\\n\"\r\n\r\nECHO 'c\r\n"))
+	g.Expect(err).To(BeNil())
+	g.Expect(readReply(r)).To(Equal("PONG"))
+	g.Expect(readReply(r)).To(Equal("a b\n"))
+	g.Expect(readReply(r)).To(Equal(fmt.Errorf("ERR Protocol error: unbalanced quotes in request")))
+	_, err = readReply(r)
+	g.Expect(err).To(Equal(io.EOF))
+}
+
+func TestServeScan(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	prefix := uuid.NewString()
+	g.Expect(do("MSET", prefix+":a", "1", prefix+":b", "2", prefix+":c", "3")).To(Equal("OK"))
+
+	keys := []interface{}{}
+	cursor := "0"
+	for {
+		reply := do("SCAN", cursor, "MATCH", prefix+":[ab]", "COUNT", "50").([]interface{})
+		keys = append(keys, reply[1].([]interface{})...)
+		cursor = reply[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+	g.Expect(len(keys)).To(Equal(2))
+	g.Expect(do("SCAN", "0", "COUNT", "0")).To(Equal(fmt.Errorf("ERR syntax error")))
+	g.Expect(do("SCAN", "x")).To(Equal(fmt.Errorf("ERR invalid cursor")))
+	g.Expect(len(do("KEYS", prefix+"*").([]interface{}))).To(Equal(3))
+}
+
+func TestServeFlush(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	key := uuid.NewString()
+	g.Expect(do("SET", key, "a")).To(Equal("OK"))
+	g.Expect(do("DBSIZE").(int64) > 0).To(Equal(true))
+	g.Expect(do("FLUSHDB", "LAZY")).To(Equal(fmt.Errorf("ERR syntax error")))
+	g.Expect(do("FLUSHALL", "ASYNC")).To(Equal("OK"))
+	g.Expect(do("GET", key)).To(BeNil())
+	g.Expect(do("DBSIZE")).To(Equal(int64(0)))
+	g.Expect(do("SET", key, "a")).To(Equal("OK"))
+	g.Expect(do("FLUSHDB")).To(Equal("OK"))
+	g.Expect(do("DBSIZE")).To(Equal(int64(0)))
+}
+
+func TestServeSelect(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	key := uuid.NewString()
+	g.Expect(do("SELECT", "16")).To(Equal(fmt.Errorf("ERR DB index is out of range")))
+	g.Expect(do("SELECT", "x")).To(Equal(fmt.Errorf("ERR value is not an integer or out of range")))
+	g.Expect(do("SELECT", "3")).To(Equal("OK"))
+	g.Expect(do("SET", key, "a")).To(Equal("OK"))
+	g.Expect(do("MOVE", key, "3")).To(Equal(fmt.Errorf("ERR source and destination objects are the same")))
+	g.Expect(do("SELECT", "0")).To(Equal("OK"))
+	g.Expect(do("GET", key)).To(BeNil())
+
+	// the connection follows the swap of its database
+	g.Expect(do("SWAPDB", "0", "3")).To(Equal("OK"))
+	g.Expect(do("GET", key)).To(Equal("a"))
+	g.Expect(do("SWAPDB", "3", "0")).To(Equal("OK"))
+	g.Expect(do("GET", key)).To(BeNil())
+
+	g.Expect(do("SELECT", "3")).To(Equal("OK"))
+	g.Expect(do("MOVE", key, "4")).To(Equal(int64(1)))
+	g.Expect(do("MOVE", key, "4")).To(Equal(int64(0)))
+	g.Expect(do("SELECT", "4")).To(Equal("OK"))
+	g.Expect(do("GET", key)).To(Equal("a"))
+	info := do("INFO").(string)
+	g.Expect(strings.Contains(info, "\r\ndb4: keys=")).To(Equal(true))
+	g.Expect(do("FLUSHDB")).To(Equal("OK"))
+	g.Expect(do("DBSIZE")).To(Equal(int64(0)))
+}
+
+func TestServeRename(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	src, dst := uuid.NewString(), uuid.NewString()
+	g.Expect(do("RENAME", src, dst)).To(Equal(fmt.Errorf("ERR no such key")))
+	g.Expect(do("SET", src, "a")).To(Equal("OK"))
+	g.Expect(do("RENAME", src, dst)).To(Equal("OK"))
+	g.Expect(do("GET", src)).To(BeNil())
+	g.Expect(do("GET", dst)).To(Equal("a"))
+	g.Expect(do("SET", src, "b")).To(Equal("OK"))
+	g.Expect(do("RENAMENX", src, dst)).To(Equal(int64(0)))
+	g.Expect(do("RENAMENX", dst, uuid.NewString())).To(Equal(int64(1)))
+
+	g.Expect(do("COPY", src, src)).To(Equal(fmt.Errorf("ERR source and destination objects are the same")))
+	g.Expect(do("COPY", src, dst, "REPLACE", "DB")).To(Equal(fmt.Errorf("ERR syntax error")))
+	g.Expect(do("COPY", src, dst)).To(Equal(int64(1)))
+	g.Expect(do("COPY", src, dst)).To(Equal(int64(0)))
+	g.Expect(do("COPY", src, dst, "DB", "5")).To(Equal(int64(1)))
+	g.Expect(do("SET", src, "c")).To(Equal("OK"))
+	g.Expect(do("COPY", src, dst, "DB", "5", "REPLACE")).To(Equal(int64(1)))
+	g.Expect(do("GET", dst)).To(Equal("b"))
+	g.Expect(do("SELECT", "5")).To(Equal("OK"))
+	g.Expect(do("GET", dst)).To(Equal("c"))
+}
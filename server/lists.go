@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+func (c *Server) push(ctx context.Context, key []byte, left bool, values [][]byte) (int64, error) {
+	n := int64(0)
+	err := c.db.Update(ctx, key, func(tx *db.Tx) error {
+		list, err := tx.OpenList(key, true)
+		if err != nil {
+			return err
+		}
+		err = list.Push(left, values...)
+		n = list.Len()
+		return err
+	})
+	return n, err
+}
+
+// LPush inserts values at the head of the list stored at key and returns the
+// length of the list.
+func (c *Server) LPush(ctx context.Context, key []byte, values ...[]byte) (int64, error) {
+	ctx = withCommand(ctx, "LPUSH", key, values)
+	return c.push(ctx, key, true, values)
+}
+
+// RPush inserts values at the tail of the list stored at key and returns the
+// length of the list.
+func (c *Server) RPush(ctx context.Context, key []byte, values ...[]byte) (int64, error) {
+	ctx = withCommand(ctx, "RPUSH", key, values)
+	return c.push(ctx, key, false, values)
+}
+
+func (c *Server) pop(ctx context.Context, key []byte, left bool, count int64) ([][]byte, error) {
+	if count < 0 {
+		return nil, fmt.Errorf("ERR value is out of range, must be positive")
+	}
+	var values [][]byte
+	err := c.update(ctx, key, func(tx *db.Tx) error {
+		list, err := tx.OpenList(key, false)
+		if err != nil {
+			return err
+		}
+		if list == nil || count == 0 {
+			return errNoop
+		}
+		values, err = list.Pop(left, count)
+		return err
+	})
+	return values, err
+}
+
+// LPop removes and returns the first element of the list stored at key, or
+// nil if the key does not exist.
+func (c *Server) LPop(ctx context.Context, key []byte) ([]byte, error) {
+	ctx = withCommand(ctx, "LPOP", key)
+	values, err := c.pop(ctx, key, true, 1)
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+	return values[0], nil
+}
+
+// LPopCount removes and returns up to count elements from the head of the
+// list stored at key.
+func (c *Server) LPopCount(ctx context.Context, key []byte, count int64) ([][]byte, error) {
+	ctx = withCommand(ctx, "LPOP", key, count)
+	return c.pop(ctx, key, true, count)
+}
+
+// RPop removes and returns the last element of the list stored at key, or
+// nil if the key does not exist.
+func (c *Server) RPop(ctx context.Context, key []byte) ([]byte, error) {
+	ctx = withCommand(ctx, "RPOP", key)
+	values, err := c.pop(ctx, key, false, 1)
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+	return values[0], nil
+}
+
+// RPopCount removes and returns up to count elements from the tail of the
+// list stored at key.
+func (c *Server) RPopCount(ctx context.Context, key []byte, count int64) ([][]byte, error) {
+	ctx = withCommand(ctx, "RPOP", key, count)
+	return c.pop(ctx, key, false, count)
+}
+
+// bpop pops an element from the first non-empty list among keys, waiting
+// for one up to timeout, zero waiting forever. It returns a nil key if
+// timeout expired.
+func (c *Server) bpop(ctx context.Context, keys [][]byte, left bool, timeout time.Duration) ([]byte, []byte, error) {
+	var key, val []byte
+	_, err := c.block(ctx, keys, timeout, func() (bool, error) {
+		err := c.updateKeys(ctx, keys, func(m *db.MultiTx) error {
+			for _, k := range keys {
+				list, err := m.Tx(k).OpenList(k, false)
+				if err != nil {
+					return err
+				}
+				if list != nil {
+					values, err := list.Pop(left, 1)
+					key, val = k, values[0]
+					return err
+				}
+			}
+			return errNoop
+		})
+		return key != nil, err
+	})
+	return key, val, err
+}
+
+// BLPop removes and returns the first element of the first non-empty list
+// among keys, with the key it was popped from. If all lists are empty it
+// waits for an element up to timeout, zero waiting forever, and returns a
+// nil key if timeout expires.
+func (c *Server) BLPop(ctx context.Context, timeout time.Duration, keys ...[]byte) ([]byte, []byte, error) {
+	ctx = withCommand(ctx, "BLPOP", keys, timeout.Seconds())
+	return c.bpop(ctx, keys, true, timeout)
+}
+
+// BRPop is like BLPop, but pops the last element of the list.
+func (c *Server) BRPop(ctx context.Context, timeout time.Duration, keys ...[]byte) ([]byte, []byte, error) {
+	ctx = withCommand(ctx, "BRPOP", keys, timeout.Seconds())
+	return c.bpop(ctx, keys, false, timeout)
+}
+
+// viewList runs fn with the list stored at key, fn is not called if the key
+// does not exist
+func (c *Server) viewList(ctx context.Context, key []byte, fn func(list *db.List) error) error {
+	return c.db.View(ctx, key, func(tx *db.Tx) error {
+		list, err := tx.OpenList(key, false)
+		if err != nil || list == nil {
+			return err
+		}
+		return fn(list)
+	})
+}
+
+// LRange returns the elements of the list stored at key between the indexes
+// start and stop, inclusive. Negative indexes count from the tail.
+func (c *Server) LRange(ctx context.Context, key []byte, start, stop int64) ([][]byte, error) {
+	values := [][]byte{}
+	err := c.viewList(ctx, key, func(list *db.List) error {
+		values = list.Range(start, stop)
+		return nil
+	})
+	return values, err
+}
+
+// LLen returns the length of the list stored at key.
+func (c *Server) LLen(ctx context.Context, key []byte) (int64, error) {
+	n := int64(0)
+	err := c.viewList(ctx, key, func(list *db.List) error {
+		n = list.Len()
+		return nil
+	})
+	return n, err
+}
+
+// LIndex returns the element at index in the list stored at key, or nil if
+// index is out of range.
+func (c *Server) LIndex(ctx context.Context, key []byte, index int64) ([]byte, error) {
+	var val []byte
+	err := c.viewList(ctx, key, func(list *db.List) error {
+		val, _ = list.Index(index)
+		return nil
+	})
+	return val, err
+}
+
+// LSet sets the element at index in the list stored at key.
+func (c *Server) LSet(ctx context.Context, key []byte, index int64, value []byte) error {
+	ctx = withCommand(ctx, "LSET", key, index, value)
+	return c.db.Update(ctx, key, func(tx *db.Tx) error {
+		list, err := tx.OpenList(key, false)
+		if err != nil {
+			return err
+		}
+		if list == nil {
+			return fmt.Errorf("ERR no such key")
+		}
+		return list.Set(index, value)
+	})
+}
+
+// LRem removes the first count occurrences of value from the list stored at
+// key, from the tail if count is negative and all of them if count is zero.
+// It returns the number of removed elements.
+func (c *Server) LRem(ctx context.Context, key []byte, count int64, value []byte) (int64, error) {
+	ctx = withCommand(ctx, "LREM", key, count, value)
+	n := int64(0)
+	err := c.update(ctx, key, func(tx *db.Tx) error {
+		list, err := tx.OpenList(key, false)
+		if err != nil {
+			return err
+		}
+		if list == nil {
+			return errNoop
+		}
+		n, err = list.Rem(count, value)
+		if err == nil && n == 0 {
+			return errNoop
+		}
+		return err
+	})
+	return n, err
+}
+
+// LTrim trims the list stored at key to the elements between start and stop,
+// inclusive.
+func (c *Server) LTrim(ctx context.Context, key []byte, start, stop int64) error {
+	ctx = withCommand(ctx, "LTRIM", key, start, stop)
+	return c.update(ctx, key, func(tx *db.Tx) error {
+		list, err := tx.OpenList(key, false)
+		if err != nil {
+			return err
+		}
+		if list == nil {
+			return errNoop
+		}
+		return list.Trim(start, stop)
+	})
+}
+
+func parseListDirection(where string) (bool, error) {
+	switch strings.ToUpper(where) {
+	case "LEFT":
+		return true, nil
+	case "RIGHT":
+		return false, nil
+	}
+	return false, errSyntax
+}
+
+// LMove pops an element from the wherefrom side (LEFT or RIGHT) of the list
+// stored at source and pushes it to the whereto side of the list stored at
+// destination. It returns the moved element, or nil if source does not exist.
+//
+// Both keys are updated with UpdateKeys, so the move is all or nothing even
+// across partitions.
+func (c *Server) LMove(ctx context.Context, source []byte, destination []byte, wherefrom string, whereto string) ([]byte, error) {
+	ctx = withCommand(ctx, "LMOVE", source, destination, wherefrom, whereto)
+	fromLeft, err := parseListDirection(wherefrom)
+	if err != nil {
+		return nil, err
+	}
+	toLeft, err := parseListDirection(whereto)
+	if err != nil {
+		return nil, err
+	}
+	var val []byte
+	err = c.updateKeys(ctx, [][]byte{source, destination}, func(m *db.MultiTx) error {
+		src, err := m.Tx(source).OpenList(source, false)
+		if err != nil {
+			return err
+		}
+		if src == nil {
+			return errNoop
+		}
+		typ, err := m.Tx(destination).Type(destination)
+		if err != nil {
+			return err
+		}
+		if typ != db.TypeNone && typ != db.TypeList {
+			return db.ErrWrongType
+		}
+		values, err := src.Pop(fromLeft, 1)
+		if err != nil {
+			return err
+		}
+		val = values[0]
+		// the destination is opened after the pop, as it may be the source
+		dst, err := m.Tx(destination).OpenList(destination, true)
+		if err != nil {
+			return err
+		}
+		return dst.Push(toLeft, val)
+	})
+	return val, err
+}
+
+// BLMove is like LMove, but waits for an element up to timeout if source
+// does not exist, zero waiting forever. It returns nil if timeout expires.
+func (c *Server) BLMove(ctx context.Context, source []byte, destination []byte, wherefrom string, whereto string, timeout time.Duration) ([]byte, error) {
+	ctx = withCommand(ctx, "BLMOVE", source, destination, wherefrom, whereto, timeout.Seconds())
+	var val []byte
+	_, err := c.block(ctx, [][]byte{source}, timeout, func() (bool, error) {
+		var err error
+		val, err = c.LMove(ctx, source, destination, wherefrom, whereto)
+		return val != nil, err
+	})
+	return val, err
+}
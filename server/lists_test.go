@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/zenozeng/s3dis/db"
+)
+
+func bytesList(values ...string) [][]byte {
+	res := [][]byte{}
+	for _, v := range values {
+		res = append(res, []byte(v))
+	}
+	return res
+}
+
+func TestLists(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	n, err := server.RPush(ctx, key, bytesList("c", "d")...)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(2)))
+	n, err = server.LPush(ctx, key, bytesList("b", "a")...)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(4)))
+
+	values, err := server.LRange(ctx, key, 0, -1)
+	g.Expect(err).To(BeNil())
+	g.Expect(values).To(Equal(bytesList("a", "b", "c", "d")))
+	values, err = server.LRange(ctx, key, -3, 1)
+	g.Expect(err).To(BeNil())
+	g.Expect(values).To(Equal(bytesList("b")))
+
+	val, err := server.LIndex(ctx, key, -1)
+	g.Expect(err).To(BeNil())
+	g.Expect(string(val)).To(Equal("d"))
+	val, err = server.LIndex(ctx, key, 10)
+	g.Expect(err).To(BeNil())
+	g.Expect(val).To(BeNil())
+
+	err = server.LSet(ctx, key, 1, []byte("B"))
+	g.Expect(err).To(BeNil())
+	err = server.LSet(ctx, key, 10, []byte("B"))
+	g.Expect(err).To(Equal(db.ErrIndexOutOfRange))
+
+	val, err = server.LPop(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(string(val)).To(Equal("a"))
+	values, err = server.RPopCount(ctx, key, 2)
+	g.Expect(err).To(BeNil())
+	g.Expect(values).To(Equal(bytesList("d", "c")))
+	_, err = server.LPopCount(ctx, key, -1)
+	g.Expect(err).To(Equal(fmt.Errorf("ERR value is out of range, must be positive")))
+	n, err = server.LLen(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(1)))
+
+	// popping the last element deletes the key
+	val, err = server.RPop(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(string(val)).To(Equal("B"))
+	val, err = server.RPop(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(val).To(BeNil())
+	n, err = server.LLen(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(0)))
+}
+
+func TestLRemLTrim(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	_, err := server.RPush(ctx, key, bytesList("x", "a", "x", "b", "x", "c", "x")...)
+	g.Expect(err).To(BeNil())
+	n, err := server.LRem(ctx, key, -2, []byte("x"))
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(2)))
+	values, err := server.LRange(ctx, key, 0, -1)
+	g.Expect(err).To(BeNil())
+	g.Expect(values).To(Equal(bytesList("x", "a", "x", "b", "c")))
+	n, err = server.LRem(ctx, key, 0, []byte("x"))
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(2)))
+	values, err = server.LRange(ctx, key, 0, -1)
+	g.Expect(err).To(BeNil())
+	g.Expect(values).To(Equal(bytesList("a", "b", "c")))
+
+	// pushing after a removal keeps positions contiguous
+	_, err = server.LPush(ctx, key, []byte("z"))
+	g.Expect(err).To(BeNil())
+	val, err := server.LIndex(ctx, key, 2)
+	g.Expect(err).To(BeNil())
+	g.Expect(string(val)).To(Equal("b"))
+
+	err = server.LTrim(ctx, key, 1, -2)
+	g.Expect(err).To(BeNil())
+	values, err = server.LRange(ctx, key, 0, -1)
+	g.Expect(err).To(BeNil())
+	g.Expect(values).To(Equal(bytesList("a", "b")))
+	err = server.LTrim(ctx, key, 5, 10)
+	g.Expect(err).To(BeNil())
+	n, err = server.LLen(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(0)))
+}
+
+func TestLMove(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	src := []byte(uuid.NewString())
+	dst := []byte(uuid.NewString())
+
+	_, err := server.RPush(ctx, src, bytesList("a", "b", "c")...)
+	g.Expect(err).To(BeNil())
+	val, err := server.LMove(ctx, src, dst, "RIGHT", "LEFT")
+	g.Expect(err).To(BeNil())
+	g.Expect(string(val)).To(Equal("c"))
+	val, err = server.LMove(ctx, src, src, "LEFT", "RIGHT")
+	g.Expect(err).To(BeNil())
+	g.Expect(string(val)).To(Equal("a"))
+	values, err := server.LRange(ctx, src, 0, -1)
+	g.Expect(err).To(BeNil())
+	g.Expect(values).To(Equal(bytesList("b", "a")))
+	values, err = server.LRange(ctx, dst, 0, -1)
+	g.Expect(err).To(BeNil())
+	g.Expect(values).To(Equal(bytesList("c")))
+	_, err = server.LMove(ctx, src, dst, "UP", "LEFT")
+	g.Expect(err).To(Equal(errSyntax))
+
+	// wrong type
+	str := []byte(uuid.NewString())
+	err = server.Set(ctx, str, []byte("v"), nil)
+	g.Expect(err).To(BeNil())
+	_, err = server.LMove(ctx, src, str, "LEFT", "LEFT")
+	g.Expect(err).To(Equal(db.ErrWrongType))
+	_, err = server.LPush(ctx, str, []byte("a"))
+	g.Expect(err).To(Equal(db.ErrWrongType))
+	// SET replaces a list
+	err = server.Set(ctx, src, []byte("v"), nil)
+	g.Expect(err).To(BeNil())
+	val, err = server.Get(ctx, src)
+	g.Expect(err).To(BeNil())
+	g.Expect(string(val)).To(Equal("v"))
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+// errWatchFailed aborts EXEC when a watched key was written
+var errWatchFailed = errors.New("watched key changed")
+
+// watchedKey is a key watched by WATCH, with its version at that time
+type watchedKey struct {
+	index   int          // logical database selected by WATCH
+	db      *db.Database // database of index when WATCH ran
+	key     []byte
+	version string
+}
+
+// queue queues a command within MULTI, err being the error of its lookup.
+// Commands failing to queue make EXEC discard the transaction.
+func (cl *client) queue(cmd command, args [][]byte, err error) {
+	if err == nil && cmd.flags&flagNoMulti != 0 {
+		err = fmt.Errorf("ERR Command not allowed inside a transaction")
+	}
+	if err != nil {
+		cl.aborted = true
+		cl.w.writeError(err)
+		return
+	}
+	cl.queued = append(cl.queued, args)
+	cl.w.writeSimple("QUEUED")
+}
+
+// discard ends the transaction of the client and forgets its watched keys
+func (cl *client) discard() {
+	cl.multi = false
+	cl.queued = nil
+	cl.aborted = false
+	cl.watched = nil
+}
+
+func keyVersion(ctx context.Context, d *db.Database, key []byte) (string, error) {
+	var version string
+	err := d.View(ctx, key, func(tx *db.Tx) error {
+		var err error
+		version, err = tx.Version(key)
+		return err
+	})
+	return version, err
+}
+
+func cmdMulti(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	if cl.multi {
+		return fmt.Errorf("ERR MULTI calls can not be nested")
+	}
+	cl.multi = true
+	cl.w.writeSimple("OK")
+	return nil
+}
+
+func cmdDiscard(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	if !cl.multi {
+		return fmt.Errorf("ERR DISCARD without MULTI")
+	}
+	cl.discard()
+	cl.w.writeSimple("OK")
+	return nil
+}
+
+func cmdWatch(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	if cl.multi {
+		return fmt.Errorf("ERR WATCH inside MULTI is not allowed")
+	}
+	for _, key := range args {
+		version, err := keyVersion(ctx, c.db, key)
+		if err != nil {
+			return err
+		}
+		cl.watched = append(cl.watched, watchedKey{index: cl.db, db: c.db, key: key, version: version})
+	}
+	cl.w.writeSimple("OK")
+	return nil
+}
+
+func cmdUnwatch(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	cl.watched = nil
+	cl.w.writeSimple("OK")
+	return nil
+}
+
+// keyspaceContextKey marks the context of a command holding the keyspace
+// for reading, see lockKeyspace
+type keyspaceContextKey struct{}
+
+// execContextKey marks the context of the commands run by EXEC outside of
+// db.Batch, see execKeyspace
+type execContextKey struct{}
+
+// inTransaction reports whether ctx runs the commands of EXEC or of a
+// script, which must not wait for other clients
+func inTransaction(ctx context.Context) bool {
+	return db.InBatch(ctx) || ctx.Value(execContextKey{}) != nil
+}
+
+// lockKeyspace holds the keyspace of this process while a command runs, and
+// returns the context of the command and the function releasing it. EXEC
+// running keyspace commands holds it for writing, which isolates the
+// transaction from the other commands, the other commands hold it for
+// reading, except while they block.
+func (c *Server) lockKeyspace(ctx context.Context, cl *client, name string) (context.Context, func()) {
+	if name == "exec" && cl.multi && !cl.aborted {
+		for _, args := range cl.queued {
+			queued, err := lookupCommand(args)
+			if err == nil && queued.flags&flagKeyspace != 0 {
+				c.keyspace.Lock()
+				return ctx, c.keyspace.Unlock
+			}
+		}
+	}
+	c.keyspace.RLock()
+	return context.WithValue(ctx, keyspaceContextKey{}, true), c.keyspace.RUnlock
+}
+
+// cmdExec runs the queued commands atomically, see db.Batch: the
+// partitions holding their keys and the watched keys stay locked from the
+// check of the watched versions until the writes are uploaded. The keys of
+// a command are those of the database selected when it runs, following the
+// queued SELECT commands. Transactions running keyspace commands, like
+// FLUSHDB, FLUSHALL, SWAPDB or SCAN, are run by execKeyspace instead, and are
+// not atomic across a crash. EXEC replies with a null array if a watched key
+// was written, or if its database was swapped, since WATCH.
+func cmdExec(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	if !cl.multi {
+		return fmt.Errorf("ERR EXEC without MULTI")
+	}
+	queued, aborted, watched := cl.queued, cl.aborted, cl.watched
+	cl.discard()
+	if aborted {
+		return fmt.Errorf("EXECABORT Transaction discarded because of previous errors.")
+	}
+	cmds := make([]command, len(queued))
+	keyspace := false
+	for i, args := range queued {
+		// commands were looked up when queued
+		cmds[i], _ = lookupCommand(args)
+		keyspace = keyspace || cmds[i].flags&flagKeyspace != 0
+	}
+	for _, w := range watched {
+		selected, err := c.Select(w.index)
+		if err != nil {
+			return err
+		}
+		if selected.db != w.db {
+			cl.w.writeNullArray()
+			return nil
+		}
+	}
+	if keyspace {
+		return c.execKeyspace(ctx, cl, queued, cmds, watched)
+	}
+	keys, err := c.declaredKeys(cl, queued, cmds)
+	if err != nil {
+		return err
+	}
+	for _, w := range watched {
+		keys = append(keys, db.DBKey{DB: w.db, Key: w.key})
+	}
+
+	// replies are buffered until the transaction is committed
+	replies := &bytes.Buffer{}
+	w := cl.w
+	err = db.Batch(ctx, keys, func(ctx context.Context) error {
+		for _, watchedKey := range watched {
+			version, err := keyVersion(ctx, watchedKey.db, watchedKey.key)
+			if err != nil {
+				return err
+			}
+			if version != watchedKey.version {
+				return errWatchFailed
+			}
+		}
+		cl.w = &respWriter{Writer: bufio.NewWriter(replies), resp3: w.resp3}
+		cl.w.writeArray(len(queued))
+		for i, args := range queued {
+			c.run(ctx, cl, cmds[i], args)
+		}
+		return cl.w.Flush()
+	})
+	cl.w = w
+	if errors.Is(err, errWatchFailed) {
+		cl.w.writeNullArray()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = cl.w.Write(replies.Bytes())
+	return err
+}
+
+// declaredKeys returns the keys of the queued commands in the database
+// selected when each of them runs, and the key of MOVE in its destination
+func (c *Server) declaredKeys(cl *client, queued [][][]byte, cmds []command) ([]db.DBKey, error) {
+	keys := []db.DBKey{}
+	index := cl.db
+	for i, args := range queued {
+		selected, err := c.Select(index)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range cmds[i].keys.keys(args) {
+			keys = append(keys, db.DBKey{DB: selected.db, Key: key})
+		}
+		// invalid indexes fail when the command runs
+		switch strings.ToLower(string(args[0])) {
+		case "select":
+			n, err := parseDBIndex(args[1])
+			if _, selectErr := c.Select(n); err == nil && selectErr == nil {
+				index = n
+			}
+		case "move":
+			n, err := parseDBIndex(args[2])
+			if dst, selectErr := c.Select(n); err == nil && selectErr == nil {
+				keys = append(keys, db.DBKey{DB: dst.db, Key: args[1]})
+			}
+		}
+	}
+	return keys, nil
+}
+
+// execKeyspace runs queued commands of which some read or write the whole
+// keyspace, which can not be locked partition by partition like db.Batch
+// does. The caller holds the keyspace of this process for writing instead,
+// see lockKeyspace, so that no other command of this process runs
+// meanwhile.
+//
+// Each command commits its own writes, so such a transaction is isolated
+// but not crash-atomic: a crash while it runs keeps the writes of the
+// queued commands which completed, keyspace commands or not, and loses those
+// of the next ones.
+func (c *Server) execKeyspace(ctx context.Context, cl *client, queued [][][]byte, cmds []command, watched []watchedKey) error {
+	ctx = context.WithValue(ctx, execContextKey{}, true)
+	for _, w := range watched {
+		version, err := keyVersion(ctx, w.db, w.key)
+		if err != nil {
+			return err
+		}
+		if version != w.version {
+			cl.w.writeNullArray()
+			return nil
+		}
+	}
+	cl.w.writeArray(len(queued))
+	for i, args := range queued {
+		c.run(ctx, cl, cmds[i], args)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestServeMulti(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	a, b := uuid.NewString(), uuid.NewString()
+	g.Expect(do("EXEC")).To(Equal(fmt.Errorf("ERR EXEC without MULTI")))
+	g.Expect(do("DISCARD")).To(Equal(fmt.Errorf("ERR DISCARD without MULTI")))
+
+	g.Expect(do("MULTI")).To(Equal("OK"))
+	g.Expect(do("MULTI")).To(Equal(fmt.Errorf("ERR MULTI calls can not be nested")))
+	g.Expect(do("SET", a, "1")).To(Equal("QUEUED"))
+	g.Expect(do("SET", b, "2")).To(Equal("QUEUED"))
+	g.Expect(do("RENAME", uuid.NewString(), a)).To(Equal("QUEUED"))
+	g.Expect(do("MGET", a, b)).To(Equal("QUEUED"))
+	g.Expect(do("PING")).To(Equal("QUEUED"))
+	g.Expect(do("EXEC")).To(Equal([]interface{}{
+		"OK",
+		"OK",
+		fmt.Errorf("ERR no such key"),
+		[]interface{}{"1", "2"},
+		"PONG",
+	}))
+	g.Expect(do("EXEC")).To(Equal(fmt.Errorf("ERR EXEC without MULTI")))
+
+	g.Expect(do("MULTI")).To(Equal("OK"))
+	g.Expect(do("SET", a, "3")).To(Equal("QUEUED"))
+	g.Expect(do("DISCARD")).To(Equal("OK"))
+	g.Expect(do("GET", a)).To(Equal("1"))
+
+	// errors while queuing discard the transaction
+	g.Expect(do("MULTI")).To(Equal("OK"))
+	g.Expect(do("SET", a, "3")).To(Equal("QUEUED"))
+	g.Expect(do("NOSUCHCOMMAND")).To(Equal(fmt.Errorf("ERR unknown command 'NOSUCHCOMMAND'")))
+	g.Expect(do("GET")).To(Equal(fmt.Errorf("ERR wrong number of arguments for 'get' command")))
+	g.Expect(do("SUBSCRIBE", "ch")).To(Equal(fmt.Errorf("ERR Command not allowed inside a transaction")))
+	g.Expect(do("EXEC")).To(Equal(fmt.Errorf("EXECABORT Transaction discarded because of previous errors.")))
+	g.Expect(do("GET", a)).To(Equal("1"))
+
+	g.Expect(do("MULTI")).To(Equal("OK"))
+	g.Expect(do("EXEC")).To(Equal([]interface{}{}))
+}
+
+func TestServeMultiDatabases(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	key := uuid.NewString()
+
+	// keys are those of the database selected when the command runs
+	g.Expect(do("MULTI")).To(Equal("OK"))
+	g.Expect(do("SET", key, "0")).To(Equal("QUEUED"))
+	g.Expect(do("SELECT", "3")).To(Equal("QUEUED"))
+	g.Expect(do("SET", key, "3")).To(Equal("QUEUED"))
+	g.Expect(do("MOVE", key, "4")).To(Equal("QUEUED"))
+	g.Expect(do("SELECT", "16")).To(Equal("QUEUED"))
+	g.Expect(do("GET", key)).To(Equal("QUEUED"))
+	g.Expect(do("EXEC")).To(Equal([]interface{}{"OK", "OK", "OK", int64(1), fmt.Errorf("ERR DB index is out of range"), nil}))
+	g.Expect(do("GET", key)).To(BeNil())
+	g.Expect(do("SELECT", "4")).To(Equal("OK"))
+	g.Expect(do("GET", key)).To(Equal("3"))
+	g.Expect(do("SELECT", "0")).To(Equal("OK"))
+	g.Expect(do("GET", key)).To(Equal("0"))
+
+	// keyspace commands run while the other clients wait, except those
+	// blocked
+	send, receive := connect(t, listen(t, server))
+	blocked := uuid.NewString()
+	send("BLPOP", blocked, "0")
+	time.Sleep(100 * time.Millisecond)
+	g.Expect(do("SELECT", "3")).To(Equal("OK"))
+	g.Expect(do("MULTI")).To(Equal("OK"))
+	g.Expect(do("SET", key, "a")).To(Equal("QUEUED"))
+	g.Expect(do("KEYS", key)).To(Equal("QUEUED"))
+	g.Expect(do("FLUSHDB")).To(Equal("QUEUED"))
+	g.Expect(do("DBSIZE")).To(Equal("QUEUED"))
+	g.Expect(do("SWAPDB", "3", "4")).To(Equal("QUEUED"))
+	g.Expect(do("GET", key)).To(Equal("QUEUED"))
+	g.Expect(do("SWAPDB", "3", "4")).To(Equal("QUEUED"))
+	g.Expect(do("EXEC")).To(Equal([]interface{}{"OK", []interface{}{key}, "OK", int64(0), "OK", "3", "OK"}))
+	g.Expect(do("SELECT", "0")).To(Equal("OK"))
+	_, err := server.RPush(context.Background(), []byte(blocked), []byte("x"))
+	g.Expect(err).To(BeNil())
+	g.Expect(receive()).To(Equal([]interface{}{blocked, "x"}))
+}
+
+func TestServeWatch(t *testing.T) {
+	g := NewWithT(t)
+	do, other := dial(t), dial(t)
+	a, b := uuid.NewString(), uuid.NewString()
+
+	// a key written by another client aborts EXEC
+	g.Expect(do("WATCH", a, b)).To(Equal("OK"))
+	g.Expect(other("SET", b, "x")).To(Equal("OK"))
+	g.Expect(do("MULTI")).To(Equal("OK"))
+	g.Expect(do("WATCH", a)).To(Equal(fmt.Errorf("ERR WATCH inside MULTI is not allowed")))
+	g.Expect(do("SET", a, "1")).To(Equal("QUEUED"))
+	g.Expect(do("EXEC")).To(BeNil())
+	g.Expect(do("GET", a)).To(BeNil())
+
+	// reads do not abort EXEC, and EXEC forgets the watched keys
+	g.Expect(do("WATCH", a, b)).To(Equal("OK"))
+	g.Expect(other("GET", b)).To(Equal("x"))
+	g.Expect(other("MGET", a, b)).To(Equal([]interface{}{nil, "x"}))
+	g.Expect(do("MULTI")).To(Equal("OK"))
+	g.Expect(do("SET", a, "1")).To(Equal("QUEUED"))
+	g.Expect(do("EXEC")).To(Equal([]interface{}{"OK"}))
+	g.Expect(other("SET", a, "2")).To(Equal("OK"))
+	g.Expect(do("MULTI")).To(Equal("OK"))
+	g.Expect(do("GET", a)).To(Equal("QUEUED"))
+	g.Expect(do("EXEC")).To(Equal([]interface{}{"2"}))
+
+	// deleting a watched key aborts EXEC
+	g.Expect(do("WATCH", a)).To(Equal("OK"))
+	g.Expect(other("RENAME", a, b)).To(Equal("OK"))
+	g.Expect(do("MULTI")).To(Equal("OK"))
+	g.Expect(do("SET", a, "3")).To(Equal("QUEUED"))
+	g.Expect(do("EXEC")).To(BeNil())
+
+	// so does the swap of the database of a watched key
+	g.Expect(do("WATCH", a)).To(Equal("OK"))
+	g.Expect(other("SWAPDB", "6", "7")).To(Equal("OK"))
+	g.Expect(do("MULTI")).To(Equal("OK"))
+	g.Expect(do("EXEC")).To(Equal([]interface{}{}))
+	g.Expect(do("WATCH", a)).To(Equal("OK"))
+	g.Expect(other("SWAPDB", "0", "7")).To(Equal("OK"))
+	g.Expect(do("MULTI")).To(Equal("OK"))
+	g.Expect(do("EXEC")).To(BeNil())
+	g.Expect(other("SWAPDB", "0", "7")).To(Equal("OK"))
+
+	g.Expect(do("WATCH", a)).To(Equal("OK"))
+	g.Expect(do("UNWATCH")).To(Equal("OK"))
+	g.Expect(other("SET", a, "4")).To(Equal("OK"))
+	g.Expect(do("MULTI")).To(Equal("OK"))
+	g.Expect(do("GET", a)).To(Equal("QUEUED"))
+	g.Expect(do("EXEC")).To(Equal([]interface{}{"4"}))
+}
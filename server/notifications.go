@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+// notify publishes a keyspace notification to __keyspace@<db>__:<key>, with
+// the name of the event as message, and to __keyevent@<db>__:<event>, with
+// the key as message, as selected by K and E in notify-keyspace-events
+func (c *Server) notify(e db.Event) {
+	flags := c.db.NotifyKeyspaceEvents()
+	prefix := "__keyspace@" + strconv.Itoa(e.DB) + "__:"
+	if strings.IndexByte(flags, 'K') >= 0 {
+		c.broadcast(append([]byte(prefix), e.Key...), []byte(e.Name))
+	}
+	prefix = "__keyevent@" + strconv.Itoa(e.DB) + "__:"
+	if strings.IndexByte(flags, 'E') >= 0 {
+		c.broadcast([]byte(prefix+e.Name), e.Key)
+	}
+}
+
+// broadcast publishes a message on behalf of the server, to the subscribers
+// of this process and of the other processes if the fan-out is enabled
+func (c *Server) broadcast(channel []byte, message []byte) {
+	c.pubsub.publish(channel, message, false)
+	if c.pubsub.fanout != nil {
+		c.pubsub.fanout.forward(context.Background(), channel, message, false)
+	}
+}
+
+// configParameters are the parameters of CONFIG GET and CONFIG SET
+var configParameters = map[string]struct {
+	get func(c *Server) string
+	set func(c *Server, value string) error
+}{
+	"notify-keyspace-events": {
+		get: func(c *Server) string { return c.db.NotifyKeyspaceEvents() },
+		set: func(c *Server, value string) error { return c.db.SetNotifyKeyspaceEvents(value) },
+	},
+}
+
+func cmdConfig(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	switch sub := strings.ToLower(string(args[0])); {
+	case sub == "get" && len(args) >= 2:
+		names := []string{}
+		for name := range configParameters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		res := [][]byte{}
+		for _, name := range names {
+			for _, pattern := range args[1:] {
+				if db.MatchGlob([]byte(strings.ToLower(string(pattern))), []byte(name)) {
+					res = append(res, []byte(name), []byte(configParameters[name].get(c)))
+					break
+				}
+			}
+		}
+		cl.w.writeMap(len(res) / 2)
+		for _, b := range res {
+			cl.w.writeBulk(b)
+		}
+	case sub == "set" && len(args) >= 3 && len(args)%2 == 1:
+		for i := 1; i < len(args); i += 2 {
+			name := strings.ToLower(string(args[i]))
+			if _, ok := configParameters[name]; !ok {
+				return fmt.Errorf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i])
+			}
+		}
+		for i := 1; i < len(args); i += 2 {
+			name := strings.ToLower(string(args[i]))
+			err := configParameters[name].set(c, string(args[i+1]))
+			if err != nil {
+				return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", name, err)
+			}
+		}
+		cl.w.writeSimple("OK")
+	default:
+		return fmt.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'", sub)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestServeKeyspaceNotifications(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	send, receive := connect(t, listen(t, server))
+	key := uuid.NewString()
+	t.Cleanup(func() {
+		do("CONFIG", "SET", "notify-keyspace-events", "")
+	})
+
+	g.Expect(do("CONFIG", "SET", "notify-keyspace-events", "KEA")).To(Equal("OK"))
+	g.Expect(do("CONFIG", "GET", "notify-*")).To(Equal([]interface{}{"notify-keyspace-events", "AKE"}))
+	g.Expect(do("CONFIG", "SET", "notify-keyspace-events", "Kw")).To(Equal(fmt.Errorf("ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")))
+	g.Expect(do("CONFIG", "SET", "maxmemory", "1")).To(Equal(fmt.Errorf("ERR Unknown option or number of arguments for CONFIG SET - 'maxmemory'")))
+
+	send("PSUBSCRIBE", "__keyspace@0__:"+key, "__keyevent@0__:rename_to")
+	g.Expect(receive()).To(Equal([]interface{}{"psubscribe", "__keyspace@0__:" + key, int64(1)}))
+	g.Expect(receive()).To(Equal([]interface{}{"psubscribe", "__keyevent@0__:rename_to", int64(2)}))
+
+	g.Expect(do("SET", key, "v")).To(Equal("OK"))
+	g.Expect(receive()).To(Equal([]interface{}{"pmessage", "__keyspace@0__:" + key, "__keyspace@0__:" + key, "set"}))
+	g.Expect(do("RENAME", key, key+"2")).To(Equal("OK"))
+	g.Expect(receive()).To(Equal([]interface{}{"pmessage", "__keyspace@0__:" + key, "__keyspace@0__:" + key, "rename_from"}))
+	g.Expect(receive()).To(Equal([]interface{}{"pmessage", "__keyevent@0__:rename_to", "__keyevent@0__:rename_to", key + "2"}))
+
+	// only key events are published without K
+	g.Expect(do("CONFIG", "SET", "notify-keyspace-events", "Eg")).To(Equal("OK"))
+	g.Expect(do("SET", key, "v")).To(Equal("OK"))
+	g.Expect(do("RENAME", key, key+"3")).To(Equal("OK"))
+	g.Expect(receive()).To(Equal([]interface{}{"pmessage", "__keyevent@0__:rename_to", "__keyevent@0__:rename_to", key + "3"}))
+}
+
+func TestServeExpiredNotifications(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	send, receive := connect(t, listen(t, server))
+	key := uuid.NewString()
+	t.Cleanup(func() {
+		do("CONFIG", "SET", "notify-keyspace-events", "")
+	})
+
+	g.Expect(do("CONFIG", "SET", "notify-keyspace-events", "Kx")).To(Equal("OK"))
+	send("SUBSCRIBE", "__keyspace@0__:"+key)
+	g.Expect(receive()).To(Equal([]interface{}{"subscribe", "__keyspace@0__:" + key, int64(1)}))
+
+	// the leader purges the key in the background, see ExpireSweepInterval
+	g.Expect(do("SET", key, "v", "PX", "100")).To(Equal("OK"))
+	g.Expect(receive()).To(Equal([]interface{}{"message", "__keyspace@0__:" + key, "expired"}))
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+// pubsubBufferLen is the number of messages which may wait for delivery to
+// a subscriber, slower subscribers are disconnected like in Redis
+const pubsubBufferLen = 1024
+
+// kinds of subscriptions, by SUBSCRIBE, PSUBSCRIBE and SSUBSCRIBE
+const (
+	channelSubscription = iota
+	patternSubscription
+	shardSubscription
+	subscriptionKinds
+)
+
+var (
+	subscribeReplies   = [subscriptionKinds]string{"subscribe", "psubscribe", "ssubscribe"}
+	unsubscribeReplies = [subscriptionKinds]string{"unsubscribe", "punsubscribe", "sunsubscribe"}
+)
+
+// subscribers maps channels, or patterns, to their subscribers
+type subscribers map[string]map[*client]bool
+
+// pubsub holds the subscriptions of the clients of this process. Messages
+// published on this process are also forwarded to the other processes
+// sharing the object storage if fanout is set.
+type pubsub struct {
+	mu          sync.RWMutex
+	subscribers [subscriptionKinds]subscribers
+	fanout      *fanout
+}
+
+func newPubSub() *pubsub {
+	ps := &pubsub{}
+	for kind := range ps.subscribers {
+		ps.subscribers[kind] = subscribers{}
+	}
+	return ps
+}
+
+// subscribed reports whether the client is subscribed to a channel or a
+// pattern, which restricts the commands it may run
+func (cl *client) subscribed() bool {
+	for _, names := range cl.subscriptions {
+		if len(names) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriptionCount returns the count replied by the subscriptions of kind:
+// shard channels are counted apart from channels and patterns
+func (cl *client) subscriptionCount(kind int) int {
+	if kind == shardSubscription {
+		return len(cl.subscriptions[shardSubscription])
+	}
+	return len(cl.subscriptions[channelSubscription]) + len(cl.subscriptions[patternSubscription])
+}
+
+// send queues a message written by write for delivery to the connection,
+// the connection of a client which does not keep up is closed
+func (cl *client) send(write func(w *respWriter)) {
+	select {
+	case cl.messages <- write:
+	default:
+		cl.conn.Close()
+	}
+}
+
+// push queues a message of Pub/Sub, a push message in RESP3
+func (cl *client) push(msg [][]byte) {
+	cl.send(func(w *respWriter) {
+		w.writePush(len(msg))
+		for _, b := range msg {
+			w.writeBulk(b)
+		}
+	})
+}
+
+// deliver writes the messages sent to a connection until ctx is done
+func deliver(ctx context.Context, cl *client) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case write := <-cl.messages:
+			cl.mu.Lock()
+			write(cl.w)
+			var err error
+			if len(cl.messages) == 0 {
+				err = cl.w.Flush()
+			}
+			cl.mu.Unlock()
+			if err != nil {
+				cl.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (ps *pubsub) subscribe(cl *client, kind int, names [][]byte) {
+	if cl.subscriptions[kind] == nil {
+		cl.subscriptions[kind] = map[string]bool{}
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, name := range names {
+		cl.subscriptions[kind][string(name)] = true
+		if ps.subscribers[kind][string(name)] == nil {
+			ps.subscribers[kind][string(name)] = map[*client]bool{}
+		}
+		ps.subscribers[kind][string(name)][cl] = true
+		cl.w.writePush(3)
+		cl.w.writeBulk([]byte(subscribeReplies[kind]))
+		cl.w.writeBulk(name)
+		cl.w.writeInt(int64(cl.subscriptionCount(kind)))
+	}
+}
+
+// unsubscribe unsubscribes the client from names, or from all its
+// subscriptions of kind if names is empty
+func (ps *pubsub) unsubscribe(cl *client, kind int, names [][]byte) {
+	if len(names) == 0 {
+		for name := range cl.subscriptions[kind] {
+			names = append(names, []byte(name))
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return string(names[i]) < string(names[j])
+		})
+	}
+	reply := unsubscribeReplies[kind]
+	if len(names) == 0 {
+		cl.w.writePush(3)
+		cl.w.writeBulk([]byte(reply))
+		cl.w.writeBulk(nil)
+		cl.w.writeInt(int64(cl.subscriptionCount(kind)))
+		return
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, name := range names {
+		ps.remove(cl, kind, string(name))
+		cl.w.writePush(3)
+		cl.w.writeBulk([]byte(reply))
+		cl.w.writeBulk(name)
+		cl.w.writeInt(int64(cl.subscriptionCount(kind)))
+	}
+}
+
+// remove removes a subscription, the caller must hold mu
+func (ps *pubsub) remove(cl *client, kind int, name string) {
+	delete(cl.subscriptions[kind], name)
+	delete(ps.subscribers[kind][name], cl)
+	if len(ps.subscribers[kind][name]) == 0 {
+		delete(ps.subscribers[kind], name)
+	}
+}
+
+// unsubscribeAll removes the subscriptions of a client which disconnects
+func (ps *pubsub) unsubscribeAll(cl *client) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for kind := range cl.subscriptions {
+		for name := range cl.subscriptions[kind] {
+			ps.remove(cl, kind, name)
+		}
+	}
+}
+
+// publish delivers a message to the subscribers of this process and returns
+// their number. Messages of shard channels only reach SSUBSCRIBE, like in
+// Redis.
+func (ps *pubsub) publish(channel []byte, message []byte, shard bool) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	receivers := 0
+	if shard {
+		for cl := range ps.subscribers[shardSubscription][string(channel)] {
+			cl.push([][]byte{[]byte("smessage"), channel, message})
+			receivers++
+		}
+		return receivers
+	}
+	for cl := range ps.subscribers[channelSubscription][string(channel)] {
+		cl.push([][]byte{[]byte("message"), channel, message})
+		receivers++
+	}
+	for pattern, clients := range ps.subscribers[patternSubscription] {
+		if !db.MatchGlob([]byte(pattern), channel) {
+			continue
+		}
+		for cl := range clients {
+			cl.push([][]byte{[]byte("pmessage"), []byte(pattern), channel, message})
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// names returns the channels of kind with subscribers matching pattern, in
+// lexical order
+func (ps *pubsub) names(kind int, pattern []byte) [][]byte {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	names := [][]byte{}
+	for name := range ps.subscribers[kind] {
+		if pattern == nil || db.MatchGlob(pattern, []byte(name)) {
+			names = append(names, []byte(name))
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return string(names[i]) < string(names[j])
+	})
+	return names
+}
+
+func (ps *pubsub) writeNumSub(cl *client, kind int, channels [][]byte) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	cl.w.writeMap(len(channels))
+	for _, channel := range channels {
+		cl.w.writeBulk(channel)
+		cl.w.writeInt(int64(len(ps.subscribers[kind][string(channel)])))
+	}
+}
+
+func cmdSubscribe(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	c.pubsub.subscribe(cl, channelSubscription, args)
+	return nil
+}
+
+func cmdUnsubscribe(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	c.pubsub.unsubscribe(cl, channelSubscription, args)
+	return nil
+}
+
+func cmdPSubscribe(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	c.pubsub.subscribe(cl, patternSubscription, args)
+	return nil
+}
+
+func cmdPUnsubscribe(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	c.pubsub.unsubscribe(cl, patternSubscription, args)
+	return nil
+}
+
+func cmdSSubscribe(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	c.pubsub.subscribe(cl, shardSubscription, args)
+	return nil
+}
+
+func cmdSUnsubscribe(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	c.pubsub.unsubscribe(cl, shardSubscription, args)
+	return nil
+}
+
+// publish publishes a message to the subscribers of this process, and
+// forwards it to the other processes if the fan-out is enabled. Like in
+// Redis Cluster, the number of receivers only counts those of this process.
+func (c *Server) publish(ctx context.Context, cl *client, channel []byte, message []byte, shard bool) {
+	receivers := c.pubsub.publish(channel, message, shard)
+	if c.pubsub.fanout != nil {
+		c.pubsub.fanout.forward(ctx, channel, message, shard)
+	}
+	cl.w.writeInt(int64(receivers))
+}
+
+func cmdPublish(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	c.publish(ctx, cl, args[0], args[1], false)
+	return nil
+}
+
+func cmdSPublish(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	c.publish(ctx, cl, args[0], args[1], true)
+	return nil
+}
+
+// cmdForwardedPublish implements S3DIS.PUBLISH channel message [SHARD], sent
+// by the fan-out of the other processes, which publishes a message to the
+// subscribers of this process only
+func cmdForwardedPublish(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	shard := false
+	switch {
+	case len(args) == 3 && strings.EqualFold(string(args[2]), "shard"):
+		shard = true
+	case len(args) != 2:
+		return errSyntax
+	}
+	cl.w.writeInt(int64(c.pubsub.publish(args[0], args[1], shard)))
+	return nil
+}
+
+func cmdPubSub(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	switch sub := strings.ToLower(string(args[0])); {
+	case (sub == "channels" || sub == "shardchannels") && len(args) <= 2:
+		var pattern []byte
+		if len(args) == 2 {
+			pattern = args[1]
+		}
+		kind := channelSubscription
+		if sub == "shardchannels" {
+			kind = shardSubscription
+		}
+		cl.w.writeBulks(c.pubsub.names(kind, pattern))
+	case sub == "numsub":
+		c.pubsub.writeNumSub(cl, channelSubscription, args[1:])
+	case sub == "shardnumsub":
+		c.pubsub.writeNumSub(cl, shardSubscription, args[1:])
+	case sub == "numpat" && len(args) == 1:
+		cl.w.writeInt(int64(len(c.pubsub.names(patternSubscription, nil))))
+	default:
+		return fmt.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'", sub)
+	}
+	return nil
+}
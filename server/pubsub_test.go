@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// listen serves s on a random port and returns its address
+func listen(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() {
+		l.Close()
+	})
+	return l.Addr().String()
+}
+
+// listenPeers is listen for the connections of the other processes
+func listenPeers(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServePeers(l)
+	t.Cleanup(func() {
+		l.Close()
+	})
+	return l.Addr().String()
+}
+
+// connect connects to addr and returns functions sending a command, and
+// reading the next reply or message
+func connect(t *testing.T, addr string) (func(args ...string), func() interface{}) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	r := bufio.NewReader(conn)
+	send := func(args ...string) {
+		req := fmt.Sprintf("*%d\r\n", len(args))
+		for _, arg := range args {
+			req += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+		}
+		_, err := conn.Write([]byte(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func() interface{} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply, err := readReply(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	return send, receive
+}
+
+func TestServePubSub(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	send, receive := connect(t, listen(t, server))
+	ch, other := uuid.NewString(), uuid.NewString()
+	pattern := ch[:8] + "*"
+
+	send("SUBSCRIBE", ch, other)
+	g.Expect(receive()).To(Equal([]interface{}{"subscribe", ch, int64(1)}))
+	g.Expect(receive()).To(Equal([]interface{}{"subscribe", other, int64(2)}))
+	send("PSUBSCRIBE", pattern)
+	g.Expect(receive()).To(Equal([]interface{}{"psubscribe", pattern, int64(3)}))
+	send("SSUBSCRIBE", ch)
+	g.Expect(receive()).To(Equal([]interface{}{"ssubscribe", ch, int64(1)}))
+
+	g.Expect(do("PUBLISH", ch, "hello")).To(Equal(int64(2)))
+	g.Expect(receive()).To(Equal([]interface{}{"message", ch, "hello"}))
+	g.Expect(receive()).To(Equal([]interface{}{"pmessage", pattern, ch, "hello"}))
+	g.Expect(do("SPUBLISH", ch, "sharded")).To(Equal(int64(1)))
+	g.Expect(receive()).To(Equal([]interface{}{"smessage", ch, "sharded"}))
+	g.Expect(do("PUBLISH", uuid.NewString(), "nobody")).To(Equal(int64(0)))
+
+	g.Expect(do("PUBSUB", "CHANNELS", ch)).To(Equal([]interface{}{ch}))
+	nobody := uuid.NewString()
+	g.Expect(do("PUBSUB", "NUMSUB", ch, nobody)).To(Equal([]interface{}{ch, int64(1), nobody, int64(0)}))
+	g.Expect(do("PUBSUB", "SHARDCHANNELS", ch)).To(Equal([]interface{}{ch}))
+	g.Expect(do("PUBSUB", "SHARDNUMSUB", ch)).To(Equal([]interface{}{ch, int64(1)}))
+	g.Expect(do("PUBSUB", "NUMPAT")).To(Equal(int64(1)))
+
+	// subscribed clients are restricted
+	send("GET", ch)
+	g.Expect(receive()).To(Equal(fmt.Errorf("ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context")))
+	send("PING")
+	g.Expect(receive()).To(Equal([]interface{}{"pong", ""}))
+
+	send("UNSUBSCRIBE", ch)
+	g.Expect(receive()).To(Equal([]interface{}{"unsubscribe", ch, int64(2)}))
+	send("UNSUBSCRIBE")
+	g.Expect(receive()).To(Equal([]interface{}{"unsubscribe", other, int64(1)}))
+	send("PUNSUBSCRIBE")
+	g.Expect(receive()).To(Equal([]interface{}{"punsubscribe", pattern, int64(0)}))
+	send("PUNSUBSCRIBE")
+	g.Expect(receive()).To(Equal([]interface{}{"punsubscribe", nil, int64(0)}))
+	send("SUNSUBSCRIBE", ch)
+	g.Expect(receive()).To(Equal([]interface{}{"sunsubscribe", ch, int64(0)}))
+	g.Expect(do("PUBLISH", ch, "hello")).To(Equal(int64(0)))
+	g.Expect(do("PUBSUB", "CHANNELS", ch)).To(Equal([]interface{}{}))
+	send("PING")
+	g.Expect(receive()).To(Equal("PONG"))
+
+	g.Expect(do("MULTI")).To(Equal("OK"))
+	g.Expect(do("SUBSCRIBE", ch)).To(Equal(fmt.Errorf("ERR Command not allowed inside a transaction")))
+	g.Expect(do("DISCARD")).To(Equal("OK"))
+	g.Expect(do("EVAL", "return redis.call('PUBLISH', ARGV[1], ARGV[2])", "0", ch, "x")).To(Equal(int64(0)))
+}
+
+func TestServePubSubDisconnect(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	addr := listen(t, server)
+	ch := uuid.NewString()
+	send, receive := connect(t, addr)
+	send("SUBSCRIBE", ch)
+	g.Expect(receive()).To(Equal([]interface{}{"subscribe", ch, int64(1)}))
+	send("QUIT")
+	g.Expect(receive()).To(Equal("OK"))
+	g.Eventually(func() interface{} {
+		return do("PUBLISH", ch, "hello")
+	}).Should(Equal(int64(0)))
+}
+
+func TestServePubSubFanout(t *testing.T) {
+	g := NewWithT(t)
+	// processes sharing the object storage, which are not the leader
+	newServer := func() (*Server, string, string) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewServer(objectStorage, &ServerConfig{
+			CacheDir:        os.Getenv("S3DIS_TEST_CACHE_DIR"),
+			MaxPartitionNum: 1024,
+			PubSubAddr:      l.Addr().String(),
+		})
+		go s.ServePeers(l)
+		t.Cleanup(func() {
+			s.Close(context.Background())
+			l.Close()
+		})
+		return s, listen(t, s), l.Addr().String()
+	}
+	first, a, _ := newServer()
+	s, b, peerAddr := newServer()
+	// the peers are refreshed in the background, the first server only
+	// finds the second one on its next refresh
+	g.Expect(first.pubsub.fanout.refresh(context.Background())).To(BeNil())
+	ch := uuid.NewString()
+	send, receive := connect(t, b)
+	send("SUBSCRIBE", ch)
+	g.Expect(receive()).To(Equal([]interface{}{"subscribe", ch, int64(1)}))
+	send("SSUBSCRIBE", ch)
+	g.Expect(receive()).To(Equal([]interface{}{"ssubscribe", ch, int64(1)}))
+
+	publish, reply := connect(t, a)
+	publish("PUBLISH", ch, "hello")
+	g.Expect(reply()).To(Equal(int64(0)))
+	g.Expect(receive()).To(Equal([]interface{}{"message", ch, "hello"}))
+	publish("SPUBLISH", ch, "sharded")
+	g.Expect(reply()).To(Equal(int64(0)))
+	g.Expect(receive()).To(Equal([]interface{}{"smessage", ch, "sharded"}))
+
+	// the internal commands are only served to the other processes
+	publish("S3DIS.PUBLISH", ch, "forged")
+	g.Expect(reply()).To(Equal(fmt.Errorf("ERR unknown command 'S3DIS.PUBLISH'")))
+	peer, peerReply := connect(t, peerAddr)
+	peer("PUBLISH", ch, "hello")
+	g.Expect(peerReply()).To(Equal(fmt.Errorf("ERR unknown command 'PUBLISH'")))
+	peer("S3DIS.PUBLISH", ch, "forwarded")
+	g.Expect(peerReply()).To(Equal(int64(1)))
+	g.Expect(receive()).To(Equal([]interface{}{"message", ch, "forwarded"}))
+
+	// a closed server is no longer registered
+	ctx := context.Background()
+	registered := func() bool {
+		addrs, err := s.db.Nodes(ctx)
+		g.Expect(err).To(BeNil())
+		for _, addr := range addrs {
+			if addr == peerAddr {
+				return true
+			}
+		}
+		return false
+	}
+	g.Expect(registered()).To(Equal(true))
+	g.Expect(s.Close(ctx)).To(BeNil())
+	g.Expect(registered()).To(Equal(false))
+}
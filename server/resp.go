@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxBulkLen       = 512 << 20
+	maxMultiBulkLen  = 1 << 20
+	maxInlineLen     = 64 << 10
+	respLineEnd      = "\r\n"
+	respErrorDefault = "ERR"
+)
+
+// errProtocol is returned by readCommand for malformed requests, the
+// connection is closed after replying
+type errProtocol string
+
+func (e errProtocol) Error() string {
+	return "ERR Protocol error: " + string(e)
+}
+
+// readLine reads a line terminated by \r\n or \n, without its terminator
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, errProtocol("too big request")
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	return line, nil
+}
+
+// readLength parses the length following the type byte of a RESP header
+func readLength(line []byte, max int64, what string) (int64, error) {
+	n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil || n > max {
+		return 0, errProtocol("invalid " + what + " length")
+	}
+	return n, nil
+}
+
+// readCommand reads a command sent either as an array of bulk strings or
+// inline, as a line of space separated arguments. It returns no arguments for
+// empty requests.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		if len(line) > maxInlineLen {
+			return nil, errProtocol("too big inline request")
+		}
+		return splitInline(line)
+	}
+	n, err := readLength(line, maxMultiBulkLen, "multibulk")
+	if err != nil {
+		return nil, err
+	}
+	args := make([][]byte, 0, n)
+	for i := int64(0); i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol("expected '$'")
+		}
+		size, err := readLength(line, maxBulkLen, "bulk")
+		if err != nil || size < 0 {
+			return nil, errProtocol("invalid bulk length")
+		}
+		arg := make([]byte, size+2)
+		_, err = io.ReadFull(r, arg)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(arg, []byte(respLineEnd)) {
+			return nil, errProtocol("invalid bulk terminator")
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// splitInline splits an inline command, honoring double and single quoted
+// arguments as redis-cli does
+func splitInline(line []byte) ([][]byte, error) {
+	args := [][]byte{}
+	for i := 0; i < len(line); {
+		if unicode.IsSpace(rune(line[i])) {
+			i++
+			continue
+		}
+		arg := []byte{}
+		var quote byte
+		if line[i] == '"' || line[i] == '\'' {
+			quote = line[i]
+			i++
+		}
+		for ; i < len(line); i++ {
+			ch := line[i]
+			if quote == 0 && unicode.IsSpace(rune(ch)) {
+				break
+			}
+			if quote != 0 && ch == quote {
+				quote = 0
+				i++
+				if i < len(line) && !unicode.IsSpace(rune(line[i])) {
+					return nil, errProtocol("unbalanced quotes in request")
+				}
+				break
+			}
+			if quote == '"' && ch == '\\' && i+1 < len(line) {
+				i++
+				ch = line[i]
+				switch ch {
+				case 'n':
+					ch = '\n'
+				case 'r':
+					ch = '\r'
+				case 't':
+					ch = '\t'
+				}
+			}
+			arg = append(arg, ch)
+		}
+		if quote != 0 {
+			return nil, errProtocol("unbalanced quotes in request")
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// respWriter buffers replies in RESP2, or in RESP3 once the client
+// negotiated it with HELLO. Write errors are reported by Flush.
+type respWriter struct {
+	*bufio.Writer
+	resp3 bool
+}
+
+func (w *respWriter) writeHeader(prefix byte, n int64) {
+	w.WriteByte(prefix)
+	w.WriteString(strconv.FormatInt(n, 10))
+	w.WriteString(respLineEnd)
+}
+
+// writeSimple writes a simple string, which must not contain \r or \n
+func (w *respWriter) writeSimple(s string) {
+	w.WriteByte('+')
+	w.WriteString(s)
+	w.WriteString(respLineEnd)
+}
+
+// writeError writes err as an error reply. Messages which do not start with
+// an upper case error code, such as WRONGTYPE, are prefixed with ERR.
+func (w *respWriter) writeError(err error) {
+	msg := err.Error()
+	code, _, _ := strings.Cut(msg, " ")
+	if code == "" || strings.ToUpper(code) != code {
+		msg = respErrorDefault + " " + msg
+	}
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	w.WriteByte('-')
+	w.WriteString(msg)
+	w.WriteString(respLineEnd)
+}
+
+func (w *respWriter) writeInt(n int64) {
+	w.writeHeader(':', n)
+}
+
+// writeBool writes a boolean as the integer 1 or 0
+func (w *respWriter) writeBool(b bool) {
+	if b {
+		w.writeInt(1)
+	} else {
+		w.writeInt(0)
+	}
+}
+
+// writeNull writes the null of RESP3, which is written as a null bulk
+// string or a null array in RESP2
+func (w *respWriter) writeNull() {
+	w.WriteString("_" + respLineEnd)
+}
+
+// writeBulk writes b as a bulk string, or a null bulk string if b is nil
+func (w *respWriter) writeBulk(b []byte) {
+	if b == nil {
+		if w.resp3 {
+			w.writeNull()
+			return
+		}
+		w.WriteString("$-1" + respLineEnd)
+		return
+	}
+	w.writeHeader('$', int64(len(b)))
+	w.Write(b)
+	w.WriteString(respLineEnd)
+}
+
+func (w *respWriter) writeArray(n int) {
+	w.writeHeader('*', int64(n))
+}
+
+func (w *respWriter) writeNullArray() {
+	if w.resp3 {
+		w.writeNull()
+		return
+	}
+	w.WriteString("*-1" + respLineEnd)
+}
+
+// writeMap writes the header of a map of n pairs, an array of 2n items in
+// RESP2
+func (w *respWriter) writeMap(n int) {
+	if w.resp3 {
+		w.writeHeader('%', int64(n))
+		return
+	}
+	w.writeArray(2 * n)
+}
+
+// writeSet writes the header of a set, an array in RESP2
+func (w *respWriter) writeSet(n int) {
+	if w.resp3 {
+		w.writeHeader('~', int64(n))
+		return
+	}
+	w.writeArray(n)
+}
+
+// writePush writes the header of a push message, like the messages of
+// Pub/Sub, an array in RESP2
+func (w *respWriter) writePush(n int) {
+	if w.resp3 {
+		w.writeHeader('>', int64(n))
+		return
+	}
+	w.writeArray(n)
+}
+
+// writeDouble writes f as a double, a bulk string in RESP2
+func (w *respWriter) writeDouble(f float64) {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !w.resp3 {
+		w.writeBulk([]byte(s))
+		return
+	}
+	switch {
+	case math.IsInf(f, 1):
+		s = "inf"
+	case math.IsInf(f, -1):
+		s = "-inf"
+	case math.IsNaN(f):
+		s = "nan"
+	}
+	w.WriteByte(',')
+	w.WriteString(s)
+	w.WriteString(respLineEnd)
+}
+
+// writeBulks writes an array of bulk strings
+func (w *respWriter) writeBulks(items [][]byte) {
+	w.writeArray(len(items))
+	for _, item := range items {
+		w.writeBulk(item)
+	}
+}
@@ -0,0 +1,388 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"github.com/zenozeng/s3dis/db"
+)
+
+var errNoScript = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+
+// scriptCache holds the scripts loaded by EVAL and SCRIPT LOAD, compiled
+// and by SHA1 digest. It is shared by the logical databases and, like in
+// Redis, it is not persisted.
+type scriptCache struct {
+	mu      sync.Mutex
+	scripts map[string]*lua.FunctionProto
+}
+
+func newScriptCache() *scriptCache {
+	return &scriptCache{scripts: map[string]*lua.FunctionProto{}}
+}
+
+func sha1hex(s []byte) string {
+	sum := sha1.Sum(s)
+	return hex.EncodeToString(sum[:])
+}
+
+// load compiles a script and caches it, it returns the SHA1 digest of the
+// script
+func (sc *scriptCache) load(script []byte) (string, *lua.FunctionProto, error) {
+	sha := sha1hex(script)
+	sc.mu.Lock()
+	cached, ok := sc.scripts[sha]
+	sc.mu.Unlock()
+	if ok {
+		return sha, cached, nil
+	}
+	proto, err := compileLua(script, "user_script")
+	if err != nil {
+		return "", nil, fmt.Errorf("ERR Error compiling script: %s", err)
+	}
+	sc.mu.Lock()
+	sc.scripts[sha] = proto
+	sc.mu.Unlock()
+	return sha, proto, nil
+}
+
+func (sc *scriptCache) get(sha string) *lua.FunctionProto {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.scripts[strings.ToLower(sha)]
+}
+
+func (sc *scriptCache) flush() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.scripts = map[string]*lua.FunctionProto{}
+}
+
+func compileLua(code []byte, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(bytes.NewReader(code), name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, name)
+}
+
+// newLuaState returns an interpreter with the libraries available to
+// scripts, and without access to files or to the operating system
+func newLuaState(ctx context.Context) *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for name, open := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.TabLibName:    lua.OpenTable,
+		lua.StringLibName: lua.OpenString,
+		lua.MathLibName:   lua.OpenMath,
+	} {
+		L.Push(L.NewFunction(open))
+		L.Push(lua.LString(name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "print", "module", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetContext(ctx)
+	return L
+}
+
+// parseNumKeys splits the arguments of EVAL following the script into keys
+// and arguments
+func parseNumKeys(args [][]byte) ([][]byte, [][]byte, error) {
+	n, err := parseInt(args[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if n < 0 {
+		return nil, nil, fmt.Errorf("ERR Number of keys can't be negative")
+	}
+	if n > int64(len(args)-1) {
+		return nil, nil, fmt.Errorf("ERR Number of keys can't be greater than number of args")
+	}
+	return args[1 : 1+n], args[1+n:], nil
+}
+
+// eval runs a script and writes its reply. The script runs in a db.Batch on
+// the partitions of keys, so that it is atomic with respect to other
+// commands, and redis.call fails for keys of other partitions. Like in Redis,
+// the writes made before a script fails are kept. run runs the script in an
+// interpreter providing the redis library, and returns its result.
+func (c *Server) eval(ctx context.Context, cl *client, keys [][]byte, run func(L *lua.LState) (lua.LValue, error)) error {
+	dbKeys := make([]db.DBKey, len(keys))
+	for i, key := range keys {
+		dbKeys[i] = db.DBKey{DB: c.db, Key: key}
+	}
+	var reply lua.LValue
+	var scriptErr error
+	err := db.Batch(ctx, dbKeys, func(ctx context.Context) error {
+		L := newLuaState(ctx)
+		defer L.Close()
+		redis := luaRedisLib(L)
+		L.SetFuncs(redis, map[string]lua.LGFunction{
+			"call": func(L *lua.LState) int {
+				return c.luaCall(ctx, cl, L, true)
+			},
+			"pcall": func(L *lua.LState) int {
+				return c.luaCall(ctx, cl, L, false)
+			},
+		})
+		L.SetGlobal("redis", redis)
+		reply, scriptErr = run(L)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var apiErr *lua.ApiError
+	if errors.As(scriptErr, &apiErr) {
+		// errors raised by redis.call are replied as they are
+		if t, ok := apiErr.Object.(*lua.LTable); ok {
+			if msg, ok := t.RawGetString("err").(lua.LString); ok {
+				return errors.New(string(msg))
+			}
+		}
+		return fmt.Errorf("ERR Error running script: %s", apiErr.Object)
+	}
+	if scriptErr != nil {
+		return fmt.Errorf("ERR Error running script: %s", scriptErr)
+	}
+	writeLuaReply(cl.w, reply)
+	return nil
+}
+
+// evalScript runs a script of EVAL, with its keys and arguments in the
+// globals KEYS and ARGV
+func (c *Server) evalScript(ctx context.Context, cl *client, proto *lua.FunctionProto, keys [][]byte, args [][]byte) error {
+	return c.eval(ctx, cl, keys, func(L *lua.LState) (lua.LValue, error) {
+		L.SetGlobal("KEYS", luaStrings(L, keys))
+		L.SetGlobal("ARGV", luaStrings(L, args))
+		L.Push(L.NewFunctionFromProto(proto))
+		err := L.PCall(0, 1, nil)
+		if err != nil {
+			return nil, err
+		}
+		return L.Get(-1), nil
+	})
+}
+
+// luaRedisLib returns the redis table without the functions running
+// commands
+func luaRedisLib(L *lua.LState) *lua.LTable {
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"sha1hex": func(L *lua.LState) int {
+			L.Push(lua.LString(sha1hex([]byte(L.CheckString(1)))))
+			return 1
+		},
+		"error_reply": func(L *lua.LState) int {
+			L.Push(luaReplyTable(L, "err", L.CheckString(1)))
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			L.Push(luaReplyTable(L, "ok", L.CheckString(1)))
+			return 1
+		},
+	})
+	return redis
+}
+
+func luaStrings(L *lua.LState, values [][]byte) *lua.LTable {
+	t := L.CreateTable(len(values), 0)
+	for _, value := range values {
+		t.Append(lua.LString(value))
+	}
+	return t
+}
+
+// luaReplyTable returns a status or error reply, {ok = msg} or {err = msg}
+func luaReplyTable(L *lua.LState, field string, msg string) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString(field, lua.LString(msg))
+	return t
+}
+
+// luaCall implements redis.call, which raises errors, and redis.pcall, which
+// returns them as tables
+func (c *Server) luaCall(ctx context.Context, cl *client, L *lua.LState, raise bool) int {
+	args := [][]byte{}
+	for i := 1; i <= L.GetTop(); i++ {
+		switch arg := L.Get(i).(type) {
+		case lua.LString:
+			args = append(args, []byte(arg))
+		case lua.LNumber:
+			args = append(args, []byte(arg.String()))
+		default:
+			L.RaiseError("Lua redis lib command arguments must be strings or integers")
+			return 0
+		}
+	}
+	if len(args) == 0 {
+		L.RaiseError("Please specify at least one argument for this redis lib call")
+		return 0
+	}
+	cmd, err := lookupCommand(args)
+	if err == nil && cmd.flags&(flagNoQueue|flagNoMulti|flagNoScript) != 0 {
+		err = fmt.Errorf("ERR This Redis command is not allowed from script")
+	}
+	buf := &bytes.Buffer{}
+	inner := &client{w: &respWriter{Writer: bufio.NewWriter(buf)}, db: cl.db}
+	if err != nil {
+		inner.w.writeError(err)
+	} else {
+		c.run(ctx, inner, cmd, args)
+	}
+	inner.w.Flush()
+	reply, err := readLuaReply(L, bufio.NewReader(buf))
+	if err != nil {
+		L.RaiseError(err.Error())
+		return 0
+	}
+	if t, ok := reply.(*lua.LTable); ok && raise && t.RawGetString("err") != lua.LNil {
+		L.Error(t, 1)
+		return 0
+	}
+	L.Push(reply)
+	return 1
+}
+
+// readLuaReply converts a RESP reply to a Lua value like Redis: integers to
+// numbers, bulk strings to strings, arrays to tables, nil replies to false,
+// status and error replies to {ok = msg} and {err = msg}
+func readLuaReply(L *lua.LState, r *bufio.Reader) (lua.LValue, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return luaReplyTable(L, "ok", string(line[1:])), nil
+	case '-':
+		return luaReplyTable(L, "err", string(line[1:])), nil
+	case ':':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		return lua.LNumber(n), err
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 {
+			return lua.LFalse, err
+		}
+		b := make([]byte, n+len(respLineEnd))
+		_, err = io.ReadFull(r, b)
+		return lua.LString(b[:n]), err
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 {
+			return lua.LFalse, err
+		}
+		t := L.CreateTable(n, 0)
+		for i := 0; i < n; i++ {
+			item, err := readLuaReply(L, r)
+			if err != nil {
+				return nil, err
+			}
+			t.Append(item)
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// writeLuaReply converts the value returned by a script to a RESP reply like
+// Redis: numbers are truncated to integers, true is 1, false and nil are nil
+// replies, and tables are arrays up to their first nil, unless they have an
+// ok or err field
+func writeLuaReply(w *respWriter, v lua.LValue) {
+	switch v := v.(type) {
+	case lua.LNumber:
+		w.writeInt(int64(v))
+	case lua.LString:
+		w.writeBulk([]byte(v))
+	case lua.LBool:
+		if v {
+			w.writeInt(1)
+		} else {
+			w.writeBulk(nil)
+		}
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			w.writeError(errors.New(string(msg)))
+			return
+		}
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			w.writeSimple(string(msg))
+			return
+		}
+		items := []lua.LValue{}
+		for i := 1; v.RawGetInt(i) != lua.LNil; i++ {
+			items = append(items, v.RawGetInt(i))
+		}
+		w.writeArray(len(items))
+		for _, item := range items {
+			writeLuaReply(w, item)
+		}
+	default:
+		w.writeBulk(nil)
+	}
+}
+
+func cmdEval(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	keys, argv, err := parseNumKeys(args[1:])
+	if err != nil {
+		return err
+	}
+	_, proto, err := c.scripts.load(args[0])
+	if err != nil {
+		return err
+	}
+	return c.evalScript(ctx, cl, proto, keys, argv)
+}
+
+func cmdEvalSha(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	keys, argv, err := parseNumKeys(args[1:])
+	if err != nil {
+		return err
+	}
+	proto := c.scripts.get(string(args[0]))
+	if proto == nil {
+		return errNoScript
+	}
+	return c.evalScript(ctx, cl, proto, keys, argv)
+}
+
+func cmdScript(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	switch sub := strings.ToLower(string(args[0])); {
+	case sub == "load" && len(args) == 2:
+		sha, _, err := c.scripts.load(args[1])
+		if err != nil {
+			return err
+		}
+		cl.w.writeBulk([]byte(sha))
+	case sub == "exists" && len(args) >= 2:
+		cl.w.writeArray(len(args) - 1)
+		for _, sha := range args[1:] {
+			cl.w.writeBool(c.scripts.get(string(sha)) != nil)
+		}
+	case sub == "flush" && len(args) <= 2:
+		_, err := parseFlushMode(args[1:])
+		if err != nil {
+			return err
+		}
+		c.scripts.flush()
+		cl.w.writeSimple("OK")
+	default:
+		return fmt.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestServeEval(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	a, b := uuid.NewString(), uuid.NewString()
+
+	g.Expect(do("EVAL", "return 1", "0")).To(Equal(int64(1)))
+	g.Expect(do("EVAL", "return 3.7", "0")).To(Equal(int64(3)))
+	g.Expect(do("EVAL", "return 'a'", "0")).To(Equal("a"))
+	g.Expect(do("EVAL", "return {1, 'a', {true}, nil, 2}", "0")).To(Equal([]interface{}{int64(1), "a", []interface{}{int64(1)}}))
+	g.Expect(do("EVAL", "return false", "0")).To(BeNil())
+	g.Expect(do("EVAL", "return nil", "0")).To(BeNil())
+	g.Expect(do("EVAL", "return redis.status_reply('FINE')", "0")).To(Equal("FINE"))
+	g.Expect(do("EVAL", "return {err = 'ERR custom'}", "0")).To(Equal(fmt.Errorf("ERR custom")))
+	g.Expect(do("EVAL", "return {KEYS[1], KEYS[2], ARGV[1]}", "2", "k1", "k2", "arg")).To(Equal([]interface{}{"k1", "k2", "arg"}))
+	g.Expect(do("EVAL", "return redis.sha1hex('')", "0")).To(Equal("da39a3ee5e6b4b0d3255bfef95601890afd80709"))
+	g.Expect(do("EVAL", "return type(os) .. type(io) .. type(loadstring)", "0")).To(Equal("nilnilnil"))
+
+	g.Expect(do("EVAL", "return 1", "-1")).To(Equal(fmt.Errorf("ERR Number of keys can't be negative")))
+	g.Expect(do("EVAL", "return 1", "2", "k")).To(Equal(fmt.Errorf("ERR Number of keys can't be greater than number of args")))
+	err := do("EVAL", "return (", "0").(error)
+	g.Expect(strings.HasPrefix(err.Error(), "ERR Error compiling script")).To(Equal(true))
+	err = do("EVAL", "error('boom')", "0").(error)
+	g.Expect(strings.HasPrefix(err.Error(), "ERR Error running script")).To(Equal(true))
+	g.Expect(strings.Contains(err.Error(), "boom")).To(Equal(true))
+
+	// a lock
+	lock := "if redis.call('SET', KEYS[1], ARGV[1], 'NX') then return 1 end return 0"
+	g.Expect(do("EVAL", lock, "1", a, "owner")).To(Equal(int64(1)))
+	g.Expect(do("EVAL", lock, "1", a, "other")).To(Equal(int64(0)))
+	g.Expect(do("GET", a)).To(Equal("owner"))
+
+	// errors of redis.call are raised, those of redis.pcall are returned
+	g.Expect(do("EVAL", "return redis.call('RENAME', KEYS[2], KEYS[1])", "2", a, b)).To(Equal(fmt.Errorf("ERR no such key")))
+	g.Expect(do("EVAL", "return redis.pcall('RENAME', KEYS[2], KEYS[1])['err']", "2", a, b)).To(Equal("ERR no such key"))
+	g.Expect(do("EVAL", "return redis.call('GET', 'undeclared')", "0")).To(Equal(fmt.Errorf("ERR command accesses a key which is not declared by the transaction")))
+	g.Expect(do("EVAL", "return redis.call('KEYS', '*')", "0")).To(Equal(fmt.Errorf("ERR This Redis command is not allowed from script")))
+	g.Expect(do("EVAL", "return redis.call('EVAL', 'return 1', '0')", "0")).To(Equal(fmt.Errorf("ERR This Redis command is not allowed from script")))
+	g.Expect(do("EVAL", "return redis.call('NOSUCHCOMMAND')", "0")).To(Equal(fmt.Errorf("ERR unknown command 'NOSUCHCOMMAND'")))
+
+	// writes made before an error are kept
+	err = do("EVAL", "redis.call('SET', KEYS[1], 'x') error('boom')", "1", b).(error)
+	g.Expect(strings.Contains(err.Error(), "boom")).To(Equal(true))
+	g.Expect(do("GET", b)).To(Equal("x"))
+
+	g.Expect(do("MULTI")).To(Equal("OK"))
+	g.Expect(do("EVAL", "return redis.call('MGET', KEYS[1], KEYS[2])", "2", a, b)).To(Equal("QUEUED"))
+	g.Expect(do("EXEC")).To(Equal([]interface{}{[]interface{}{"owner", "x"}}))
+}
+
+func TestServeEvalDataTypes(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	a, b := uuid.NewString(), uuid.NewString()
+
+	// a rate limiter allowing 2 calls per window
+	limiter := `
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('EXPIRE', KEYS[1], ARGV[1]) end
+if n > tonumber(ARGV[2]) then return 0 end
+return 1`
+	g.Expect(do("EVAL", limiter, "1", a, "60", "2")).To(Equal(int64(1)))
+	g.Expect(do("EVAL", limiter, "1", a, "60", "2")).To(Equal(int64(1)))
+	g.Expect(do("EVAL", limiter, "1", a, "60", "2")).To(Equal(int64(0)))
+	g.Expect(do("GET", a)).To(Equal("3"))
+	g.Expect(do("TTL", a)).To(Equal(int64(60)))
+	g.Expect(do("EVAL", "return redis.call('INCR', KEYS[1])", "1", b)).To(Equal(int64(1)))
+	g.Expect(do("SET", b, "x")).To(Equal("OK"))
+	g.Expect(do("EVAL", "return redis.pcall('INCR', KEYS[1])['err']", "1", b)).To(Equal("ERR value is not an integer or out of range"))
+
+	// a lock released by its owner only
+	acquire := "return redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2])"
+	release := "if redis.call('GET', KEYS[1]) == ARGV[1] then return redis.call('DEL', KEYS[1]) else return 0 end"
+	g.Expect(do("DEL", b)).To(Equal(int64(1)))
+	g.Expect(do("EVAL", acquire, "1", b, "owner", "30000")).To(Equal("OK"))
+	g.Expect(do("EVAL", acquire, "1", b, "other", "30000")).To(BeNil())
+	g.Expect(do("PTTL", b).(int64) > 29000).To(Equal(true))
+	g.Expect(do("EVAL", release, "1", b, "other")).To(Equal(int64(0)))
+	g.Expect(do("EVAL", release, "1", b, "owner")).To(Equal(int64(1)))
+	g.Expect(do("EXISTS", b)).To(Equal(int64(0)))
+	g.Expect(do("PTTL", b)).To(Equal(int64(-2)))
+
+	// the other data types
+	g.Expect(do("EVAL", "return redis.call('HSET', KEYS[1], 'f', 'v', 'g', 'w')", "1", b)).To(Equal(int64(2)))
+	g.Expect(do("EVAL", "return redis.call('HGET', KEYS[1], 'g')", "1", b)).To(Equal("w"))
+	g.Expect(do("DEL", b)).To(Equal(int64(1)))
+	g.Expect(do("EVAL", "redis.call('SADD', KEYS[1], 'm', 'n', 'm') return redis.call('SCARD', KEYS[1])", "1", b)).To(Equal(int64(2)))
+	g.Expect(do("EVAL", "return redis.call('SISMEMBER', KEYS[1], 'n')", "1", b)).To(Equal(int64(1)))
+	g.Expect(do("DEL", b)).To(Equal(int64(1)))
+	g.Expect(do("EVAL", "redis.call('RPUSH', KEYS[1], 'x', 'y', 'z') redis.call('LPOP', KEYS[1]) return redis.call('LRANGE', KEYS[1], 0, -1)", "1", b)).To(Equal([]interface{}{"y", "z"}))
+	g.Expect(do("DEL", b)).To(Equal(int64(1)))
+	g.Expect(do("EVAL", "redis.call('ZADD', KEYS[1], 1, 'm', 2, 'n') redis.call('ZREM', KEYS[1], 'm') return redis.call('ZCARD', KEYS[1])", "1", b)).To(Equal(int64(1)))
+	g.Expect(do("PEXPIRE", b, "-1")).To(Equal(int64(1)))
+	g.Expect(do("EXISTS", a, b, a)).To(Equal(int64(2)))
+	g.Expect(do("TTL", b)).To(Equal(int64(-2)))
+	g.Expect(do("SET", b, "10")).To(Equal("OK"))
+	g.Expect(do("TTL", b)).To(Equal(int64(-1)))
+	g.Expect(do("DECRBY", b, "15")).To(Equal(int64(-5)))
+	g.Expect(do("DEL", a, b, a)).To(Equal(int64(2)))
+}
+
+func TestServeEvalSha(t *testing.T) {
+	g := NewWithT(t)
+	do := dial(t)
+	script := "return ARGV[1]"
+	sha := "8a2e8fb2e7a1b1a2a1e3c50bb0b6de5bc7f0a1dc"
+	g.Expect(do("EVALSHA", sha, "0", "x")).To(Equal(errNoScript))
+	sha = do("SCRIPT", "LOAD", script).(string)
+	g.Expect(sha).To(Equal(sha1hex([]byte(script))))
+	g.Expect(do("EVALSHA", sha, "0", "x")).To(Equal("x"))
+	g.Expect(do("EVALSHA", strings.ToUpper(sha), "0", "y")).To(Equal("y"))
+	g.Expect(do("SCRIPT", "EXISTS", sha, "nosuchsha")).To(Equal([]interface{}{int64(1), int64(0)}))
+	g.Expect(do("SCRIPT", "FLUSH")).To(Equal("OK"))
+	g.Expect(do("SCRIPT", "EXISTS", sha)).To(Equal([]interface{}{int64(0)}))
+	g.Expect(do("EVALSHA", sha, "0", "x")).To(Equal(errNoScript))
+
+	// EVAL caches the script too
+	g.Expect(do("EVAL", script, "0", "z")).To(Equal("z"))
+	g.Expect(do("EVALSHA", sha, "0", "x")).To(Equal("x"))
+	g.Expect(do("SCRIPT", "NOSUCHSUBCOMMAND")).To(Equal(fmt.Errorf("ERR unknown subcommand or wrong number of arguments for 'NOSUCHSUBCOMMAND'")))
+}
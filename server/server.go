@@ -1,22 +1,205 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
 	"github.com/zenozeng/s3dis/db"
 	"github.com/zenozeng/s3dis/storage"
 )
 
+// errNoop aborts a read-write transaction which has nothing to write, so that
+// the partition is not uploaded
+var errNoop = errors.New("noop")
+
+const defaultDatabases = 16
+
 type Server struct {
-	db *db.Database
+	db        *db.Database // the selected logical database
+	databases int
+	scripts   *scriptCache // shared by the logical databases
+	functions *functionCache
+	pubsub    *pubsub
+	blocking  *blocking
+	clients   *clients // connections served by this process
+	tracking  *tracking
+	// held for reading by the commands served over RESP, and for writing by
+	// EXEC running keyspace commands, see lockKeyspace
+	keyspace *sync.RWMutex
+	stop     context.CancelFunc // stops the background goroutines
 }
 
 type ServerConfig struct {
 	CacheDir        string
 	Singleton       bool
 	MaxPartitionNum int
+	Databases       int // number of logical databases, 16 if zero
+	// address at which the other processes sharing the object storage reach
+	// this one, served by ServePeers, messages published on any of them are
+	// forwarded to the others if set
+	PubSubAddr string
+	// notify-keyspace-events, keyspace notifications are disabled if empty
+	NotifyKeyspaceEvents string
+	// receives a change record for every write if set, e.g. a
+	// db.FileSink, which requires Singleton, see db.CaptureChanges
+	ChangeSink db.ChangeSink
+	// interval between the purges of the expired keys, which notify their
+	// expired events, by a Singleton server; never if zero. The first purge
+	// loads every partition of every logical database, the next ones only
+	// read the partitions already loaded. Otherwise expired keys are only
+	// purged by the writes looking them up.
+	ExpireSweepInterval time.Duration
 }
 
 func NewServer(storage *storage.ObjectStorage, config *ServerConfig) *Server {
-	return &Server{
-		db: db.NewDatabase(storage, config.MaxPartitionNum, config.CacheDir, config.Singleton),
+	databases := config.Databases
+	if databases == 0 {
+		databases = defaultDatabases
+	}
+	d := db.NewDatabase(storage, config.MaxPartitionNum, config.CacheDir, config.Singleton)
+	ps := newPubSub()
+	if config.PubSubAddr != "" {
+		err := d.RegisterNode(context.Background(), config.PubSubAddr)
+		if err != nil {
+			panic(err)
+		}
+		ps.fanout = newFanout(d, config.PubSubAddr)
+	}
+	err := d.SetNotifyKeyspaceEvents(config.NotifyKeyspaceEvents)
+	if err != nil {
+		panic(err)
+	}
+	if config.ChangeSink != nil {
+		err = d.CaptureChanges(context.Background(), config.ChangeSink)
+		if err != nil {
+			panic(err)
+		}
+	}
+	poll := blockingPollInterval
+	if config.Singleton {
+		poll = 0
+	}
+	c := &Server{
+		db:        d,
+		databases: databases,
+		scripts:   newScriptCache(),
+		functions: newFunctionCache(),
+		pubsub:    ps,
+		blocking:  newBlocking(poll),
+		clients:   newClients(),
+		tracking:  newTracking(),
+		keyspace:  &sync.RWMutex{},
+	}
+	d.OnEvent(c.notify)
+	d.OnWrite(c.onWrite)
+	ctx, stop := context.WithCancel(context.Background())
+	c.stop = stop
+	if ps.fanout != nil {
+		go ps.fanout.heartbeat(ctx)
+		go ps.fanout.refreshPeers(ctx)
+	}
+	if config.Singleton && config.ExpireSweepInterval > 0 {
+		go c.sweepExpired(ctx, config.ExpireSweepInterval)
+	}
+	return c
+}
+
+// Close stops the background work of the server and removes its
+// registration, so that the other processes stop forwarding messages to it.
+// It does not close the listeners nor the connections.
+func (c *Server) Close(ctx context.Context) error {
+	c.stop()
+	if c.pubsub.fanout != nil {
+		return c.db.DeregisterNode(ctx, c.pubsub.fanout.addr)
+	}
+	return nil
+}
+
+// Select returns a Server running commands on the logical database index,
+// from 0 to ServerConfig.Databases - 1. The returned Server keeps using the
+// same data if the database is later swapped by SwapDB, select it again to
+// follow the swap.
+func (c *Server) Select(index int) (*Server, error) {
+	if index < 0 || index >= c.databases {
+		return nil, fmt.Errorf("ERR DB index is out of range")
+	}
+	selected, err := c.db.Select(index)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{db: selected, databases: c.databases, scripts: c.scripts, functions: c.functions, pubsub: c.pubsub, blocking: c.blocking, clients: c.clients, tracking: c.tracking, keyspace: c.keyspace, stop: c.stop}, nil
+}
+
+// update runs fn in a read-write transaction on the partition of key,
+// treating errNoop as success
+func (c *Server) update(ctx context.Context, key []byte, fn func(tx *db.Tx) error) error {
+	err := c.db.Update(ctx, key, fn)
+	if errors.Is(err, errNoop) {
+		return nil
+	}
+	return err
+}
+
+// updateKeys is the multi-key counterpart of update
+func (c *Server) updateKeys(ctx context.Context, keys [][]byte, fn func(m *db.MultiTx) error) error {
+	err := c.db.UpdateKeys(ctx, keys, fn)
+	if errors.Is(err, errNoop) {
+		return nil
+	}
+	return err
+}
+
+// withCommand marks ctx with the command equivalent to a call of the Go API,
+// which change data capture records with the writes, unless ctx already
+// comes from a command served over RESP. The arguments are byte slices,
+// strings, integers, floats or slices of them.
+func withCommand(ctx context.Context, name string, args ...interface{}) context.Context {
+	if db.CommandFromContext(ctx) != nil {
+		return ctx
+	}
+	cmd := [][]byte{[]byte(name)}
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case []byte:
+			cmd = append(cmd, arg)
+		case [][]byte:
+			cmd = append(cmd, arg...)
+		case string:
+			cmd = append(cmd, []byte(arg))
+		case []string:
+			for _, s := range arg {
+				cmd = append(cmd, []byte(s))
+			}
+		case int:
+			cmd = append(cmd, []byte(strconv.Itoa(arg)))
+		case int64:
+			cmd = append(cmd, []byte(strconv.FormatInt(arg, 10)))
+		case float64:
+			cmd = append(cmd, []byte(strconv.FormatFloat(arg, 'f', -1, 64)))
+		default:
+			cmd = append(cmd, []byte(fmt.Sprint(arg)))
+		}
+	}
+	return db.WithCommand(ctx, cmd)
+}
+
+// flag returns name as the argument of a command if set
+func flag(set bool, name string) [][]byte {
+	if !set {
+		return nil
+	}
+	return [][]byte{[]byte(name)}
+}
+
+// optionalInt returns name followed by n as arguments of a command, unless n
+// is zero
+func optionalInt(name string, n int64) [][]byte {
+	if n == 0 {
+		return nil
 	}
+	return [][]byte{[]byte(name), []byte(strconv.FormatInt(n, 10))}
 }
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zenozeng/s3dis/db"
+)
+
+// changeSink keeps the changes of some keys
+type changeSink struct {
+	mu      sync.Mutex
+	keys    map[string]bool
+	changes []db.Change
+}
+
+func (s *changeSink) WriteChanges(ctx context.Context, changes []db.Change) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, change := range changes {
+		if s.keys[string(change.Key)] {
+			s.changes = append(s.changes, change)
+		}
+	}
+	return nil
+}
+
+// wait returns the changes received once there are n of them
+func (s *changeSink) wait(n int) []db.Change {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		s.mu.Lock()
+		changes := append([]db.Change{}, s.changes...)
+		s.mu.Unlock()
+		if len(changes) >= n || time.Now().After(deadline) {
+			return changes
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCaptureCommands(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	list := []byte(uuid.NewString())
+	str := []byte(uuid.NewString())
+	sink := &changeSink{keys: map[string]bool{string(list): true, string(str): true}}
+	g.Expect(server.db.CaptureChanges(ctx, sink)).To(BeNil())
+	defer server.db.StopCapture(ctx)
+
+	// the writes of the Go API record the equivalent command
+	_, err := server.RPush(ctx, list, []byte("a"), []byte("b"))
+	g.Expect(err).To(BeNil())
+	ex := int64(100)
+	_, err = server.SetWithOptions(ctx, str, []byte("v"), &SetOptions{NX: true, EX: &ex})
+	g.Expect(err).To(BeNil())
+
+	changes := sink.wait(3)
+	g.Expect(len(changes)).To(Equal(3))
+	byOp := map[string]db.Change{}
+	for _, change := range changes {
+		byOp[change.Op] = change
+	}
+	rpush := byOp["rpush"]
+	g.Expect(rpush.Args).To(Equal([][]byte{[]byte("RPUSH"), list, []byte("a"), []byte("b")}))
+	g.Expect(rpush.Type).To(Equal(db.TypeList))
+	g.Expect(rpush.Elements).NotTo(BeNil())
+	set := byOp["set"]
+	g.Expect(set.Args).To(Equal([][]byte{[]byte("SET"), str, []byte("v"), []byte("NX"), []byte("EX"), []byte("100")}))
+	g.Expect(set.Value).To(Equal([]byte("v")))
+	g.Expect(set.Expiry).NotTo(BeNil())
+	g.Expect(byOp["expire"].Args).To(Equal(set.Args))
+}
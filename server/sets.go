@@ -0,0 +1,374 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+// SAdd adds members to the set stored at key and returns the number of
+// members that were added.
+func (c *Server) SAdd(ctx context.Context, key []byte, members ...[]byte) (int64, error) {
+	ctx = withCommand(ctx, "SADD", key, members)
+	added := int64(0)
+	err := c.update(ctx, key, func(tx *db.Tx) error {
+		set, err := tx.OpenSet(key, true)
+		if err != nil {
+			return err
+		}
+		added, err = set.Add(members...)
+		if err == nil && added == 0 {
+			return errNoop
+		}
+		return err
+	})
+	return added, err
+}
+
+// SRem removes members from the set stored at key and returns the number of
+// members that were removed.
+func (c *Server) SRem(ctx context.Context, key []byte, members ...[]byte) (int64, error) {
+	ctx = withCommand(ctx, "SREM", key, members)
+	removed := int64(0)
+	err := c.update(ctx, key, func(tx *db.Tx) error {
+		set, err := tx.OpenSet(key, false)
+		if err != nil {
+			return err
+		}
+		if set == nil {
+			return errNoop
+		}
+		removed, err = set.Rem(members...)
+		if err == nil && removed == 0 {
+			return errNoop
+		}
+		return err
+	})
+	return removed, err
+}
+
+// viewSet runs fn with the set stored at key, fn is not called if the key
+// does not exist
+func (c *Server) viewSet(ctx context.Context, key []byte, fn func(set *db.Set) error) error {
+	return c.db.View(ctx, key, func(tx *db.Tx) error {
+		set, err := tx.OpenSet(key, false)
+		if err != nil || set == nil {
+			return err
+		}
+		return fn(set)
+	})
+}
+
+// SMembers returns all members of the set stored at key.
+func (c *Server) SMembers(ctx context.Context, key []byte) ([][]byte, error) {
+	members := [][]byte{}
+	err := c.viewSet(ctx, key, func(set *db.Set) error {
+		members = set.Members()
+		return nil
+	})
+	return members, err
+}
+
+// SIsMember reports whether member belongs to the set stored at key.
+func (c *Server) SIsMember(ctx context.Context, key []byte, member []byte) (bool, error) {
+	res, err := c.SMIsMember(ctx, key, member)
+	if err != nil {
+		return false, err
+	}
+	return res[0], nil
+}
+
+// SMIsMember reports for every member whether it belongs to the set stored
+// at key.
+func (c *Server) SMIsMember(ctx context.Context, key []byte, members ...[]byte) ([]bool, error) {
+	res := make([]bool, len(members))
+	err := c.viewSet(ctx, key, func(set *db.Set) error {
+		for i, member := range members {
+			res[i] = set.IsMember(member)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// SCard returns the number of members of the set stored at key.
+func (c *Server) SCard(ctx context.Context, key []byte) (int64, error) {
+	n := int64(0)
+	err := c.viewSet(ctx, key, func(set *db.Set) error {
+		n = set.Len()
+		return nil
+	})
+	return n, err
+}
+
+// SPop removes and returns a random member of the set stored at key, or nil
+// if the key does not exist.
+func (c *Server) SPop(ctx context.Context, key []byte) ([]byte, error) {
+	ctx = withCommand(ctx, "SPOP", key)
+	members, err := c.SPopCount(ctx, key, 1)
+	if err != nil || len(members) == 0 {
+		return nil, err
+	}
+	return members[0], nil
+}
+
+// SPopCount removes and returns up to count random members of the set stored
+// at key.
+func (c *Server) SPopCount(ctx context.Context, key []byte, count int64) ([][]byte, error) {
+	ctx = withCommand(ctx, "SPOP", key, count)
+	if count < 0 {
+		return nil, fmt.Errorf("value is out of range, must be positive")
+	}
+	members := [][]byte{}
+	err := c.update(ctx, key, func(tx *db.Tx) error {
+		set, err := tx.OpenSet(key, false)
+		if err != nil {
+			return err
+		}
+		if set == nil || count == 0 {
+			return errNoop
+		}
+		members, err = set.Pop(count)
+		return err
+	})
+	return members, err
+}
+
+// SRandMember returns a random member of the set stored at key, or nil if
+// the key does not exist.
+func (c *Server) SRandMember(ctx context.Context, key []byte) ([]byte, error) {
+	members, err := c.SRandMemberCount(ctx, key, 1)
+	if err != nil || len(members) == 0 {
+		return nil, err
+	}
+	return members[0], nil
+}
+
+// SRandMemberCount returns count distinct random members of the set stored
+// at key, or -count possibly repeated members if count is negative.
+func (c *Server) SRandMemberCount(ctx context.Context, key []byte, count int64) ([][]byte, error) {
+	members := [][]byte{}
+	err := c.viewSet(ctx, key, func(set *db.Set) error {
+		members = set.RandMembers(count)
+		return nil
+	})
+	return members, err
+}
+
+// SMove moves member from the set stored at source to the set stored at
+// destination, and reports whether the member was moved.
+func (c *Server) SMove(ctx context.Context, source []byte, destination []byte, member []byte) (bool, error) {
+	ctx = withCommand(ctx, "SMOVE", source, destination, member)
+	moved := false
+	err := c.updateKeys(ctx, [][]byte{source, destination}, func(m *db.MultiTx) error {
+		src, err := m.Tx(source).OpenSet(source, false)
+		if err != nil {
+			return err
+		}
+		typ, err := m.Tx(destination).Type(destination)
+		if err != nil {
+			return err
+		}
+		if typ != db.TypeNone && typ != db.TypeSet {
+			return db.ErrWrongType
+		}
+		if src == nil || !src.IsMember(member) {
+			return errNoop
+		}
+		_, err = src.Rem(member)
+		if err != nil {
+			return err
+		}
+		// the destination is opened after the removal, as it may be the source
+		dst, err := m.Tx(destination).OpenSet(destination, true)
+		if err != nil {
+			return err
+		}
+		_, err = dst.Add(member)
+		moved = true
+		return err
+	})
+	return moved, err
+}
+
+// readSets returns the sets stored at keys, nil for missing keys
+func readSets(m *db.MultiTx, keys [][]byte) ([]*db.Set, error) {
+	sets := []*db.Set{}
+	for _, key := range keys {
+		set, err := m.Tx(key).OpenSet(key, false)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+// inter returns the members of the intersection of sets, stopping once
+// limit members are found if limit is positive
+func inter(sets []*db.Set, limit int64) [][]byte {
+	res := [][]byte{}
+	smallest := sets[0]
+	for _, set := range sets {
+		if set == nil {
+			return res
+		}
+		if set.Len() < smallest.Len() {
+			smallest = set
+		}
+	}
+	for _, member := range smallest.Members() {
+		found := true
+		for _, set := range sets {
+			if !set.IsMember(member) {
+				found = false
+				break
+			}
+		}
+		if found {
+			res = append(res, member)
+			if limit > 0 && int64(len(res)) >= limit {
+				return res
+			}
+		}
+	}
+	return res
+}
+
+func union(sets []*db.Set) [][]byte {
+	res := [][]byte{}
+	seen := map[string]bool{}
+	for _, set := range sets {
+		if set == nil {
+			continue
+		}
+		for _, member := range set.Members() {
+			if !seen[string(member)] {
+				seen[string(member)] = true
+				res = append(res, member)
+			}
+		}
+	}
+	return res
+}
+
+func diff(sets []*db.Set) [][]byte {
+	res := [][]byte{}
+	if sets[0] == nil {
+		return res
+	}
+	for _, member := range sets[0].Members() {
+		found := false
+		for _, set := range sets[1:] {
+			if set != nil && set.IsMember(member) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, member)
+		}
+	}
+	return res
+}
+
+// setOp computes op over the sets stored at keys. Keys in other partitions
+// are read under a consistent view of all touched partitions.
+func (c *Server) setOp(ctx context.Context, keys [][]byte, op func(sets []*db.Set) [][]byte) ([][]byte, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("wrong number of arguments")
+	}
+	var res [][]byte
+	err := c.db.ViewKeys(ctx, keys, func(m *db.MultiTx) error {
+		sets, err := readSets(m, keys)
+		if err != nil {
+			return err
+		}
+		res = op(sets)
+		return nil
+	})
+	return res, err
+}
+
+// setOpStore stores the result of op over the sets stored at keys in
+// destination, replacing any value, and returns the size of the result.
+func (c *Server) setOpStore(ctx context.Context, destination []byte, keys [][]byte, op func(sets []*db.Set) [][]byte) (int64, error) {
+	if len(keys) == 0 {
+		return 0, fmt.Errorf("wrong number of arguments")
+	}
+	n := int64(0)
+	err := c.updateKeys(ctx, append([][]byte{destination}, keys...), func(m *db.MultiTx) error {
+		sets, err := readSets(m, keys)
+		if err != nil {
+			return err
+		}
+		members := op(sets)
+		n = int64(len(members))
+		tx := m.Tx(destination)
+		_, err = tx.Delete(destination)
+		if err != nil || n == 0 {
+			return err
+		}
+		set, err := tx.OpenSet(destination, true)
+		if err != nil {
+			return err
+		}
+		_, err = set.Add(members...)
+		return err
+	})
+	return n, err
+}
+
+// SInter returns the members of the intersection of the sets stored at keys.
+func (c *Server) SInter(ctx context.Context, keys ...[]byte) ([][]byte, error) {
+	return c.setOp(ctx, keys, func(sets []*db.Set) [][]byte {
+		return inter(sets, 0)
+	})
+}
+
+// SInterCard returns the size of the intersection of the sets stored at keys,
+// counting at most limit members if limit is positive.
+func (c *Server) SInterCard(ctx context.Context, limit int64, keys ...[]byte) (int64, error) {
+	if limit < 0 {
+		return 0, fmt.Errorf("LIMIT can't be negative")
+	}
+	res, err := c.setOp(ctx, keys, func(sets []*db.Set) [][]byte {
+		return inter(sets, limit)
+	})
+	return int64(len(res)), err
+}
+
+// SUnion returns the members of the union of the sets stored at keys.
+func (c *Server) SUnion(ctx context.Context, keys ...[]byte) ([][]byte, error) {
+	return c.setOp(ctx, keys, union)
+}
+
+// SDiff returns the members of the first set stored at keys which are not in
+// any of the following ones.
+func (c *Server) SDiff(ctx context.Context, keys ...[]byte) ([][]byte, error) {
+	return c.setOp(ctx, keys, diff)
+}
+
+// SInterStore is like SInter but stores the result in destination and
+// returns its size.
+func (c *Server) SInterStore(ctx context.Context, destination []byte, keys ...[]byte) (int64, error) {
+	ctx = withCommand(ctx, "SINTERSTORE", destination, keys)
+	return c.setOpStore(ctx, destination, keys, func(sets []*db.Set) [][]byte {
+		return inter(sets, 0)
+	})
+}
+
+// SUnionStore is like SUnion but stores the result in destination and
+// returns its size.
+func (c *Server) SUnionStore(ctx context.Context, destination []byte, keys ...[]byte) (int64, error) {
+	ctx = withCommand(ctx, "SUNIONSTORE", destination, keys)
+	return c.setOpStore(ctx, destination, keys, union)
+}
+
+// SDiffStore is like SDiff but stores the result in destination and returns
+// its size.
+func (c *Server) SDiffStore(ctx context.Context, destination []byte, keys ...[]byte) (int64, error) {
+	ctx = withCommand(ctx, "SDIFFSTORE", destination, keys)
+	return c.setOpStore(ctx, destination, keys, diff)
+}
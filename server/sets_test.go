@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func sortedStrings(values [][]byte) []string {
+	res := []string{}
+	for _, v := range values {
+		res = append(res, string(v))
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestSets(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	n, err := server.SAdd(ctx, key, bytesList("a", "b", "c", "a")...)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(3)))
+	n, err = server.SAdd(ctx, key, bytesList("a")...)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(0)))
+	n, err = server.SCard(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(3)))
+
+	ok, err := server.SIsMember(ctx, key, []byte("b"))
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(true))
+	res, err := server.SMIsMember(ctx, key, bytesList("a", "x")...)
+	g.Expect(err).To(BeNil())
+	g.Expect(res).To(Equal([]bool{true, false}))
+
+	n, err = server.SRem(ctx, key, bytesList("b", "x")...)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(1)))
+	members, err := server.SMembers(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(sortedStrings(members)).To(Equal([]string{"a", "c"}))
+
+	members, err = server.SRandMemberCount(ctx, key, -5)
+	g.Expect(err).To(BeNil())
+	g.Expect(len(members)).To(Equal(5))
+	members, err = server.SRandMemberCount(ctx, key, 5)
+	g.Expect(err).To(BeNil())
+	g.Expect(sortedStrings(members)).To(Equal([]string{"a", "c"}))
+
+	members, err = server.SPopCount(ctx, key, 5)
+	g.Expect(err).To(BeNil())
+	g.Expect(sortedStrings(members)).To(Equal([]string{"a", "c"}))
+	n, err = server.SCard(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(0)))
+	member, err := server.SPop(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(member).To(BeNil())
+}
+
+func TestSetsEmptyMember(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	n, err := server.SAdd(ctx, key, bytesList("", "\x00", "a")...)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(3)))
+	ok, err := server.SIsMember(ctx, key, []byte{})
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(true))
+	members, err := server.SMembers(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(members).To(Equal(bytesList("", "\x00", "a")))
+	n, err = server.SRem(ctx, key, []byte{})
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(1)))
+
+	zkey := []byte(uuid.NewString())
+	n, err = server.ZAdd(ctx, zkey, nil, Z{Score: 1, Member: []byte{}}, Z{Score: 2, Member: []byte("a")})
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(2)))
+	score, ok, err := server.ZScore(ctx, zkey, []byte{})
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(true))
+	g.Expect(score).To(Equal(1.0))
+}
+
+func TestSetOperations(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	a := []byte(uuid.NewString())
+	b := []byte(uuid.NewString())
+	missing := []byte(uuid.NewString())
+	dst := []byte(uuid.NewString())
+
+	_, err := server.SAdd(ctx, a, bytesList("1", "2", "3", "4")...)
+	g.Expect(err).To(BeNil())
+	_, err = server.SAdd(ctx, b, bytesList("3", "4", "5")...)
+	g.Expect(err).To(BeNil())
+
+	members, err := server.SInter(ctx, a, b)
+	g.Expect(err).To(BeNil())
+	g.Expect(sortedStrings(members)).To(Equal([]string{"3", "4"}))
+	members, err = server.SInter(ctx, a, missing)
+	g.Expect(err).To(BeNil())
+	g.Expect(members).To(BeEmpty())
+	members, err = server.SUnion(ctx, a, b, missing)
+	g.Expect(err).To(BeNil())
+	g.Expect(sortedStrings(members)).To(Equal([]string{"1", "2", "3", "4", "5"}))
+	members, err = server.SDiff(ctx, a, b)
+	g.Expect(err).To(BeNil())
+	g.Expect(sortedStrings(members)).To(Equal([]string{"1", "2"}))
+	n, err := server.SInterCard(ctx, 1, a, b)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(1)))
+
+	// the destination is replaced, whatever its type
+	err = server.Set(ctx, dst, []byte("v"), nil)
+	g.Expect(err).To(BeNil())
+	n, err = server.SUnionStore(ctx, dst, a, b)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(5)))
+	n, err = server.SDiffStore(ctx, dst, dst, a)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(1)))
+	members, err = server.SMembers(ctx, dst)
+	g.Expect(err).To(BeNil())
+	g.Expect(sortedStrings(members)).To(Equal([]string{"5"}))
+	n, err = server.SInterStore(ctx, dst, a, missing)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(0)))
+	n, err = server.SCard(ctx, dst)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(0)))
+
+	ok, err := server.SMove(ctx, a, b, []byte("1"))
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(true))
+	ok, err = server.SIsMember(ctx, b, []byte("1"))
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(true))
+}
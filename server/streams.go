@@ -0,0 +1,983 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+// XMessage is an entry of a stream.
+type XMessage = db.StreamEntry
+
+// XStream is the list of entries read from a stream by XREAD or XREADGROUP.
+type XStream struct {
+	Stream   []byte
+	Messages []XMessage
+}
+
+// parseRangeID parses the start or end of a range, such as -, +, an ID, a
+// millisecond time, or an exclusive (ID. It returns false if the range is
+// empty because an exclusive bound can not be incremented.
+func parseRangeID(s string, start bool) (db.StreamID, bool, error) {
+	switch s {
+	case "-":
+		return db.StreamID{}, true, nil
+	case "+":
+		return db.MaxStreamID, true, nil
+	}
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	seq := uint64(0)
+	if !start {
+		seq = db.MaxStreamID.Seq
+	}
+	id, err := db.ParseStreamID(s, seq)
+	if err != nil || !exclusive {
+		return id, true, err
+	}
+	if start {
+		id, ok := id.Next()
+		return id, ok, nil
+	}
+	id, ok := id.Prev()
+	return id, ok, nil
+}
+
+func openStream(tx *db.Tx, key []byte) (*db.Stream, error) {
+	return tx.OpenStream(key, false)
+}
+
+// viewStream runs fn with the stream stored at key, fn is not called if the
+// key does not exist
+func (c *Server) viewStream(ctx context.Context, key []byte, fn func(s *db.Stream) error) error {
+	return c.db.View(ctx, key, func(tx *db.Tx) error {
+		s, err := openStream(tx, key)
+		if err != nil || s == nil {
+			return err
+		}
+		return fn(s)
+	})
+}
+
+// updateStream runs fn with the stream stored at key in a read-write
+// transaction, nothing is written if the key does not exist
+func (c *Server) updateStream(ctx context.Context, key []byte, fn func(s *db.Stream) error) error {
+	return c.update(ctx, key, func(tx *db.Tx) error {
+		s, err := openStream(tx, key)
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			return errNoop
+		}
+		return fn(s)
+	})
+}
+
+// XTrimArgs mirrors the trimming options of XADD and XTRIM. The MINID
+// strategy is used if MinID is set, MAXLEN otherwise. Approximate trimming is
+// accepted but trimming is always exact, up to Limit entries if positive.
+type XTrimArgs struct {
+	MaxLen int64
+	MinID  string
+	Approx bool
+	Limit  int64
+}
+
+func (args *XTrimArgs) trim(s *db.Stream) (int64, error) {
+	if args.Limit != 0 && !args.Approx {
+		return 0, fmt.Errorf("syntax error, LIMIT cannot be used without the special ~ option")
+	}
+	if args.MinID != "" {
+		minID, err := db.ParseStreamID(args.MinID, 0)
+		if err != nil {
+			return 0, err
+		}
+		return s.Trim(0, &minID, args.Limit)
+	}
+	if args.MaxLen < 0 {
+		return 0, fmt.Errorf("The MAXLEN argument must be >= 0.")
+	}
+	return s.Trim(args.MaxLen, nil, args.Limit)
+}
+
+// XAddArgs mirrors the arguments of the Redis XADD command. ID defaults to
+// "*", and Fields holds field names and values alternately.
+type XAddArgs struct {
+	NoMkStream bool
+	Trim       *XTrimArgs
+	ID         string
+	Fields     [][]byte
+}
+
+// XAdd appends an entry to the stream stored at key and returns its ID, or
+// an empty string if the stream does not exist and NoMkStream is set.
+func (c *Server) XAdd(ctx context.Context, key []byte, args *XAddArgs) (string, error) {
+	ctx = withCommand(ctx, "XADD", key, args.args())
+	if len(args.Fields) == 0 || len(args.Fields)%2 != 0 {
+		return "", fmt.Errorf("ERR wrong number of arguments for 'xadd' command")
+	}
+	res := ""
+	err := c.update(ctx, key, func(tx *db.Tx) error {
+		s, err := tx.OpenStream(key, !args.NoMkStream)
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			return errNoop
+		}
+		var id db.StreamID
+		switch {
+		case args.ID == "" || args.ID == "*":
+			id = s.NextID()
+		case strings.HasSuffix(args.ID, "-*"):
+			ms, err := db.ParseStreamID(strings.TrimSuffix(args.ID, "-*"), 0)
+			if err != nil {
+				return err
+			}
+			var ok bool
+			id, ok = s.NextSeq(ms.Ms)
+			if !ok {
+				return db.ErrStreamIDTooSmall
+			}
+		default:
+			id, err = db.ParseStreamID(args.ID, 0)
+			if err != nil {
+				return err
+			}
+		}
+		err = s.Add(id, args.Fields)
+		if err != nil {
+			return err
+		}
+		if args.Trim != nil {
+			_, err = args.Trim.trim(s)
+			if err != nil {
+				return err
+			}
+		}
+		res = id.String()
+		return nil
+	})
+	return res, err
+}
+
+// XLen returns the number of entries of the stream stored at key.
+func (c *Server) XLen(ctx context.Context, key []byte) (int64, error) {
+	n := int64(0)
+	err := c.viewStream(ctx, key, func(s *db.Stream) error {
+		n = s.Len()
+		return nil
+	})
+	return n, err
+}
+
+func (c *Server) xrange(ctx context.Context, key []byte, start, end string, rev bool, count int64) ([]XMessage, error) {
+	startID, ok, err := parseRangeID(start, true)
+	if err != nil {
+		return nil, err
+	}
+	endID, ok2, err := parseRangeID(end, false)
+	if err != nil {
+		return nil, err
+	}
+	res := []XMessage{}
+	if !ok || !ok2 {
+		return res, nil
+	}
+	err = c.viewStream(ctx, key, func(s *db.Stream) error {
+		res = s.Range(startID, endID, rev, count)
+		return nil
+	})
+	return res, err
+}
+
+// XRange returns the entries of the stream stored at key with IDs between
+// start and end, inclusive.
+func (c *Server) XRange(ctx context.Context, key []byte, start, end string) ([]XMessage, error) {
+	return c.xrange(ctx, key, start, end, false, -1)
+}
+
+// XRangeN is like XRange but returns at most count entries.
+func (c *Server) XRangeN(ctx context.Context, key []byte, start, end string, count int64) ([]XMessage, error) {
+	return c.xrange(ctx, key, start, end, false, count)
+}
+
+// XRevRange returns the entries of the stream stored at key with IDs between
+// end and start, inclusive, in reverse order.
+func (c *Server) XRevRange(ctx context.Context, key []byte, end, start string) ([]XMessage, error) {
+	return c.xrange(ctx, key, start, end, true, -1)
+}
+
+// XRevRangeN is like XRevRange but returns at most count entries.
+func (c *Server) XRevRangeN(ctx context.Context, key []byte, end, start string, count int64) ([]XMessage, error) {
+	return c.xrange(ctx, key, start, end, true, count)
+}
+
+func parseStreamIDs(ids []string) ([]db.StreamID, error) {
+	res := []db.StreamID{}
+	for _, s := range ids {
+		id, err := db.ParseStreamID(s, 0)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+	}
+	return res, nil
+}
+
+// XDel removes entries from the stream stored at key and returns the number
+// of removed entries.
+func (c *Server) XDel(ctx context.Context, key []byte, ids ...string) (int64, error) {
+	ctx = withCommand(ctx, "XDEL", key, ids)
+	streamIDs, err := parseStreamIDs(ids)
+	if err != nil {
+		return 0, err
+	}
+	n := int64(0)
+	err = c.updateStream(ctx, key, func(s *db.Stream) error {
+		var err error
+		n, err = s.Delete(streamIDs...)
+		if err == nil && n == 0 {
+			return errNoop
+		}
+		return err
+	})
+	return n, err
+}
+
+// XTrim trims the stream stored at key and returns the number of removed
+// entries.
+func (c *Server) XTrim(ctx context.Context, key []byte, args *XTrimArgs) (int64, error) {
+	ctx = withCommand(ctx, "XTRIM", key, args.args())
+	n := int64(0)
+	err := c.updateStream(ctx, key, func(s *db.Stream) error {
+		var err error
+		n, err = args.trim(s)
+		if err == nil && n == 0 {
+			return errNoop
+		}
+		return err
+	})
+	return n, err
+}
+
+// XSetID sets the last generated ID of the stream stored at key.
+func (c *Server) XSetID(ctx context.Context, key []byte, id string) error {
+	ctx = withCommand(ctx, "XSETID", key, id)
+	streamID, err := db.ParseStreamID(id, 0)
+	if err != nil {
+		return err
+	}
+	return c.update(ctx, key, func(tx *db.Tx) error {
+		s, err := openStream(tx, key)
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			return fmt.Errorf("ERR no such key")
+		}
+		return s.SetLastID(streamID)
+	})
+}
+
+// XReadArgs mirrors the arguments of XREAD. IDs holds one ID per stream, "$"
+// meaning the last ID of the stream. A zero Count means no limit. If Block is
+// set and there are no entries, XRead waits for new entries up to Timeout,
+// zero waiting forever.
+type XReadArgs struct {
+	Streams [][]byte
+	IDs     []string
+	Count   int64
+	Block   bool
+	Timeout time.Duration
+}
+
+func (args *XReadArgs) validate() error {
+	if len(args.Streams) == 0 || len(args.Streams) != len(args.IDs) {
+		return fmt.Errorf("Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+	}
+	return nil
+}
+
+func readCount(count int64) int64 {
+	if count <= 0 {
+		return -1
+	}
+	return count
+}
+
+// XRead returns the entries with IDs greater than the given ones from each
+// stream, omitting streams without such entries.
+func (c *Server) XRead(ctx context.Context, args *XReadArgs) ([]XStream, error) {
+	err := args.validate()
+	if err != nil {
+		return nil, err
+	}
+	if !args.Block {
+		return c.xread(ctx, args)
+	}
+	// entries added while blocked are read after the IDs of $ at this time
+	ids, err := c.lastIDs(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	blocked := *args
+	blocked.IDs = ids
+	res := []XStream{}
+	_, err = c.block(ctx, args.Streams, args.Timeout, func() (bool, error) {
+		var err error
+		res, err = c.xread(ctx, &blocked)
+		return len(res) > 0, err
+	})
+	return res, err
+}
+
+// lastIDs returns the IDs of args, with $ replaced by the last ID of the
+// stream
+func (c *Server) lastIDs(ctx context.Context, args *XReadArgs) ([]string, error) {
+	ids := append([]string{}, args.IDs...)
+	err := c.db.ViewKeys(ctx, args.Streams, func(m *db.MultiTx) error {
+		for i, key := range args.Streams {
+			if ids[i] != "$" {
+				continue
+			}
+			s, err := openStream(m.Tx(key), key)
+			if err != nil {
+				return err
+			}
+			ids[i] = db.StreamID{}.String()
+			if s != nil {
+				ids[i] = s.LastID().String()
+			}
+		}
+		return nil
+	})
+	return ids, err
+}
+
+func (c *Server) xread(ctx context.Context, args *XReadArgs) ([]XStream, error) {
+	res := []XStream{}
+	err := c.db.ViewKeys(ctx, args.Streams, func(m *db.MultiTx) error {
+		for i, key := range args.Streams {
+			s, err := openStream(m.Tx(key), key)
+			if err != nil {
+				return err
+			}
+			if args.IDs[i] == "$" || s == nil {
+				continue
+			}
+			id, err := db.ParseStreamID(args.IDs[i], 0)
+			if err != nil {
+				return err
+			}
+			start, ok := id.Next()
+			if !ok {
+				continue
+			}
+			entries := s.Range(start, db.MaxStreamID, false, readCount(args.Count))
+			if len(entries) > 0 {
+				res = append(res, XStream{Stream: key, Messages: entries})
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// XGroupCreateArgs mirrors the options of XGROUP CREATE. EntriesRead is the
+// number of entries already read by the group, used to compute its lag.
+type XGroupCreateArgs struct {
+	MkStream    bool
+	EntriesRead *int64
+}
+
+// XGroupCreate creates the consumer group group of the stream stored at key,
+// whose last delivered ID is id, "$" meaning the last ID of the stream.
+func (c *Server) XGroupCreate(ctx context.Context, key []byte, group []byte, id string, args *XGroupCreateArgs) error {
+	if args == nil {
+		args = &XGroupCreateArgs{}
+	}
+	ctx = withCommand(ctx, "XGROUP", "CREATE", key, group, id, flag(args.MkStream, "MKSTREAM"), entriesReadArgs(args.EntriesRead))
+	return c.db.Update(ctx, key, func(tx *db.Tx) error {
+		s, err := tx.OpenStream(key, args.MkStream)
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			return fmt.Errorf("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+		}
+		lastID, entriesRead, err := parseGroupID(s, id, args.EntriesRead)
+		if err != nil {
+			return err
+		}
+		return s.CreateGroup(group, lastID, entriesRead)
+	})
+}
+
+func parseGroupID(s *db.Stream, id string, entriesRead *int64) (db.StreamID, int64, error) {
+	read := int64(-1)
+	if entriesRead != nil {
+		read = *entriesRead
+	}
+	if id == "$" {
+		if entriesRead == nil {
+			read = int64(s.EntriesAdded())
+		}
+		return s.LastID(), read, nil
+	}
+	lastID, err := db.ParseStreamID(id, 0)
+	if err != nil {
+		return lastID, 0, err
+	}
+	if lastID == (db.StreamID{}) && entriesRead == nil {
+		read = 0
+	}
+	return lastID, read, nil
+}
+
+// updateGroup runs fn with the consumer group group of the stream stored at
+// key, it returns db.ErrNoGroup if either does not exist
+func (c *Server) updateGroup(ctx context.Context, key []byte, group []byte, fn func(s *db.Stream, g *db.Group) error) error {
+	return c.update(ctx, key, func(tx *db.Tx) error {
+		s, err := openStream(tx, key)
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			return db.ErrNoGroup
+		}
+		g := s.Group(group)
+		if g == nil {
+			return db.ErrNoGroup
+		}
+		return fn(s, g)
+	})
+}
+
+// viewGroup is the read-only counterpart of updateGroup
+func (c *Server) viewGroup(ctx context.Context, key []byte, group []byte, fn func(s *db.Stream, g *db.Group) error) error {
+	return c.db.View(ctx, key, func(tx *db.Tx) error {
+		s, err := openStream(tx, key)
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			return db.ErrNoGroup
+		}
+		g := s.Group(group)
+		if g == nil {
+			return db.ErrNoGroup
+		}
+		return fn(s, g)
+	})
+}
+
+// XGroupSetID sets the last delivered ID of a consumer group.
+func (c *Server) XGroupSetID(ctx context.Context, key []byte, group []byte, id string, entriesRead *int64) error {
+	ctx = withCommand(ctx, "XGROUP", "SETID", key, group, id, entriesReadArgs(entriesRead))
+	return c.updateGroup(ctx, key, group, func(s *db.Stream, g *db.Group) error {
+		lastID, read, err := parseGroupID(s, id, entriesRead)
+		if err != nil {
+			return err
+		}
+		return g.SetLastID(lastID, read)
+	})
+}
+
+// XGroupDestroy removes a consumer group and returns the number of removed
+// groups.
+func (c *Server) XGroupDestroy(ctx context.Context, key []byte, group []byte) (int64, error) {
+	ctx = withCommand(ctx, "XGROUP", "DESTROY", key, group)
+	n := int64(0)
+	err := c.updateStream(ctx, key, func(s *db.Stream) error {
+		ok, err := s.DestroyGroup(group)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errNoop
+		}
+		n = 1
+		return nil
+	})
+	return n, err
+}
+
+// XGroupCreateConsumer creates a consumer in a group and returns the number
+// of created consumers.
+func (c *Server) XGroupCreateConsumer(ctx context.Context, key []byte, group []byte, consumer []byte) (int64, error) {
+	ctx = withCommand(ctx, "XGROUP", "CREATECONSUMER", key, group, consumer)
+	n := int64(0)
+	err := c.updateGroup(ctx, key, group, func(s *db.Stream, g *db.Group) error {
+		ok, err := g.CreateConsumer(consumer)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errNoop
+		}
+		n = 1
+		return nil
+	})
+	return n, err
+}
+
+// XGroupDelConsumer removes a consumer from a group and returns the number of
+// entries which were pending for it.
+func (c *Server) XGroupDelConsumer(ctx context.Context, key []byte, group []byte, consumer []byte) (int64, error) {
+	ctx = withCommand(ctx, "XGROUP", "DELCONSUMER", key, group, consumer)
+	n := int64(0)
+	err := c.updateGroup(ctx, key, group, func(s *db.Stream, g *db.Group) error {
+		var err error
+		n, err = g.DeleteConsumer(consumer)
+		return err
+	})
+	return n, err
+}
+
+// XReadGroupArgs mirrors the arguments of XREADGROUP. An ID of ">" reads
+// entries never delivered to the group, other IDs read the history of
+// pending entries of the consumer. A zero Count means no limit.
+type XReadGroupArgs struct {
+	Group    []byte
+	Consumer []byte
+	Streams  [][]byte
+	IDs      []string
+	Count    int64
+	NoAck    bool
+}
+
+// XReadGroup reads entries from streams on behalf of a consumer of a group.
+// Streams without entries to return are omitted, except for history reads.
+func (c *Server) XReadGroup(ctx context.Context, args *XReadGroupArgs) ([]XStream, error) {
+	ctx = withCommand(ctx, "XREADGROUP", args.args())
+	if len(args.Streams) == 0 || len(args.Streams) != len(args.IDs) {
+		return nil, fmt.Errorf("Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified.")
+	}
+	res := []XStream{}
+	err := c.updateKeys(ctx, args.Streams, func(m *db.MultiTx) error {
+		for i, key := range args.Streams {
+			s, err := openStream(m.Tx(key), key)
+			if err != nil {
+				return err
+			}
+			if s == nil {
+				return db.ErrNoGroup
+			}
+			g := s.Group(args.Group)
+			if g == nil {
+				return db.ErrNoGroup
+			}
+			if args.IDs[i] == ">" {
+				entries, err := g.ReadNew(args.Consumer, readCount(args.Count), args.NoAck)
+				if err != nil {
+					return err
+				}
+				if len(entries) > 0 {
+					res = append(res, XStream{Stream: key, Messages: entries})
+				}
+				continue
+			}
+			start, err := db.ParseStreamID(args.IDs[i], 0)
+			if err != nil {
+				return err
+			}
+			entries, err := g.ReadPending(args.Consumer, start, readCount(args.Count))
+			if err != nil {
+				return err
+			}
+			res = append(res, XStream{Stream: key, Messages: entries})
+		}
+		return nil
+	})
+	return res, err
+}
+
+// XAck acknowledges entries pending in a group and returns the number of
+// acknowledged entries.
+func (c *Server) XAck(ctx context.Context, key []byte, group []byte, ids ...string) (int64, error) {
+	ctx = withCommand(ctx, "XACK", key, group, ids)
+	streamIDs, err := parseStreamIDs(ids)
+	if err != nil {
+		return 0, err
+	}
+	n := int64(0)
+	err = c.updateGroup(ctx, key, group, func(s *db.Stream, g *db.Group) error {
+		var err error
+		n, err = g.Ack(streamIDs...)
+		if err == nil && n == 0 {
+			return errNoop
+		}
+		return err
+	})
+	if err == db.ErrNoGroup {
+		return 0, nil
+	}
+	return n, err
+}
+
+// XPending is the summary of the pending entries of a group.
+type XPending struct {
+	Count     int64
+	Lower     string
+	Higher    string
+	Consumers map[string]int64
+}
+
+// XPending returns the summary of the pending entries of a group.
+func (c *Server) XPending(ctx context.Context, key []byte, group []byte) (*XPending, error) {
+	res := &XPending{Consumers: map[string]int64{}}
+	err := c.viewGroup(ctx, key, group, func(s *db.Stream, g *db.Group) error {
+		pending := g.Pending(db.StreamID{}, db.MaxStreamID, -1, nil, 0)
+		res.Count = int64(len(pending))
+		if len(pending) == 0 {
+			return nil
+		}
+		res.Lower = pending[0].ID.String()
+		res.Higher = pending[len(pending)-1].ID.String()
+		for _, p := range pending {
+			res.Consumers[string(p.Consumer)]++
+		}
+		return nil
+	})
+	return res, err
+}
+
+// XPendingExt describes a pending entry.
+type XPendingExt struct {
+	ID         string
+	Consumer   string
+	Idle       time.Duration
+	RetryCount int64
+}
+
+// XPendingExtArgs mirrors the extended form of XPENDING.
+type XPendingExtArgs struct {
+	Idle     time.Duration
+	Start    string
+	End      string
+	Count    int64
+	Consumer []byte
+}
+
+// XPendingExt returns the pending entries of a group matching args.
+func (c *Server) XPendingExt(ctx context.Context, key []byte, group []byte, args *XPendingExtArgs) ([]XPendingExt, error) {
+	start, ok, err := parseRangeID(args.Start, true)
+	if err != nil {
+		return nil, err
+	}
+	end, ok2, err := parseRangeID(args.End, false)
+	if err != nil {
+		return nil, err
+	}
+	res := []XPendingExt{}
+	if !ok || !ok2 || args.Count <= 0 {
+		return res, nil
+	}
+	now := time.Now().UnixMilli()
+	err = c.viewGroup(ctx, key, group, func(s *db.Stream, g *db.Group) error {
+		for _, p := range g.Pending(start, end, args.Count, args.Consumer, args.Idle.Milliseconds()) {
+			res = append(res, XPendingExt{
+				ID:         p.ID.String(),
+				Consumer:   string(p.Consumer),
+				Idle:       time.Duration(now-p.DeliveryMs) * time.Millisecond,
+				RetryCount: p.DeliveryCount,
+			})
+		}
+		return nil
+	})
+	return res, err
+}
+
+// XClaimOptions mirrors the options of XCLAIM. Idle and Time set the last
+// delivery time of claimed entries, RetryCount their delivery count.
+type XClaimOptions struct {
+	Idle       *time.Duration
+	Time       *time.Time
+	RetryCount *int64
+	Force      bool
+	JustID     bool
+}
+
+// claim transfers the pending entry id to consumer if it is idle for at least
+// minIdle, returning false if it was not claimed. Entries deleted from the
+// stream are removed from the pending entries and not claimed.
+func claim(s *db.Stream, g *db.Group, consumer []byte, minIdle time.Duration, id db.StreamID, opts *XClaimOptions, now time.Time) (XMessage, bool, error) {
+	p, pending := g.GetPending(id)
+	entry, exists := s.Get(id)
+	if !pending {
+		if !opts.Force || !exists {
+			return entry, false, nil
+		}
+		p = db.PendingEntry{ID: id, DeliveryMs: now.UnixMilli()}
+	}
+	if !exists {
+		_, err := g.Ack(id)
+		return entry, false, err
+	}
+	if minIdle > 0 && now.UnixMilli()-p.DeliveryMs < minIdle.Milliseconds() {
+		return entry, false, nil
+	}
+	p.Consumer = consumer
+	p.DeliveryMs = now.UnixMilli()
+	if opts.Idle != nil {
+		p.DeliveryMs = now.Add(-*opts.Idle).UnixMilli()
+	}
+	if opts.Time != nil {
+		p.DeliveryMs = opts.Time.UnixMilli()
+	}
+	if !opts.JustID {
+		p.DeliveryCount++
+	}
+	if opts.RetryCount != nil {
+		p.DeliveryCount = *opts.RetryCount
+	}
+	if opts.JustID {
+		entry.Fields = nil
+	}
+	return entry, true, g.SetPending(p)
+}
+
+// XClaim transfers the ownership of pending entries idle for at least
+// minIdle to consumer, and returns the claimed entries.
+func (c *Server) XClaim(ctx context.Context, key []byte, group []byte, consumer []byte, minIdle time.Duration, ids []string, opts *XClaimOptions) ([]XMessage, error) {
+	if opts == nil {
+		opts = &XClaimOptions{}
+	}
+	ctx = withCommand(ctx, "XCLAIM", key, group, consumer, minIdle.Milliseconds(), ids, opts.args())
+	streamIDs, err := parseStreamIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	res := []XMessage{}
+	now := time.Now()
+	err = c.updateGroup(ctx, key, group, func(s *db.Stream, g *db.Group) error {
+		for _, id := range streamIDs {
+			entry, ok, err := claim(s, g, consumer, minIdle, id, opts, now)
+			if err != nil {
+				return err
+			}
+			if ok {
+				res = append(res, entry)
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// XAutoClaim claims up to count pending entries idle for at least minIdle,
+// scanning the pending entries from start. It returns the ID to start the
+// next scan from, "0-0" once the scan is complete, the claimed entries and
+// the IDs of pending entries which were deleted from the stream.
+func (c *Server) XAutoClaim(ctx context.Context, key []byte, group []byte, consumer []byte, minIdle time.Duration, start string, count int64, justID bool) (string, []XMessage, []string, error) {
+	ctx = withCommand(ctx, "XAUTOCLAIM", key, group, consumer, minIdle.Milliseconds(), start, "COUNT", count, flag(justID, "JUSTID"))
+	if count <= 0 {
+		count = 100
+	}
+	startID, ok, err := parseRangeID(start, true)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	next := "0-0"
+	res := []XMessage{}
+	deleted := []string{}
+	if !ok {
+		return next, res, deleted, nil
+	}
+	now := time.Now()
+	err = c.updateGroup(ctx, key, group, func(s *db.Stream, g *db.Group) error {
+		// scan at most count*10 entries, as Redis does
+		pending := g.Pending(startID, db.MaxStreamID, count*10+1, nil, 0)
+		if int64(len(pending)) > count*10 {
+			next = pending[count*10].ID.String()
+			pending = pending[:count*10]
+		}
+		for i, p := range pending {
+			if int64(len(res)) >= count {
+				next = p.ID.String()
+				break
+			}
+			if _, exists := s.Get(p.ID); !exists {
+				_, err := g.Ack(p.ID)
+				if err != nil {
+					return err
+				}
+				deleted = append(deleted, p.ID.String())
+				continue
+			}
+			entry, ok, err := claim(s, g, consumer, minIdle, p.ID, &XClaimOptions{JustID: justID}, now)
+			if err != nil {
+				return err
+			}
+			if ok {
+				res = append(res, entry)
+			}
+			if i == len(pending)-1 && int64(len(pending)) < count*10 {
+				next = "0-0"
+			}
+		}
+		return nil
+	})
+	return next, res, deleted, err
+}
+
+// XInfoStream describes a stream.
+type XInfoStream struct {
+	Length            int64
+	Groups            int64
+	LastGeneratedID   string
+	MaxDeletedEntryID string
+	EntriesAdded      int64
+	FirstEntry        *XMessage
+	LastEntry         *XMessage
+}
+
+// XInfoStream returns information about the stream stored at key.
+func (c *Server) XInfoStream(ctx context.Context, key []byte) (*XInfoStream, error) {
+	var res *XInfoStream
+	err := c.viewStream(ctx, key, func(s *db.Stream) error {
+		res = &XInfoStream{
+			Length:            s.Len(),
+			Groups:            int64(len(s.Groups())),
+			LastGeneratedID:   s.LastID().String(),
+			MaxDeletedEntryID: s.MaxDeletedID().String(),
+			EntriesAdded:      int64(s.EntriesAdded()),
+		}
+		if first, ok := s.First(); ok {
+			res.FirstEntry = &first
+		}
+		if last, ok := s.Last(); ok {
+			res.LastEntry = &last
+		}
+		return nil
+	})
+	if err == nil && res == nil {
+		return nil, fmt.Errorf("ERR no such key")
+	}
+	return res, err
+}
+
+// XInfoGroup describes a consumer group.
+type XInfoGroup struct {
+	Name            string
+	Consumers       int64
+	Pending         int64
+	LastDeliveredID string
+	EntriesRead     int64
+	Lag             int64
+}
+
+// XInfoGroups returns the consumer groups of the stream stored at key.
+func (c *Server) XInfoGroups(ctx context.Context, key []byte) ([]XInfoGroup, error) {
+	res := []XInfoGroup{}
+	err := c.viewStream(ctx, key, func(s *db.Stream) error {
+		for _, g := range s.Groups() {
+			res = append(res, XInfoGroup{
+				Name:            string(g.Name),
+				Consumers:       int64(len(g.Consumers())),
+				Pending:         g.PendingCount(),
+				LastDeliveredID: g.LastID().String(),
+				EntriesRead:     g.EntriesRead(),
+				Lag:             g.Lag(),
+			})
+		}
+		return nil
+	})
+	return res, err
+}
+
+// XInfoConsumer describes a consumer of a group.
+type XInfoConsumer struct {
+	Name    string
+	Pending int64
+	Idle    time.Duration
+}
+
+// XInfoConsumers returns the consumers of a group.
+func (c *Server) XInfoConsumers(ctx context.Context, key []byte, group []byte) ([]XInfoConsumer, error) {
+	res := []XInfoConsumer{}
+	now := time.Now().UnixMilli()
+	err := c.viewGroup(ctx, key, group, func(s *db.Stream, g *db.Group) error {
+		for _, consumer := range g.Consumers() {
+			res = append(res, XInfoConsumer{
+				Name:    string(consumer.Name),
+				Pending: consumer.Pending,
+				Idle:    time.Duration(now-consumer.SeenMs) * time.Millisecond,
+			})
+		}
+		return nil
+	})
+	return res, err
+}
+
+// args returns the options as the trimming arguments of XADD and XTRIM
+func (args *XTrimArgs) args() [][]byte {
+	if args == nil {
+		return nil
+	}
+	res := [][]byte{[]byte("MAXLEN")}
+	threshold := strconv.FormatInt(args.MaxLen, 10)
+	if args.MinID != "" {
+		res, threshold = [][]byte{[]byte("MINID")}, args.MinID
+	}
+	res = append(res, flag(args.Approx, "~")...)
+	res = append(res, []byte(threshold))
+	return append(res, optionalInt("LIMIT", args.Limit)...)
+}
+
+// args returns the arguments of XADD following the key
+func (args *XAddArgs) args() [][]byte {
+	res := flag(args.NoMkStream, "NOMKSTREAM")
+	res = append(res, args.Trim.args()...)
+	id := args.ID
+	if id == "" {
+		id = "*"
+	}
+	res = append(res, []byte(id))
+	return append(res, args.Fields...)
+}
+
+// entriesReadArgs returns the ENTRIESREAD argument of XGROUP if n is set
+func entriesReadArgs(n *int64) [][]byte {
+	if n == nil {
+		return nil
+	}
+	return [][]byte{[]byte("ENTRIESREAD"), []byte(strconv.FormatInt(*n, 10))}
+}
+
+// args returns the arguments of XREADGROUP
+func (args *XReadGroupArgs) args() [][]byte {
+	res := [][]byte{[]byte("GROUP"), args.Group, args.Consumer}
+	res = append(res, optionalInt("COUNT", args.Count)...)
+	res = append(res, flag(args.NoAck, "NOACK")...)
+	res = append(res, []byte("STREAMS"))
+	res = append(res, args.Streams...)
+	for _, id := range args.IDs {
+		res = append(res, []byte(id))
+	}
+	return res
+}
+
+// args returns the options as arguments of XCLAIM
+func (opts *XClaimOptions) args() [][]byte {
+	res := [][]byte{}
+	if opts.Idle != nil {
+		res = append(res, []byte("IDLE"), []byte(strconv.FormatInt(opts.Idle.Milliseconds(), 10)))
+	}
+	if opts.Time != nil {
+		res = append(res, []byte("TIME"), []byte(strconv.FormatInt(opts.Time.UnixMilli(), 10)))
+	}
+	if opts.RetryCount != nil {
+		res = append(res, []byte("RETRYCOUNT"), []byte(strconv.FormatInt(*opts.RetryCount, 10)))
+	}
+	res = append(res, flag(opts.Force, "FORCE")...)
+	return append(res, flag(opts.JustID, "JUSTID")...)
+}
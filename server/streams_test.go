@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func xids(messages []XMessage) []string {
+	ids := []string{}
+	for _, m := range messages {
+		ids = append(ids, m.ID.String())
+	}
+	return ids
+}
+
+func TestStreams(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	id, err := server.XAdd(ctx, key, &XAddArgs{NoMkStream: true, Fields: bytesList("a", "1")})
+	g.Expect(err).To(BeNil())
+	g.Expect(id).To(Equal(""))
+	for _, id := range []string{"1-1", "1-*", "2", "3-0"} {
+		_, err = server.XAdd(ctx, key, &XAddArgs{ID: id, Fields: bytesList("a", "1")})
+		g.Expect(err).To(BeNil())
+	}
+	_, err = server.XAdd(ctx, key, &XAddArgs{ID: "3-0", Fields: bytesList("a", "1")})
+	g.Expect(err).NotTo(BeNil())
+	_, err = server.XAdd(ctx, key, &XAddArgs{ID: "4", Fields: bytesList("a")})
+	g.Expect(err).NotTo(BeNil())
+	id, err = server.XAdd(ctx, key, &XAddArgs{Fields: bytesList("b", "2")})
+	g.Expect(err).To(BeNil())
+
+	n, err := server.XLen(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(5)))
+	res, err := server.XRange(ctx, key, "-", "+")
+	g.Expect(err).To(BeNil())
+	g.Expect(xids(res)).To(Equal([]string{"1-1", "1-2", "2-0", "3-0", id}))
+	g.Expect(res[4].Fields).To(Equal(bytesList("b", "2")))
+	res, err = server.XRangeN(ctx, key, "(1-1", "3", 2)
+	g.Expect(err).To(BeNil())
+	g.Expect(xids(res)).To(Equal([]string{"1-2", "2-0"}))
+	res, err = server.XRevRange(ctx, key, "(3-0", "1")
+	g.Expect(err).To(BeNil())
+	g.Expect(xids(res)).To(Equal([]string{"2-0", "1-2", "1-1"}))
+
+	n, err = server.XDel(ctx, key, "1-2", "9-9")
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(1)))
+	n, err = server.XTrim(ctx, key, &XTrimArgs{MaxLen: 2})
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(2)))
+	_, err = server.XTrim(ctx, key, &XTrimArgs{MaxLen: 2, Limit: 10})
+	g.Expect(err).NotTo(BeNil())
+
+	info, err := server.XInfoStream(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(info.Length).To(Equal(int64(2)))
+	g.Expect(info.EntriesAdded).To(Equal(int64(5)))
+	g.Expect(info.MaxDeletedEntryID).To(Equal("2-0"))
+	g.Expect(info.FirstEntry.ID.String()).To(Equal("3-0"))
+
+	streams, err := server.XRead(ctx, &XReadArgs{Streams: [][]byte{key}, IDs: []string{"3-0"}})
+	g.Expect(err).To(BeNil())
+	g.Expect(len(streams)).To(Equal(1))
+	g.Expect(xids(streams[0].Messages)).To(Equal([]string{id}))
+	streams, err = server.XRead(ctx, &XReadArgs{Streams: [][]byte{key}, IDs: []string{"$"}})
+	g.Expect(err).To(BeNil())
+	g.Expect(streams).To(BeEmpty())
+}
+
+func TestStreamGroups(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+	group := []byte("group")
+
+	err := server.XGroupCreate(ctx, key, group, "$", nil)
+	g.Expect(err).NotTo(BeNil())
+	err = server.XGroupCreate(ctx, key, group, "$", &XGroupCreateArgs{MkStream: true})
+	g.Expect(err).To(BeNil())
+	err = server.XGroupCreate(ctx, key, group, "$", nil)
+	g.Expect(err).NotTo(BeNil())
+	for _, id := range []string{"1", "2", "3"} {
+		_, err = server.XAdd(ctx, key, &XAddArgs{ID: id, Fields: bytesList("f", id)})
+		g.Expect(err).To(BeNil())
+	}
+
+	streams, err := server.XReadGroup(ctx, &XReadGroupArgs{Group: group, Consumer: []byte("alice"), Streams: [][]byte{key}, IDs: []string{">"}, Count: 2})
+	g.Expect(err).To(BeNil())
+	g.Expect(xids(streams[0].Messages)).To(Equal([]string{"1-0", "2-0"}))
+	streams, err = server.XReadGroup(ctx, &XReadGroupArgs{Group: group, Consumer: []byte("bob"), Streams: [][]byte{key}, IDs: []string{">"}})
+	g.Expect(err).To(BeNil())
+	g.Expect(xids(streams[0].Messages)).To(Equal([]string{"3-0"}))
+	streams, err = server.XReadGroup(ctx, &XReadGroupArgs{Group: group, Consumer: []byte("alice"), Streams: [][]byte{key}, IDs: []string{"0"}})
+	g.Expect(err).To(BeNil())
+	g.Expect(xids(streams[0].Messages)).To(Equal([]string{"1-0", "2-0"}))
+
+	pending, err := server.XPending(ctx, key, group)
+	g.Expect(err).To(BeNil())
+	g.Expect(pending.Count).To(Equal(int64(3)))
+	g.Expect(pending.Lower).To(Equal("1-0"))
+	g.Expect(pending.Consumers).To(Equal(map[string]int64{"alice": 2, "bob": 1}))
+
+	n, err := server.XAck(ctx, key, group, "1-0", "9-0")
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(1)))
+
+	ext, err := server.XPendingExt(ctx, key, group, &XPendingExtArgs{Start: "-", End: "+", Count: 10, Consumer: []byte("alice")})
+	g.Expect(err).To(BeNil())
+	g.Expect(len(ext)).To(Equal(1))
+	g.Expect(ext[0].ID).To(Equal("2-0"))
+	g.Expect(ext[0].RetryCount).To(Equal(int64(1)))
+
+	claimed, err := server.XClaim(ctx, key, group, []byte("bob"), time.Hour, []string{"2-0"}, nil)
+	g.Expect(err).To(BeNil())
+	g.Expect(claimed).To(BeEmpty())
+	claimed, err = server.XClaim(ctx, key, group, []byte("bob"), 0, []string{"2-0"}, nil)
+	g.Expect(err).To(BeNil())
+	g.Expect(xids(claimed)).To(Equal([]string{"2-0"}))
+
+	_, err = server.XDel(ctx, key, "3-0")
+	g.Expect(err).To(BeNil())
+	next, claimed, deleted, err := server.XAutoClaim(ctx, key, group, []byte("carol"), 0, "0", 10, false)
+	g.Expect(err).To(BeNil())
+	g.Expect(next).To(Equal("0-0"))
+	g.Expect(xids(claimed)).To(Equal([]string{"2-0"}))
+	g.Expect(deleted).To(Equal([]string{"3-0"}))
+
+	groups, err := server.XInfoGroups(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(len(groups)).To(Equal(1))
+	g.Expect(groups[0].Pending).To(Equal(int64(1)))
+	g.Expect(groups[0].LastDeliveredID).To(Equal("3-0"))
+	g.Expect(groups[0].Consumers).To(Equal(int64(3)))
+	consumers, err := server.XInfoConsumers(ctx, key, group)
+	g.Expect(err).To(BeNil())
+	g.Expect(len(consumers)).To(Equal(3))
+
+	n, err = server.XGroupDelConsumer(ctx, key, group, []byte("carol"))
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(1)))
+	err = server.XGroupSetID(ctx, key, group, "0", nil)
+	g.Expect(err).To(BeNil())
+	n, err = server.XGroupDestroy(ctx, key, group)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(1)))
+	_, err = server.XPending(ctx, key, group)
+	g.Expect(err).NotTo(BeNil())
+}
@@ -2,15 +2,180 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"strconv"
 	"time"
+
+	"github.com/zenozeng/s3dis/db"
 )
 
+// Set sets key to hold value, replacing a value of any type.
 func (c *Server) Set(ctx context.Context, key []byte, value []byte, exp *time.Time) error {
-	return c.db.Set(ctx, []byte(key), func(prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
-		return value, exp, nil
+	if exp != nil {
+		ctx = withCommand(ctx, "SET", key, value, "PXAT", exp.UnixMilli())
+	} else {
+		ctx = withCommand(ctx, "SET", key, value)
+	}
+	return c.db.Update(ctx, key, func(tx *db.Tx) error {
+		return tx.Put(key, value, exp)
 	})
 }
 
+// SetOptions mirrors the options of the Redis SET command.
+//
+// At most one of EX, PX, EXAT, PXAT and KeepTTL may be set, and NX and XX
+// are mutually exclusive. Without any expiration option the TTL of the key
+// is discarded, as in Redis. The expiration options must be positive.
+type SetOptions struct {
+	NX      bool   // only set the key if it does not already exist
+	XX      bool   // only set the key if it already exists
+	Get     bool   // return the old value stored at key
+	EX      *int64 // expire time, in seconds
+	PX      *int64 // expire time, in milliseconds
+	EXAT    *int64 // Unix time at which the key will expire, in seconds
+	PXAT    *int64 // Unix time at which the key will expire, in milliseconds
+	KeepTTL bool   // retain the time to live associated with the key
+}
+
+type SetResult struct {
+	// Applied is false if the NX or XX condition was not met
+	Applied bool
+	// Old is the previous value, only filled in when SetOptions.Get is true
+	Old []byte
+}
+
+var errInvalidSetExpireTime = fmt.Errorf("ERR invalid expire time in 'set' command")
+
+// expiration returns the absolute expiration described by the options,
+// relative to now. It returns nil if no expiration option is given.
+func (opts *SetOptions) expiration(now time.Time) (*time.Time, error) {
+	n := 0
+	var exp time.Time
+	var val int64
+	if opts.EX != nil {
+		n++
+		val = *opts.EX
+		exp = now.Add(time.Duration(val) * time.Second)
+	}
+	if opts.PX != nil {
+		n++
+		val = *opts.PX
+		exp = now.Add(time.Duration(val) * time.Millisecond)
+	}
+	if opts.EXAT != nil {
+		n++
+		val = *opts.EXAT
+		exp = time.Unix(val, 0)
+	}
+	if opts.PXAT != nil {
+		n++
+		val = *opts.PXAT
+		exp = time.UnixMilli(val)
+	}
+	if opts.KeepTTL && n > 0 || n > 1 || opts.NX && opts.XX {
+		return nil, errSyntax
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if val <= 0 {
+		return nil, errInvalidSetExpireTime
+	}
+	return &exp, nil
+}
+
+// args returns the options as arguments of SET
+func (opts *SetOptions) args() [][]byte {
+	args := [][]byte{}
+	flags := []struct {
+		set  bool
+		name string
+	}{{opts.NX, "NX"}, {opts.XX, "XX"}, {opts.Get, "GET"}, {opts.KeepTTL, "KEEPTTL"}}
+	for _, flag := range flags {
+		if flag.set {
+			args = append(args, []byte(flag.name))
+		}
+	}
+	ttls := []struct {
+		val  *int64
+		name string
+	}{{opts.EX, "EX"}, {opts.PX, "PX"}, {opts.EXAT, "EXAT"}, {opts.PXAT, "PXAT"}}
+	for _, ttl := range ttls {
+		if ttl.val != nil {
+			args = append(args, []byte(ttl.name), []byte(strconv.FormatInt(*ttl.val, 10)))
+		}
+	}
+	return args
+}
+
+// SetWithOptions sets key to hold value according to the Redis SET options.
+func (c *Server) SetWithOptions(ctx context.Context, key []byte, value []byte, opts *SetOptions) (*SetResult, error) {
+	if opts == nil {
+		opts = &SetOptions{}
+	}
+	ctx = withCommand(ctx, "SET", key, value, opts.args())
+	exp, err := opts.expiration(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	res := &SetResult{}
+	err = c.update(ctx, key, func(tx *db.Tx) error {
+		typ, err := tx.Type(key)
+		if err != nil {
+			return err
+		}
+		exists := typ != db.TypeNone
+		if opts.Get && exists {
+			res.Old, _, err = tx.Get(key)
+			if err != nil {
+				return err
+			}
+		}
+		if opts.NX && exists || opts.XX && !exists {
+			return errNoop
+		}
+		res.Applied = true
+		if opts.KeepTTL {
+			exp, err = tx.Expiration(key)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Put(key, value, exp)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// IncrBy increments the integer stored at key by increment and returns the
+// new value, a missing key counts as 0. The expiration of key is kept.
+func (c *Server) IncrBy(ctx context.Context, key []byte, increment int64) (int64, error) {
+	ctx = withCommand(ctx, "INCRBY", key, increment)
+	n := int64(0)
+	err := c.update(ctx, key, func(tx *db.Tx) error {
+		tx.Notify(db.EventString, "incrby", key)
+		return tx.Set(key, func(prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
+			n = 0
+			if prevVal != nil {
+				var err error
+				n, err = parseInt(prevVal)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			if increment > 0 && n > math.MaxInt64-increment || increment < 0 && n < math.MinInt64-increment {
+				return nil, nil, fmt.Errorf("ERR increment or decrement would overflow")
+			}
+			n += increment
+			return strconv.AppendInt(nil, n, 10), prevExp, nil
+		})
+	})
+	return n, err
+}
+
 func (c *Server) Get(ctx context.Context, key []byte) ([]byte, error) {
 	val, _, err := c.db.Get(ctx, []byte(key))
 	if err != nil {
@@ -18,3 +183,38 @@ func (c *Server) Get(ctx context.Context, key []byte) ([]byte, error) {
 	}
 	return val, err
 }
+
+// MGet returns the values of keys in request order, missing keys have nil values.
+func (c *Server) MGet(ctx context.Context, keys [][]byte) ([][]byte, error) {
+	return c.db.MGet(ctx, keys)
+}
+
+// MSet sets keys to values, discarding any previous TTL.
+func (c *Server) MSet(ctx context.Context, keys [][]byte, values [][]byte) error {
+	if len(keys) != len(values) {
+		return fmt.Errorf("wrong number of arguments for 'mset' command")
+	}
+	ctx = withCommand(ctx, "MSET", pairs(keys, values))
+	return c.db.MSet(ctx, keys, func(i int, prevVal []byte, prevExp *time.Time) ([]byte, *time.Time, error) {
+		return values[i], nil, nil
+	})
+}
+
+// MSetNX sets keys to values only if none of them exists, it reports whether
+// the keys were set.
+func (c *Server) MSetNX(ctx context.Context, keys [][]byte, values [][]byte) (bool, error) {
+	if len(keys) != len(values) {
+		return false, fmt.Errorf("wrong number of arguments for 'msetnx' command")
+	}
+	ctx = withCommand(ctx, "MSETNX", pairs(keys, values))
+	return c.db.MSetNX(ctx, keys, values)
+}
+
+// pairs interleaves keys and values like the arguments of MSET
+func pairs(keys [][]byte, values [][]byte) [][]byte {
+	args := make([][]byte, 0, 2*len(keys))
+	for i := range keys {
+		args = append(args, keys[i], values[i])
+	}
+	return args
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -24,3 +25,102 @@ func TestStrings(t *testing.T) {
 	g.Expect(err).To(BeNil())
 	g.Expect(string(val)).To(Equal(val2))
 }
+
+func TestSetWithOptions(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	// XX on a missing key is not applied
+	res, err := server.SetWithOptions(ctx, key, []byte("a"), &SetOptions{XX: true})
+	g.Expect(err).To(BeNil())
+	g.Expect(res.Applied).To(Equal(false))
+
+	// NX on a missing key is applied
+	ex := int64(100)
+	res, err = server.SetWithOptions(ctx, key, []byte("a"), &SetOptions{NX: true, EX: &ex})
+	g.Expect(err).To(BeNil())
+	g.Expect(res.Applied).To(Equal(true))
+
+	// NX on an existing key is not applied, GET returns the old value
+	res, err = server.SetWithOptions(ctx, key, []byte("b"), &SetOptions{NX: true, Get: true})
+	g.Expect(err).To(BeNil())
+	g.Expect(res.Applied).To(Equal(false))
+	g.Expect(string(res.Old)).To(Equal("a"))
+
+	// KEEPTTL keeps the expiration
+	res, err = server.SetWithOptions(ctx, key, []byte("b"), &SetOptions{XX: true, KeepTTL: true, Get: true})
+	g.Expect(err).To(BeNil())
+	g.Expect(res.Applied).To(Equal(true))
+	g.Expect(string(res.Old)).To(Equal("a"))
+	_, exp, err := server.db.Get(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(exp).NotTo(BeNil())
+
+	// without expiration options the TTL is discarded
+	_, err = server.SetWithOptions(ctx, key, []byte("c"), nil)
+	g.Expect(err).To(BeNil())
+	_, exp, err = server.db.Get(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(exp).To(BeNil())
+
+	// PXAT in the past expires the key immediately
+	pxat := time.Now().Add(-time.Second).UnixMilli()
+	_, err = server.SetWithOptions(ctx, key, []byte("d"), &SetOptions{PXAT: &pxat})
+	g.Expect(err).To(BeNil())
+	val, err := server.Get(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(val).To(BeEmpty())
+
+	// conflicting options
+	_, err = server.SetWithOptions(ctx, key, []byte("e"), &SetOptions{EX: &ex, KeepTTL: true})
+	g.Expect(err).To(Equal(errSyntax))
+	_, err = server.SetWithOptions(ctx, key, []byte("e"), &SetOptions{NX: true, XX: true})
+	g.Expect(err).NotTo(BeNil())
+
+	// an explicit zero or negative expiration is rejected
+	for _, ttl := range []int64{0, -1} {
+		ttl := ttl
+		_, err = server.SetWithOptions(ctx, key, []byte("f"), &SetOptions{EX: &ttl})
+		g.Expect(err).To(Equal(errInvalidSetExpireTime))
+	}
+	_, err = server.SetWithOptions(ctx, key, []byte("f"), &SetOptions{PX: new(int64)})
+	g.Expect(err).To(Equal(errInvalidSetExpireTime))
+}
+
+func TestMSetMGet(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	keys := [][]byte{}
+	values := [][]byte{}
+	for i := 0; i < 50; i++ {
+		keys = append(keys, []byte(uuid.NewString()))
+		values = append(values, []byte(uuid.NewString()))
+	}
+	res, err := server.MGet(ctx, keys)
+	g.Expect(err).To(BeNil())
+	g.Expect(res).To(Equal(make([][]byte, len(keys))))
+
+	err = server.MSet(ctx, keys, values)
+	g.Expect(err).To(BeNil())
+	res, err = server.MGet(ctx, keys)
+	g.Expect(err).To(BeNil())
+	g.Expect(res).To(Equal(values))
+
+	// MSETNX is not applied if any key exists
+	missing := []byte(uuid.NewString())
+	ok, err := server.MSetNX(ctx, [][]byte{missing, keys[0]}, [][]byte{[]byte("a"), []byte("b")})
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(false))
+	res, err = server.MGet(ctx, [][]byte{missing, keys[0]})
+	g.Expect(err).To(BeNil())
+	g.Expect(res).To(Equal([][]byte{nil, values[0]}))
+
+	other := []byte(uuid.NewString())
+	ok, err = server.MSetNX(ctx, [][]byte{missing, other}, [][]byte{[]byte("a"), []byte("b")})
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(true))
+	res, err = server.MGet(ctx, [][]byte{missing, other})
+	g.Expect(err).To(BeNil())
+	g.Expect(res).To(Equal([][]byte{[]byte("a"), []byte("b")}))
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// trackingChannel is the channel on which the invalidations redirected to a
+// RESP2 connection are published, like in Redis
+const trackingChannel = "__redis__:invalidate"
+
+// trackingOptions are the options of CLIENT TRACKING ON
+type trackingOptions struct {
+	redirect int64 // id of the connection receiving the invalidations, 0 for itself
+	// bcast invalidates the keys matching prefixes, all keys without
+	// prefixes, rather than the keys read by the connection
+	bcast    bool
+	prefixes [][]byte
+}
+
+// tracked is a connection with CLIENT TRACKING on
+type tracked struct {
+	opts *trackingOptions
+	keys map[string]bool // keys read since their last invalidation
+}
+
+// tracking holds the keys read by the connections of this process with
+// CLIENT TRACKING on, so that their client side caches are invalidated when
+// the keys are written. Like in Redis, keys are tracked by name whatever
+// their logical database, and a key read is only invalidated once.
+type tracking struct {
+	mu      sync.Mutex
+	keys    map[string]map[*client]bool
+	clients map[*client]*tracked
+}
+
+func newTracking() *tracking {
+	return &tracking{keys: map[string]map[*client]bool{}, clients: map[*client]*tracked{}}
+}
+
+// enable starts tracking the keys read by cl, or the keys matching the
+// prefixes of opts in BCAST mode
+func (t *tracking) enable(cl *client, opts *trackingOptions) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if prev := t.clients[cl]; prev != nil {
+		prev.opts = opts
+		return
+	}
+	t.clients[cl] = &tracked{opts: opts, keys: map[string]bool{}}
+}
+
+// disable stops tracking cl, when it turns tracking off or disconnects
+func (t *tracking) disable(cl *client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tc := t.clients[cl]
+	if tc == nil {
+		return
+	}
+	for key := range tc.keys {
+		t.forget(cl, key)
+	}
+	delete(t.clients, cl)
+}
+
+// forget stops tracking a key read by cl, the caller must hold mu
+func (t *tracking) forget(cl *client, key string) {
+	delete(t.keys[key], cl)
+	if len(t.keys[key]) == 0 {
+		delete(t.keys, key)
+	}
+}
+
+// track records the keys read by a command of cl
+func (t *tracking) track(cl *client, keys [][]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tc := t.clients[cl]
+	if tc == nil || tc.opts.bcast {
+		return
+	}
+	for _, key := range keys {
+		tc.keys[string(key)] = true
+		if t.keys[string(key)] == nil {
+			t.keys[string(key)] = map[*client]bool{}
+		}
+		t.keys[string(key)][cl] = true
+	}
+}
+
+// invalidation is an invalidation message due to a connection
+type invalidation struct {
+	cl   *client
+	opts *trackingOptions
+}
+
+// written returns the invalidations of a write to key
+func (t *tracking) written(key []byte) []invalidation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := []invalidation{}
+	for cl := range t.keys[string(key)] {
+		tc := t.clients[cl]
+		delete(tc.keys, string(key))
+		res = append(res, invalidation{cl, tc.opts})
+	}
+	delete(t.keys, string(key))
+	for cl, tc := range t.clients {
+		if tc.opts.bcast && matchPrefixes(tc.opts.prefixes, key) {
+			res = append(res, invalidation{cl, tc.opts})
+		}
+	}
+	return res
+}
+
+// flushed returns the invalidations of FLUSHDB and FLUSHALL, which
+// invalidate the keys of every connection
+func (t *tracking) flushed() []invalidation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := []invalidation{}
+	for cl, tc := range t.clients {
+		tc.keys = map[string]bool{}
+		res = append(res, invalidation{cl, tc.opts})
+	}
+	t.keys = map[string]map[*client]bool{}
+	return res
+}
+
+func matchPrefixes(prefixes [][]byte, key []byte) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidate sends the invalidation of keys, nil for every key, to the
+// connection receiving the invalidations of inv.cl: a push message if it
+// speaks RESP3, otherwise a message of trackingChannel if it subscribed to
+// it. Invalidations redirected to a connection which is gone are dropped.
+func (c *Server) invalidate(inv invalidation, keys [][]byte) {
+	target := inv.cl
+	if inv.opts.redirect != 0 {
+		target = c.clients.get(inv.opts.redirect)
+		if target == nil {
+			return
+		}
+	}
+	writeKeys := func(w *respWriter) {
+		if keys == nil {
+			w.writeNullArray()
+			return
+		}
+		w.writeBulks(keys)
+	}
+	if target.resp3() {
+		target.send(func(w *respWriter) {
+			w.writePush(2)
+			w.writeBulk([]byte("invalidate"))
+			writeKeys(w)
+		})
+		return
+	}
+	c.pubsub.mu.RLock()
+	subscribed := c.pubsub.subscribers[channelSubscription][trackingChannel][target]
+	c.pubsub.mu.RUnlock()
+	if subscribed {
+		target.send(func(w *respWriter) {
+			w.writePush(3)
+			w.writeBulk([]byte("message"))
+			w.writeBulk([]byte(trackingChannel))
+			writeKeys(w)
+		})
+	}
+}
+
+// invalidateKey invalidates the caches of the connections tracking key
+func (c *Server) invalidateKey(key []byte) {
+	for _, inv := range c.tracking.written(key) {
+		c.invalidate(inv, [][]byte{key})
+	}
+}
+
+// invalidateAll invalidates the caches of every tracking connection
+func (c *Server) invalidateAll() {
+	for _, inv := range c.tracking.flushed() {
+		c.invalidate(inv, nil)
+	}
+}
+
+// flushed invalidates the caches once a FLUSHDB or FLUSHALL succeeded, and
+// forwards the flush to the other processes for their connections
+func (c *Server) flushed(ctx context.Context) {
+	c.invalidateAll()
+	if c.pubsub.fanout != nil {
+		c.pubsub.fanout.send(ctx, [][]byte{[]byte("s3dis.invalidate")})
+	}
+}
+
+// cmdInvalidate implements S3DIS.INVALIDATE [key], sent by the other
+// processes when they write a key, or flush without key, which invalidates
+// the caches of the connections of this process. Like the other messages of
+// the fan-out, it is best effort.
+func cmdInvalidate(c *Server, ctx context.Context, cl *client, args [][]byte) error {
+	switch len(args) {
+	case 0:
+		c.invalidateAll()
+	case 1:
+		c.invalidateKey(args[0])
+	default:
+		return fmt.Errorf("ERR wrong number of arguments for 's3dis.invalidate' command")
+	}
+	cl.w.writeSimple("OK")
+	return nil
+}
+
+// parseTracking parses the options of CLIENT TRACKING ON following ON.
+// OPTIN, OPTOUT and NOLOOP are not supported.
+func parseTracking(c *Server, args [][]byte) (*trackingOptions, error) {
+	opts := &trackingOptions{}
+	for i := 0; i < len(args); i++ {
+		switch opt := strings.ToLower(string(args[i])); {
+		case opt == "redirect" && i+1 < len(args):
+			id, err := parseInt(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			if c.clients.get(id) == nil {
+				return nil, fmt.Errorf("ERR The client ID you want redirect to does not exist")
+			}
+			opts.redirect = id
+			i++
+		case opt == "bcast":
+			opts.bcast = true
+		case opt == "prefix" && i+1 < len(args):
+			opts.prefixes = append(opts.prefixes, args[i+1])
+			i++
+		case opt == "optin" || opt == "optout" || opt == "noloop":
+			return nil, fmt.Errorf("ERR CLIENT TRACKING %s is not supported", strings.ToUpper(opt))
+		default:
+			return nil, errSyntax
+		}
+	}
+	if len(opts.prefixes) > 0 && !opts.bcast {
+		return nil, fmt.Errorf("ERR PREFIX option requires BCAST mode to be enabled")
+	}
+	return opts, nil
+}
+
+// clientTracking implements CLIENT TRACKING ON|OFF [options]
+func (c *Server) clientTracking(cl *client, args [][]byte) error {
+	switch strings.ToLower(string(args[0])) {
+	case "on":
+		opts, err := parseTracking(c, args[1:])
+		if err != nil {
+			return err
+		}
+		if cl.tracking != nil && cl.tracking.bcast != opts.bcast {
+			return fmt.Errorf("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+		}
+		cl.tracking = opts
+		c.tracking.enable(cl, opts)
+	case "off":
+		cl.tracking = nil
+		c.tracking.disable(cl)
+	default:
+		return errSyntax
+	}
+	cl.w.writeSimple("OK")
+	return nil
+}
+
+// writeTrackingInfo replies CLIENT TRACKINGINFO
+func (cl *client) writeTrackingInfo() {
+	flags := [][]byte{[]byte("off")}
+	redirect := int64(-1)
+	var prefixes [][]byte
+	if opts := cl.tracking; opts != nil {
+		flags = [][]byte{[]byte("on")}
+		if opts.bcast {
+			flags = append(flags, []byte("bcast"))
+		}
+		redirect = opts.redirect
+		prefixes = opts.prefixes
+	}
+	cl.w.writeMap(3)
+	cl.w.writeBulk([]byte("flags"))
+	cl.w.writeSet(len(flags))
+	for _, flag := range flags {
+		cl.w.writeBulk(flag)
+	}
+	cl.w.writeBulk([]byte("redirect"))
+	cl.w.writeInt(redirect)
+	cl.w.writeBulk([]byte("prefixes"))
+	cl.w.writeBulks(prefixes)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestServeTracking(t *testing.T) {
+	g := NewWithT(t)
+	addr := listen(t, server)
+	send, receive := connect(t, addr)
+	do := func(args ...string) interface{} {
+		send(args...)
+		return receive()
+	}
+	writer, writerReceive := connect(t, addr)
+	write := func(args ...string) {
+		writer(args...)
+		writerReceive()
+	}
+	key := uuid.NewString()
+	other := uuid.NewString()
+
+	do("HELLO", "3")
+	g.Expect(do("CLIENT", "TRACKING", "on", "PREFIX", "a")).To(Equal(fmt.Errorf("ERR PREFIX option requires BCAST mode to be enabled")))
+	g.Expect(do("CLIENT", "TRACKING", "on", "REDIRECT", "999999")).To(Equal(fmt.Errorf("ERR The client ID you want redirect to does not exist")))
+	g.Expect(do("CLIENT", "TRACKING", "on", "NOLOOP")).To(Equal(fmt.Errorf("ERR CLIENT TRACKING NOLOOP is not supported")))
+	g.Expect(do("CLIENT", "TRACKING", "on")).To(Equal("OK"))
+	g.Expect(do("CLIENT", "TRACKINGINFO")).To(Equal(map[string]interface{}{
+		"flags": respSet{"on"}, "redirect": int64(0), "prefixes": []interface{}{},
+	}))
+
+	// keys read are invalidated once when written
+	g.Expect(do("GET", key)).To(BeNil())
+	write("SET", other, "x")
+	write("SET", key, "a")
+	g.Expect(receive()).To(Equal(respPush{"invalidate", []interface{}{key}}))
+	write("SET", key, "b")
+	g.Expect(do("GET", key)).To(Equal("b"))
+	write("SET", key, "c")
+	g.Expect(receive()).To(Equal(respPush{"invalidate", []interface{}{key}}))
+
+	// BCAST invalidates the keys matching the prefixes, read or not
+	g.Expect(do("CLIENT", "TRACKING", "on", "BCAST")).To(Equal(fmt.Errorf("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")))
+	g.Expect(do("CLIENT", "TRACKING", "off")).To(Equal("OK"))
+	g.Expect(do("CLIENT", "TRACKING", "on", "BCAST", "PREFIX", key)).To(Equal("OK"))
+	write("SET", other, "y")
+	write("SET", key+":1", "a")
+	g.Expect(receive()).To(Equal(respPush{"invalidate", []interface{}{key + ":1"}}))
+	g.Expect(do("CLIENT", "TRACKING", "off")).To(Equal("OK"))
+}
+
+func TestServeTrackingRedirect(t *testing.T) {
+	g := NewWithT(t)
+	addr := listen(t, server)
+	send, receive := connect(t, addr)
+	do := func(args ...string) interface{} {
+		send(args...)
+		return receive()
+	}
+	target, targetReceive := connect(t, addr)
+	writer, writerReceive := connect(t, addr)
+	key := uuid.NewString()
+
+	// RESP2 connections receive the invalidations on __redis__:invalidate
+	target("CLIENT", "ID")
+	id := targetReceive().(int64)
+	target("SUBSCRIBE", trackingChannel)
+	g.Expect(targetReceive()).To(Equal([]interface{}{"subscribe", trackingChannel, int64(1)}))
+	g.Expect(do("CLIENT", "TRACKING", "on", "REDIRECT", fmt.Sprint(id))).To(Equal("OK"))
+	g.Expect(do("CLIENT", "GETREDIR")).To(Equal(id))
+	g.Expect(do("GET", key)).To(BeNil())
+	writer("SET", key, "a")
+	g.Expect(writerReceive()).To(Equal("OK"))
+	g.Expect(targetReceive()).To(Equal([]interface{}{"message", trackingChannel, []interface{}{key}}))
+
+	// flushes invalidate every key, like those forwarded by other processes
+	g.Expect(do("GET", key)).To(Equal("a"))
+	peer, peerReceive := connect(t, listenPeers(t, server))
+	peer("S3DIS.INVALIDATE")
+	g.Expect(peerReceive()).To(Equal("OK"))
+	g.Expect(targetReceive()).To(Equal([]interface{}{"message", trackingChannel, nil}))
+}
@@ -0,0 +1,861 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenozeng/s3dis/db"
+)
+
+// Z is a member of a sorted set with its score.
+type Z = db.Z
+
+// ZAddOptions mirrors the options of the Redis ZADD command.
+type ZAddOptions struct {
+	NX bool // only add new members
+	XX bool // only update existing members
+	GT bool // only update existing members if the new score is greater
+	LT bool // only update existing members if the new score is lower
+	CH bool // count changed members, not only added ones
+}
+
+func (opts *ZAddOptions) validate() error {
+	if opts.NX && opts.XX {
+		return fmt.Errorf("ERR XX and NX options at the same time are not compatible")
+	}
+	if opts.NX && (opts.GT || opts.LT) || opts.GT && opts.LT {
+		return fmt.Errorf("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	return nil
+}
+
+// zadd adds or updates members of the sorted set stored at key, adding the
+// scores to the current ones if incr is true. It returns the number of added
+// and changed members, and the last resulting score.
+func zadd(tx *db.Tx, key []byte, opts *ZAddOptions, incr bool, members []Z) (int64, int64, *float64, error) {
+	z, err := tx.OpenZSet(key, true)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	added := int64(0)
+	changed := int64(0)
+	var last *float64
+	for _, m := range members {
+		cur, exists := z.Score(m.Member)
+		if opts.NX && exists || opts.XX && !exists {
+			continue
+		}
+		score := m.Score
+		if incr {
+			score += cur
+		}
+		if math.IsNaN(score) {
+			return 0, 0, nil, fmt.Errorf("resulting score is not a number (NaN)")
+		}
+		if exists && (opts.GT && score <= cur || opts.LT && score >= cur) {
+			continue
+		}
+		ok, err := z.Add(m.Member, score)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if ok {
+			added++
+		} else if score != cur {
+			changed++
+		}
+		last = &score
+	}
+	if last != nil {
+		event := "zadd"
+		if incr {
+			event = "zincr"
+		}
+		tx.Notify(db.EventZSet, event, key)
+	}
+	return added, changed, last, nil
+}
+
+// ZAdd adds members to the sorted set stored at key, or updates their scores.
+// It returns the number of added members, or of added and changed members if
+// opts.CH is set.
+func (c *Server) ZAdd(ctx context.Context, key []byte, opts *ZAddOptions, members ...Z) (int64, error) {
+	if opts == nil {
+		opts = &ZAddOptions{}
+	}
+	ctx = withCommand(ctx, "ZADD", key, opts.args(), scoreMembers(members))
+	err := opts.validate()
+	if err != nil {
+		return 0, err
+	}
+	n := int64(0)
+	err = c.update(ctx, key, func(tx *db.Tx) error {
+		added, changed, _, err := zadd(tx, key, opts, false, members)
+		if err != nil {
+			return err
+		}
+		if added+changed == 0 {
+			return errNoop
+		}
+		n = added
+		if opts.CH {
+			n += changed
+		}
+		return nil
+	})
+	return n, err
+}
+
+// ZAddIncr is ZADD with the INCR option: it increments the score of member
+// and returns the new score, or false if the options prevented the update.
+func (c *Server) ZAddIncr(ctx context.Context, key []byte, opts *ZAddOptions, member Z) (float64, bool, error) {
+	if opts == nil {
+		opts = &ZAddOptions{}
+	}
+	ctx = withCommand(ctx, "ZADD", key, opts.args(), "INCR", scoreMembers([]Z{member}))
+	err := opts.validate()
+	if err != nil {
+		return 0, false, err
+	}
+	var score *float64
+	err = c.update(ctx, key, func(tx *db.Tx) error {
+		var err error
+		_, _, score, err = zadd(tx, key, opts, true, []Z{member})
+		if err == nil && score == nil {
+			return errNoop
+		}
+		return err
+	})
+	if err != nil || score == nil {
+		return 0, false, err
+	}
+	return *score, true, nil
+}
+
+// ZIncrBy increments the score of member in the sorted set stored at key and
+// returns the new score.
+func (c *Server) ZIncrBy(ctx context.Context, key []byte, increment float64, member []byte) (float64, error) {
+	ctx = withCommand(ctx, "ZINCRBY", key, increment, member)
+	score, _, err := c.ZAddIncr(ctx, key, nil, Z{Score: increment, Member: member})
+	return score, err
+}
+
+// viewZSet runs fn with the sorted set stored at key, fn is not called if
+// the key does not exist
+func (c *Server) viewZSet(ctx context.Context, key []byte, fn func(z *db.ZSet) error) error {
+	return c.db.View(ctx, key, func(tx *db.Tx) error {
+		z, err := tx.OpenZSet(key, false)
+		if err != nil || z == nil {
+			return err
+		}
+		return fn(z)
+	})
+}
+
+// updateZSet runs fn with the sorted set stored at key in a read-write
+// transaction, nothing is written if the key does not exist
+func (c *Server) updateZSet(ctx context.Context, key []byte, fn func(z *db.ZSet) error) error {
+	return c.update(ctx, key, func(tx *db.Tx) error {
+		z, err := tx.OpenZSet(key, false)
+		if err != nil {
+			return err
+		}
+		if z == nil {
+			return errNoop
+		}
+		return fn(z)
+	})
+}
+
+// ZCard returns the number of members of the sorted set stored at key.
+func (c *Server) ZCard(ctx context.Context, key []byte) (int64, error) {
+	n := int64(0)
+	err := c.viewZSet(ctx, key, func(z *db.ZSet) error {
+		n = z.Len()
+		return nil
+	})
+	return n, err
+}
+
+// ZScore returns the score of member, or false if it is not a member.
+func (c *Server) ZScore(ctx context.Context, key []byte, member []byte) (float64, bool, error) {
+	scores, err := c.ZMScore(ctx, key, member)
+	if err != nil || scores[0] == nil {
+		return 0, false, err
+	}
+	return *scores[0], true, nil
+}
+
+// ZMScore returns the scores of members, nil for non-members.
+func (c *Server) ZMScore(ctx context.Context, key []byte, members ...[]byte) ([]*float64, error) {
+	scores := make([]*float64, len(members))
+	err := c.viewZSet(ctx, key, func(z *db.ZSet) error {
+		for i, member := range members {
+			if score, ok := z.Score(member); ok {
+				scores[i] = &score
+			}
+		}
+		return nil
+	})
+	return scores, err
+}
+
+func (c *Server) zrank(ctx context.Context, key []byte, member []byte, rev bool) (int64, bool, error) {
+	rank := int64(0)
+	ok := false
+	err := c.viewZSet(ctx, key, func(z *db.ZSet) error {
+		rank, ok = z.Rank(member, rev)
+		return nil
+	})
+	return rank, ok, err
+}
+
+// ZRank returns the rank of member from the lowest score, or false if it is
+// not a member.
+func (c *Server) ZRank(ctx context.Context, key []byte, member []byte) (int64, bool, error) {
+	return c.zrank(ctx, key, member, false)
+}
+
+// ZRevRank returns the rank of member from the highest score, or false if it
+// is not a member.
+func (c *Server) ZRevRank(ctx context.Context, key []byte, member []byte) (int64, bool, error) {
+	return c.zrank(ctx, key, member, true)
+}
+
+// ZRem removes members from the sorted set stored at key and returns the
+// number of removed members.
+func (c *Server) ZRem(ctx context.Context, key []byte, members ...[]byte) (int64, error) {
+	ctx = withCommand(ctx, "ZREM", key, members)
+	n := int64(0)
+	err := c.updateZSet(ctx, key, func(z *db.ZSet) error {
+		var err error
+		n, err = z.Rem(members...)
+		if err == nil && n == 0 {
+			return errNoop
+		}
+		return err
+	})
+	return n, err
+}
+
+// parseScoreBound parses a score bound such as 1.5, (1.5, -inf or +inf
+func parseScoreBound(s string) (db.ScoreBound, error) {
+	b := db.ScoreBound{}
+	if strings.HasPrefix(s, "(") {
+		b.Exclusive = true
+		s = s[1:]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) {
+		return b, fmt.Errorf("min or max is not a float")
+	}
+	b.Value = v
+	return b, nil
+}
+
+// parseLexBound parses a lexicographical bound such as [a, (a, - or +
+func parseLexBound(s string) (db.LexBound, error) {
+	switch {
+	case s == "-":
+		return db.LexBound{Inf: -1}, nil
+	case s == "+":
+		return db.LexBound{Inf: 1}, nil
+	case strings.HasPrefix(s, "["):
+		return db.LexBound{Value: []byte(s[1:])}, nil
+	case strings.HasPrefix(s, "("):
+		return db.LexBound{Value: []byte(s[1:]), Exclusive: true}, nil
+	}
+	return db.LexBound{}, fmt.Errorf("min or max not valid string range item")
+}
+
+// ZRangeOptions mirrors the options of the Redis ZRANGE command.
+type ZRangeOptions struct {
+	ByScore bool
+	ByLex   bool
+	Rev     bool
+	// Limit enables Offset and Count, a negative Count returns all members
+	// after Offset
+	Limit  bool
+	Offset int64
+	Count  int64
+}
+
+// zrange returns the range of z described by start, stop and opts, z may be
+// nil for a missing key
+func zrange(z *db.ZSet, start, stop string, opts *ZRangeOptions) ([]Z, error) {
+	if opts.ByScore && opts.ByLex {
+		return nil, fmt.Errorf("syntax error")
+	}
+	offset, count := int64(0), int64(-1)
+	if opts.Limit {
+		if !opts.ByScore && !opts.ByLex {
+			return nil, fmt.Errorf("syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+		}
+		offset, count = opts.Offset, opts.Count
+		if offset < 0 {
+			return []Z{}, nil
+		}
+	}
+	min, max := start, stop
+	if opts.Rev {
+		min, max = stop, start
+	}
+	switch {
+	case opts.ByScore:
+		minBound, err := parseScoreBound(min)
+		if err != nil {
+			return nil, err
+		}
+		maxBound, err := parseScoreBound(max)
+		if err != nil {
+			return nil, err
+		}
+		if z == nil {
+			return []Z{}, nil
+		}
+		return z.RangeByScore(minBound, maxBound, opts.Rev, offset, count), nil
+	case opts.ByLex:
+		minBound, err := parseLexBound(min)
+		if err != nil {
+			return nil, err
+		}
+		maxBound, err := parseLexBound(max)
+		if err != nil {
+			return nil, err
+		}
+		if z == nil {
+			return []Z{}, nil
+		}
+		return z.RangeByLex(minBound, maxBound, opts.Rev, offset, count), nil
+	}
+	startRank, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("value is not an integer or out of range")
+	}
+	stopRank, err := strconv.ParseInt(stop, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("value is not an integer or out of range")
+	}
+	if z == nil {
+		return []Z{}, nil
+	}
+	return z.RangeByRank(startRank, stopRank, opts.Rev), nil
+}
+
+// ZRange returns the members of the sorted set stored at key between start
+// and stop, which are ranks, scores or lexicographical bounds depending on
+// opts, with the semantics of ZRANGE.
+func (c *Server) ZRange(ctx context.Context, key []byte, start, stop string, opts *ZRangeOptions) ([]Z, error) {
+	if opts == nil {
+		opts = &ZRangeOptions{}
+	}
+	res := []Z{}
+	err := c.db.View(ctx, key, func(tx *db.Tx) error {
+		z, err := tx.OpenZSet(key, false)
+		if err != nil {
+			return err
+		}
+		res, err = zrange(z, start, stop, opts)
+		return err
+	})
+	return res, err
+}
+
+// ZRangeStore is like ZRange but stores the result in destination, replacing
+// any value, and returns its size.
+func (c *Server) ZRangeStore(ctx context.Context, destination []byte, source []byte, start, stop string, opts *ZRangeOptions) (int64, error) {
+	if opts == nil {
+		opts = &ZRangeOptions{}
+	}
+	ctx = withCommand(ctx, "ZRANGESTORE", destination, source, start, stop, opts.args())
+	n := int64(0)
+	err := c.updateKeys(ctx, [][]byte{destination, source}, func(m *db.MultiTx) error {
+		z, err := m.Tx(source).OpenZSet(source, false)
+		if err != nil {
+			return err
+		}
+		res, err := zrange(z, start, stop, opts)
+		if err != nil {
+			return err
+		}
+		n = int64(len(res))
+		return storeZ(m.Tx(destination), destination, res)
+	})
+	return n, err
+}
+
+// storeZ replaces the value of key with a sorted set of members
+func storeZ(tx *db.Tx, key []byte, members []Z) error {
+	_, err := tx.Delete(key)
+	if err != nil || len(members) == 0 {
+		return err
+	}
+	_, _, _, err = zadd(tx, key, &ZAddOptions{}, false, members)
+	return err
+}
+
+// ZCount returns the number of members with scores between min and max.
+func (c *Server) ZCount(ctx context.Context, key []byte, min, max string) (int64, error) {
+	res, err := c.ZRange(ctx, key, min, max, &ZRangeOptions{ByScore: true})
+	return int64(len(res)), err
+}
+
+// ZLexCount returns the number of members between min and max in
+// lexicographical order.
+func (c *Server) ZLexCount(ctx context.Context, key []byte, min, max string) (int64, error) {
+	res, err := c.ZRange(ctx, key, min, max, &ZRangeOptions{ByLex: true})
+	return int64(len(res)), err
+}
+
+func (c *Server) zremRange(ctx context.Context, key []byte, start, stop string, opts *ZRangeOptions) (int64, error) {
+	n := int64(0)
+	err := c.updateZSet(ctx, key, func(z *db.ZSet) error {
+		res, err := zrange(z, start, stop, opts)
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			return errNoop
+		}
+		members := [][]byte{}
+		for _, m := range res {
+			members = append(members, m.Member)
+		}
+		n, err = z.Rem(members...)
+		return err
+	})
+	return n, err
+}
+
+// ZRemRangeByRank removes the members with ranks between start and stop and
+// returns the number of removed members.
+func (c *Server) ZRemRangeByRank(ctx context.Context, key []byte, start, stop int64) (int64, error) {
+	ctx = withCommand(ctx, "ZREMRANGEBYRANK", key, start, stop)
+	return c.zremRange(ctx, key, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10), &ZRangeOptions{})
+}
+
+// ZRemRangeByScore removes the members with scores between min and max and
+// returns the number of removed members.
+func (c *Server) ZRemRangeByScore(ctx context.Context, key []byte, min, max string) (int64, error) {
+	ctx = withCommand(ctx, "ZREMRANGEBYSCORE", key, min, max)
+	return c.zremRange(ctx, key, min, max, &ZRangeOptions{ByScore: true})
+}
+
+// ZRemRangeByLex removes the members between min and max in lexicographical
+// order and returns the number of removed members.
+func (c *Server) ZRemRangeByLex(ctx context.Context, key []byte, min, max string) (int64, error) {
+	ctx = withCommand(ctx, "ZREMRANGEBYLEX", key, min, max)
+	return c.zremRange(ctx, key, min, max, &ZRangeOptions{ByLex: true})
+}
+
+func (c *Server) zpop(ctx context.Context, key []byte, max bool, count int64) ([]Z, error) {
+	if count < 0 {
+		return nil, fmt.Errorf("value is out of range, must be positive")
+	}
+	res := []Z{}
+	err := c.updateZSet(ctx, key, func(z *db.ZSet) error {
+		if count == 0 {
+			return errNoop
+		}
+		var err error
+		res, err = z.Pop(max, count)
+		return err
+	})
+	return res, err
+}
+
+// ZPopMin removes and returns up to count members with the lowest scores.
+func (c *Server) ZPopMin(ctx context.Context, key []byte, count int64) ([]Z, error) {
+	ctx = withCommand(ctx, "ZPOPMIN", key, count)
+	return c.zpop(ctx, key, false, count)
+}
+
+// ZPopMax removes and returns up to count members with the highest scores.
+func (c *Server) ZPopMax(ctx context.Context, key []byte, count int64) ([]Z, error) {
+	ctx = withCommand(ctx, "ZPOPMAX", key, count)
+	return c.zpop(ctx, key, true, count)
+}
+
+// ZMPop pops up to count members with the lowest scores, or the highest if
+// max is true, from the first non-empty sorted set among keys. It returns
+// the key members were popped from, or nil if all sorted sets are empty.
+func (c *Server) ZMPop(ctx context.Context, keys [][]byte, max bool, count int64) ([]byte, []Z, error) {
+	ctx = withCommand(ctx, "ZMPOP", len(keys), keys, minOrMax(max), "COUNT", count)
+	if count <= 0 {
+		return nil, nil, fmt.Errorf("count should be greater than 0")
+	}
+	var key []byte
+	res := []Z{}
+	err := c.updateKeys(ctx, keys, func(m *db.MultiTx) error {
+		for _, k := range keys {
+			z, err := m.Tx(k).OpenZSet(k, false)
+			if err != nil {
+				return err
+			}
+			if z != nil {
+				key = k
+				res, err = z.Pop(max, count)
+				return err
+			}
+		}
+		return errNoop
+	})
+	return key, res, err
+}
+
+// bzpop pops the member with the lowest score, or the highest if max is
+// true, from the first non-empty sorted set among keys, waiting for one up to
+// timeout, zero waiting forever. It returns a nil key if timeout expired.
+func (c *Server) bzpop(ctx context.Context, keys [][]byte, max bool, timeout time.Duration) ([]byte, *Z, error) {
+	var key []byte
+	var res []Z
+	_, err := c.block(ctx, keys, timeout, func() (bool, error) {
+		var err error
+		key, res, err = c.ZMPop(ctx, keys, max, 1)
+		return key != nil, err
+	})
+	if key == nil || err != nil {
+		return nil, nil, err
+	}
+	return key, &res[0], nil
+}
+
+// BZPopMin removes and returns the member with the lowest score of the first
+// non-empty sorted set among keys, with the key it was popped from. If all
+// sorted sets are empty it waits for a member up to timeout, zero waiting
+// forever, and returns a nil key if timeout expires.
+func (c *Server) BZPopMin(ctx context.Context, timeout time.Duration, keys ...[]byte) ([]byte, *Z, error) {
+	ctx = withCommand(ctx, "BZPOPMIN", keys, timeout.Seconds())
+	return c.bzpop(ctx, keys, false, timeout)
+}
+
+// BZPopMax is like BZPopMin, but pops the member with the highest score.
+func (c *Server) BZPopMax(ctx context.Context, timeout time.Duration, keys ...[]byte) ([]byte, *Z, error) {
+	ctx = withCommand(ctx, "BZPOPMAX", keys, timeout.Seconds())
+	return c.bzpop(ctx, keys, true, timeout)
+}
+
+// ZRandMember returns count distinct random members of the sorted set stored
+// at key, or -count possibly repeated members if count is negative.
+func (c *Server) ZRandMember(ctx context.Context, key []byte, count int64) ([]Z, error) {
+	res := []Z{}
+	err := c.viewZSet(ctx, key, func(z *db.ZSet) error {
+		res = z.RandMembers(count)
+		return nil
+	})
+	return res, err
+}
+
+// ZStoreOptions mirrors the WEIGHTS and AGGREGATE options of ZUNION and
+// ZINTER. Aggregate is SUM, MIN or MAX, and defaults to SUM.
+type ZStoreOptions struct {
+	Weights   []float64
+	Aggregate string
+}
+
+// zsource is the content of an input of ZUNION, ZINTER or ZDIFF, which may be
+// a sorted set or a set whose members have a score of 1
+type zsource struct {
+	members []Z
+	scores  map[string]float64
+}
+
+func readZSources(m *db.MultiTx, keys [][]byte, weights []float64) ([]*zsource, error) {
+	sources := []*zsource{}
+	for i, key := range keys {
+		tx := m.Tx(key)
+		typ, err := tx.Type(key)
+		if err != nil {
+			return nil, err
+		}
+		src := &zsource{scores: map[string]float64{}}
+		switch typ {
+		case db.TypeNone:
+		case db.TypeZSet:
+			z, err := tx.OpenZSet(key, false)
+			if err != nil {
+				return nil, err
+			}
+			src.members = z.Members()
+		case db.TypeSet:
+			set, err := tx.OpenSet(key, false)
+			if err != nil {
+				return nil, err
+			}
+			for _, member := range set.Members() {
+				src.members = append(src.members, Z{Score: 1, Member: member})
+			}
+		default:
+			return nil, db.ErrWrongType
+		}
+		weight := 1.0
+		if weights != nil {
+			weight = weights[i]
+		}
+		for j := range src.members {
+			score := src.members[j].Score * weight
+			if math.IsNaN(score) {
+				score = 0
+			}
+			src.members[j].Score = score
+			src.scores[string(src.members[j].Member)] = score
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+func aggregate(aggregate string, a, b float64) float64 {
+	switch aggregate {
+	case "MIN":
+		return math.Min(a, b)
+	case "MAX":
+		return math.Max(a, b)
+	}
+	res := a + b
+	if math.IsNaN(res) {
+		return 0
+	}
+	return res
+}
+
+func sortZ(res []Z) {
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Score != res[j].Score {
+			return res[i].Score < res[j].Score
+		}
+		return bytes.Compare(res[i].Member, res[j].Member) < 0
+	})
+}
+
+type zop func(sources []*zsource, opts *ZStoreOptions) []Z
+
+func zunion(sources []*zsource, opts *ZStoreOptions) []Z {
+	res := []Z{}
+	index := map[string]int{}
+	for _, src := range sources {
+		for _, m := range src.members {
+			i, ok := index[string(m.Member)]
+			if !ok {
+				index[string(m.Member)] = len(res)
+				res = append(res, m)
+				continue
+			}
+			res[i].Score = aggregate(opts.Aggregate, res[i].Score, m.Score)
+		}
+	}
+	sortZ(res)
+	return res
+}
+
+func zinter(sources []*zsource, opts *ZStoreOptions) []Z {
+	res := []Z{}
+	for _, m := range sources[0].members {
+		found := true
+		for _, src := range sources[1:] {
+			score, ok := src.scores[string(m.Member)]
+			if !ok {
+				found = false
+				break
+			}
+			m.Score = aggregate(opts.Aggregate, m.Score, score)
+		}
+		if found {
+			res = append(res, m)
+		}
+	}
+	sortZ(res)
+	return res
+}
+
+func zdiff(sources []*zsource, opts *ZStoreOptions) []Z {
+	res := []Z{}
+	for _, m := range sources[0].members {
+		found := false
+		for _, src := range sources[1:] {
+			if _, ok := src.scores[string(m.Member)]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, m)
+		}
+	}
+	sortZ(res)
+	return res
+}
+
+func (opts *ZStoreOptions) validate(numkeys int) error {
+	if numkeys == 0 {
+		return fmt.Errorf("at least 1 input key is needed")
+	}
+	if opts.Weights != nil && len(opts.Weights) != numkeys {
+		return fmt.Errorf("syntax error")
+	}
+	opts.Aggregate = strings.ToUpper(opts.Aggregate)
+	switch opts.Aggregate {
+	case "", "SUM", "MIN", "MAX":
+		return nil
+	}
+	return fmt.Errorf("syntax error")
+}
+
+func (c *Server) zsetOp(ctx context.Context, keys [][]byte, opts *ZStoreOptions, op zop) ([]Z, error) {
+	if opts == nil {
+		opts = &ZStoreOptions{}
+	}
+	err := opts.validate(len(keys))
+	if err != nil {
+		return nil, err
+	}
+	var res []Z
+	err = c.db.ViewKeys(ctx, keys, func(m *db.MultiTx) error {
+		sources, err := readZSources(m, keys, opts.Weights)
+		if err != nil {
+			return err
+		}
+		res = op(sources, opts)
+		return nil
+	})
+	return res, err
+}
+
+func (c *Server) zsetOpStore(ctx context.Context, destination []byte, keys [][]byte, opts *ZStoreOptions, op zop) (int64, error) {
+	if opts == nil {
+		opts = &ZStoreOptions{}
+	}
+	err := opts.validate(len(keys))
+	if err != nil {
+		return 0, err
+	}
+	n := int64(0)
+	err = c.updateKeys(ctx, append([][]byte{destination}, keys...), func(m *db.MultiTx) error {
+		sources, err := readZSources(m, keys, opts.Weights)
+		if err != nil {
+			return err
+		}
+		res := op(sources, opts)
+		n = int64(len(res))
+		return storeZ(m.Tx(destination), destination, res)
+	})
+	return n, err
+}
+
+// ZUnion returns the union of the sorted sets or sets stored at keys.
+func (c *Server) ZUnion(ctx context.Context, keys [][]byte, opts *ZStoreOptions) ([]Z, error) {
+	return c.zsetOp(ctx, keys, opts, zunion)
+}
+
+// ZInter returns the intersection of the sorted sets or sets stored at keys.
+func (c *Server) ZInter(ctx context.Context, keys [][]byte, opts *ZStoreOptions) ([]Z, error) {
+	return c.zsetOp(ctx, keys, opts, zinter)
+}
+
+// ZDiff returns the members of the first sorted set stored at keys which
+// are not in any of the following ones.
+func (c *Server) ZDiff(ctx context.Context, keys [][]byte) ([]Z, error) {
+	return c.zsetOp(ctx, keys, nil, zdiff)
+}
+
+// ZUnionStore is like ZUnion but stores the result in destination and
+// returns its size.
+func (c *Server) ZUnionStore(ctx context.Context, destination []byte, keys [][]byte, opts *ZStoreOptions) (int64, error) {
+	ctx = withCommand(ctx, "ZUNIONSTORE", destination, len(keys), keys, opts.args())
+	return c.zsetOpStore(ctx, destination, keys, opts, zunion)
+}
+
+// ZInterStore is like ZInter but stores the result in destination and
+// returns its size.
+func (c *Server) ZInterStore(ctx context.Context, destination []byte, keys [][]byte, opts *ZStoreOptions) (int64, error) {
+	ctx = withCommand(ctx, "ZINTERSTORE", destination, len(keys), keys, opts.args())
+	return c.zsetOpStore(ctx, destination, keys, opts, zinter)
+}
+
+// ZDiffStore is like ZDiff but stores the result in destination and returns
+// its size.
+func (c *Server) ZDiffStore(ctx context.Context, destination []byte, keys [][]byte) (int64, error) {
+	ctx = withCommand(ctx, "ZDIFFSTORE", destination, len(keys), keys)
+	return c.zsetOpStore(ctx, destination, keys, nil, zdiff)
+}
+
+// ZInterCard returns the size of the intersection of the sorted sets or sets
+// stored at keys, counting at most limit members if limit is positive.
+func (c *Server) ZInterCard(ctx context.Context, limit int64, keys ...[]byte) (int64, error) {
+	if limit < 0 {
+		return 0, fmt.Errorf("LIMIT can't be negative")
+	}
+	res, err := c.ZInter(ctx, keys, nil)
+	if err != nil {
+		return 0, err
+	}
+	n := int64(len(res))
+	if limit > 0 && n > limit {
+		n = limit
+	}
+	return n, nil
+}
+
+// args returns the options as arguments of ZADD
+func (opts *ZAddOptions) args() [][]byte {
+	if opts == nil {
+		return nil
+	}
+	args := flag(opts.NX, "NX")
+	args = append(args, flag(opts.XX, "XX")...)
+	args = append(args, flag(opts.GT, "GT")...)
+	args = append(args, flag(opts.LT, "LT")...)
+	return append(args, flag(opts.CH, "CH")...)
+}
+
+// scoreMembers returns members as the score and member arguments of ZADD
+func scoreMembers(members []Z) [][]byte {
+	args := make([][]byte, 0, 2*len(members))
+	for _, m := range members {
+		args = append(args, []byte(strconv.FormatFloat(m.Score, 'f', -1, 64)), m.Member)
+	}
+	return args
+}
+
+// args returns the options as arguments of ZRANGESTORE
+func (opts *ZRangeOptions) args() [][]byte {
+	args := flag(opts.ByScore, "BYSCORE")
+	args = append(args, flag(opts.ByLex, "BYLEX")...)
+	args = append(args, flag(opts.Rev, "REV")...)
+	if opts.Limit {
+		args = append(args, []byte("LIMIT"), []byte(strconv.FormatInt(opts.Offset, 10)), []byte(strconv.FormatInt(opts.Count, 10)))
+	}
+	return args
+}
+
+// args returns the options as arguments of ZUNIONSTORE and ZINTERSTORE
+func (opts *ZStoreOptions) args() [][]byte {
+	if opts == nil {
+		return nil
+	}
+	args := [][]byte{}
+	if opts.Weights != nil {
+		args = append(args, []byte("WEIGHTS"))
+		for _, w := range opts.Weights {
+			args = append(args, []byte(strconv.FormatFloat(w, 'f', -1, 64)))
+		}
+	}
+	if opts.Aggregate != "" {
+		args = append(args, []byte("AGGREGATE"), []byte(opts.Aggregate))
+	}
+	return args
+}
+
+// minOrMax returns the MIN or MAX argument of ZMPOP
+func minOrMax(max bool) string {
+	if max {
+		return "MAX"
+	}
+	return "MIN"
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func zmembers(res []Z) []string {
+	members := []string{}
+	for _, m := range res {
+		members = append(members, string(m.Member))
+	}
+	return members
+}
+
+func TestZAdd(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+
+	n, err := server.ZAdd(ctx, key, nil, Z{Score: 1, Member: []byte("a")}, Z{Score: 2, Member: []byte("b")})
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(2)))
+	n, err = server.ZAdd(ctx, key, &ZAddOptions{CH: true}, Z{Score: 3, Member: []byte("b")}, Z{Score: 4, Member: []byte("c")})
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(2)))
+	n, err = server.ZAdd(ctx, key, &ZAddOptions{NX: true}, Z{Score: 10, Member: []byte("a")})
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(0)))
+	n, err = server.ZAdd(ctx, key, &ZAddOptions{XX: true, CH: true}, Z{Score: 10, Member: []byte("d")})
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(0)))
+	n, err = server.ZAdd(ctx, key, &ZAddOptions{GT: true, CH: true}, Z{Score: 0, Member: []byte("a")}, Z{Score: 5, Member: []byte("c")})
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(1)))
+	_, err = server.ZAdd(ctx, key, &ZAddOptions{NX: true, GT: true}, Z{Score: 0, Member: []byte("a")})
+	g.Expect(err).NotTo(BeNil())
+
+	_, ok, err := server.ZAddIncr(ctx, key, &ZAddOptions{LT: true}, Z{Score: 1, Member: []byte("a")})
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(false))
+	score, err := server.ZIncrBy(ctx, key, 1.5, []byte("a"))
+	g.Expect(err).To(BeNil())
+	g.Expect(score).To(Equal(2.5))
+	_, err = server.ZIncrBy(ctx, key, math.Inf(1), []byte("a"))
+	g.Expect(err).To(BeNil())
+	_, err = server.ZIncrBy(ctx, key, math.Inf(-1), []byte("a"))
+	g.Expect(err).NotTo(BeNil())
+
+	score, ok, err = server.ZScore(ctx, key, []byte("b"))
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(true))
+	g.Expect(score).To(Equal(3.0))
+	rank, ok, err := server.ZRank(ctx, key, []byte("a"))
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(Equal(true))
+	g.Expect(rank).To(Equal(int64(2)))
+	rank, _, err = server.ZRevRank(ctx, key, []byte("b"))
+	g.Expect(err).To(BeNil())
+	g.Expect(rank).To(Equal(int64(2)))
+	n, err = server.ZCard(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(3)))
+}
+
+func TestZRange(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := []byte(uuid.NewString())
+	_, err := server.ZAdd(ctx, key, nil,
+		Z{Score: -1.5, Member: []byte("a")},
+		Z{Score: 0, Member: []byte("b")},
+		Z{Score: 2, Member: []byte("c")},
+		Z{Score: 2, Member: []byte("d")},
+		Z{Score: 10, Member: []byte("e")},
+	)
+	g.Expect(err).To(BeNil())
+
+	res, err := server.ZRange(ctx, key, "1", "-2", nil)
+	g.Expect(err).To(BeNil())
+	g.Expect(zmembers(res)).To(Equal([]string{"b", "c", "d"}))
+	res, err = server.ZRange(ctx, key, "0", "1", &ZRangeOptions{Rev: true})
+	g.Expect(err).To(BeNil())
+	g.Expect(zmembers(res)).To(Equal([]string{"e", "d"}))
+	res, err = server.ZRange(ctx, key, "(-1.5", "2", &ZRangeOptions{ByScore: true})
+	g.Expect(err).To(BeNil())
+	g.Expect(zmembers(res)).To(Equal([]string{"b", "c", "d"}))
+	res, err = server.ZRange(ctx, key, "+inf", "(0", &ZRangeOptions{ByScore: true, Rev: true, Limit: true, Offset: 1, Count: 2})
+	g.Expect(err).To(BeNil())
+	g.Expect(zmembers(res)).To(Equal([]string{"d", "c"}))
+	_, err = server.ZRange(ctx, key, "0", "1", &ZRangeOptions{Limit: true})
+	g.Expect(err).NotTo(BeNil())
+	n, err := server.ZCount(ctx, key, "-inf", "+inf")
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(5)))
+
+	lex := []byte(uuid.NewString())
+	_, err = server.ZAdd(ctx, lex, nil,
+		Z{Member: []byte("a")}, Z{Member: []byte("b")}, Z{Member: []byte("bb")}, Z{Member: []byte("c")},
+	)
+	g.Expect(err).To(BeNil())
+	res, err = server.ZRange(ctx, lex, "[b", "(c", &ZRangeOptions{ByLex: true})
+	g.Expect(err).To(BeNil())
+	g.Expect(zmembers(res)).To(Equal([]string{"b", "bb"}))
+	res, err = server.ZRange(ctx, lex, "[bb", "-", &ZRangeOptions{ByLex: true, Rev: true})
+	g.Expect(err).To(BeNil())
+	g.Expect(zmembers(res)).To(Equal([]string{"bb", "b", "a"}))
+	n, err = server.ZLexCount(ctx, lex, "(a", "+")
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(3)))
+
+	dst := []byte(uuid.NewString())
+	n, err = server.ZRangeStore(ctx, dst, key, "0", "(2", &ZRangeOptions{ByScore: true})
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(1)))
+
+	n, err = server.ZRemRangeByScore(ctx, key, "2", "2")
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(2)))
+	n, err = server.ZRemRangeByRank(ctx, key, 0, 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(1)))
+	n, err = server.ZRemRangeByLex(ctx, lex, "-", "[b")
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(2)))
+
+	popped, err := server.ZPopMin(ctx, key, 1)
+	g.Expect(err).To(BeNil())
+	g.Expect(popped).To(Equal([]Z{{Score: 0, Member: []byte("b")}}))
+	popped, err = server.ZPopMax(ctx, key, 5)
+	g.Expect(err).To(BeNil())
+	g.Expect(zmembers(popped)).To(Equal([]string{"e"}))
+	n, err = server.ZCard(ctx, key)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(0)))
+}
+
+func TestZSetOperations(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	a := []byte(uuid.NewString())
+	b := []byte(uuid.NewString())
+	s := []byte(uuid.NewString())
+	_, err := server.ZAdd(ctx, a, nil, Z{Score: 1, Member: []byte("x")}, Z{Score: 2, Member: []byte("y")})
+	g.Expect(err).To(BeNil())
+	_, err = server.ZAdd(ctx, b, nil, Z{Score: 10, Member: []byte("y")}, Z{Score: 20, Member: []byte("z")})
+	g.Expect(err).To(BeNil())
+	_, err = server.SAdd(ctx, s, []byte("y"))
+	g.Expect(err).To(BeNil())
+
+	res, err := server.ZUnion(ctx, [][]byte{a, b}, &ZStoreOptions{Weights: []float64{1, 2}})
+	g.Expect(err).To(BeNil())
+	g.Expect(res).To(Equal([]Z{{Score: 1, Member: []byte("x")}, {Score: 22, Member: []byte("y")}, {Score: 40, Member: []byte("z")}}))
+	res, err = server.ZInter(ctx, [][]byte{a, b, s}, &ZStoreOptions{Aggregate: "max"})
+	g.Expect(err).To(BeNil())
+	g.Expect(res).To(Equal([]Z{{Score: 10, Member: []byte("y")}}))
+	res, err = server.ZDiff(ctx, [][]byte{a, b})
+	g.Expect(err).To(BeNil())
+	g.Expect(zmembers(res)).To(Equal([]string{"x"}))
+
+	dst := []byte(uuid.NewString())
+	n, err := server.ZUnionStore(ctx, dst, [][]byte{a, b}, nil)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(3)))
+	n, err = server.ZInterCard(ctx, 0, a, dst)
+	g.Expect(err).To(BeNil())
+	g.Expect(n).To(Equal(int64(2)))
+
+	key, popped, err := server.ZMPop(ctx, [][]byte{[]byte(uuid.NewString()), a}, true, 1)
+	g.Expect(err).To(BeNil())
+	g.Expect(key).To(Equal(a))
+	g.Expect(zmembers(popped)).To(Equal([]string{"y"}))
+}
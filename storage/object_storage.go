@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"path"
+	"strings"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
@@ -107,6 +108,30 @@ func (s *ObjectStorage) PutObject(ctx context.Context, objectPath string, value
 	return err
 }
 
+func (s *ObjectStorage) RemoveObject(ctx context.Context, objectPath string) error {
+	return s.minioClient.RemoveObject(ctx, s.bucket, path.Join(s.pathPrefix, objectPath), minio.RemoveObjectOptions{})
+}
+
+// ListObjects returns the paths of the objects whose path starts with
+// prefix, in lexical order
+func (s *ObjectStorage) ListObjects(ctx context.Context, prefix string) ([]string, error) {
+	root := ""
+	if s.pathPrefix != "" {
+		root = path.Clean(s.pathPrefix) + "/"
+	}
+	paths := []string{}
+	for obj := range s.minioClient.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    root + prefix,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		paths = append(paths, strings.TrimPrefix(obj.Key, root))
+	}
+	return paths, nil
+}
+
 func (s *ObjectStorage) MakeBucket(ctx context.Context, bucketName string) error {
 	return s.minioClient.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{})
 }
\ No newline at end of file
@@ -104,3 +104,17 @@ func TestGetObjectWithExpiredEtag(t *testing.T) {
 	g.Expect(err).NotTo(BeNil())
 	g.Expect(err.(minio.ErrorResponse).Code).To(Equal("PreconditionFailed"))
 }
+
+func TestListObjects(t *testing.T) {
+	g := NewWithT(t)
+	prefix := uuid.NewString() + "/"
+	for _, name := range []string{"b", "a", "c/d"} {
+		g.Expect(storage.PutObject(context.Background(), prefix+name, []byte(name))).To(BeNil())
+	}
+	paths, err := storage.ListObjects(context.Background(), prefix)
+	g.Expect(err).To(BeNil())
+	g.Expect(paths).To(Equal([]string{prefix + "a", prefix + "b", prefix + "c/d"}))
+	paths, err = storage.ListObjects(context.Background(), uuid.NewString())
+	g.Expect(err).To(BeNil())
+	g.Expect(paths).To(BeEmpty())
+}